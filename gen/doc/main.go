@@ -4,7 +4,7 @@ import (
 	"log"
 
 	"github.com/spf13/cobra/doc"
-	"github.com/tinyzimmer/btrsync/pkg/cmd"
+	"github.com/madworx/btrsync/pkg/cmd"
 )
 
 func main() {
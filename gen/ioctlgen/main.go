@@ -68,64 +68,68 @@ var (
 
 // BTRFS ioctl commands
 var (
-	BTRFS_IOC_SNAP_CREATE         = _IOW(BTRFS_IOCTL_MAGIC, 1, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_DEFRAG              = _IOW(BTRFS_IOCTL_MAGIC, 2, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_RESIZE              = _IOW(BTRFS_IOCTL_MAGIC, 3, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_SCAN_DEV            = _IOW(BTRFS_IOCTL_MAGIC, 4, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_FORGET_DEV          = _IOW(BTRFS_IOCTL_MAGIC, 5, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_TRANS_START         = _IO(BTRFS_IOCTL_MAGIC, 6)
-	BTRFS_IOC_TRANS_END           = _IO(BTRFS_IOCTL_MAGIC, 7)
-	BTRFS_IOC_SYNC                = _IO(BTRFS_IOCTL_MAGIC, 8)
-	BTRFS_IOC_CLONE               = _IOW(BTRFS_IOCTL_MAGIC, 9, C.sizeof_int)
-	BTRFS_IOC_ADD_DEV             = _IOW(BTRFS_IOCTL_MAGIC, 10, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_RM_DEV              = _IOW(BTRFS_IOCTL_MAGIC, 11, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_BALANCE             = _IOW(BTRFS_IOCTL_MAGIC, 12, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_CLONE_RANGE         = _IOW(BTRFS_IOCTL_MAGIC, 13, C.sizeof_struct_btrfs_ioctl_clone_range_args)
-	BTRFS_IOC_SUBVOL_CREATE       = _IOW(BTRFS_IOCTL_MAGIC, 14, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_SNAP_DESTROY        = _IOW(BTRFS_IOCTL_MAGIC, 15, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_DEFRAG_RANGE        = _IOW(BTRFS_IOCTL_MAGIC, 16, C.sizeof_struct_btrfs_ioctl_defrag_range_args)
-	BTRFS_IOC_TREE_SEARCH         = _IOWR(BTRFS_IOCTL_MAGIC, 17, C.sizeof_struct_btrfs_ioctl_search_args)
-	BTRFS_IOC_TREE_SEARCH_V2      = _IOWR(BTRFS_IOCTL_MAGIC, 17, C.sizeof_struct_btrfs_ioctl_search_args_v2)
-	BTRFS_IOC_INO_LOOKUP          = _IOWR(BTRFS_IOCTL_MAGIC, 18, C.sizeof_struct_btrfs_ioctl_ino_lookup_args)
-	BTRFS_IOC_DEFAULT_SUBVOL      = _IOW(BTRFS_IOCTL_MAGIC, 19, C.sizeof___u64)
-	BTRFS_IOC_SPACE_INFO          = _IOWR(BTRFS_IOCTL_MAGIC, 20, C.sizeof_struct_btrfs_ioctl_space_args)
-	BTRFS_IOC_START_SYNC          = _IOR(BTRFS_IOCTL_MAGIC, 24, C.sizeof___u64)
-	BTRFS_IOC_WAIT_SYNC           = _IOW(BTRFS_IOCTL_MAGIC, 22, C.sizeof___u64)
-	BTRFS_IOC_SNAP_CREATE_V2      = _IOW(BTRFS_IOCTL_MAGIC, 23, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
-	BTRFS_IOC_SUBVOL_CREATE_V2    = _IOW(BTRFS_IOCTL_MAGIC, 24, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
-	BTRFS_IOC_SUBVOL_GETFLAGS     = _IOR(BTRFS_IOCTL_MAGIC, 25, C.sizeof___u64)
-	BTRFS_IOC_SUBVOL_SETFLAGS     = _IOW(BTRFS_IOCTL_MAGIC, 26, C.sizeof___u64)
-	BTRFS_IOC_SCRUB               = _IOWR(BTRFS_IOCTL_MAGIC, 27, C.sizeof_struct_btrfs_ioctl_scrub_args)
-	BTRFS_IOC_SCRUB_CANCEL        = _IO(BTRFS_IOCTL_MAGIC, 28)
-	BTRFS_IOC_SCRUB_PROGRESS      = _IOWR(BTRFS_IOCTL_MAGIC, 29, C.sizeof_struct_btrfs_ioctl_scrub_args)
-	BTRFS_IOC_DEV_INFO            = _IOWR(BTRFS_IOCTL_MAGIC, 30, C.sizeof_struct_btrfs_ioctl_dev_info_args)
-	BTRFS_IOC_FS_INFO             = _IOR(BTRFS_IOCTL_MAGIC, 31, C.sizeof_struct_btrfs_ioctl_fs_info_args)
-	BTRFS_IOC_BALANCE_V2          = _IOWR(BTRFS_IOCTL_MAGIC, 32, C.sizeof_struct_btrfs_ioctl_balance_args)
-	BTRFS_IOC_BALANCE_CTL         = _IOW(BTRFS_IOCTL_MAGIC, 33, C.sizeof_int)
-	BTRFS_IOC_BALANCE_PROGRESS    = _IOR(BTRFS_IOCTL_MAGIC, 34, C.sizeof_struct_btrfs_ioctl_balance_args)
-	BTRFS_IOC_INO_PATHS           = _IOWR(BTRFS_IOCTL_MAGIC, 35, C.sizeof_struct_btrfs_ioctl_ino_path_args)
-	BTRFS_IOC_LOGICAL_INO         = _IOWR(BTRFS_IOCTL_MAGIC, 36, C.sizeof_struct_btrfs_ioctl_logical_ino_args)
-	BTRFS_IOC_SET_RECEIVED_SUBVOL = _IOWR(BTRFS_IOCTL_MAGIC, 37, C.sizeof_struct_btrfs_ioctl_received_subvol_args)
-	BTRFS_IOC_SEND                = _IOW(BTRFS_IOCTL_MAGIC, 38, C.sizeof_struct_btrfs_ioctl_send_args)
-	BTRFS_IOC_DEVICES_READY       = _IOR(BTRFS_IOCTL_MAGIC, 39, C.sizeof_struct_btrfs_ioctl_vol_args)
-	BTRFS_IOC_QUOTA_CTL           = _IOWR(BTRFS_IOCTL_MAGIC, 40, C.sizeof_struct_btrfs_ioctl_quota_ctl_args)
-	BTRFS_IOC_QGROUP_ASSIGN       = _IOW(BTRFS_IOCTL_MAGIC, 41, C.sizeof_struct_btrfs_ioctl_qgroup_assign_args)
-	BTRFS_IOC_QGROUP_CREATE       = _IOW(BTRFS_IOCTL_MAGIC, 42, C.sizeof_struct_btrfs_ioctl_qgroup_create_args)
-	BTRFS_IOC_QGROUP_LIMIT        = _IOR(BTRFS_IOCTL_MAGIC, 43, C.sizeof_struct_btrfs_ioctl_qgroup_limit_args)
-	BTRFS_IOC_QUOTA_RESCAN        = _IOW(BTRFS_IOCTL_MAGIC, 44, C.sizeof_struct_btrfs_ioctl_quota_rescan_args)
-	BTRFS_IOC_QUOTA_RESCAN_STATUS = _IOR(BTRFS_IOCTL_MAGIC, 45, C.sizeof_struct_btrfs_ioctl_quota_rescan_args)
-	BTRFS_IOC_QUOTA_RESCAN_WAIT   = _IO(BTRFS_IOCTL_MAGIC, 46)
-	BTRFS_IOC_GET_DEV_STATS       = _IOWR(BTRFS_IOCTL_MAGIC, 52, C.sizeof_struct_btrfs_ioctl_get_dev_stats)
-	BTRFS_IOC_DEV_REPLACE         = _IOWR(BTRFS_IOCTL_MAGIC, 53, C.sizeof_struct_btrfs_ioctl_dev_replace_args)
-	BTRFS_IOC_FILE_EXTENT_SAME    = _IOWR(BTRFS_IOCTL_MAGIC, 54, C.sizeof_struct_btrfs_ioctl_same_args)
-	BTRFS_IOC_RM_DEV_V2           = _IOW(BTRFS_IOCTL_MAGIC, 58, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
-	BTRFS_IOC_LOGICAL_INO_V2      = _IOWR(BTRFS_IOCTL_MAGIC, 59, C.sizeof_struct_btrfs_ioctl_logical_ino_args)
-	BTRFS_IOC_GET_SUBVOL_INFO     = _IOR(BTRFS_IOCTL_MAGIC, 60, C.sizeof_struct_btrfs_ioctl_get_subvol_info_args)
-	BTRFS_IOC_GET_SUBVOL_ROOTREF  = _IOWR(BTRFS_IOCTL_MAGIC, 61, C.sizeof_struct_btrfs_ioctl_get_subvol_rootref_args)
-	BTRFS_IOC_INO_LOOKUP_USER     = _IOWR(BTRFS_IOCTL_MAGIC, 62, C.sizeof_struct_btrfs_ioctl_ino_lookup_user_args)
-	BTRFS_IOC_SNAP_DESTROY_V2     = _IOW(BTRFS_IOCTL_MAGIC, 63, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
-	BTRFS_IOC_ENCODED_READ        = _IOR(BTRFS_IOCTL_MAGIC, 64, C.sizeof_struct_btrfs_ioctl_encoded_io_args)
-	BTRFS_IOC_ENCODED_WRITE       = _IOW(BTRFS_IOCTL_MAGIC, 64, C.sizeof_struct_btrfs_ioctl_encoded_io_args)
+	BTRFS_IOC_SNAP_CREATE            = _IOW(BTRFS_IOCTL_MAGIC, 1, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_DEFRAG                 = _IOW(BTRFS_IOCTL_MAGIC, 2, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_RESIZE                 = _IOW(BTRFS_IOCTL_MAGIC, 3, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_SCAN_DEV               = _IOW(BTRFS_IOCTL_MAGIC, 4, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_FORGET_DEV             = _IOW(BTRFS_IOCTL_MAGIC, 5, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_TRANS_START            = _IO(BTRFS_IOCTL_MAGIC, 6)
+	BTRFS_IOC_TRANS_END              = _IO(BTRFS_IOCTL_MAGIC, 7)
+	BTRFS_IOC_SYNC                   = _IO(BTRFS_IOCTL_MAGIC, 8)
+	BTRFS_IOC_CLONE                  = _IOW(BTRFS_IOCTL_MAGIC, 9, C.sizeof_int)
+	BTRFS_IOC_ADD_DEV                = _IOW(BTRFS_IOCTL_MAGIC, 10, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_RM_DEV                 = _IOW(BTRFS_IOCTL_MAGIC, 11, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_BALANCE                = _IOW(BTRFS_IOCTL_MAGIC, 12, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_CLONE_RANGE            = _IOW(BTRFS_IOCTL_MAGIC, 13, C.sizeof_struct_btrfs_ioctl_clone_range_args)
+	BTRFS_IOC_SUBVOL_CREATE          = _IOW(BTRFS_IOCTL_MAGIC, 14, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_SNAP_DESTROY           = _IOW(BTRFS_IOCTL_MAGIC, 15, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_DEFRAG_RANGE           = _IOW(BTRFS_IOCTL_MAGIC, 16, C.sizeof_struct_btrfs_ioctl_defrag_range_args)
+	BTRFS_IOC_TREE_SEARCH            = _IOWR(BTRFS_IOCTL_MAGIC, 17, C.sizeof_struct_btrfs_ioctl_search_args)
+	BTRFS_IOC_TREE_SEARCH_V2         = _IOWR(BTRFS_IOCTL_MAGIC, 17, C.sizeof_struct_btrfs_ioctl_search_args_v2)
+	BTRFS_IOC_INO_LOOKUP             = _IOWR(BTRFS_IOCTL_MAGIC, 18, C.sizeof_struct_btrfs_ioctl_ino_lookup_args)
+	BTRFS_IOC_DEFAULT_SUBVOL         = _IOW(BTRFS_IOCTL_MAGIC, 19, C.sizeof___u64)
+	BTRFS_IOC_SPACE_INFO             = _IOWR(BTRFS_IOCTL_MAGIC, 20, C.sizeof_struct_btrfs_ioctl_space_args)
+	BTRFS_IOC_START_SYNC             = _IOR(BTRFS_IOCTL_MAGIC, 24, C.sizeof___u64)
+	BTRFS_IOC_WAIT_SYNC              = _IOW(BTRFS_IOCTL_MAGIC, 22, C.sizeof___u64)
+	BTRFS_IOC_SNAP_CREATE_V2         = _IOW(BTRFS_IOCTL_MAGIC, 23, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
+	BTRFS_IOC_SUBVOL_CREATE_V2       = _IOW(BTRFS_IOCTL_MAGIC, 24, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
+	BTRFS_IOC_SUBVOL_GETFLAGS        = _IOR(BTRFS_IOCTL_MAGIC, 25, C.sizeof___u64)
+	BTRFS_IOC_SUBVOL_SETFLAGS        = _IOW(BTRFS_IOCTL_MAGIC, 26, C.sizeof___u64)
+	BTRFS_IOC_SCRUB                  = _IOWR(BTRFS_IOCTL_MAGIC, 27, C.sizeof_struct_btrfs_ioctl_scrub_args)
+	BTRFS_IOC_SCRUB_CANCEL           = _IO(BTRFS_IOCTL_MAGIC, 28)
+	BTRFS_IOC_SCRUB_PROGRESS         = _IOWR(BTRFS_IOCTL_MAGIC, 29, C.sizeof_struct_btrfs_ioctl_scrub_args)
+	BTRFS_IOC_DEV_INFO               = _IOWR(BTRFS_IOCTL_MAGIC, 30, C.sizeof_struct_btrfs_ioctl_dev_info_args)
+	BTRFS_IOC_FS_INFO                = _IOR(BTRFS_IOCTL_MAGIC, 31, C.sizeof_struct_btrfs_ioctl_fs_info_args)
+	BTRFS_IOC_BALANCE_V2             = _IOWR(BTRFS_IOCTL_MAGIC, 32, C.sizeof_struct_btrfs_ioctl_balance_args)
+	BTRFS_IOC_BALANCE_CTL            = _IOW(BTRFS_IOCTL_MAGIC, 33, C.sizeof_int)
+	BTRFS_IOC_BALANCE_PROGRESS       = _IOR(BTRFS_IOCTL_MAGIC, 34, C.sizeof_struct_btrfs_ioctl_balance_args)
+	BTRFS_IOC_INO_PATHS              = _IOWR(BTRFS_IOCTL_MAGIC, 35, C.sizeof_struct_btrfs_ioctl_ino_path_args)
+	BTRFS_IOC_LOGICAL_INO            = _IOWR(BTRFS_IOCTL_MAGIC, 36, C.sizeof_struct_btrfs_ioctl_logical_ino_args)
+	BTRFS_IOC_SET_RECEIVED_SUBVOL    = _IOWR(BTRFS_IOCTL_MAGIC, 37, C.sizeof_struct_btrfs_ioctl_received_subvol_args)
+	BTRFS_IOC_SEND                   = _IOW(BTRFS_IOCTL_MAGIC, 38, C.sizeof_struct_btrfs_ioctl_send_args)
+	BTRFS_IOC_DEVICES_READY          = _IOR(BTRFS_IOCTL_MAGIC, 39, C.sizeof_struct_btrfs_ioctl_vol_args)
+	BTRFS_IOC_QUOTA_CTL              = _IOWR(BTRFS_IOCTL_MAGIC, 40, C.sizeof_struct_btrfs_ioctl_quota_ctl_args)
+	BTRFS_IOC_QGROUP_ASSIGN          = _IOW(BTRFS_IOCTL_MAGIC, 41, C.sizeof_struct_btrfs_ioctl_qgroup_assign_args)
+	BTRFS_IOC_QGROUP_CREATE          = _IOW(BTRFS_IOCTL_MAGIC, 42, C.sizeof_struct_btrfs_ioctl_qgroup_create_args)
+	BTRFS_IOC_QGROUP_LIMIT           = _IOR(BTRFS_IOCTL_MAGIC, 43, C.sizeof_struct_btrfs_ioctl_qgroup_limit_args)
+	BTRFS_IOC_QUOTA_RESCAN           = _IOW(BTRFS_IOCTL_MAGIC, 44, C.sizeof_struct_btrfs_ioctl_quota_rescan_args)
+	BTRFS_IOC_QUOTA_RESCAN_STATUS    = _IOR(BTRFS_IOCTL_MAGIC, 45, C.sizeof_struct_btrfs_ioctl_quota_rescan_args)
+	BTRFS_IOC_QUOTA_RESCAN_WAIT      = _IO(BTRFS_IOCTL_MAGIC, 46)
+	BTRFS_IOC_GET_FSLABEL            = _IOR(BTRFS_IOCTL_MAGIC, 49, C.BTRFS_LABEL_SIZE)
+	BTRFS_IOC_SET_FSLABEL            = _IOW(BTRFS_IOCTL_MAGIC, 50, C.BTRFS_LABEL_SIZE)
+	BTRFS_IOC_GET_DEV_STATS          = _IOWR(BTRFS_IOCTL_MAGIC, 52, C.sizeof_struct_btrfs_ioctl_get_dev_stats)
+	BTRFS_IOC_DEV_REPLACE            = _IOWR(BTRFS_IOCTL_MAGIC, 53, C.sizeof_struct_btrfs_ioctl_dev_replace_args)
+	BTRFS_IOC_FILE_EXTENT_SAME       = _IOWR(BTRFS_IOCTL_MAGIC, 54, C.sizeof_struct_btrfs_ioctl_same_args)
+	BTRFS_IOC_GET_FEATURES           = _IOR(BTRFS_IOCTL_MAGIC, 57, C.sizeof_struct_btrfs_ioctl_feature_flags)
+	BTRFS_IOC_GET_SUPPORTED_FEATURES = _IOR(BTRFS_IOCTL_MAGIC, 57, 3*C.sizeof_struct_btrfs_ioctl_feature_flags)
+	BTRFS_IOC_RM_DEV_V2              = _IOW(BTRFS_IOCTL_MAGIC, 58, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
+	BTRFS_IOC_LOGICAL_INO_V2         = _IOWR(BTRFS_IOCTL_MAGIC, 59, C.sizeof_struct_btrfs_ioctl_logical_ino_args)
+	BTRFS_IOC_GET_SUBVOL_INFO        = _IOR(BTRFS_IOCTL_MAGIC, 60, C.sizeof_struct_btrfs_ioctl_get_subvol_info_args)
+	BTRFS_IOC_GET_SUBVOL_ROOTREF     = _IOWR(BTRFS_IOCTL_MAGIC, 61, C.sizeof_struct_btrfs_ioctl_get_subvol_rootref_args)
+	BTRFS_IOC_INO_LOOKUP_USER        = _IOWR(BTRFS_IOCTL_MAGIC, 62, C.sizeof_struct_btrfs_ioctl_ino_lookup_user_args)
+	BTRFS_IOC_SNAP_DESTROY_V2        = _IOW(BTRFS_IOCTL_MAGIC, 63, C.sizeof_struct_btrfs_ioctl_vol_args_v2)
+	BTRFS_IOC_ENCODED_READ           = _IOR(BTRFS_IOCTL_MAGIC, 64, C.sizeof_struct_btrfs_ioctl_encoded_io_args)
+	BTRFS_IOC_ENCODED_WRITE          = _IOW(BTRFS_IOCTL_MAGIC, 64, C.sizeof_struct_btrfs_ioctl_encoded_io_args)
 )
 
 // _IOC generates an IOC command.
@@ -268,9 +272,13 @@ const (
 	BTRFS_IOC_QUOTA_RESCAN        IoctlCmd = 0x%02x
 	BTRFS_IOC_QUOTA_RESCAN_STATUS IoctlCmd = 0x%02x
 	BTRFS_IOC_QUOTA_RESCAN_WAIT   IoctlCmd = 0x%02x
+	BTRFS_IOC_GET_FSLABEL         IoctlCmd = 0x%02x
+	BTRFS_IOC_SET_FSLABEL         IoctlCmd = 0x%02x
 	BTRFS_IOC_GET_DEV_STATS       IoctlCmd = 0x%02x
 	BTRFS_IOC_DEV_REPLACE         IoctlCmd = 0x%02x
 	BTRFS_IOC_FILE_EXTENT_SAME    IoctlCmd = 0x%02x
+	BTRFS_IOC_GET_FEATURES        IoctlCmd = 0x%02x
+	BTRFS_IOC_GET_SUPPORTED_FEATURES IoctlCmd = 0x%02x
 	BTRFS_IOC_RM_DEV_V2           IoctlCmd = 0x%02x
 	BTRFS_IOC_LOGICAL_INO_V2      IoctlCmd = 0x%02x
 	BTRFS_IOC_GET_SUBVOL_INFO     IoctlCmd = 0x%02x
@@ -332,9 +340,13 @@ const (
 		BTRFS_IOC_QUOTA_RESCAN,
 		BTRFS_IOC_QUOTA_RESCAN_STATUS,
 		BTRFS_IOC_QUOTA_RESCAN_WAIT,
+		BTRFS_IOC_GET_FSLABEL,
+		BTRFS_IOC_SET_FSLABEL,
 		BTRFS_IOC_GET_DEV_STATS,
 		BTRFS_IOC_DEV_REPLACE,
 		BTRFS_IOC_FILE_EXTENT_SAME,
+		BTRFS_IOC_GET_FEATURES,
+		BTRFS_IOC_GET_SUPPORTED_FEATURES,
 		BTRFS_IOC_RM_DEV_V2,
 		BTRFS_IOC_LOGICAL_INO_V2,
 		BTRFS_IOC_GET_SUBVOL_INFO,
@@ -1,6 +1,6 @@
 module github.com/madworx/btrsync
 
-go 1.19
+go 1.20
 
 retract v0.0.1
 
@@ -11,11 +11,12 @@ require (
 	github.com/klauspost/compress v1.15.12
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/pelletier/go-toml/v2 v2.0.5
+	github.com/pierrec/lz4/v4 v4.1.17
+	github.com/prometheus/client_golang v1.20.5
 	github.com/rasky/go-lzo v0.0.0-20200203143853-96a758eda86e
 	github.com/spf13/cobra v1.6.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.14.0
-	github.com/tinyzimmer/btrsync v0.0.10
 	github.com/xlab/treeprint v1.1.0
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	golang.org/x/sys v0.0.0-20220908164124-27713097b956
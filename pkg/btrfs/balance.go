@@ -0,0 +1,267 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrBalanceNotRunning is returned when querying or cancelling a balance on a
+// filesystem that is not being balanced.
+var ErrBalanceNotRunning = errors.New("no balance is running")
+
+const (
+	balanceData     = 1 << 0
+	balanceSystem   = 1 << 1
+	balanceMetadata = 1 << 2
+	balanceForce    = 1 << 3
+
+	balanceArgsProfiles = 1 << 0
+	balanceArgsUsage    = 1 << 1
+	balanceArgsDevid    = 1 << 2
+	balanceArgsLimit    = 1 << 5
+	balanceArgsConvert  = 1 << 8
+
+	balanceStateRunning   = 1 << 0
+	balanceStatePauseReq  = 1 << 1
+	balanceStateCancelReq = 1 << 2
+
+	balanceCtlCancel = 2
+
+	// balanceStartPollInterval is how often StartBalance checks whether the balance
+	// has started.
+	balanceStartPollInterval = 50 * time.Millisecond
+)
+
+// BalanceFilter selects the chunks of one block group type to balance. Zero fields
+// do not filter.
+type BalanceFilter struct {
+	// Profiles only balances chunks with one of the given block group profile flags.
+	Profiles uint64
+	// Usage only balances chunks that are at most this percent full.
+	Usage uint64
+	// Devid only balances chunks that have a stripe on the given device.
+	Devid uint64
+	// Limit balances at most this many chunks.
+	Limit uint64
+	// Convert converts the balanced chunks to the given block group profile flags.
+	Convert uint64
+}
+
+// BalanceArgs are the arguments for a balance. Only the block group types with a
+// filter are balanced. If no filter is set at all, all chunks are balanced.
+type BalanceArgs struct {
+	// Data filters data chunks.
+	Data *BalanceFilter
+	// Metadata filters metadata chunks.
+	Metadata *BalanceFilter
+	// System filters system chunks. Balancing system chunks explicitly requires Force.
+	System *BalanceFilter
+	// Force allows balancing system chunks and reducing redundancy when converting.
+	Force bool
+}
+
+// BalanceStatus is the state of a running balance.
+type BalanceStatus struct {
+	// Running is true while the balance is running.
+	Running bool
+	// PauseRequested is true if the balance was asked to pause.
+	PauseRequested bool
+	// CancelRequested is true if the balance was asked to cancel.
+	CancelRequested bool
+	// Expected is the estimated number of chunks to balance.
+	Expected uint64
+	// Considered is the number of chunks considered so far.
+	Considered uint64
+	// Completed is the number of chunks balanced so far.
+	Completed uint64
+}
+
+func balanceStatusFromArgs(args *ioctlBalanceArgs) *BalanceStatus {
+	return &BalanceStatus{
+		Running:         args.State&balanceStateRunning != 0,
+		PauseRequested:  args.State&balanceStatePauseReq != 0,
+		CancelRequested: args.State&balanceStateCancelReq != 0,
+		Expected:        args.Stat.Expected,
+		Considered:      args.Stat.Considered,
+		Completed:       args.Stat.Completed,
+	}
+}
+
+func (f *BalanceFilter) toArgs() balanceArgs {
+	var args balanceArgs
+	if f.Profiles != 0 {
+		args.Flags |= balanceArgsProfiles
+		args.Profiles = f.Profiles
+	}
+	if f.Usage != 0 {
+		args.Flags |= balanceArgsUsage
+		args.Usage = f.Usage
+	}
+	if f.Devid != 0 {
+		args.Flags |= balanceArgsDevid
+		args.Devid = f.Devid
+	}
+	if f.Limit != 0 {
+		args.Flags |= balanceArgsLimit
+		args.Limit = f.Limit
+	}
+	if f.Convert != 0 {
+		args.Flags |= balanceArgsConvert
+		args.Target = f.Convert
+	}
+	return args
+}
+
+func (b BalanceArgs) toArgs() *ioctlBalanceArgs {
+	args := &ioctlBalanceArgs{}
+	if b.Data == nil && b.Metadata == nil && b.System == nil {
+		args.Flags = balanceData | balanceMetadata | balanceSystem
+	}
+	if b.Data != nil {
+		args.Flags |= balanceData
+		args.Data = b.Data.toArgs()
+	}
+	if b.Metadata != nil {
+		args.Flags |= balanceMetadata
+		args.Meta = b.Metadata.toArgs()
+	}
+	if b.System != nil {
+		args.Flags |= balanceSystem
+		args.Sys = b.System.toArgs()
+	}
+	if b.Force {
+		args.Flags |= balanceForce
+	}
+	return args
+}
+
+// GetBalanceStatus returns the status of the balance running on the filesystem
+// mounted at mountpoint. If no balance is running ErrBalanceNotRunning is returned.
+func GetBalanceStatus(mountpoint string) (*BalanceStatus, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return balanceStatusFd(f.Fd())
+}
+
+func balanceStatusFd(fd uintptr) (*BalanceStatus, error) {
+	args := &ioctlBalanceArgs{}
+	if err := callReadIoctl(fd, BTRFS_IOC_BALANCE_PROGRESS, args); err != nil {
+		if errors.Is(err, syscall.ENOTCONN) {
+			return nil, ErrBalanceNotRunning
+		}
+		return nil, err
+	}
+	return balanceStatusFromArgs(args), nil
+}
+
+// StartBalance starts a balance of the filesystem mounted at mountpoint and returns
+// once it is running, without waiting for it to complete. Use GetBalanceStatus to
+// follow its progress and CancelBalance to stop it.
+func StartBalance(mountpoint string, args BalanceArgs) error {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer f.Close()
+		done <- callWriteIoctl(f.Fd(), BTRFS_IOC_BALANCE_V2, args.toArgs())
+	}()
+	ticker := time.NewTicker(balanceStartPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if _, err := GetBalanceStatus(mountpoint); err == nil {
+				return nil
+			}
+		}
+	}
+}
+
+// StartBalanceContext balances the filesystem mounted at mountpoint and blocks until
+// the balance completes. If the context is done the balance is cancelled and the
+// status so far is returned along with the context's error.
+func StartBalanceContext(ctx context.Context, mountpoint string, args BalanceArgs) (*BalanceStatus, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ioctlArgs := args.toArgs()
+	done := make(chan error, 1)
+	go func() {
+		done <- callWriteIoctl(f.Fd(), BTRFS_IOC_BALANCE_V2, ioctlArgs)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return balanceStatusFromArgs(ioctlArgs), nil
+	case <-ctx.Done():
+		if err := cancelBalanceFd(f.Fd()); err != nil && !errors.Is(err, ErrBalanceNotRunning) {
+			return nil, fmt.Errorf("failed to cancel balance: %w", err)
+		}
+		<-done
+		return balanceStatusFromArgs(ioctlArgs), ctx.Err()
+	}
+}
+
+// CancelBalance cancels the balance running on the filesystem mounted at mountpoint.
+// It returns once the balance has stopped. If no balance is running
+// ErrBalanceNotRunning is returned.
+func CancelBalance(mountpoint string) error {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cancelBalanceFd(f.Fd())
+}
+
+func cancelBalanceFd(fd uintptr) error {
+	if err := ioctlValue(fd, BTRFS_IOC_BALANCE_CTL, balanceCtlCancel); err != nil {
+		if errors.Is(err, syscall.ENOTCONN) {
+			return ErrBalanceNotRunning
+		}
+		return err
+	}
+	return nil
+}
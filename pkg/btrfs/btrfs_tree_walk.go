@@ -21,7 +21,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"syscall"
 )
 
 // TreeIterFunc is a function that is called for each item found in the tree. If the function returns
@@ -35,6 +37,9 @@ var ErrStopWalk = fmt.Errorf("stop btrfs walk")
 // WalkBtrfsTree walks the Btrfs tree at the given path with the given search arguments.
 // The TreeIterFunc is called for each item found in the tree.
 func WalkBtrfsTree(path string, params SearchParams, fn TreeIterFunc) error {
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return fmt.Errorf("open file: %w", err)
@@ -67,15 +72,9 @@ func walkBtrfsTreeFd(fd uintptr, params SearchParams, fn TreeIterFunc) error {
 			if _, err = io.ReadFull(r, databuf); err != nil {
 				return fmt.Errorf("failed to read item data: %w", err)
 			}
-			item := TreeItem{Data: databuf}
-			if hdr.Type == uint32(RootBackrefKey) || hdr.Type == uint32(RootRefKey) {
-				ref, _, err := item.RootRef()
-				if err != nil {
-					return fmt.Errorf("failed to decode root backref: %w", err)
-				}
-				namebuf := databuf[len(databuf)-int(ref.Len):]
-				item.Name = string(namebuf)
-				item.Data = bytes.TrimSuffix(item.Data, namebuf)
+			item, err := newTreeItem(hdr, databuf)
+			if err != nil {
+				return err
 			}
 			lastErr = fn(hdr, item, lastErr)
 			if lastErr != nil && errors.Is(lastErr, ErrStopWalk) {
@@ -99,3 +98,162 @@ func walkBtrfsTreeFd(fd uintptr, params SearchParams, fn TreeIterFunc) error {
 	}
 	return lastErr
 }
+
+// treeSearchV2BufSize is the initial size of the result buffer used with
+// BTRFS_IOC_TREE_SEARCH_V2. It is grown on demand when a single item does
+// not fit.
+const treeSearchV2BufSize = 64 * 1024
+
+// treeSearchV2MaxBufSize is the largest result buffer the kernel accepts.
+const treeSearchV2MaxBufSize = 16 * 1024 * 1024
+
+func walkBtrfsTreeV2Fd(fd uintptr, params SearchParams, fn TreeIterFunc) error {
+	var lastErr error
+	bufSize := treeSearchV2BufSize
+	key := params
+	for {
+		key.Nr_items = math.MaxUint32
+		hdrs, data, err := treeSearchV2(fd, key, &bufSize)
+		if err != nil {
+			return err
+		}
+		if len(hdrs) == 0 {
+			return lastErr
+		}
+		for i, hdr := range hdrs {
+			item, err := newTreeItem(hdr, data[i])
+			if err != nil {
+				return err
+			}
+			lastErr = fn(hdr, item, lastErr)
+			if lastErr != nil && errors.Is(lastErr, ErrStopWalk) {
+				return nil
+			}
+		}
+		if !nextSearchKey(&key, hdrs[len(hdrs)-1]) {
+			break
+		}
+	}
+	return lastErr
+}
+
+// TreeSearchArgs select the items returned by TreeSearch.
+type TreeSearchArgs struct {
+	// SearchParams are the tree and the range of keys and transids to search. The
+	// Nr_items field is ignored.
+	SearchParams
+	// MaxItems is the maximum number of items returned. Zero returns all items in
+	// the range.
+	MaxItems int
+}
+
+// TreeSearch returns the headers and payloads of the items matching args from the
+// tree search of the filesystem of the open file fd, in key order. It issues
+// BTRFS_IOC_TREE_SEARCH_V2 as often as needed to cover the whole range, growing
+// the result buffer when a single item does not fit in it. The payloads are
+// returned as stored in the tree, item i being the payload of header i. Searching
+// requires CAP_SYS_ADMIN. For large ranges WalkBtrfsTree avoids holding all items
+// in memory at once.
+func TreeSearch(fd uintptr, args TreeSearchArgs) ([]SearchHeader, [][]byte, error) {
+	var hdrs []SearchHeader
+	var data [][]byte
+	bufSize := treeSearchV2BufSize
+	key := args.SearchParams
+	for {
+		key.Nr_items = math.MaxUint32
+		if args.MaxItems > 0 {
+			if remaining := args.MaxItems - len(hdrs); uint64(remaining) < math.MaxUint32 {
+				key.Nr_items = uint32(remaining)
+			}
+		}
+		batchHdrs, batchData, err := treeSearchV2(fd, key, &bufSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(batchHdrs) == 0 {
+			break
+		}
+		hdrs = append(hdrs, batchHdrs...)
+		data = append(data, batchData...)
+		if args.MaxItems > 0 && len(hdrs) >= args.MaxItems {
+			break
+		}
+		if !nextSearchKey(&key, batchHdrs[len(batchHdrs)-1]) {
+			break
+		}
+	}
+	return hdrs, data, nil
+}
+
+// treeSearchV2 issues a single BTRFS_IOC_TREE_SEARCH_V2 for key with a result
+// buffer of *bufSize bytes and returns the items found. If a single item does not
+// fit in the buffer it is doubled, up to the largest size the kernel accepts, and
+// the search is retried; the grown size is kept in *bufSize for later searches.
+func treeSearchV2(fd uintptr, key SearchParams, bufSize *int) ([]SearchHeader, [][]byte, error) {
+	hdrSize := binary.Size(searchArgsV2{})
+	for {
+		buf, err := encodeStructure(&searchArgsV2{Key: key, Size: uint64(*bufSize)})
+		if err != nil {
+			return nil, nil, err
+		}
+		buf = append(buf, make([]byte, *bufSize)...)
+		if err := ioctlBytes(fd, BTRFS_IOC_TREE_SEARCH_V2, buf); err != nil {
+			if errors.Is(err, syscall.EOVERFLOW) && *bufSize < treeSearchV2MaxBufSize {
+				// A single item did not fit in the buffer, grow it and retry
+				*bufSize *= 2
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to call ioctl: %w", err)
+		}
+		var args searchArgsV2
+		if err := decodeStructure(buf[:hdrSize], &args); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode search args: %w", err)
+		}
+		hdrs := make([]SearchHeader, args.Key.Nr_items)
+		data := make([][]byte, args.Key.Nr_items)
+		r := bytes.NewReader(buf[hdrSize:])
+		for i := range hdrs {
+			if err := binary.Read(r, binary.LittleEndian, &hdrs[i]); err != nil {
+				return nil, nil, fmt.Errorf("failed to read search header: %w", err)
+			}
+			data[i] = make([]byte, hdrs[i].Len)
+			if _, err := io.ReadFull(r, data[i]); err != nil {
+				return nil, nil, fmt.Errorf("failed to read item data: %w", err)
+			}
+		}
+		return hdrs, data, nil
+	}
+}
+
+// nextSearchKey moves the minimum of key to the key following last, and returns
+// false if that is beyond the end of the range.
+func nextSearchKey(key *SearchParams, last SearchHeader) bool {
+	key.Min_objectid = last.Objectid
+	key.Min_type = last.Type
+	key.Min_offset = last.Offset + 1
+	if key.Min_offset == 0 {
+		key.Min_type++
+		if key.Min_type > math.MaxUint8 {
+			key.Min_type = 0
+			key.Min_objectid++
+			if key.Min_objectid == 0 {
+				return false
+			}
+		}
+	}
+	return key.Min_objectid <= key.Max_objectid
+}
+
+func newTreeItem(hdr SearchHeader, data []byte) (TreeItem, error) {
+	item := TreeItem{Data: data}
+	if hdr.Type == uint32(RootBackrefKey) || hdr.Type == uint32(RootRefKey) {
+		ref, _, err := item.RootRef()
+		if err != nil {
+			return item, fmt.Errorf("failed to decode root backref: %w", err)
+		}
+		namebuf := data[len(data)-int(ref.Len):]
+		item.Name = string(namebuf)
+		item.Data = bytes.TrimSuffix(item.Data, namebuf)
+	}
+	return item, nil
+}
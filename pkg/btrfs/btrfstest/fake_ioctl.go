@@ -0,0 +1,390 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package btrfstest provides helpers for testing code that uses the btrfs package
+// without a real btrfs filesystem.
+package btrfstest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// IoctlCall is a record of a single ioctl issued through a FakeIoctlRunner.
+type IoctlCall struct {
+	// Fd is the file descriptor the call was issued against.
+	Fd uintptr
+	// Cmd is the ioctl command.
+	Cmd btrfs.IoctlCmd
+	// Data is a copy of the argument at the time of the call. For structure
+	// arguments this is the structure value, for uint64 arguments the value and
+	// for buffer arguments a copy of the buffer. Arguments passed by value are
+	// recorded as a uintptr. It is nil for pointer arguments.
+	Data any
+}
+
+// Field returns the named field of a structure argument, as for Field.
+func (c IoctlCall) Field(name string) (any, error) {
+	return Field(c.Data, name)
+}
+
+// StringField returns the named field of a structure argument, which must be a
+// NUL-terminated byte or int8 array such as a subvolume name, as a string.
+func (c IoctlCall) StringField(name string) (string, error) {
+	v, err := fieldValue(reflect.ValueOf(c.Data), name)
+	if err != nil {
+		return "", err
+	}
+	b, ok := byteValues(v)
+	if !ok {
+		return "", fmt.Errorf("btrfstest: field %s of %T is not a byte array", name, c.Data)
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b), nil
+}
+
+// IoctlReply is a canned reply returned by a FakeIoctlRunner.
+type IoctlReply struct {
+	// Out is written back into the argument of the call. It must be a value of
+	// the argument's structure type, a uint64 or a []byte, depending on the call.
+	// Use Fields for structure arguments of types that are not exported. If nil the
+	// argument is left untouched.
+	Out any
+	// Fields sets fields of a structure argument by name after Out is applied, for
+	// the argument types that package btrfs does not export. Nested fields are named
+	// with dots, such as "Otime.Sec". See SetField for how values are converted.
+	Fields map[string]any
+	// Err is returned from the call.
+	Err error
+}
+
+// FakeIoctlRunner is a btrfs.IoctlRunner that records calls and returns canned
+// replies instead of issuing syscalls. Its statfs calls report every path as being
+// on btrfs, unless another filesystem type is set with Filesystem, so that the
+// package can be exercised on any directory. It is safe for concurrent use.
+type FakeIoctlRunner struct {
+	mu      sync.Mutex
+	calls   []IoctlCall
+	replies map[btrfs.IoctlCmd][]IoctlReply
+	fsType  uint32
+}
+
+var _ btrfs.IoctlRunner = &FakeIoctlRunner{}
+
+// NewFakeIoctlRunner returns a new FakeIoctlRunner with no replies configured.
+// Calls without a configured reply succeed and leave their arguments untouched.
+func NewFakeIoctlRunner() *FakeIoctlRunner {
+	return &FakeIoctlRunner{replies: make(map[btrfs.IoctlCmd][]IoctlReply), fsType: btrfs.BTRFS_SUPER_MAGIC}
+}
+
+// Filesystem sets the filesystem magic number reported by statfs calls, such as
+// 0xef53 for ext4 to make paths appear not to be on btrfs.
+func (f *FakeIoctlRunner) Filesystem(magic uint32) *FakeIoctlRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fsType = magic
+	return f
+}
+
+// Install installs the runner for the btrfs package and returns a function that
+// restores the previous runner.
+func (f *FakeIoctlRunner) Install() (restore func()) {
+	return btrfs.SetIoctlRunner(f)
+}
+
+// Reply queues replies for the given command. Replies are consumed in order and
+// the last one is repeated once the queue is exhausted.
+func (f *FakeIoctlRunner) Reply(cmd btrfs.IoctlCmd, replies ...IoctlReply) *FakeIoctlRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies[cmd] = append(f.replies[cmd], replies...)
+	return f
+}
+
+// Calls returns the calls made so far.
+func (f *FakeIoctlRunner) Calls() []IoctlCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]IoctlCall(nil), f.calls...)
+}
+
+// CallsFor returns the calls made so far for the given command.
+func (f *FakeIoctlRunner) CallsFor(cmd btrfs.IoctlCmd) []IoctlCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []IoctlCall
+	for _, call := range f.calls {
+		if call.Cmd == cmd {
+			out = append(out, call)
+		}
+	}
+	return out
+}
+
+// Reset clears all recorded calls and configured replies.
+func (f *FakeIoctlRunner) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+	f.replies = make(map[btrfs.IoctlCmd][]IoctlReply)
+}
+
+// ReadIoctl implements btrfs.IoctlRunner.
+func (f *FakeIoctlRunner) ReadIoctl(fd uintptr, c btrfs.IoctlCmd, out any) error {
+	reply := f.record(fd, c, nil)
+	if err := reply.apply(out); err != nil {
+		return err
+	}
+	return reply.Err
+}
+
+// WriteIoctl implements btrfs.IoctlRunner.
+func (f *FakeIoctlRunner) WriteIoctl(fd uintptr, c btrfs.IoctlCmd, data any) error {
+	reply := f.record(fd, c, reflect.ValueOf(data).Elem().Interface())
+	if err := reply.apply(data); err != nil {
+		return err
+	}
+	return reply.Err
+}
+
+// apply writes Out and Fields into the structure pointed to by arg.
+func (r IoctlReply) apply(arg any) error {
+	if r.Out != nil {
+		if err := assign(arg, r.Out); err != nil {
+			return err
+		}
+	}
+	for name, value := range r.Fields {
+		if err := SetField(arg, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uint64Ioctl implements btrfs.IoctlRunner.
+func (f *FakeIoctlRunner) Uint64Ioctl(fd uintptr, c btrfs.IoctlCmd, data *uint64) error {
+	reply := f.record(fd, c, *data)
+	if reply.Out != nil {
+		v, ok := reply.Out.(uint64)
+		if !ok {
+			return fmt.Errorf("btrfstest: reply for %s must be a uint64, got %T", c, reply.Out)
+		}
+		*data = v
+	}
+	return reply.Err
+}
+
+// BytesIoctl implements btrfs.IoctlRunner.
+func (f *FakeIoctlRunner) BytesIoctl(fd uintptr, c btrfs.IoctlCmd, data []byte) error {
+	reply := f.record(fd, c, append([]byte(nil), data...))
+	if reply.Out != nil {
+		v, ok := reply.Out.([]byte)
+		if !ok {
+			return fmt.Errorf("btrfstest: reply for %s must be a []byte, got %T", c, reply.Out)
+		}
+		copy(data, v)
+	}
+	return reply.Err
+}
+
+// UnsafeIoctl implements btrfs.IoctlRunner. Replies may only carry an error.
+func (f *FakeIoctlRunner) UnsafeIoctl(fd uintptr, c btrfs.IoctlCmd, data unsafe.Pointer) error {
+	return f.record(fd, c, nil).Err
+}
+
+// ValueIoctl implements btrfs.IoctlRunner. The argument is recorded as a uintptr and
+// replies may only carry an error.
+func (f *FakeIoctlRunner) ValueIoctl(fd uintptr, c btrfs.IoctlCmd, arg uintptr) error {
+	return f.record(fd, c, arg).Err
+}
+
+// Statfs implements btrfs.IoctlRunner. The path must exist.
+func (f *FakeIoctlRunner) Statfs(path string, buf *syscall.Statfs_t) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	f.fillStatfs(buf)
+	return nil
+}
+
+// Fstatfs implements btrfs.IoctlRunner.
+func (f *FakeIoctlRunner) Fstatfs(fd uintptr, buf *syscall.Statfs_t) error {
+	f.fillStatfs(buf)
+	return nil
+}
+
+func (f *FakeIoctlRunner) fillStatfs(buf *syscall.Statfs_t) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*buf = syscall.Statfs_t{}
+	// The type of the field differs between architectures
+	switch t := reflect.ValueOf(&buf.Type).Elem(); t.Kind() {
+	case reflect.Uint32, reflect.Uint64:
+		t.SetUint(uint64(f.fsType))
+	default:
+		t.SetInt(int64(f.fsType))
+	}
+}
+
+func (f *FakeIoctlRunner) record(fd uintptr, c btrfs.IoctlCmd, data any) IoctlReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, IoctlCall{Fd: fd, Cmd: c, Data: data})
+	queue := f.replies[c]
+	switch len(queue) {
+	case 0:
+		return IoctlReply{}
+	case 1:
+		return queue[0]
+	}
+	f.replies[c] = queue[1:]
+	return queue[0]
+}
+
+func assign(dst, src any) error {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Pointer || dv.IsNil() {
+		return fmt.Errorf("btrfstest: cannot assign reply to %T", dst)
+	}
+	sv := reflect.ValueOf(src)
+	if !sv.Type().AssignableTo(dv.Elem().Type()) {
+		return fmt.Errorf("btrfstest: reply of type %T does not match argument %T", src, dst)
+	}
+	dv.Elem().Set(sv)
+	return nil
+}
+
+// SetField sets the named field of the structure pointed to by arg to value. Nested
+// fields are named with dots. The value is converted to the type of the field if
+// both are numbers, and strings, byte slices and byte arrays such as uuid.UUID are
+// copied into byte and int8 arrays, zeroing the rest of the array. Any other value
+// must be assignable to the field.
+func SetField(arg any, name string, value any) error {
+	v := reflect.ValueOf(arg)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("btrfstest: cannot set field %s of %T", name, arg)
+	}
+	field, err := fieldValue(v.Elem(), name)
+	if err != nil {
+		return err
+	}
+	if err := setValue(field, reflect.ValueOf(value)); err != nil {
+		return fmt.Errorf("btrfstest: field %s of %T: %w", name, arg, err)
+	}
+	return nil
+}
+
+// Field returns the named field of the structure arg, or of the structure it points
+// to. Nested fields are named with dots.
+func Field(arg any, name string) (any, error) {
+	v, err := fieldValue(reflect.ValueOf(arg), name)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+func fieldValue(v reflect.Value, name string) (reflect.Value, error) {
+	for _, part := range strings.Split(name, ".") {
+		if v.Kind() == reflect.Pointer {
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("btrfstest: no field %s in non-structure %s", name, v.Kind())
+		}
+		v = v.FieldByName(part)
+		if !v.IsValid() {
+			return reflect.Value{}, fmt.Errorf("btrfstest: no field %s", name)
+		}
+	}
+	return v, nil
+}
+
+func setValue(dst, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("nil value")
+	}
+	switch {
+	case v.Type().AssignableTo(dst.Type()):
+		dst.Set(v)
+	case isNumber(dst.Kind()) && isNumber(v.Kind()):
+		dst.Set(v.Convert(dst.Type()))
+	case dst.Kind() == reflect.Array && isByte(dst.Type().Elem().Kind()):
+		b, ok := byteValues(v)
+		if !ok {
+			return fmt.Errorf("cannot copy %s into %s", v.Type(), dst.Type())
+		}
+		if len(b) > dst.Len() {
+			return fmt.Errorf("%d bytes do not fit into %s", len(b), dst.Type())
+		}
+		dst.Set(reflect.Zero(dst.Type()))
+		for i, c := range b {
+			if e := dst.Index(i); e.Kind() == reflect.Int8 {
+				e.SetInt(int64(int8(c)))
+			} else {
+				e.SetUint(uint64(c))
+			}
+		}
+	default:
+		return fmt.Errorf("cannot use %s as %s", v.Type(), dst.Type())
+	}
+	return nil
+}
+
+// byteValues returns the bytes of a string or of a slice or array of bytes or int8.
+func byteValues(v reflect.Value) ([]byte, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return []byte(v.String()), true
+	case reflect.Slice, reflect.Array:
+		if !isByte(v.Type().Elem().Kind()) {
+			return nil, false
+		}
+		b := make([]byte, v.Len())
+		for i := range b {
+			if e := v.Index(i); e.Kind() == reflect.Int8 {
+				b[i] = byte(e.Int())
+			} else {
+				b[i] = byte(e.Uint())
+			}
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+func isByte(k reflect.Kind) bool {
+	return k == reflect.Uint8 || k == reflect.Int8
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
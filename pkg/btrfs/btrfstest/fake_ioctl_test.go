@@ -0,0 +1,314 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfstest_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs/btrfstest"
+)
+
+const ext4Magic = 0xef53
+
+func TestStatfsGoesThroughRunner(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      func(dir string) error
+		wantCmd btrfs.IoctlCmd
+	}{
+		{
+			name:    "create subvolume",
+			op:      func(dir string) error { return btrfs.CreateSubvolume(filepath.Join(dir, "vol")) },
+			wantCmd: btrfs.BTRFS_IOC_SUBVOL_CREATE_V2,
+		},
+		{
+			name:    "sync filesystem",
+			op:      btrfs.SyncFilesystem,
+			wantCmd: btrfs.BTRFS_IOC_SYNC,
+		},
+		{
+			name:    "start transaction sync",
+			op:      func(dir string) error { _, err := btrfs.StartTransactionSync(dir); return err },
+			wantCmd: btrfs.BTRFS_IOC_START_SYNC,
+		},
+	}
+	for _, tt := range tests {
+		for _, onBtrfs := range []bool{true, false} {
+			name := tt.name + "/btrfs"
+			if !onBtrfs {
+				name = tt.name + "/ext4"
+			}
+			t.Run(name, func(t *testing.T) {
+				fake := btrfstest.NewFakeIoctlRunner()
+				if !onBtrfs {
+					fake.Filesystem(ext4Magic)
+				}
+				defer fake.Install()()
+				err := tt.op(t.TempDir())
+				calls := fake.CallsFor(tt.wantCmd)
+				if onBtrfs {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if len(calls) != 1 {
+						t.Fatalf("got %d %s calls, want 1", len(calls), tt.wantCmd)
+					}
+					return
+				}
+				if !errors.Is(err, btrfs.ErrNotBtrfs) {
+					t.Fatalf("error = %v, want ErrNotBtrfs", err)
+				}
+				if len(fake.Calls()) != 0 {
+					t.Fatalf("ioctls issued on a non-btrfs path: %v", fake.Calls())
+				}
+			})
+		}
+	}
+}
+
+func TestIsSubvolumeUsesRunner(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		magic uint32
+		want  bool
+	}{
+		{btrfs.BTRFS_SUPER_MAGIC, true},
+		{ext4Magic, false},
+	} {
+		fake := btrfstest.NewFakeIoctlRunner().Filesystem(tt.magic)
+		restore := fake.Install()
+		got, err := btrfs.IsSubvolume(dir)
+		restore()
+		if err != nil || got != tt.want {
+			t.Errorf("IsSubvolume with magic 0x%x = %v, %v, want %v", tt.magic, got, err, tt.want)
+		}
+	}
+	fake := btrfstest.NewFakeIoctlRunner()
+	defer fake.Install()()
+	if _, err := btrfs.IsSubvolume(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("IsSubvolume of a missing path = %v, want not exist", err)
+	}
+}
+
+func TestIsSubvolumeReadOnlyReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   btrfstest.IoctlReply
+		want    bool
+		wantErr error
+	}{
+		{name: "read-only", reply: btrfstest.IoctlReply{Out: uint64(btrfs.SubvolReadOnly)}, want: true},
+		{name: "writable", reply: btrfstest.IoctlReply{Out: uint64(0)}, want: false},
+		{name: "other flags", reply: btrfstest.IoctlReply{Out: uint64(btrfs.SubvolQgroupInherit)}, want: false},
+		{name: "error", reply: btrfstest.IoctlReply{Err: syscall.EPERM}, wantErr: syscall.EPERM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := btrfstest.NewFakeIoctlRunner().Reply(btrfs.BTRFS_IOC_SUBVOL_GETFLAGS, tt.reply)
+			defer fake.Install()()
+			got, err := btrfs.IsSubvolumeReadOnly(t.TempDir())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IsSubvolumeReadOnly = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetSubvolumeReadOnlyFlags(t *testing.T) {
+	const other = uint64(1) << 40
+	tests := []struct {
+		name      string
+		flags     uint64
+		readonly  bool
+		wantFlags uint64
+	}{
+		{name: "set", flags: 0, readonly: true, wantFlags: uint64(btrfs.SubvolReadOnly)},
+		{name: "clear", flags: uint64(btrfs.SubvolReadOnly), readonly: false, wantFlags: 0},
+		{name: "set keeps other flags", flags: other, readonly: true, wantFlags: other | uint64(btrfs.SubvolReadOnly)},
+		{name: "clear keeps other flags", flags: other | uint64(btrfs.SubvolReadOnly), readonly: false, wantFlags: other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := btrfstest.NewFakeIoctlRunner().
+				Reply(btrfs.BTRFS_IOC_SUBVOL_GETFLAGS, btrfstest.IoctlReply{Out: tt.flags})
+			defer fake.Install()()
+			if err := btrfs.SetSubvolumeReadOnly(t.TempDir(), tt.readonly); err != nil {
+				t.Fatal(err)
+			}
+			calls := fake.CallsFor(btrfs.BTRFS_IOC_SUBVOL_SETFLAGS)
+			if len(calls) != 1 {
+				t.Fatalf("got %d SETFLAGS calls, want 1", len(calls))
+			}
+			if calls[0].Data != tt.wantFlags {
+				t.Errorf("flags set = %#x, want %#x", calls[0].Data, tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestGetSubvolumeInfoFromFields(t *testing.T) {
+	id, parent, received := uuid.New(), uuid.New(), uuid.New()
+	otime := time.Unix(1700000000, 500)
+	fake := btrfstest.NewFakeIoctlRunner().Reply(btrfs.BTRFS_IOC_GET_SUBVOL_INFO, btrfstest.IoctlReply{
+		Fields: map[string]any{
+			"Treeid":        257,
+			"Parent_id":     5,
+			"Name":          "snap",
+			"Flags":         btrfs.SubvolReadOnly,
+			"Uuid":          id,
+			"Parent_uuid":   parent,
+			"Received_uuid": received,
+			"Ctransid":      42,
+			"Stransid":      40,
+			"Otime.Sec":     otime.Unix(),
+			"Otime.Nsec":    otime.Nanosecond(),
+		},
+	})
+	defer fake.Install()()
+	info, err := btrfs.GetSubvolumeInfo(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := btrfs.SubvolumeInfo{
+		ID: 257, ParentID: 5, Name: "snap", ReadOnly: true,
+		UUID: id, ParentUUID: parent, ReceivedUUID: received,
+		Ctransid: 42, Stransid: 40,
+	}
+	got := *info
+	if !got.Otime.Equal(otime) {
+		t.Errorf("Otime = %v, want %v", got.Otime, otime)
+	}
+	got.Otime, got.Ctime, got.Stime, got.Rtime = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	if got != want {
+		t.Errorf("GetSubvolumeInfo = %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateSubvolumeRecordsArguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   btrfstest.IoctlReply
+		wantErr error
+	}{
+		{name: "success"},
+		{name: "exists", reply: btrfstest.IoctlReply{Err: syscall.EEXIST}, wantErr: syscall.EEXIST},
+		{name: "permission", reply: btrfstest.IoctlReply{Err: syscall.EPERM}, wantErr: syscall.EPERM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := btrfstest.NewFakeIoctlRunner().Reply(btrfs.BTRFS_IOC_SUBVOL_CREATE_V2, tt.reply)
+			defer fake.Install()()
+			err := btrfs.CreateSubvolume(filepath.Join(t.TempDir(), "data"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			calls := fake.CallsFor(btrfs.BTRFS_IOC_SUBVOL_CREATE_V2)
+			if len(calls) != 1 {
+				t.Fatalf("got %d SUBVOL_CREATE_V2 calls, want 1", len(calls))
+			}
+			name, err := calls[0].StringField("Name")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "data" {
+				t.Errorf("name = %q, want %q", name, "data")
+			}
+			if fd, err := calls[0].Field("Fd"); err != nil || fd != int64(calls[0].Fd) {
+				t.Errorf("argument fd = %v, %v, want the fd of the parent %d", fd, err, calls[0].Fd)
+			}
+		})
+	}
+}
+
+func TestReplyQueue(t *testing.T) {
+	fake := btrfstest.NewFakeIoctlRunner().Reply(btrfs.BTRFS_IOC_SUBVOL_GETFLAGS,
+		btrfstest.IoctlReply{Err: syscall.EINTR},
+		btrfstest.IoctlReply{Out: uint64(btrfs.SubvolReadOnly)},
+	)
+	defer fake.Install()()
+	dir := t.TempDir()
+	for i, want := range []error{syscall.EINTR, nil, nil} {
+		if _, err := btrfs.IsSubvolumeReadOnly(dir); !errors.Is(err, want) {
+			t.Errorf("call %d: error = %v, want %v", i, err, want)
+		}
+	}
+	if n := len(fake.Calls()); n != 3 {
+		t.Errorf("recorded %d calls, want 3", n)
+	}
+	fake.Reset()
+	if n := len(fake.Calls()); n != 0 {
+		t.Errorf("recorded %d calls after Reset, want 0", n)
+	}
+}
+
+func TestSetField(t *testing.T) {
+	type inner struct{ Sec uint64 }
+	type args struct {
+		Count uint32
+		Name  [8]int8
+		UUID  [16]uint8
+		Time  inner
+		Ptr   *int
+	}
+	id := uuid.New()
+	tests := []struct {
+		name    string
+		field   string
+		value   any
+		check   func(a args) bool
+		wantErr bool
+	}{
+		{name: "number", field: "Count", value: 7, check: func(a args) bool { return a.Count == 7 }},
+		{name: "string into int8 array", field: "Name", value: "vol", check: func(a args) bool {
+			return a.Name == [8]int8{'v', 'o', 'l'}
+		}},
+		{name: "uuid into byte array", field: "UUID", value: id, check: func(a args) bool { return a.UUID == id }},
+		{name: "nested", field: "Time.Sec", value: int64(12), check: func(a args) bool { return a.Time.Sec == 12 }},
+		{name: "too long", field: "Name", value: "too long name", wantErr: true},
+		{name: "unknown field", field: "Missing", value: 1, wantErr: true},
+		{name: "wrong type", field: "Count", value: "seven", wantErr: true},
+		{name: "nil value", field: "Ptr", value: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := args{Name: [8]int8{'x', 'x', 'x', 'x', 'x'}}
+			err := btrfstest.SetField(&a, tt.field, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(a) {
+				t.Errorf("unexpected result %+v", a)
+			}
+		})
+	}
+}
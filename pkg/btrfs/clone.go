@@ -15,27 +15,106 @@ If not, see <https://www.gnu.org/licenses/>.
 
 package btrfs
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
 
 // Clone clones a range of bytes from a source file to a destination file.
 func Clone(src string, dest string, srcOffset uint64, destOffset uint64, size uint64) error {
-	return clone(src, dest, srcOffset, destOffset, size)
+	return clone(src, dest, srcOffset, destOffset, size, os.O_WRONLY)
 }
 
-func clone(src string, dest string, srcOffset uint64, destOffset uint64, size uint64) error {
+// Reflink creates dst as a copy-on-write copy of the whole file at src. The destination
+// is created with the permissions of the source if it does not exist and truncated if it
+// does. Both files must live on the same btrfs filesystem, otherwise ErrCrossDevice is
+// returned. If dst is src, or a hard link to it, ErrSameFile is returned. An existing
+// destination is left untouched when an error is returned before cloning.
+func Reflink(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	st, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	// Only truncate once the clone is known to be possible, dst may be src
+	destFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	dstSt, err := destFile.Stat()
+	if err != nil {
+		return err
+	}
+	if os.SameFile(st, dstSt) {
+		return fmt.Errorf("%w: %s and %s", ErrSameFile, src, dst)
+	}
+	if err := checkSameFilesystem(srcFile, destFile); err != nil {
+		return err
+	}
+	if err := destFile.Truncate(0); err != nil {
+		return err
+	}
+	return wrapCloneError(ioctlValue(destFile.Fd(), BTRFS_IOC_CLONE, srcFile.Fd()), src, dst)
+}
+
+// ReflinkRange clones length bytes at srcOff in src to dstOff in dst without copying
+// the data. The destination is created if it does not exist. A length of zero clones to
+// the end of the source file. Both files must live on the same btrfs filesystem,
+// otherwise ErrCrossDevice is returned.
+func ReflinkRange(src, dst string, srcOff, dstOff, length uint64) error {
+	return clone(src, dst, srcOff, dstOff, length, os.O_WRONLY|os.O_CREATE)
+}
+
+func clone(src string, dest string, srcOffset uint64, destOffset uint64, size uint64, flag int) error {
 	srcFile, err := os.OpenFile(src, os.O_RDONLY, 0600)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
-	destFile, err := os.OpenFile(dest, os.O_WRONLY, 0600)
+	destFile, err := os.OpenFile(dest, flag, 0600)
 	if err != nil {
 		return err
 	}
+	defer destFile.Close()
+	if err := checkSameFilesystem(srcFile, destFile); err != nil {
+		return err
+	}
 	var args cloneRangeArgs
 	args.Src_fd = int64(srcFile.Fd())
 	args.Src_offset = srcOffset
 	args.Src_length = size
 	args.Dest_offset = destOffset
-	return callWriteIoctl(destFile.Fd(), BTRFS_IOC_CLONE_RANGE, &args)
+	return wrapCloneError(callWriteIoctl(destFile.Fd(), BTRFS_IOC_CLONE_RANGE, &args), src, dest)
+}
+
+// checkSameFilesystem returns ErrCrossDevice if the two files are not on the same btrfs
+// filesystem. Device numbers cannot be compared since every subvolume has its own, so
+// the filesystem IDs are compared instead.
+func checkSameFilesystem(a, b *os.File) error {
+	aInfo, err := getFilesystemInfo(a.Fd())
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.Name(), err)
+	}
+	bInfo, err := getFilesystemInfo(b.Fd())
+	if err != nil {
+		return fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	if aInfo.Fsid != bInfo.Fsid {
+		return fmt.Errorf("%w: %s and %s", ErrCrossDevice, a.Name(), b.Name())
+	}
+	return nil
+}
+
+func wrapCloneError(err error, src, dst string) error {
+	if errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("%w: %s and %s", ErrCrossDevice, src, dst)
+	}
+	return err
 }
@@ -0,0 +1,113 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs/btrfstest"
+)
+
+func TestReflinkKeepsDataOnError(t *testing.T) {
+	tests := []struct {
+		name    string
+		dst     func(dir, src string) (string, error)
+		fsInfo  []btrfstest.IoctlReply
+		wantErr error
+	}{
+		{
+			name:    "same path",
+			dst:     func(dir, src string) (string, error) { return src, nil },
+			wantErr: btrfs.ErrSameFile,
+		},
+		{
+			name: "hard link",
+			dst: func(dir, src string) (string, error) {
+				dst := filepath.Join(dir, "link")
+				return dst, os.Link(src, dst)
+			},
+			wantErr: btrfs.ErrSameFile,
+		},
+		{
+			name: "cross device",
+			dst: func(dir, src string) (string, error) {
+				dst := filepath.Join(dir, "dst")
+				return dst, os.WriteFile(dst, []byte("existing"), 0o644)
+			},
+			fsInfo:  []btrfstest.IoctlReply{{Fields: map[string]any{"Fsid": []byte{1}}}, {Fields: map[string]any{"Fsid": []byte{2}}}},
+			wantErr: btrfs.ErrCrossDevice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := btrfstest.NewFakeIoctlRunner().Reply(btrfs.BTRFS_IOC_FS_INFO, tt.fsInfo...)
+			defer fake.Install()()
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			if err := os.WriteFile(src, []byte("source data"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			dst, err := tt.dst(dir, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := btrfs.Reflink(src, dst); !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if n := len(fake.CallsFor(btrfs.BTRFS_IOC_CLONE)); n != 0 {
+				t.Errorf("got %d clone calls, want none", n)
+			}
+			if data, err := os.ReadFile(src); err != nil || string(data) != "source data" {
+				t.Errorf("source changed: %q, %v", data, err)
+			}
+			if data, err := os.ReadFile(dst); err != nil || string(data) != string(before) {
+				t.Errorf("destination changed: %q, %v, want %q", data, err, before)
+			}
+		})
+	}
+}
+
+func TestReflinkTruncatesBeforeClone(t *testing.T) {
+	fake := btrfstest.NewFakeIoctlRunner()
+	defer fake.Install()()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("longer existing data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := btrfs.Reflink(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.CallsFor(btrfs.BTRFS_IOC_CLONE)); n != 1 {
+		t.Errorf("got %d clone calls, want 1", n)
+	}
+	// The fake clones nothing, so only the truncation is visible
+	if st, err := os.Stat(dst); err != nil || st.Size() != 0 {
+		t.Errorf("destination not truncated: %v, %v", st, err)
+	}
+}
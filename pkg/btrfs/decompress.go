@@ -18,30 +18,83 @@ package btrfs
 import (
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/rasky/go-lzo"
 )
 
-func decompressZlip(data []byte) ([]byte, error) {
+// The compressed extents in send streams are padded to the sector size, so the
+// decompressors read exactly the expected number of bytes instead of the whole
+// input.
+
+func decompressZlip(data []byte, unencodedLen int) ([]byte, error) {
 	r, err := zlib.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
-	return io.ReadAll(r)
+	return readUnencoded(r, unencodedLen)
 }
 
-func decompressLzo(data []byte, encodedLen, unencodedLen int) ([]byte, error) {
-	return lzo.Decompress1X(bytes.NewReader(data), encodedLen, unencodedLen)
+// lzoLen is the size of the length fields in the btrfs LZO format.
+const lzoLen = 4
+
+// decompressLzo decompresses data in the btrfs LZO format: the total compressed
+// length followed by segments that are each a length and the LZO1X compressed data
+// of at most one sector. A length field never crosses a sector boundary, the rest
+// of the sector is padding instead.
+func decompressLzo(data []byte, sectorSize, unencodedLen int) ([]byte, error) {
+	if len(data) < lzoLen {
+		return nil, fmt.Errorf("lzo: %w", io.ErrUnexpectedEOF)
+	}
+	total := int(binary.LittleEndian.Uint32(data))
+	if total > len(data) {
+		return nil, fmt.Errorf("lzo: compressed length %d exceeds the %d bytes of data", total, len(data))
+	}
+	out := make([]byte, 0, unencodedLen)
+	pos := lzoLen
+	for pos < total && len(out) < unencodedLen {
+		if pos+lzoLen > total {
+			return nil, fmt.Errorf("lzo: %w", io.ErrUnexpectedEOF)
+		}
+		segLen := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += lzoLen
+		if segLen > total-pos {
+			return nil, fmt.Errorf("lzo: segment of %d bytes exceeds the compressed data", segLen)
+		}
+		seg, err := lzo.Decompress1X(bytes.NewReader(data[pos:pos+segLen]), segLen, sectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("lzo: %w", err)
+		}
+		out = append(out, seg...)
+		pos += segLen
+		if left := sectorSize - pos%sectorSize; left < lzoLen {
+			pos += left
+		}
+	}
+	if len(out) < unencodedLen {
+		return nil, fmt.Errorf("lzo: got %d of %d unencoded bytes", len(out), unencodedLen)
+	}
+	return out[:unencodedLen], nil
 }
 
-func decompressZstd(data []byte) ([]byte, error) {
+func decompressZstd(data []byte, unencodedLen int) ([]byte, error) {
 	r, err := zstd.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
-	return io.ReadAll(r)
+	return readUnencoded(r, unencodedLen)
+}
+
+// readUnencoded reads the unencodedLen decompressed bytes from r.
+func readUnencoded(r io.Reader, unencodedLen int) ([]byte, error) {
+	out := make([]byte, unencodedLen)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
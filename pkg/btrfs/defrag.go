@@ -0,0 +1,156 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefragCompression is the compression algorithm to apply while defragmenting.
+type DefragCompression uint32
+
+const (
+	// DefragCompressionNone leaves the compression of rewritten extents unchanged.
+	DefragCompressionNone DefragCompression = 0
+	// DefragCompressionZLib compresses rewritten extents with zlib.
+	DefragCompressionZLib DefragCompression = 1
+	// DefragCompressionLZO compresses rewritten extents with lzo.
+	DefragCompressionLZO DefragCompression = 2
+	// DefragCompressionZSTD compresses rewritten extents with zstd.
+	DefragCompressionZSTD DefragCompression = 3
+)
+
+const (
+	defragRangeCompress = 1 << 0
+	defragRangeStartIO  = 1 << 1
+)
+
+// DefragOptions are options for a defragment operation.
+type DefragOptions struct {
+	// Start is the offset in each file to start defragmenting from.
+	Start uint64
+	// Length is the number of bytes to defragment. Zero means to the end of the file.
+	Length uint64
+	// ExtentThreshold is the target extent size. Extents larger than this are left
+	// alone. Zero uses the kernel default.
+	ExtentThreshold uint32
+	// Compression, if set, compresses the rewritten extents with the given algorithm.
+	Compression DefragCompression
+	// Flush starts writeback of the defragmented ranges before returning.
+	Flush bool
+}
+
+// DefragError is returned by Defragment when one or more files could not be
+// defragmented. Files not listed were processed successfully.
+type DefragError struct {
+	// Errors maps the path of each failed file to its error.
+	Errors map[string]error
+}
+
+// Error implements the error interface.
+func (e *DefragError) Error() string {
+	paths := make([]string, 0, len(e.Errors))
+	for path := range e.Errors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	msgs := make([]string, len(paths))
+	for i, path := range paths {
+		msgs[i] = fmt.Sprintf("%s: %s", path, e.Errors[path])
+	}
+	return fmt.Sprintf("failed to defragment %d file(s): %s", len(paths), strings.Join(msgs, "; "))
+}
+
+// Defragment defragments the file at path. If path is a directory, all regular files
+// beneath it are defragmented. Failures on individual files do not abort the walk and
+// are returned together as a *DefragError.
+func Defragment(path string, opts DefragOptions) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	args := opts.toArgs()
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return defragFile(path, args)
+	}
+	failed := make(map[string]error)
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			failed[p] = err
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := defragFile(p, args); err != nil {
+			failed[p] = err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &DefragError{Errors: failed}
+	}
+	return nil
+}
+
+func (o DefragOptions) toArgs() *defragRangeArgs {
+	args := &defragRangeArgs{
+		Start:         o.Start,
+		Len:           o.Length,
+		Extent_thresh: o.ExtentThreshold,
+	}
+	if args.Len == 0 {
+		args.Len = math.MaxUint64
+	}
+	if o.Compression != DefragCompressionNone {
+		args.Flags |= defragRangeCompress
+		args.Compress_type = uint32(o.Compression)
+	}
+	if o.Flush {
+		args.Flags |= defragRangeStartIO
+	}
+	return args
+}
+
+func defragFile(path string, args *defragRangeArgs) error {
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Copy the arguments since the call decodes the result back into them
+	a := *args
+	return callWriteIoctl(f.Fd(), BTRFS_IOC_DEFRAG_RANGE, &a)
+}
@@ -16,9 +16,11 @@ If not, see <https://www.gnu.org/licenses/>.
 package btrfs
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/google/uuid"
@@ -56,6 +58,9 @@ func GetDeviceInfo(path string) (*DeviceInfo, error) {
 }
 
 func getDeviceInfoFromRoot(rootPath string) (*DeviceInfo, error) {
+	if err := assertBtrfs(rootPath); err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(rootPath, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return nil, err
@@ -95,6 +100,9 @@ func GetDeviceStats(path string) (*DeviceStats, error) {
 }
 
 func getDeviceStatsFromRoot(rootPath string) (*DeviceStats, error) {
+	if err := assertBtrfs(rootPath); err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(rootPath, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return nil, err
@@ -160,3 +168,86 @@ func readDeviceStats(fd uintptr, devid uint64) (*getDeviceStats, error) {
 	args := &getDeviceStats{Devid: devid, Items: 5, Flags: 0}
 	return args, callWriteIoctl(fd, BTRFS_IOC_GET_DEV_STATS, args)
 }
+
+// deviceSpecByID is the volume args flag identifying a device by its ID instead of
+// its path in BTRFS_IOC_RM_DEV_V2.
+const deviceSpecByID = 1 << 3
+
+// AddDevice adds the block device at devicePath to the filesystem mounted at
+// mountpoint. Errors from the kernel, such as EBUSY for a device that is mounted or
+// already in use, are returned as is.
+func AddDevice(mountpoint, devicePath string) error {
+	if err := checkBlockDevice(devicePath); err != nil {
+		return err
+	}
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args := &volumeArgs{}
+	if len(devicePath) >= len(args.Name) {
+		return fmt.Errorf("device path is too long: %d bytes", len(devicePath))
+	}
+	for i := range devicePath {
+		args.Name[i] = int8(devicePath[i])
+	}
+	return callWriteIoctl(f.Fd(), BTRFS_IOC_ADD_DEV, args)
+}
+
+// RemoveDevice removes the device at devicePath from the filesystem mounted at
+// mountpoint, relocating its data to the remaining devices. The special names
+// "missing", to remove a device that is no longer present, and "cancel", to cancel
+// a removal in progress, are passed through to the kernel. Errors from the kernel
+// are returned as is.
+func RemoveDevice(mountpoint, devicePath string) error {
+	if devicePath != "missing" && devicePath != "cancel" {
+		if err := checkBlockDevice(devicePath); err != nil {
+			return err
+		}
+	}
+	args := &volumeArgsV2{}
+	if len(devicePath) >= len(args.Name) {
+		return fmt.Errorf("device path is too long: %d bytes", len(devicePath))
+	}
+	args.Name = toSnapInt8Array(devicePath)
+	return removeDevice(mountpoint, args)
+}
+
+// RemoveDeviceByID removes the device with the given ID from the filesystem mounted
+// at mountpoint. See RemoveDevice.
+func RemoveDeviceByID(mountpoint string, devid uint64) error {
+	args := &volumeArgsV2{Flags: deviceSpecByID}
+	binary.LittleEndian.PutUint64(args.Anon0[0:8], devid)
+	return removeDevice(mountpoint, args)
+}
+
+func removeDevice(mountpoint string, args *volumeArgsV2) error {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return callWriteIoctl(f.Fd(), BTRFS_IOC_RM_DEV_V2, args)
+}
+
+// checkBlockDevice returns an error if path is not an absolute path to a block device.
+func checkBlockDevice(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("device path must be absolute: %s", path)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st.Mode()&os.ModeDevice == 0 || st.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", path)
+	}
+	return nil
+}
@@ -19,11 +19,18 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"syscall"
 	"unsafe"
 )
 
 var (
 	ErrEncryptionNotSupported = errors.New("encryption not supported")
+	// ErrEncodedWriteNotSupported is returned by EncodedWrite when the kernel or
+	// the filesystem cannot take the encoded data, or the caller lacks the
+	// CAP_SYS_ADMIN capability required for it. The data can still be written
+	// after decompressing it with EncodedWriteOp.FileData.
+	ErrEncodedWriteNotSupported = errors.New("encoded write not supported")
 )
 
 // EncodedWriteOp is an operation to write encoded data to a file.
@@ -37,32 +44,66 @@ type EncodedWriteOp struct {
 	Encryption          uint32 // Not supported yet
 }
 
-// Decompress decompresses the data in the EncodedWriteOp.
+// Decompress decompresses the data in the EncodedWriteOp. The result is the whole
+// unencoded extent of UnencodedLength bytes, of which only a part may belong in
+// the file; see FileData.
 func (e *EncodedWriteOp) Decompress() ([]byte, error) {
+	if e.Encryption != 0 {
+		return nil, fmt.Errorf("Decompress: %w", ErrEncryptionNotSupported)
+	}
 	switch e.Compression {
 	case CompressionNone:
 		return e.Data, nil
 	case CompressionZLib:
-		return decompressZlip(e.Data)
+		return decompressZlip(e.Data, int(e.UnencodedLength))
 	case CompressionLZO4k, CompressionLZO8k, CompressionLZO16k, CompressionLZO32k, CompressionLZO64k:
-		return decompressLzo(e.Data, len(e.Data), int(e.UnencodedLength))
+		sectorSize := 4096 << (e.Compression - CompressionLZO4k)
+		return decompressLzo(e.Data, sectorSize, int(e.UnencodedLength))
 	case CompressionZSTD:
-		return decompressZstd(e.Data)
+		return decompressZstd(e.Data, int(e.UnencodedLength))
 	default:
 		return nil, fmt.Errorf("Decompress: unknown compression type %d", e.Compression)
 	}
 }
 
-// EncodedWrite writes encoded data to a file via ioctl.
+// FileData decompresses the data in the EncodedWriteOp and returns the
+// UnencodedFileLength bytes at UnencodedOffset that are to be written to the file
+// at Offset.
+func (e *EncodedWriteOp) FileData() ([]byte, error) {
+	data, err := e.Decompress()
+	if err != nil {
+		return nil, err
+	}
+	if e.UnencodedOffset+e.UnencodedFileLength > uint64(len(data)) {
+		return nil, fmt.Errorf("FileData: %d bytes at offset %d exceed the %d unencoded bytes",
+			e.UnencodedFileLength, e.UnencodedOffset, len(data))
+	}
+	return data[e.UnencodedOffset : e.UnencodedOffset+e.UnencodedFileLength], nil
+}
+
+// EncodedWrite writes encoded data to a file via ioctl. ErrEncodedWriteNotSupported
+// is returned if the data cannot be written encoded.
 func EncodedWrite(path string, op *EncodedWriteOp) error {
 	if op.Encryption != 0 {
 		return fmt.Errorf("EncodedWrite: %w", ErrEncryptionNotSupported)
 	}
+	if len(op.Data) == 0 {
+		return errors.New("EncodedWrite: no data")
+	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	iov := &ioVec{
+		IovBase: uint64(uintptr(unsafe.Pointer(&op.Data[0]))),
+		IovLen:  uint64(len(op.Data)),
+	}
 	args := encodedIOArgs{
-		Iov: &ioVec{
-			IovBase: uintptr(unsafe.Pointer(&op.Data[0])),
-			IovLen:  uint64(len(op.Data)),
-		},
+		Iov:              uint64(uintptr(unsafe.Pointer(iov))),
 		Iovcnt:           1,
 		Offset:           int64(op.Offset),
 		Len:              op.UnencodedFileLength,
@@ -71,16 +112,20 @@ func EncodedWrite(path string, op *EncodedWriteOp) error {
 		Compression:      uint32(op.Compression),
 		Encryption:       op.Encryption,
 	}
-	f, err := os.OpenFile(path, os.O_RDWR, 0600)
-	if err != nil {
-		return err
+	err = callWriteIoctl(f.Fd(), BTRFS_IOC_ENCODED_WRITE, &args)
+	// The kernel reads the iovec and the data through the pointers in the arguments
+	runtime.KeepAlive(iov)
+	runtime.KeepAlive(op.Data)
+	switch {
+	case errors.Is(err, syscall.ENOTTY), errors.Is(err, syscall.EOPNOTSUPP),
+		errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EINVAL):
+		return fmt.Errorf("EncodedWrite: %w: %v", ErrEncodedWriteNotSupported, err)
 	}
-	defer f.Close()
-	return callWriteIoctl(f.Fd(), BTRFS_IOC_ENCODED_WRITE, &args)
+	return err
 }
 
 type encodedIOArgs struct {
-	Iov              *ioVec
+	Iov              uint64
 	Iovcnt           uint64
 	Offset           int64
 	Flags            uint64
@@ -93,6 +138,6 @@ type encodedIOArgs struct {
 }
 
 type ioVec struct {
-	IovBase uintptr
+	IovBase uint64
 	IovLen  uint64
 }
@@ -0,0 +1,56 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotBtrfs is returned when a path is expected to be on a btrfs filesystem but
+	// is not.
+	ErrNotBtrfs = errors.New("not a btrfs filesystem")
+	// ErrNotASubvolume is returned when a path is expected to be a subvolume but is not.
+	ErrNotASubvolume = errors.New("not a subvolume")
+	// ErrReadOnlySubvolume is returned when an operation requires a writable subvolume
+	// but the subvolume is read-only.
+	ErrReadOnlySubvolume = errors.New("subvolume is read-only")
+	// ErrNotReadOnlySubvolume is returned when an operation requires a read-only
+	// subvolume, such as sending it, but the subvolume is writable.
+	ErrNotReadOnlySubvolume = errors.New("subvolume is not read-only")
+	// ErrCrossDevice is returned when cloning between files on different filesystems.
+	ErrCrossDevice = errors.New("source and destination are on different filesystems")
+	// ErrSameFile is returned when cloning a whole file onto itself.
+	ErrSameFile = errors.New("source and destination are the same file")
+	// ErrNestedSubvolumes is returned when deleting a subvolume that contains other
+	// subvolumes.
+	ErrNestedSubvolumes = errors.New("subvolume contains nested subvolumes")
+	// ErrSubvolumeNotFound is returned when a subvolume matching a lookup could not be found.
+	// It wraps ErrNotFound.
+	ErrSubvolumeNotFound = fmt.Errorf("subvolume %w", ErrNotFound)
+	// ErrInvalidParent is returned when a subvolume cannot be used as the parent of an
+	// incremental send of another, because it is not an ancestor of it or is not older.
+	ErrInvalidParent = errors.New("invalid send parent")
+	// ErrAncestryCycle is returned when the parent UUIDs of subvolumes form a cycle.
+	ErrAncestryCycle = errors.New("parent UUID chain contains a cycle")
+	// ErrDependentSnapshots is returned when making a subvolume read-write that has
+	// read-only snapshots, which may be the parents of incremental sends.
+	ErrDependentSnapshots = errors.New("subvolume has dependent read-only snapshots")
+	// ErrCtransidRegression is returned when setting a received state on a subvolume
+	// would lower the ctransid it has already received from the same source.
+	ErrCtransidRegression = errors.New("received ctransid regression")
+)
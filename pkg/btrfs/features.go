@@ -0,0 +1,164 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CompatROFeatures are the compat_ro feature flags of a filesystem. Kernels that do
+// not know one of them can only mount the filesystem read-only.
+type CompatROFeatures uint64
+
+// IncompatFeatures are the incompat feature flags of a filesystem. Kernels that do
+// not know one of them cannot mount the filesystem.
+type IncompatFeatures uint64
+
+const (
+	CompatROFreeSpaceTree      CompatROFeatures = 1 << 0
+	CompatROFreeSpaceTreeValid CompatROFeatures = 1 << 1
+	CompatROVerity             CompatROFeatures = 1 << 2
+	CompatROBlockGroupTree     CompatROFeatures = 1 << 3
+)
+
+const (
+	IncompatMixedBackref   IncompatFeatures = 1 << 0
+	IncompatDefaultSubvol  IncompatFeatures = 1 << 1
+	IncompatMixedGroups    IncompatFeatures = 1 << 2
+	IncompatCompressLZO    IncompatFeatures = 1 << 3
+	IncompatCompressZSTD   IncompatFeatures = 1 << 4
+	IncompatBigMetadata    IncompatFeatures = 1 << 5
+	IncompatExtendedIref   IncompatFeatures = 1 << 6
+	IncompatRAID56         IncompatFeatures = 1 << 7
+	IncompatSkinnyMetadata IncompatFeatures = 1 << 8
+	IncompatNoHoles        IncompatFeatures = 1 << 9
+	IncompatMetadataUUID   IncompatFeatures = 1 << 10
+	IncompatRAID1C34       IncompatFeatures = 1 << 11
+	IncompatZoned          IncompatFeatures = 1 << 12
+	IncompatExtentTreeV2   IncompatFeatures = 1 << 13
+	IncompatRAIDStripeTree IncompatFeatures = 1 << 14
+	IncompatSimpleQuota    IncompatFeatures = 1 << 16
+)
+
+var compatROFeatureNames = []string{
+	0: "free_space_tree",
+	1: "free_space_tree_valid",
+	2: "verity",
+	3: "block_group_tree",
+}
+
+var incompatFeatureNames = []string{
+	0:  "mixed_backref",
+	1:  "default_subvol",
+	2:  "mixed_groups",
+	3:  "compress_lzo",
+	4:  "compress_zstd",
+	5:  "big_metadata",
+	6:  "extended_iref",
+	7:  "raid56",
+	8:  "skinny_metadata",
+	9:  "no_holes",
+	10: "metadata_uuid",
+	11: "raid1c34",
+	12: "zoned",
+	13: "extent_tree_v2",
+	14: "raid_stripe_tree",
+	16: "simple_quota",
+}
+
+// Has returns true if all of the given flags are set.
+func (f CompatROFeatures) Has(flags CompatROFeatures) bool { return f&flags == flags }
+
+// String returns the names of the set flags, separated by commas.
+func (f CompatROFeatures) String() string { return featureString(uint64(f), compatROFeatureNames) }
+
+// Has returns true if all of the given flags are set.
+func (f IncompatFeatures) Has(flags IncompatFeatures) bool { return f&flags == flags }
+
+// String returns the names of the set flags, separated by commas.
+func (f IncompatFeatures) String() string { return featureString(uint64(f), incompatFeatureNames) }
+
+// featureString names the bits set in flags, using their hex value for bits that
+// have no name.
+func featureString(flags uint64, names []string) string {
+	var out []string
+	for bit := 0; bit < 64; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		if bit < len(names) && names[bit] != "" {
+			out = append(out, names[bit])
+		} else {
+			out = append(out, fmt.Sprintf("%#x", uint64(1)<<bit))
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// FeatureSet is a set of compat, compat_ro and incompat feature flags. No compat
+// features are currently defined.
+type FeatureSet struct {
+	Compat   uint64
+	CompatRO CompatROFeatures
+	Incompat IncompatFeatures
+}
+
+// Features describes the features of a mounted filesystem and of the running
+// kernel, as returned by GetFeatures.
+type Features struct {
+	// Enabled are the features enabled on the filesystem.
+	Enabled FeatureSet
+	// Supported are the features the running kernel supports.
+	Supported FeatureSet
+	// SafeSet are the features that can be enabled while the filesystem is mounted.
+	SafeSet FeatureSet
+	// SafeClear are the features that can be disabled while the filesystem is
+	// mounted.
+	SafeClear FeatureSet
+}
+
+// GetFeatures returns the features enabled on the filesystem mounted at
+// mountpoint, together with the features the running kernel supports.
+func GetFeatures(mountpoint string) (*Features, error) {
+	f, err := openBtrfs(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var enabled featureFlags
+	if err := callReadIoctl(f.Fd(), BTRFS_IOC_GET_FEATURES, &enabled); err != nil {
+		return nil, fmt.Errorf("failed to get features of %s: %w", mountpoint, err)
+	}
+	var supported [3]featureFlags
+	if err := callReadIoctl(f.Fd(), BTRFS_IOC_GET_SUPPORTED_FEATURES, &supported); err != nil {
+		return nil, fmt.Errorf("failed to get supported features: %w", err)
+	}
+	return &Features{
+		Enabled:   enabled.set(),
+		Supported: supported[0].set(),
+		SafeSet:   supported[1].set(),
+		SafeClear: supported[2].set(),
+	}, nil
+}
+
+func (f featureFlags) set() FeatureSet {
+	return FeatureSet{
+		Compat:   f.Compat_flags,
+		CompatRO: CompatROFeatures(f.Compat_ro_flags),
+		Incompat: IncompatFeatures(f.Incompat_flags),
+	}
+}
@@ -16,12 +16,28 @@ If not, see <https://www.gnu.org/licenses/>.
 package btrfs
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"os"
 
 	"github.com/google/uuid"
 )
 
+// filesystemLabelSize is the size of the label buffer, including the terminating
+// null byte.
+const filesystemLabelSize = 256
+
+// Flags of the FS_INFO ioctl requesting optional fields. The kernel sets the flags
+// of the fields it filled in on return.
+const (
+	fsInfoFlagCsumInfo     = 1 << 0
+	fsInfoFlagGeneration   = 1 << 1
+	fsInfoFlagMetadataUUID = 1 << 2
+)
+
 type FilesystemInfo struct {
+	Label        string
 	MaxID        uint64
 	NumDevices   uint64
 	FSID         uuid.UUID
@@ -38,6 +54,9 @@ type FilesystemInfo struct {
 // GetFilesystemInfo returns metadata about the filesystem at the given path.
 // If the path is not a BTRFS filesystem, an error will be returned.
 func GetFilesystemInfo(path string) (*FilesystemInfo, error) {
+	if err := assertBtrfs(path); err != nil {
+		return nil, err
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -47,7 +66,12 @@ func GetFilesystemInfo(path string) (*FilesystemInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	label, err := getFilesystemLabel(f.Fd())
+	if err != nil {
+		return nil, err
+	}
 	return &FilesystemInfo{
+		Label:        label,
 		MaxID:        rawInfo.Max_id,
 		NumDevices:   rawInfo.Num_devices,
 		FSID:         uuid.UUID(rawInfo.Fsid),
@@ -63,6 +87,93 @@ func GetFilesystemInfo(path string) (*FilesystemInfo, error) {
 }
 
 func getFilesystemInfo(fd uintptr) (*filesystemInfoArgs, error) {
-	args := &filesystemInfoArgs{}
-	return args, callReadIoctl(fd, BTRFS_IOC_FS_INFO, args)
+	// The optional fields are only filled in when requested
+	args := &filesystemInfoArgs{
+		Flags: fsInfoFlagCsumInfo | fsInfoFlagGeneration | fsInfoFlagMetadataUUID,
+	}
+	return args, callWriteIoctl(fd, BTRFS_IOC_FS_INFO, args)
+}
+
+// GetFilesystemGeneration returns the generation of the last committed transaction
+// of the filesystem at the given path. The generation increases with every
+// transaction that changes the filesystem, so comparing it with a stored value tells
+// whether anything changed since. Kernels older than 5.6 do not report it, in which
+// case the highest generation of the trees in the root tree is returned, which
+// requires CAP_SYS_ADMIN. If the path is not a BTRFS filesystem, an error matching
+// ErrNotBtrfs will be returned.
+func GetFilesystemGeneration(path string) (uint64, error) {
+	f, err := openBtrfs(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := getFilesystemInfo(f.Fd())
+	if err != nil {
+		return 0, err
+	}
+	if info.Flags&fsInfoFlagGeneration != 0 {
+		return info.Generation, nil
+	}
+	params := SearchParams{
+		Tree_id:      uint64(RootTreeObjectID),
+		Max_objectid: math.MaxUint64,
+		Max_offset:   math.MaxUint64,
+		Max_transid:  math.MaxUint64,
+		Min_type:     uint32(RootItemKey),
+		Max_type:     uint32(RootItemKey),
+	}
+	var gen uint64
+	err = walkBtrfsTreeFd(f.Fd(), params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if hdr.ItemType() != RootItemKey {
+			return nil
+		}
+		root, err := item.RootItem()
+		if err != nil {
+			return err
+		}
+		if root.Generation > gen {
+			gen = root.Generation
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read tree generations: %w", err)
+	}
+	return gen, nil
+}
+
+// SetFilesystemLabel sets the label of the filesystem at the given path. The label
+// may be at most 255 bytes long.
+func SetFilesystemLabel(path, label string) error {
+	if len(label) >= filesystemLabelSize {
+		return fmt.Errorf("label is %d bytes long, the maximum is %d", len(label), filesystemLabelSize-1)
+	}
+	if bytes.IndexByte([]byte(label), 0) != -1 {
+		return fmt.Errorf("label must not contain null bytes")
+	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, filesystemLabelSize)
+	copy(buf, label)
+	return ioctlBytes(f.Fd(), BTRFS_IOC_SET_FSLABEL, buf)
+}
+
+func getFilesystemLabel(fd uintptr) (string, error) {
+	buf := make([]byte, filesystemLabelSize)
+	if err := ioctlBytes(fd, BTRFS_IOC_GET_FSLABEL, buf); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(buf, 0); i != -1 {
+		buf = buf[:i]
+	}
+	return string(buf), nil
 }
@@ -0,0 +1,73 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// filesystemNames maps statfs magic numbers of common filesystems to their names,
+// for error messages about paths that are not on btrfs.
+var filesystemNames = map[uint32]string{
+	0xef53:     "ext2/ext3/ext4",
+	0x58465342: "xfs",
+	0x01021994: "tmpfs",
+	0x794c7630: "overlayfs",
+	0x6969:     "nfs",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x2fc12fc1: "zfs",
+	0xf2f52010: "f2fs",
+	0x4d44:     "vfat",
+	0x2011bab0: "exfat",
+	0x5346544e: "ntfs",
+	0x65735546: "fuse",
+	0x9fa0:     "proc",
+	0x62656572: "sysfs",
+	0x1373:     "devfs",
+	0x858458f6: "ramfs",
+	0x9123683e: "btrfs",
+}
+
+// filesystemName returns a human readable name for a statfs magic number.
+func filesystemName(magic uint32) string {
+	if name, ok := filesystemNames[magic]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (magic 0x%x)", magic)
+}
+
+// assertBtrfs returns an error matching ErrNotBtrfs, naming the detected filesystem
+// type, unless path is on a btrfs filesystem. If the path does not exist the returned
+// error matches os.ErrNotExist. It costs a single statfs call and caches nothing.
+func assertBtrfs(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var statfs syscall.Statfs_t
+	if err := runner.Statfs(path, &statfs); err != nil {
+		return &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	// Cast to uint32 avoids compile error on arm: "constant 2435016766 overflows int32"
+	if magic := uint32(statfs.Type); magic != BTRFS_SUPER_MAGIC {
+		return fmt.Errorf("%w: %s is on %s", ErrNotBtrfs, path, filesystemName(magic))
+	}
+	return nil
+}
@@ -23,26 +23,124 @@ import (
 	"unsafe"
 )
 
+// IoctlRunner performs the ioctl calls made by this package. The default
+// implementation issues real syscalls. An alternative implementation can be
+// installed with SetIoctlRunner to exercise the package without a btrfs filesystem.
+// The statfs calls that check for btrfs before issuing ioctls go through the runner
+// as well, so that an alternative implementation can pass them on any filesystem.
+type IoctlRunner interface {
+	// ReadIoctl issues a command that fills out, which must be a pointer to a
+	// structure matching the command's argument.
+	ReadIoctl(fd uintptr, c IoctlCmd, out any) error
+	// WriteIoctl issues a command with the structure pointed to by data. Any
+	// result written back by the kernel is decoded into data.
+	WriteIoctl(fd uintptr, c IoctlCmd, data any) error
+	// Uint64Ioctl issues a command whose argument is a single uint64.
+	Uint64Ioctl(fd uintptr, c IoctlCmd, data *uint64) error
+	// BytesIoctl issues a command whose argument is a raw buffer.
+	BytesIoctl(fd uintptr, c IoctlCmd, data []byte) error
+	// UnsafeIoctl issues a command with an arbitrary pointer argument.
+	UnsafeIoctl(fd uintptr, c IoctlCmd, data unsafe.Pointer) error
+	// ValueIoctl issues a command whose argument is passed by value, such as a file
+	// descriptor or a control code.
+	ValueIoctl(fd uintptr, c IoctlCmd, arg uintptr) error
+	// Statfs fills buf with information about the filesystem containing path.
+	Statfs(path string, buf *syscall.Statfs_t) error
+	// Fstatfs fills buf with information about the filesystem containing the open
+	// file fd.
+	Fstatfs(fd uintptr, buf *syscall.Statfs_t) error
+}
+
+var runner IoctlRunner = syscallRunner{}
+
+// SetIoctlRunner replaces the IoctlRunner used by this package and returns a function
+// that restores the previous one. Passing nil installs the default syscall runner.
+// It is intended for tests and must not be called while other operations are in
+// progress.
+func SetIoctlRunner(r IoctlRunner) (restore func()) {
+	prev := runner
+	if r == nil {
+		r = syscallRunner{}
+	}
+	runner = r
+	return func() { runner = prev }
+}
+
 func callReadIoctl(fd uintptr, c IoctlCmd, out any) error {
+	return runner.ReadIoctl(fd, c, out)
+}
+
+func callWriteIoctl(fd uintptr, c IoctlCmd, data any) error {
+	return runner.WriteIoctl(fd, c, data)
+}
+
+// ioctlUint64 sends an ioctl command with a uint64.
+func ioctlUint64(fd uintptr, name IoctlCmd, data *uint64) error {
+	return runner.Uint64Ioctl(fd, name, data)
+}
+
+// ioctlBytes sends an ioctl command with a byte slice.
+func ioctlBytes(fd uintptr, name IoctlCmd, data []byte) error {
+	return runner.BytesIoctl(fd, name, data)
+}
+
+// ioctlUnsafe sends an ioctl command with an unsafe.Pointer.
+func ioctlUnsafe(fd uintptr, name IoctlCmd, data unsafe.Pointer) error {
+	return runner.UnsafeIoctl(fd, name, data)
+}
+
+// ioctlValue sends an ioctl command with an argument passed by value.
+func ioctlValue(fd uintptr, name IoctlCmd, arg uintptr) error {
+	return runner.ValueIoctl(fd, name, arg)
+}
+
+// syscallRunner is the default IoctlRunner that issues real syscalls.
+type syscallRunner struct{}
+
+func (r syscallRunner) ReadIoctl(fd uintptr, c IoctlCmd, out any) error {
 	buf := make([]byte, c.Size())
-	if err := ioctlBytes(fd, c, buf); err != nil {
+	if err := r.BytesIoctl(fd, c, buf); err != nil {
 		return err
 	}
 	return decodeStructure(buf, out)
 }
 
-func callWriteIoctl(fd uintptr, c IoctlCmd, data any) error {
+func (r syscallRunner) WriteIoctl(fd uintptr, c IoctlCmd, data any) error {
 	buf, err := encodeStructure(data)
 	if err != nil {
 		return err
 	}
-	err = ioctlBytes(fd, c, buf)
+	err = r.BytesIoctl(fd, c, buf)
 	if err != nil {
 		return err
 	}
 	return decodeStructure(buf, data)
 }
 
+func (r syscallRunner) Uint64Ioctl(fd uintptr, c IoctlCmd, data *uint64) error {
+	return r.UnsafeIoctl(fd, c, unsafe.Pointer(data))
+}
+
+func (r syscallRunner) BytesIoctl(fd uintptr, c IoctlCmd, data []byte) error {
+	return r.UnsafeIoctl(fd, c, unsafe.Pointer(&data[0]))
+}
+
+func (r syscallRunner) UnsafeIoctl(fd uintptr, c IoctlCmd, data unsafe.Pointer) error {
+	return ioctl(fd, c, uintptr(data))
+}
+
+func (r syscallRunner) ValueIoctl(fd uintptr, c IoctlCmd, arg uintptr) error {
+	return ioctl(fd, c, arg)
+}
+
+func (r syscallRunner) Statfs(path string, buf *syscall.Statfs_t) error {
+	return syscall.Statfs(path, buf)
+}
+
+func (r syscallRunner) Fstatfs(fd uintptr, buf *syscall.Statfs_t) error {
+	return syscall.Fstatfs(int(fd), buf)
+}
+
 // decodeStructure decodes a structure from a byte slice.
 func decodeStructure(data []byte, out any) error {
 	return binary.Read(bytes.NewReader(data), binary.LittleEndian, out)
@@ -57,26 +155,17 @@ func encodeStructure(data any) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// ioctlUint64 sends an ioctl command with a uint64.
-func ioctlUint64(fd uintptr, name IoctlCmd, data *uint64) error {
-	return ioctlUnsafe(fd, name, unsafe.Pointer(data))
-}
-
-// ioctlBytes sends an ioctl command with a byte slice.
-func ioctlBytes(fd uintptr, name IoctlCmd, data []byte) error {
-	return ioctlUnsafe(fd, name, unsafe.Pointer(&data[0]))
-}
-
-// ioctlUnsafe sends an ioctl command with an unsafe.Pointer.
-func ioctlUnsafe(fd uintptr, name IoctlCmd, data unsafe.Pointer) error {
-	return ioctl(fd, name, uintptr(data))
-}
-
-// ioctl sends an ioctl command.
+// ioctl sends an ioctl command. Idempotent commands are retried when they are
+// interrupted or the kernel asks to try again, see shouldRetryIoctl.
 func ioctl(fd uintptr, name IoctlCmd, data uintptr) error {
-	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(name), data)
-	if err != 0 {
-		return fmt.Errorf("ioctl %s failed: %w", name.String(), syscall.Errno(err))
+	var attempts int
+	for {
+		_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(name), data)
+		if err == 0 {
+			return nil
+		}
+		if !shouldRetryIoctl(name, err, &attempts) {
+			return fmt.Errorf("ioctl %s failed: %w", name.String(), err)
+		}
 	}
-	return nil
 }
@@ -0,0 +1,106 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"syscall"
+	"time"
+)
+
+// DefaultIoctlEAGAINRetries is the default number of times an idempotent ioctl is
+// retried when it fails with EAGAIN.
+const DefaultIoctlEAGAINRetries = 5
+
+// ioctlEAGAINBackoff is the delay before the first retry after EAGAIN. It grows
+// linearly with each retry.
+const ioctlEAGAINBackoff = 10 * time.Millisecond
+
+var ioctlEAGAINRetries = DefaultIoctlEAGAINRetries
+
+// SetIoctlEAGAINRetries sets how many times an idempotent ioctl is retried when it
+// fails with EAGAIN and returns a function that restores the previous limit. Zero
+// disables retrying on EAGAIN. Interrupted calls failing with EINTR are always
+// retried. Like SetIoctlRunner, it must not be called while other operations are in
+// progress.
+func SetIoctlEAGAINRetries(n int) (restore func()) {
+	prev := ioctlEAGAINRetries
+	if n < 0 {
+		n = 0
+	}
+	ioctlEAGAINRetries = n
+	return func() { ioctlEAGAINRetries = prev }
+}
+
+// idempotentIoctls are the commands that can safely be issued again after failing
+// with EINTR or EAGAIN. They either only read state or set it to an absolute value.
+// Commands that create, destroy or move data, and sends, which would write a
+// duplicate stream prefix to their output, are never retried.
+var idempotentIoctls = map[IoctlCmd]bool{
+	BTRFS_IOC_TREE_SEARCH:            true,
+	BTRFS_IOC_TREE_SEARCH_V2:         true,
+	BTRFS_IOC_INO_LOOKUP:             true,
+	BTRFS_IOC_INO_LOOKUP_USER:        true,
+	BTRFS_IOC_INO_PATHS:              true,
+	BTRFS_IOC_LOGICAL_INO:            true,
+	BTRFS_IOC_LOGICAL_INO_V2:         true,
+	BTRFS_IOC_GET_SUBVOL_INFO:        true,
+	BTRFS_IOC_GET_SUBVOL_ROOTREF:     true,
+	BTRFS_IOC_FS_INFO:                true,
+	BTRFS_IOC_DEV_INFO:               true,
+	BTRFS_IOC_GET_DEV_STATS:          true,
+	BTRFS_IOC_SPACE_INFO:             true,
+	BTRFS_IOC_SUBVOL_GETFLAGS:        true,
+	BTRFS_IOC_SUBVOL_SETFLAGS:        true,
+	BTRFS_IOC_SET_RECEIVED_SUBVOL:    true,
+	BTRFS_IOC_DEFAULT_SUBVOL:         true,
+	BTRFS_IOC_GET_FSLABEL:            true,
+	BTRFS_IOC_GET_FEATURES:           true,
+	BTRFS_IOC_GET_SUPPORTED_FEATURES: true,
+	BTRFS_IOC_SET_FSLABEL:            true,
+	BTRFS_IOC_QGROUP_LIMIT:           true,
+	BTRFS_IOC_QUOTA_RESCAN_STATUS:    true,
+	BTRFS_IOC_QUOTA_RESCAN_WAIT:      true,
+	BTRFS_IOC_SCRUB_PROGRESS:         true,
+	BTRFS_IOC_BALANCE_PROGRESS:       true,
+	BTRFS_IOC_SYNC:                   true,
+	BTRFS_IOC_START_SYNC:             true,
+	BTRFS_IOC_WAIT_SYNC:              true,
+	BTRFS_IOC_DEVICES_READY:          true,
+	BTRFS_IOC_ENCODED_READ:           true,
+	FS_IOC_MEASURE_VERITY:            true,
+	FS_IOC_READ_VERITY_METADATA:      true,
+}
+
+// shouldRetryIoctl reports whether a command that failed with errno should be issued
+// again. attempts counts the EAGAIN retries made so far and is incremented when a
+// retry after EAGAIN is allowed, after sleeping for the backoff.
+func shouldRetryIoctl(name IoctlCmd, errno syscall.Errno, attempts *int) bool {
+	if !idempotentIoctls[name] {
+		return false
+	}
+	switch errno {
+	case syscall.EINTR:
+		return true
+	case syscall.EAGAIN:
+		if *attempts >= ioctlEAGAINRetries {
+			return false
+		}
+		*attempts++
+		time.Sleep(time.Duration(*attempts) * ioctlEAGAINBackoff)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LockFileName is the name of the file FilesystemLock locks inside its directory.
+const LockFileName = ".btrsync.lock"
+
+// lockPollInterval is how often Lock retries while the lock is held elsewhere.
+const lockPollInterval = 100 * time.Millisecond
+
+// ErrLocked is returned by Lock and TryLock when the FilesystemLock is already
+// held by the caller.
+var ErrLocked = errors.New("lock is already held")
+
+// FilesystemLock is an advisory lock shared by all processes, backed by flock on a
+// file inside a directory. It is used to keep snapshot creation and pruning of the
+// same subvolume tree from interleaving. Each FilesystemLock value can be held once;
+// separate values for the same directory exclude each other, also within a process.
+type FilesystemLock struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// NewFilesystemLock returns a lock on the directory dir, which is typically a
+// mountpoint or snapshot directory. The lock file is created when the lock is first
+// acquired.
+func NewFilesystemLock(dir string) *FilesystemLock {
+	return &FilesystemLock{path: filepath.Join(dir, LockFileName)}
+}
+
+// Lock acquires the lock, waiting until it is released by its current holder or
+// ctx is done, in which case ctx.Err() is returned.
+func (l *FilesystemLock) Lock(ctx context.Context) error {
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		ok, err := l.TryLock()
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// TryLock acquires the lock if it is free and returns whether it was acquired.
+func (l *FilesystemLock) TryLock() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		return false, ErrLocked
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, &os.PathError{Op: "flock", Path: l.path, Err: err}
+	}
+	l.f = f
+	return true, nil
+}
+
+// Unlock releases the lock. It is a no-op if the lock is not held.
+func (l *FilesystemLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	f := l.f
+	l.f = nil
+	// Closing the file releases the lock as well, unlocking first reports errors
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
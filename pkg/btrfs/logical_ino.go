@@ -0,0 +1,109 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// logicalInoIgnoreOffset returns all references to the extent containing the
+	// logical address instead of only those covering the address itself.
+	logicalInoIgnoreOffset = 1 << 0
+	// logicalInoInitialSize is the size of the first result buffer.
+	logicalInoInitialSize = 64 << 10
+	// logicalInoMaxSize is the largest result buffer accepted by LOGICAL_INO_V2.
+	logicalInoMaxSize = 16 << 20
+	// dataContainerHeaderSize is the size of the btrfs_data_container header.
+	dataContainerHeaderSize = 16
+)
+
+// logicalInoArgs is btrfs_ioctl_logical_ino_args.
+type logicalInoArgs struct {
+	Logical  uint64
+	Size     uint64
+	Reserved [3]uint64
+	Flags    uint64
+	Inodes   uint64
+}
+
+// InodeRef is a reference from a file to a data extent, as returned by
+// LogicalToInodes.
+type InodeRef struct {
+	// Subvolume is the ID of the subvolume containing the file.
+	Subvolume uint64
+	// Inode is the inode number of the file within the subvolume.
+	Inode uint64
+	// Offset is the offset in the file at which the extent is referenced.
+	Offset uint64
+}
+
+// LogicalToInodes returns the references to the data extent containing the given
+// logical address on the filesystem mounted at mountpoint, using
+// BTRFS_IOC_LOGICAL_INO_V2. Every file and subvolume sharing the extent is listed,
+// not only those whose reference covers the address itself. Combine it with
+// InodeToPath to resolve the references to paths. It requires CAP_SYS_ADMIN.
+func LogicalToInodes(mountpoint string, logical uint64) ([]InodeRef, error) {
+	f, err := openBtrfs(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size := uint64(logicalInoInitialSize)
+	for {
+		buf := make([]byte, size)
+		args := &logicalInoArgs{
+			Logical: logical,
+			Size:    size,
+			Flags:   logicalInoIgnoreOffset,
+			Inodes:  uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		}
+		err := callWriteIoctl(f.Fd(), BTRFS_IOC_LOGICAL_INO_V2, args)
+		// The kernel writes the results through the pointer in the arguments
+		runtime.KeepAlive(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve logical address %d: %w", logical, err)
+		}
+		bytesMissing := binary.LittleEndian.Uint32(buf[4:8])
+		elemCnt := binary.LittleEndian.Uint32(buf[8:12])
+		elemMissed := binary.LittleEndian.Uint32(buf[12:16])
+		if bytesMissing > 0 || elemMissed > 0 {
+			if size >= logicalInoMaxSize {
+				return nil, fmt.Errorf("logical address %d has more references than fit in %d bytes (%d missed)",
+					logical, size, elemMissed/3)
+			}
+			// Grow the buffer to what the kernel reported as missing and retry
+			size += uint64(bytesMissing)
+			if bytesMissing == 0 || size > logicalInoMaxSize {
+				size = logicalInoMaxSize
+			}
+			continue
+		}
+		vals := buf[dataContainerHeaderSize:]
+		refs := make([]InodeRef, 0, elemCnt/3)
+		for i := uint32(0); i+2 < elemCnt; i += 3 {
+			refs = append(refs, InodeRef{
+				Inode:     binary.LittleEndian.Uint64(vals[i*8:]),
+				Offset:    binary.LittleEndian.Uint64(vals[(i+1)*8:]),
+				Subvolume: binary.LittleEndian.Uint64(vals[(i+2)*8:]),
+			})
+		}
+		return refs, nil
+	}
+}
@@ -0,0 +1,261 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ManifestVersion is the version of the backup manifest format written by
+// WriteManifest.
+const ManifestVersion = 1
+
+// ErrDigestMismatch is returned when a stored send stream does not match the size or
+// digest recorded for it in a backup manifest.
+var ErrDigestMismatch = errors.New("send stream does not match its manifest entry")
+
+// BackupManifest is a catalog of the send streams making up a backup set. It is
+// stored as JSON, and the files of the streams are relative to the directory of the
+// manifest.
+type BackupManifest struct {
+	// Version is the version of the manifest format.
+	Version int `json:"version"`
+	// Streams are the send streams of the backup set, in the order they were
+	// added.
+	Streams []ManifestStream `json:"streams"`
+}
+
+// ManifestStream describes a single stored send stream in a BackupManifest.
+type ManifestStream struct {
+	// File is the path of the stream, relative to the directory of the manifest.
+	File string `json:"file"`
+	// UUID is the UUID of the sent subvolume.
+	UUID uuid.UUID `json:"uuid"`
+	// ParentUUID is the UUID the stream is relative to, uuid.Nil for full
+	// streams. It is the UUID the receiving side looks up as received UUID.
+	ParentUUID uuid.UUID `json:"parent_uuid"`
+	// Ctransid is the ctransid of the sent subvolume.
+	Ctransid uint64 `json:"ctransid"`
+	// Size is the size of the stream in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 digest of the stream.
+	SHA256 string `json:"sha256"`
+}
+
+// ReadManifest reads the backup manifest at path. If it does not exist the returned
+// error matches os.ErrNotExist.
+func ReadManifest(path string) (*BackupManifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return nil, fmt.Errorf("manifest %s has unsupported version %d", path, m.Version)
+	}
+	return &m, nil
+}
+
+// WriteManifest atomically writes m to path. The manifest is written to a temporary
+// file that is synced and renamed over path.
+func WriteManifest(path string, m *BackupManifest) error {
+	if m.Version == 0 {
+		m.Version = ManifestVersion
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// UpdateManifest adds s to the manifest at path, replacing an existing entry for
+// the same file. If the file of s is an absolute path beneath the directory of the
+// manifest it is stored relative to it. The manifest is created if it does not
+// exist.
+func UpdateManifest(path string, s ManifestStream) error {
+	s.File = manifestFile(path, s.File)
+	m, err := ReadManifest(path)
+	if errors.Is(err, os.ErrNotExist) {
+		m, err = &BackupManifest{Version: ManifestVersion}, nil
+	}
+	if err != nil {
+		return err
+	}
+	m.Put(s)
+	return WriteManifest(path, m)
+}
+
+// Put adds s to the manifest, replacing an existing entry for the same file.
+func (m *BackupManifest) Put(s ManifestStream) {
+	for i := range m.Streams {
+		if m.Streams[i].File == s.File {
+			m.Streams[i] = s
+			return
+		}
+	}
+	m.Streams = append(m.Streams, s)
+}
+
+// RestoreOrder returns the streams of the manifest in an order in which they can be
+// received: every stream comes after the stream of its parent. Streams whose parent
+// is not in the manifest come first, in the order they were added, and need the
+// parent to be present at the destination already. An error matching
+// ErrAncestryCycle is returned if the parents form a cycle.
+func (m *BackupManifest) RestoreOrder() ([]ManifestStream, error) {
+	present := make(map[uuid.UUID]bool, len(m.Streams))
+	for _, s := range m.Streams {
+		present[s.UUID] = true
+	}
+	received := make(map[uuid.UUID]bool, len(m.Streams))
+	out := make([]ManifestStream, 0, len(m.Streams))
+	done := make([]bool, len(m.Streams))
+	for len(out) < len(m.Streams) {
+		progressed := false
+		for i, s := range m.Streams {
+			if done[i] || (present[s.ParentUUID] && !received[s.ParentUUID]) {
+				continue
+			}
+			out = append(out, s)
+			received[s.UUID] = true
+			done[i] = true
+			progressed = true
+		}
+		if !progressed {
+			return nil, fmt.Errorf("%w among the streams of the manifest", ErrAncestryCycle)
+		}
+	}
+	return out, nil
+}
+
+// VerifyManifest reads the manifest at path and checks the size and digest of every
+// stream it lists. On success the streams are returned in the order given by
+// RestoreOrder, with their files resolved relative to the directory of the
+// manifest.
+func VerifyManifest(path string) ([]ManifestStream, error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := m.RestoreOrder()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	for i := range streams {
+		if !filepath.IsAbs(streams[i].File) {
+			streams[i].File = filepath.Join(dir, streams[i].File)
+		}
+		if err := VerifyManifestStream(streams[i]); err != nil {
+			return nil, err
+		}
+	}
+	return streams, nil
+}
+
+// VerifyManifestStream checks that the file of s matches its recorded size and
+// digest, and returns an error matching ErrDigestMismatch if it does not. The file
+// is opened as given.
+func VerifyManifestStream(s ManifestStream) error {
+	f, err := os.Open(s.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := newDigestWriter(io.Discard)
+	if _, err := io.Copy(d, f); err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.File, err)
+	}
+	if d.size != s.Size {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrDigestMismatch, s.File, d.size, s.Size)
+	}
+	if sum := d.hexDigest(); sum != s.SHA256 {
+		return fmt.Errorf("%w: %s has digest %s, expected %s", ErrDigestMismatch, s.File, sum, s.SHA256)
+	}
+	return nil
+}
+
+// manifestFile returns the path of the absolute path file relative to the directory
+// of the manifest at manifestPath, or file itself if it is not beneath that
+// directory.
+func manifestFile(manifestPath, file string) string {
+	if !filepath.IsAbs(file) {
+		return file
+	}
+	dir, err := filepath.Abs(filepath.Dir(manifestPath))
+	if err != nil {
+		return file
+	}
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return file
+	}
+	return rel
+}
+
+// digestWriter counts and hashes the bytes written through it.
+type digestWriter struct {
+	w    io.Writer
+	h    hash.Hash
+	size int64
+}
+
+func newDigestWriter(w io.Writer) *digestWriter {
+	return &digestWriter{w: w, h: sha256.New()}
+}
+
+func (d *digestWriter) Write(b []byte) (int, error) {
+	n, err := d.w.Write(b)
+	d.h.Write(b[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func (d *digestWriter) hexDigest() string {
+	return hex.EncodeToString(d.h.Sum(nil))
+}
@@ -0,0 +1,86 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import "time"
+
+// Metrics receives measurements from the high-level operations of btrsync, such as
+// sends, receives, snapshots and pruning. Implementations must be safe for
+// concurrent use. Metric names are the Metric* constants; they follow Prometheus
+// naming conventions so that they can be exported as they are.
+type Metrics interface {
+	// Count adds delta to the counter name.
+	Count(name string, delta float64)
+	// Gauge sets the gauge name to value.
+	Gauge(name string, value float64)
+	// Observe records value in the histogram name.
+	Observe(name string, value float64)
+}
+
+const (
+	// MetricSendBytes counts the bytes of send streams written to writers.
+	MetricSendBytes = "btrsync_send_bytes_total"
+	// MetricSendDuration observes the duration of sends in seconds.
+	MetricSendDuration = "btrsync_send_duration_seconds"
+	// MetricSendErrors counts failed sends.
+	MetricSendErrors = "btrsync_send_errors_total"
+	// MetricLastSendTimestamp is the Unix time of the last successful send.
+	MetricLastSendTimestamp = "btrsync_last_send_timestamp_seconds"
+	// MetricReceiveBytes counts the bytes of send streams read by receives.
+	MetricReceiveBytes = "btrsync_receive_bytes_total"
+	// MetricReceiveDuration observes the duration of receives in seconds.
+	MetricReceiveDuration = "btrsync_receive_duration_seconds"
+	// MetricReceiveErrors counts the errors of receives, including commands that
+	// failed to apply.
+	MetricReceiveErrors = "btrsync_receive_errors_total"
+	// MetricSnapshotsCreated counts created snapshots.
+	MetricSnapshotsCreated = "btrsync_snapshots_created_total"
+	// MetricSnapshotsDeleted counts snapshots deleted by pruning.
+	MetricSnapshotsDeleted = "btrsync_snapshots_deleted_total"
+)
+
+// metrics is the Metrics measurements are reported to.
+var metrics Metrics = nopMetrics{}
+
+// SetMetrics sets the Metrics that measurements are reported to and returns a
+// function that restores the previous one. Passing nil discards measurements,
+// which is the default. Like SetIoctlRunner, it must not be called while other
+// operations are in progress.
+func SetMetrics(m Metrics) (restore func()) {
+	prev := metrics
+	if m == nil {
+		m = nopMetrics{}
+	}
+	metrics = m
+	return func() { metrics = prev }
+}
+
+// CurrentMetrics returns the Metrics set with SetMetrics, for packages that report
+// measurements of their own operations.
+func CurrentMetrics() Metrics {
+	return metrics
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Count(string, float64)   {}
+func (nopMetrics) Gauge(string, float64)   {}
+func (nopMetrics) Observe(string, float64) {}
+
+// observeSince records the seconds elapsed since start in the histogram name.
+func observeSince(name string, start time.Time) {
+	metrics.Observe(name, time.Since(start).Seconds())
+}
@@ -0,0 +1,99 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// compressionXattr is the extended attribute backing the btrfs compression property.
+const compressionXattr = "btrfs.compression"
+
+// ErrInvalidCompression is returned when a compression property value is not
+// recognized.
+var ErrInvalidCompression = errors.New("invalid compression")
+
+// compressionLevels are the supported compression algorithms and the range of
+// levels they accept. A zero range means the algorithm takes no level.
+var compressionLevels = map[string][2]int{
+	"zlib": {1, 9},
+	"lzo":  {0, 0},
+	"zstd": {1, 15},
+}
+
+// GetCompression returns the compression property of the file, directory or
+// subvolume root at path, such as "zstd", "zstd:3", "lzo" or "none". An empty
+// string is returned if the property is not set.
+func GetCompression(path string) (string, error) {
+	value, err := getXattr(path, compressionXattr)
+	if errors.Is(err, unix.ENODATA) {
+		return "", nil
+	}
+	if err != nil {
+		return "", &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	return string(value), nil
+}
+
+// SetCompression sets the compression property of the file, directory or subvolume
+// root at path. Files created beneath a directory inherit its property. The value is
+// an algorithm, "zlib", "lzo" or "zstd", optionally followed by a level as in
+// "zstd:3", or "none" to disable compression. An empty value removes the property.
+// Unknown algorithms and out of range levels return ErrInvalidCompression.
+func SetCompression(path, algo string) error {
+	if algo == "" {
+		err := unix.Removexattr(path, compressionXattr)
+		if err != nil && !errors.Is(err, unix.ENODATA) {
+			return &os.PathError{Op: "removexattr", Path: path, Err: err}
+		}
+		return nil
+	}
+	if err := validateCompression(algo); err != nil {
+		return err
+	}
+	if err := unix.Setxattr(path, compressionXattr, []byte(algo), 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func validateCompression(value string) error {
+	if value == "none" || value == "no" {
+		return nil
+	}
+	algo, level, hasLevel := strings.Cut(value, ":")
+	levels, ok := compressionLevels[algo]
+	if !ok {
+		return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidCompression, algo)
+	}
+	if !hasLevel {
+		return nil
+	}
+	if levels[1] == 0 {
+		return fmt.Errorf("%w: %s does not take a level", ErrInvalidCompression, algo)
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < levels[0] || n > levels[1] {
+		return fmt.Errorf("%w: %s level must be between %d and %d, got %q", ErrInvalidCompression, algo, levels[0], levels[1], level)
+	}
+	return nil
+}
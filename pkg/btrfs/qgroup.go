@@ -0,0 +1,310 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"syscall"
+)
+
+// ErrQuotasDisabled is returned when a quota operation is attempted on a filesystem
+// that does not have quotas enabled.
+var ErrQuotasDisabled = errors.New("quotas are not enabled")
+
+const (
+	qgroupStatusKey   SearchKey = 240
+	qgroupInfoKey     SearchKey = 242
+	qgroupLimitKey    SearchKey = 244
+	qgroupRelationKey SearchKey = 246
+)
+
+// qgroupInfoItem is the on-disk btrfs_qgroup_info_item.
+type qgroupInfoItem struct {
+	Generation uint64
+	Rfer       uint64
+	Rfer_cmpr  uint64
+	Excl       uint64
+	Excl_cmpr  uint64
+}
+
+// QgroupUsage reports the space accounted to a quota group.
+type QgroupUsage struct {
+	// Referenced is the number of bytes referenced by the qgroup, including data
+	// shared with other qgroups.
+	Referenced uint64
+	// Exclusive is the number of bytes referenced only by the qgroup.
+	Exclusive uint64
+	// ReferencedLimit is the maximum number of referenced bytes, or zero if unlimited.
+	ReferencedLimit uint64
+	// ExclusiveLimit is the maximum number of exclusive bytes, or zero if unlimited.
+	ExclusiveLimit uint64
+}
+
+const (
+	quotaCtlEnable  = 1
+	quotaCtlDisable = 2
+
+	qgroupStatusFlagOn = 1 << 0
+
+	qgroupLimitMaxRfer = 1 << 0
+	qgroupLimitMaxExcl = 1 << 1
+
+	// qgroupLimitClear is the limit value that tells the kernel to remove a limit.
+	qgroupLimitClear = math.MaxUint64
+)
+
+// qgroupInherit is the fixed size header of btrfs_qgroup_inherit. It is followed by
+// the qgroup IDs.
+type qgroupInherit struct {
+	Flags           uint64
+	Num_qgroups     uint64
+	Num_ref_copies  uint64
+	Num_excl_copies uint64
+	Lim             qgroupLimit
+}
+
+// encodeQgroupInherit encodes a btrfs_qgroup_inherit structure that adds a new
+// subvolume to the given qgroups.
+func encodeQgroupInherit(qgroups []uint64) ([]byte, error) {
+	hdr, err := encodeStructure(&qgroupInherit{Num_qgroups: uint64(len(qgroups))})
+	if err != nil {
+		return nil, err
+	}
+	ids, err := encodeStructure(qgroups)
+	if err != nil {
+		return nil, err
+	}
+	return append(hdr, ids...), nil
+}
+
+// qgroupStatusItem is the on-disk btrfs_qgroup_status_item.
+type qgroupStatusItem struct {
+	Version    uint64
+	Generation uint64
+	Flags      uint64
+	Rescan     uint64
+}
+
+// GetQgroupUsage returns the quota group usage of the subvolume with the given ID on
+// the filesystem mounted at mountpoint. If quotas are not enabled ErrQuotasDisabled
+// is returned.
+func GetQgroupUsage(mountpoint string, subvolID uint64) (*QgroupUsage, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, limit, err := lookupQgroup(f.Fd(), subvolID)
+	if err != nil {
+		return nil, err
+	}
+	usage := &QgroupUsage{
+		Referenced: info.Rfer,
+		Exclusive:  info.Excl,
+	}
+	if limit != nil {
+		if limit.Flags&qgroupLimitMaxRfer != 0 {
+			usage.ReferencedLimit = limit.Max_rfer
+		}
+		if limit.Flags&qgroupLimitMaxExcl != 0 {
+			usage.ExclusiveLimit = limit.Max_excl
+		}
+	}
+	return usage, nil
+}
+
+// EnableQuota enables quota accounting on the filesystem mounted at mountpoint.
+func EnableQuota(mountpoint string) error {
+	return quotaCtl(mountpoint, quotaCtlEnable)
+}
+
+// DisableQuota disables quota accounting on the filesystem mounted at mountpoint.
+func DisableQuota(mountpoint string) error {
+	return quotaCtl(mountpoint, quotaCtlDisable)
+}
+
+func quotaCtl(mountpoint string, cmd uint64) error {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return callWriteIoctl(f.Fd(), BTRFS_IOC_QUOTA_CTL, &quotaCTLArgs{Cmd: cmd})
+}
+
+// QgroupLimitOption is an option for setting or clearing a qgroup limit.
+type QgroupLimitOption func(*qgroupLimit)
+
+// WithExclusiveLimit applies the limit to the exclusive bytes of the qgroup instead
+// of the referenced bytes.
+func WithExclusiveLimit() QgroupLimitOption {
+	return func(l *qgroupLimit) {
+		l.Flags = qgroupLimitMaxExcl
+		l.Max_excl, l.Max_rfer = l.Max_rfer, 0
+	}
+}
+
+// SetQgroupLimit limits the qgroup of the subvolume with the given ID on the
+// filesystem mounted at mountpoint to limitBytes. By default the referenced bytes
+// are limited, use WithExclusiveLimit to limit the exclusive bytes instead. If
+// quotas are not enabled ErrQuotasDisabled is returned.
+func SetQgroupLimit(mountpoint string, subvolID uint64, limitBytes uint64, opts ...QgroupLimitOption) error {
+	if limitBytes == 0 || limitBytes == qgroupLimitClear {
+		return fmt.Errorf("invalid qgroup limit %d", limitBytes)
+	}
+	return setQgroupLimit(mountpoint, subvolID, limitBytes, opts...)
+}
+
+// ClearQgroupLimit removes the limit from the qgroup of the subvolume with the given
+// ID on the filesystem mounted at mountpoint. By default the referenced limit is
+// cleared, use WithExclusiveLimit to clear the exclusive limit instead.
+func ClearQgroupLimit(mountpoint string, subvolID uint64, opts ...QgroupLimitOption) error {
+	return setQgroupLimit(mountpoint, subvolID, qgroupLimitClear, opts...)
+}
+
+func setQgroupLimit(mountpoint string, subvolID uint64, value uint64, opts ...QgroupLimitOption) error {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := checkQuotasEnabled(f.Fd()); err != nil {
+		return err
+	}
+	args := &qgroupLimitArgs{
+		Qgroupid: subvolID,
+		Lim: qgroupLimit{
+			Flags:    qgroupLimitMaxRfer,
+			Max_rfer: value,
+		},
+	}
+	for _, opt := range opts {
+		opt(&args.Lim)
+	}
+	return callWriteIoctl(f.Fd(), BTRFS_IOC_QGROUP_LIMIT, args)
+}
+
+// checkQuotasEnabled returns ErrQuotasDisabled if quotas are not enabled on the
+// filesystem the given file descriptor belongs to.
+func checkQuotasEnabled(fd uintptr) error {
+	params := SearchParams{
+		Tree_id:      uint64(QuotaTreeObjectID),
+		Min_objectid: 0,
+		Max_objectid: 0,
+		Min_offset:   0,
+		Max_offset:   0,
+		Min_transid:  0,
+		Max_transid:  math.MaxUint64,
+		Min_type:     uint32(qgroupStatusKey),
+		Max_type:     uint32(qgroupStatusKey),
+	}
+	var status *qgroupStatusItem
+	err := walkBtrfsTreeV2Fd(fd, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if hdr.ItemType() == qgroupStatusKey {
+			var st qgroupStatusItem
+			if err := item.decode(&st); err != nil {
+				return fmt.Errorf("failed to decode qgroup status: %w", err)
+			}
+			status = &st
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return ErrQuotasDisabled
+		}
+		return err
+	}
+	if status == nil || status.Flags&qgroupStatusFlagOn == 0 {
+		return ErrQuotasDisabled
+	}
+	return nil
+}
+
+// lookupQgroupInfo returns the qgroup info item for the given qgroup ID from the
+// quota tree.
+func lookupQgroupInfo(fd uintptr, qgroupID uint64) (*qgroupInfoItem, error) {
+	info, _, err := lookupQgroup(fd, qgroupID)
+	return info, err
+}
+
+// lookupQgroup returns the qgroup info item and, if one is present, the qgroup
+// limit item for the given qgroup ID from the quota tree.
+func lookupQgroup(fd uintptr, qgroupID uint64) (*qgroupInfoItem, *qgroupLimit, error) {
+	params := SearchParams{
+		Tree_id:      uint64(QuotaTreeObjectID),
+		Min_objectid: 0,
+		Max_objectid: 0,
+		Min_offset:   qgroupID,
+		Max_offset:   qgroupID,
+		Min_transid:  0,
+		Max_transid:  math.MaxUint64,
+		Min_type:     uint32(qgroupInfoKey),
+		Max_type:     uint32(qgroupLimitKey),
+	}
+	var info *qgroupInfoItem
+	var limit *qgroupLimit
+	err := walkBtrfsTreeV2Fd(fd, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if hdr.Offset != qgroupID {
+			return nil
+		}
+		switch hdr.ItemType() {
+		case qgroupInfoKey:
+			var i qgroupInfoItem
+			if err := item.decode(&i); err != nil {
+				return fmt.Errorf("failed to decode qgroup info: %w", err)
+			}
+			info = &i
+		case qgroupLimitKey:
+			var l qgroupLimit
+			if err := item.decode(&l); err != nil {
+				return fmt.Errorf("failed to decode qgroup limit: %w", err)
+			}
+			limit = &l
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return nil, nil, ErrQuotasDisabled
+		}
+		return nil, nil, err
+	}
+	if info == nil {
+		return nil, nil, fmt.Errorf("qgroup %d: %w", qgroupID, ErrNotFound)
+	}
+	return info, limit, nil
+}
@@ -0,0 +1,219 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ReplicateTree sends the subvolume rootSubvol and all read-only snapshots
+// descending from it on the filesystem mounted at mountpoint, in dependency order.
+// The descendants are found by following parent UUID links, so snapshots of
+// snapshots are included. Snapshots are sent before the snapshots taken of them and
+// otherwise in order of creation.
+//
+// The first snapshot of each line is sent in full. Every other snapshot is sent
+// incrementally against the snapshot it was taken of, if that was sent, or
+// otherwise against the most recent earlier snapshot of the same parent, as with
+// `btrfs send -p`. rootSubvol itself is only sent if it is read-only.
+//
+// For each snapshot w is called with destDir joined with the path of the snapshot
+// relative to mountpoint, and the stream is written to the returned writer, which is
+// closed afterwards. The first failure stops the replication and is returned.
+func ReplicateTree(mountpoint, rootSubvol, destDir string, w func(name string) (io.WriteCloser, error), opts ...ReplicateOption) error {
+	var o replicateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+	root, err := GetSubvolumeInfo(rootSubvol)
+	if err != nil {
+		return err
+	}
+	subvols, err := ListSubvolumes(mountpoint)
+	if err != nil {
+		return err
+	}
+	order := replicationOrder(root, subvols)
+	sent := make([]*SubvolumeInfo, 0, len(order))
+	for _, info := range order {
+		path := filepath.Join(mountpoint, info.Path)
+		var parentPath string
+		parent := replicationParent(info, sent)
+		if parent != nil {
+			parentPath = filepath.Join(mountpoint, parent.Path)
+		}
+		name := filepath.Join(destDir, info.Path)
+		size, digest, err := replicateSubvolume(path, parentPath, name, w)
+		if err != nil {
+			return fmt.Errorf("failed to replicate %s: %w", path, err)
+		}
+		if o.manifest != "" {
+			file, err := filepath.Abs(name)
+			if err != nil {
+				return err
+			}
+			stream := ManifestStream{
+				File:     file,
+				UUID:     info.UUID,
+				Ctransid: info.Ctransid,
+				Size:     size,
+				SHA256:   digest,
+			}
+			if parent != nil {
+				stream.ParentUUID = streamParentUUID(parent)
+			}
+			if err := UpdateManifest(o.manifest, stream); err != nil {
+				return fmt.Errorf("failed to update manifest for %s: %w", path, err)
+			}
+		}
+		sent = append(sent, info)
+	}
+	return nil
+}
+
+// ReplicateOption is an option for ReplicateTree.
+type ReplicateOption func(*replicateOptions)
+
+type replicateOptions struct {
+	manifest string
+}
+
+// ReplicateWithManifest records every stream sent by ReplicateTree in the backup
+// manifest at path, which is created if it does not exist. The names passed to the
+// writer function are stored relative to the directory of the manifest when they
+// are beneath it, so destDir is usually that directory.
+func ReplicateWithManifest(path string) ReplicateOption {
+	return func(o *replicateOptions) {
+		o.manifest = path
+	}
+}
+
+// replicateSubvolume sends the subvolume at path to the writer returned by w for
+// name and returns the size and hex encoded SHA-256 digest of the stream.
+func replicateSubvolume(path, parent string, name string, w func(name string) (io.WriteCloser, error)) (int64, string, error) {
+	wc, err := w(name)
+	if err != nil {
+		return 0, "", err
+	}
+	d := newDigestWriter(wc)
+	if err := SendSubvolume(path, parent, nil, d); err != nil {
+		wc.Close()
+		return 0, "", err
+	}
+	if err := wc.Close(); err != nil {
+		return 0, "", err
+	}
+	return d.size, d.hexDigest(), nil
+}
+
+// streamParentUUID returns the UUID the kernel records as the parent of a send
+// relative to parent. A parent that was itself received is identified by its
+// received UUID, which is what the receiving side knows it by.
+func streamParentUUID(parent *SubvolumeInfo) uuid.UUID {
+	if parent.ReceivedUUID != uuid.Nil {
+		return parent.ReceivedUUID
+	}
+	return parent.UUID
+}
+
+// replicationOrder returns the read-only subvolumes descending from root, and root
+// itself if it is read-only, with every subvolume ordered after its parent and
+// otherwise by creation. Subvolumes outside the mounted subvolume cannot be opened
+// by path and are left out.
+func replicationOrder(root *SubvolumeInfo, subvols []SubvolumeInfo) []*SubvolumeInfo {
+	byUUID := make(map[uuid.UUID]*SubvolumeInfo, len(subvols))
+	for i := range subvols {
+		byUUID[subvols[i].UUID] = &subvols[i]
+	}
+	descends := func(info *SubvolumeInfo) bool {
+		seen := make(map[uuid.UUID]bool)
+		for next := info.ParentUUID; next != uuid.Nil && !seen[next]; {
+			if next == root.UUID {
+				return true
+			}
+			seen[next] = true
+			parent, ok := byUUID[next]
+			if !ok {
+				return false
+			}
+			next = parent.ParentUUID
+		}
+		return false
+	}
+	members := make(map[uuid.UUID]*SubvolumeInfo)
+	for i := range subvols {
+		info := &subvols[i]
+		if !info.ReadOnly || strings.HasPrefix(info.Path, topLevelPathPrefix+"/") {
+			continue
+		}
+		if info.UUID == root.UUID || descends(info) {
+			members[info.UUID] = info
+		}
+	}
+	// Repeatedly pick the oldest member whose parent is not a pending member
+	order := make([]*SubvolumeInfo, 0, len(members))
+	done := make(map[uuid.UUID]bool, len(members))
+	for len(order) < len(members) {
+		var next *SubvolumeInfo
+		for id, info := range members {
+			if done[id] {
+				continue
+			}
+			if _, pending := members[info.ParentUUID]; pending && !done[info.ParentUUID] {
+				continue
+			}
+			if next == nil || info.Otransid < next.Otransid || (info.Otransid == next.Otransid && info.ID < next.ID) {
+				next = info
+			}
+		}
+		done[next.UUID] = true
+		order = append(order, next)
+	}
+	return order
+}
+
+// replicationParent returns the subvolume of sent to use as the parent of an
+// incremental send of info, or nil for a full send. The subvolume info was taken
+// of is preferred, then the most recent sent snapshot of the same parent created
+// before info.
+func replicationParent(info *SubvolumeInfo, sent []*SubvolumeInfo) *SubvolumeInfo {
+	byUUID := make(map[uuid.UUID]*SubvolumeInfo, len(sent))
+	for _, s := range sent {
+		byUUID[s.UUID] = s
+	}
+	if parent, ok := byUUID[info.ParentUUID]; ok {
+		return parent
+	}
+	var sibling *SubvolumeInfo
+	for _, s := range sent {
+		if s.ParentUUID != info.ParentUUID || s.Otransid > info.Otransid {
+			continue
+		}
+		if sibling == nil || s.Otransid > sibling.Otransid {
+			sibling = s
+		}
+	}
+	return sibling
+}
@@ -0,0 +1,92 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ResizeMax can be passed to ResizeFilesystem to grow the filesystem to the
+// maximum size of the underlying device.
+const ResizeMax int64 = math.MaxInt64
+
+var resizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"E", 1 << 60},
+	{"P", 1 << 50},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// ResizeFilesystem resizes the filesystem mounted at the given path by newSize bytes.
+// A positive value grows the filesystem and a negative value shrinks it. Pass ResizeMax
+// to grow the filesystem to the size of the underlying device.
+func ResizeFilesystem(mountpoint string, newSize int64) error {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	size, err := formatResizeArg(newSize)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args := &volumeArgs{}
+	for i := range size {
+		args.Name[i] = int8(size[i])
+	}
+	return callWriteIoctl(f.Fd(), BTRFS_IOC_RESIZE, args)
+}
+
+// formatResizeArg formats a relative size into the string the kernel expects in the
+// name field of the resize arguments, e.g. "+1G", "-512M" or "max".
+func formatResizeArg(size int64) (string, error) {
+	switch {
+	case size == ResizeMax:
+		return "max", nil
+	case size == 0:
+		return "", errors.New("resize amount must not be zero")
+	case size == math.MinInt64:
+		return "", fmt.Errorf("resize amount %d is out of range", size)
+	}
+	sign := "+"
+	if size < 0 {
+		sign = "-"
+		size = -size
+	}
+	for _, unit := range resizeUnits {
+		if size%unit.size == 0 {
+			return sign + strconv.FormatInt(size/unit.size, 10) + unit.suffix, nil
+		}
+	}
+	return sign + strconv.FormatInt(size, 10), nil
+}
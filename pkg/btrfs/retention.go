@@ -0,0 +1,164 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Retention is a grandfather-father-son retention policy for snapshots. Each field
+// is the number of snapshots to keep for its period. For the periodic rules the
+// newest snapshot in each hour, day, week, month or year is kept, going back from
+// the newest snapshot until the count is reached. A snapshot is kept if any rule
+// selects it. A zero Retention keeps all snapshots.
+type Retention struct {
+	// KeepLast keeps the given number of most recent snapshots.
+	KeepLast int
+	// KeepHourly keeps the newest snapshot of the given number of most recent hours.
+	KeepHourly int
+	// KeepDaily keeps the newest snapshot of the given number of most recent days.
+	KeepDaily int
+	// KeepWeekly keeps the newest snapshot of the given number of most recent ISO weeks.
+	KeepWeekly int
+	// KeepMonthly keeps the newest snapshot of the given number of most recent months.
+	KeepMonthly int
+	// KeepYearly keeps the newest snapshot of the given number of most recent years.
+	KeepYearly int
+}
+
+// IsZero returns true if the policy has no rules.
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// SnapshotTime returns the wall-clock creation time of a snapshot used by retention
+// policies. This is the creation time of the subvolume, falling back to the time of
+// its last change if the creation time is not recorded.
+func SnapshotTime(info SubvolumeInfo) time.Time {
+	if t := info.CreationTime(); !t.IsZero() {
+		return t
+	}
+	return info.ChangeTime()
+}
+
+// Prune splits snapshots into those kept and those to delete according to the
+// policy. It has no side effects. Both results preserve the order of the input.
+func (r Retention) Prune(snapshots []SubvolumeInfo) (keep, delete []SubvolumeInfo) {
+	if r.IsZero() {
+		return append([]SubvolumeInfo(nil), snapshots...), nil
+	}
+	// Walk the snapshots newest first
+	order := make([]int, len(snapshots))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ti, tj := SnapshotTime(snapshots[order[i]]), SnapshotTime(snapshots[order[j]])
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return snapshots[order[i]].Ctransid > snapshots[order[j]].Ctransid
+	})
+	kept := make([]bool, len(snapshots))
+	for n, idx := range order {
+		if n < r.KeepLast {
+			kept[idx] = true
+		}
+	}
+	rules := []struct {
+		count  int
+		bucket func(time.Time) string
+	}{
+		{r.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{r.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{r.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{r.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, rule := range rules {
+		if rule.count <= 0 {
+			continue
+		}
+		var last string
+		var count int
+		for _, idx := range order {
+			if count >= rule.count {
+				break
+			}
+			bucket := rule.bucket(SnapshotTime(snapshots[idx]).Local())
+			if count > 0 && bucket == last {
+				continue
+			}
+			kept[idx] = true
+			last = bucket
+			count++
+		}
+	}
+	for i, info := range snapshots {
+		if kept[i] {
+			keep = append(keep, info)
+		} else {
+			delete = append(delete, info)
+		}
+	}
+	return keep, delete
+}
+
+// PruneSnapshots applies the policy to snapshots and deletes the snapshots it does
+// not keep. The snapshots are expected to come from ListSubvolumes or ListSnapshotsOf
+// for the filesystem mounted at mountpoint, with paths relative to it. Deletion stops
+// at the first failure. The snapshots deleted so far are returned. The
+// FilesystemLock of mountpoint is held while deleting.
+func PruneSnapshots(mountpoint string, r Retention, snapshots []SubvolumeInfo) (deleted []SubvolumeInfo, err error) {
+	return PruneSnapshotsContext(context.Background(), mountpoint, r, snapshots)
+}
+
+// PruneSnapshotsContext is like PruneSnapshots but gives up waiting for the
+// FilesystemLock of mountpoint when ctx is done.
+func PruneSnapshotsContext(ctx context.Context, mountpoint string, r Retention, snapshots []SubvolumeInfo) (deleted []SubvolumeInfo, err error) {
+	_, toDelete := r.Prune(snapshots)
+	if len(toDelete) == 0 {
+		return nil, nil
+	}
+	lock := NewFilesystemLock(mountpoint)
+	if err := lock.Lock(ctx); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", mountpoint, err)
+	}
+	defer lock.Unlock()
+	for _, info := range toDelete {
+		if info.Path == "" {
+			return deleted, fmt.Errorf("snapshot %d has no path", info.ID)
+		}
+		if strings.HasPrefix(info.Path, topLevelPathPrefix+"/") {
+			return deleted, fmt.Errorf("snapshot %s is not beneath %s", info.Path, mountpoint)
+		}
+		path := filepath.Join(mountpoint, info.Path)
+		if err := DeleteSubvolume(path, true); err != nil {
+			return deleted, fmt.Errorf("failed to delete snapshot %s: %w", path, err)
+		}
+		metrics.Count(MetricSnapshotsDeleted, 1)
+		deleted = append(deleted, info)
+	}
+	return deleted, nil
+}
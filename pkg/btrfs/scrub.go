@@ -0,0 +1,369 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrScrubInProgress is returned when starting a scrub on a filesystem that is
+// already being scrubbed.
+var ErrScrubInProgress = errors.New("scrub already in progress")
+
+// ErrScrubNotStarted is returned by WaitScrub when no scrub was started on the
+// filesystem with ScrubSubvolume.
+var ErrScrubNotStarted = errors.New("no scrub started")
+
+// DefaultScrubPollInterval is the interval at which ScrubSubvolumeWait polls for
+// progress when no interval is given.
+const DefaultScrubPollInterval = time.Second
+
+// scrubStartPollInterval is how often ScrubSubvolume checks whether the scrub has
+// started.
+const scrubStartPollInterval = 50 * time.Millisecond
+
+var (
+	// scrubRunsMu guards scrubRuns.
+	scrubRunsMu sync.Mutex
+	// scrubRuns holds the last scrub started by ScrubSubvolume for each mountpoint,
+	// so that WaitScrub and GetScrubStatus can report its final result.
+	scrubRuns = make(map[string]*scrubRun)
+)
+
+// ScrubStatus is the progress of a scrub, aggregated over all devices of the
+// filesystem.
+type ScrubStatus struct {
+	// Running is true while any device is still being scrubbed.
+	Running bool
+	// DataExtentsScrubbed is the number of data extents verified.
+	DataExtentsScrubbed uint64
+	// TreeExtentsScrubbed is the number of metadata extents verified.
+	TreeExtentsScrubbed uint64
+	// DataBytesScrubbed is the number of data bytes verified.
+	DataBytesScrubbed uint64
+	// TreeBytesScrubbed is the number of metadata bytes verified.
+	TreeBytesScrubbed uint64
+	// ReadErrors is the number of read errors encountered.
+	ReadErrors uint64
+	// CsumErrors is the number of checksum mismatches found.
+	CsumErrors uint64
+	// VerifyErrors is the number of metadata verification failures.
+	VerifyErrors uint64
+	// SuperErrors is the number of superblock errors found.
+	SuperErrors uint64
+	// UncorrectableErrors is the number of errors that could not be repaired.
+	UncorrectableErrors uint64
+	// CorrectedErrors is the number of errors that were repaired.
+	CorrectedErrors uint64
+	// UnverifiedErrors is the number of transient errors that could not be reproduced.
+	UnverifiedErrors uint64
+}
+
+// BytesScrubbed returns the total number of data and metadata bytes verified.
+func (s *ScrubStatus) BytesScrubbed() uint64 {
+	return s.DataBytesScrubbed + s.TreeBytesScrubbed
+}
+
+// Errors returns the total number of errors found.
+func (s *ScrubStatus) Errors() uint64 {
+	return s.ReadErrors + s.CsumErrors + s.VerifyErrors + s.SuperErrors
+}
+
+func (s *ScrubStatus) add(p *scrubProgress) {
+	s.DataExtentsScrubbed += p.Data_extents_scrubbed
+	s.TreeExtentsScrubbed += p.Tree_extents_scrubbed
+	s.DataBytesScrubbed += p.Data_bytes_scrubbed
+	s.TreeBytesScrubbed += p.Tree_bytes_scrubbed
+	s.ReadErrors += p.Read_errors
+	s.CsumErrors += p.Csum_errors
+	s.VerifyErrors += p.Verify_errors
+	s.SuperErrors += p.Super_errors
+	s.UncorrectableErrors += p.Uncorrectable_errors
+	s.CorrectedErrors += p.Corrected_errors
+	s.UnverifiedErrors += p.Unverified_errors
+}
+
+// ScrubSubvolume starts a scrub of the filesystem mounted at mountpoint and returns
+// its initial status once it is running, without waiting for it to complete.
+// Scrubbing always covers the whole filesystem. If the scrub ioctl fails before the
+// scrub reports progress, such as with EPERM or ErrScrubInProgress, that error is
+// returned. If the scrub completes before that, its final status is returned with
+// Running set to false. Use GetScrubStatus to follow its progress and WaitScrub to
+// block until it finishes and get its result, or ScrubSubvolumeWait to do all at
+// once.
+func ScrubSubvolume(mountpoint string) (*ScrubStatus, error) {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	run, err := startScrub(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(scrubStartPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-run.done:
+			run.f.Close()
+			st, err := run.result()
+			if err != nil {
+				return nil, err
+			}
+			setScrubRun(mountpoint, run)
+			return st, nil
+		case <-ticker.C:
+			if st, err := scrubStatusFd(run.f.Fd(), run.devids); err == nil && st.Running {
+				setScrubRun(mountpoint, run)
+				go func() {
+					run.wait()
+					run.f.Close()
+				}()
+				return st, nil
+			}
+		}
+	}
+}
+
+// WaitScrub blocks until the scrub started by ScrubSubvolume on the filesystem
+// mounted at mountpoint finishes, and returns its final status and the error of
+// the scrub ioctl, if any. It returns immediately if that scrub has already
+// finished. ErrScrubNotStarted is returned if no scrub was started on mountpoint
+// by this process.
+func WaitScrub(mountpoint string) (*ScrubStatus, error) {
+	run, err := getScrubRun(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, fmt.Errorf("%w on %s", ErrScrubNotStarted, mountpoint)
+	}
+	run.wait()
+	return run.result()
+}
+
+func setScrubRun(mountpoint string, run *scrubRun) {
+	scrubRunsMu.Lock()
+	defer scrubRunsMu.Unlock()
+	scrubRuns[mountpoint] = run
+}
+
+func getScrubRun(mountpoint string) (*scrubRun, error) {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	scrubRunsMu.Lock()
+	defer scrubRunsMu.Unlock()
+	return scrubRuns[mountpoint], nil
+}
+
+// ScrubSubvolumeWait scrubs the filesystem mounted at mountpoint and blocks until the
+// scrub completes. Progress is polled every interval, or DefaultScrubPollInterval if
+// zero, and passed to progress if it is not nil. If the context is done the scrub is
+// cancelled and the status so far is returned along with the context's error.
+func ScrubSubvolumeWait(ctx context.Context, mountpoint string, interval time.Duration, progress func(*ScrubStatus)) (*ScrubStatus, error) {
+	if interval <= 0 {
+		interval = DefaultScrubPollInterval
+	}
+	run, err := startScrub(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer run.f.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-run.done:
+			return run.result()
+		case <-ticker.C:
+			if progress != nil {
+				st, err := scrubStatusFd(run.f.Fd(), run.devids)
+				if err != nil {
+					continue
+				}
+				progress(st)
+			}
+		case <-ctx.Done():
+			if err := ioctlValue(run.f.Fd(), BTRFS_IOC_SCRUB_CANCEL, 0); err != nil && !errors.Is(err, syscall.ENOTCONN) {
+				return nil, fmt.Errorf("failed to cancel scrub: %w", err)
+			}
+			<-run.done
+			st, _ := run.result()
+			return st, ctx.Err()
+		}
+	}
+}
+
+// GetScrubStatus returns the progress of the scrub running on the filesystem mounted
+// at mountpoint. If no scrub is running the returned status has Running set to false;
+// it holds the final counts of the last scrub started on mountpoint by
+// ScrubSubvolume, if there was one. Use WaitScrub for the outcome of that scrub.
+func GetScrubStatus(mountpoint string) (*ScrubStatus, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	devids, err := listDeviceIDs(f.Fd())
+	if err != nil {
+		return nil, err
+	}
+	st, err := scrubStatusFd(f.Fd(), devids)
+	if err != nil || st.Running {
+		return st, err
+	}
+	run, err := getScrubRun(mountpoint)
+	if err != nil || run == nil || !run.finished() {
+		return st, err
+	}
+	final, _ := run.result()
+	return final, nil
+}
+
+func scrubStatusFd(fd uintptr, devids []uint64) (*ScrubStatus, error) {
+	status := &ScrubStatus{}
+	for _, devid := range devids {
+		args := &scrubArgs{Devid: devid}
+		if err := callWriteIoctl(fd, BTRFS_IOC_SCRUB_PROGRESS, args); err != nil {
+			if errors.Is(err, syscall.ENOTCONN) {
+				// No scrub running on this device
+				continue
+			}
+			return nil, err
+		}
+		status.Running = true
+		status.add(&args.Progress)
+	}
+	return status, nil
+}
+
+// scrubRun tracks a scrub running on every device of a filesystem.
+type scrubRun struct {
+	f      *os.File
+	devids []uint64
+	done   chan struct{}
+
+	mu      sync.Mutex
+	results []*scrubArgs
+	errs    []error
+}
+
+func startScrub(mountpoint string) (*scrubRun, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	devids, err := listDeviceIDs(f.Fd())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, err := scrubStatusFd(f.Fd(), devids)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Running {
+		f.Close()
+		return nil, fmt.Errorf("%w on %s", ErrScrubInProgress, mountpoint)
+	}
+	run := &scrubRun{f: f, devids: devids, done: make(chan struct{})}
+	var wg sync.WaitGroup
+	for _, devid := range devids {
+		wg.Add(1)
+		go func(devid uint64) {
+			defer wg.Done()
+			args := &scrubArgs{Devid: devid, End: ^uint64(0)}
+			err := callWriteIoctl(f.Fd(), BTRFS_IOC_SCRUB, args)
+			run.mu.Lock()
+			defer run.mu.Unlock()
+			run.results = append(run.results, args)
+			if errors.Is(err, syscall.EINPROGRESS) {
+				// Started by someone else since the status was checked
+				err = ErrScrubInProgress
+			}
+			if err != nil && !errors.Is(err, syscall.ECANCELED) {
+				run.errs = append(run.errs, fmt.Errorf("device %d: %w", devid, err))
+			}
+		}(devid)
+	}
+	go func() {
+		wg.Wait()
+		close(run.done)
+	}()
+	return run, nil
+}
+
+func (r *scrubRun) wait() { <-r.done }
+
+// finished returns true once all devices have finished.
+func (r *scrubRun) finished() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// result returns the final status once all devices have finished.
+func (r *scrubRun) result() (*ScrubStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := &ScrubStatus{}
+	for _, res := range r.results {
+		status.add(&res.Progress)
+	}
+	if len(r.errs) > 0 {
+		return status, fmt.Errorf("scrub failed: %w", r.errs[0])
+	}
+	return status, nil
+}
+
+// listDeviceIDs returns the IDs of all devices of the filesystem the given file
+// descriptor belongs to.
+func listDeviceIDs(fd uintptr) ([]uint64, error) {
+	fsInfo, err := getFilesystemInfo(fd)
+	if err != nil {
+		return nil, err
+	}
+	devids := make([]uint64, 0, fsInfo.Num_devices)
+	for devid := uint64(1); devid <= fsInfo.Max_id; devid++ {
+		if _, err := getDeviceInfo(fd, devid); err != nil {
+			if errors.Is(err, syscall.ENODEV) {
+				continue
+			}
+			return nil, err
+		}
+		devids = append(devids, devid)
+	}
+	return devids, nil
+}
@@ -0,0 +1,136 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs/btrfstest"
+)
+
+// newScrubFake returns a fake for a filesystem with a single device that replies to
+// progress requests with progress, or reports no scrub running if it is empty.
+func newScrubFake(progress ...btrfstest.IoctlReply) *btrfstest.FakeIoctlRunner {
+	if len(progress) == 0 {
+		progress = []btrfstest.IoctlReply{{Err: syscall.ENOTCONN}}
+	}
+	return btrfstest.NewFakeIoctlRunner().
+		Reply(btrfs.BTRFS_IOC_FS_INFO, btrfstest.IoctlReply{Fields: map[string]any{"Max_id": 1, "Num_devices": 1}}).
+		Reply(btrfs.BTRFS_IOC_SCRUB_PROGRESS, progress...)
+}
+
+func TestScrubSubvolumeReportsIoctlResult(t *testing.T) {
+	tests := []struct {
+		name      string
+		progress  []btrfstest.IoctlReply
+		scrub     btrfstest.IoctlReply
+		wantErr   error
+		wantBytes uint64
+		wantScrub int
+	}{
+		{name: "permission", scrub: btrfstest.IoctlReply{Err: syscall.EPERM}, wantErr: syscall.EPERM, wantScrub: 1},
+		{name: "not supported", scrub: btrfstest.IoctlReply{Err: syscall.ENOTTY}, wantErr: syscall.ENOTTY, wantScrub: 1},
+		{name: "started elsewhere", scrub: btrfstest.IoctlReply{Err: syscall.EINPROGRESS}, wantErr: btrfs.ErrScrubInProgress, wantScrub: 1},
+		{
+			name:     "already running",
+			progress: []btrfstest.IoctlReply{{}},
+			wantErr:  btrfs.ErrScrubInProgress,
+		},
+		{
+			name:      "completed at once",
+			scrub:     btrfstest.IoctlReply{Fields: map[string]any{"Progress.Data_bytes_scrubbed": 4096}},
+			wantBytes: 4096,
+			wantScrub: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newScrubFake(tt.progress...).Reply(btrfs.BTRFS_IOC_SCRUB, tt.scrub)
+			defer fake.Install()()
+			dir := t.TempDir()
+			st, err := btrfs.ScrubSubvolume(dir)
+			if n := len(fake.CallsFor(btrfs.BTRFS_IOC_SCRUB)); n != tt.wantScrub {
+				t.Errorf("got %d scrub calls, want %d", n, tt.wantScrub)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Running || st.DataBytesScrubbed != tt.wantBytes {
+				t.Errorf("status = %+v, want a finished scrub of %d bytes", st, tt.wantBytes)
+			}
+			final, err := btrfs.WaitScrub(dir)
+			if err != nil || final.DataBytesScrubbed != tt.wantBytes {
+				t.Errorf("WaitScrub = %+v, %v, want %d bytes", final, err, tt.wantBytes)
+			}
+			final, err = btrfs.GetScrubStatus(dir)
+			if err != nil || final.Running || final.DataBytesScrubbed != tt.wantBytes {
+				t.Errorf("GetScrubStatus = %+v, %v, want %d bytes", final, err, tt.wantBytes)
+			}
+		})
+	}
+}
+
+// blockingScrubRunner holds the scrub ioctl until release is closed, and then fails
+// it with err.
+type blockingScrubRunner struct {
+	*btrfstest.FakeIoctlRunner
+	release chan struct{}
+	err     error
+}
+
+func (r *blockingScrubRunner) WriteIoctl(fd uintptr, c btrfs.IoctlCmd, data any) error {
+	if c == btrfs.BTRFS_IOC_SCRUB {
+		<-r.release
+		return r.err
+	}
+	return r.FakeIoctlRunner.WriteIoctl(fd, c, data)
+}
+
+func TestScrubSubvolumeRunning(t *testing.T) {
+	fake := newScrubFake(
+		btrfstest.IoctlReply{Err: syscall.ENOTCONN},
+		btrfstest.IoctlReply{Fields: map[string]any{"Progress.Tree_bytes_scrubbed": 512}},
+	)
+	runner := &blockingScrubRunner{FakeIoctlRunner: fake, release: make(chan struct{}), err: syscall.EIO}
+	defer btrfs.SetIoctlRunner(runner)()
+	dir := t.TempDir()
+	st, err := btrfs.ScrubSubvolume(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Running || st.TreeBytesScrubbed != 512 {
+		t.Errorf("status = %+v, want a running scrub with 512 bytes", st)
+	}
+	close(runner.release)
+	if _, err := btrfs.WaitScrub(dir); !errors.Is(err, syscall.EIO) {
+		t.Errorf("WaitScrub error = %v, want EIO", err)
+	}
+}
+
+func TestWaitScrubNotStarted(t *testing.T) {
+	if _, err := btrfs.WaitScrub(t.TempDir()); !errors.Is(err, btrfs.ErrScrubNotStarted) {
+		t.Errorf("error = %v, want ErrScrubNotStarted", err)
+	}
+}
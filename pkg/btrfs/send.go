@@ -22,15 +22,33 @@ import (
 	"io"
 	"log"
 	"os"
+	"runtime"
+	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 type sendCtx struct {
 	context.Context
-	args      *sendArgs
-	osPipe    *os.File
-	logger    *log.Logger
-	verbosity int
+	args       *sendArgs
+	osPipe     *os.File
+	writer     io.Writer
+	compressor StreamCompressor
+	// isolateWriters keeps SendSubvolumeMulti writing to the remaining writers
+	// after one of them fails
+	isolateWriters bool
+	// sourceFile is an already open source subvolume used instead of opening the
+	// source path
+	sourceFile *os.File
+	progress   func(uint64)
+	limiter    *BandwidthLimiter
+	bufferSize int
+	logger     *log.Logger
+	verbosity  int
+	// cloneSources keeps the clone source IDs that args points to alive until the
+	// send ioctl has read them
+	cloneSources []uint64
 }
 
 type SendOption func(*sendCtx) error
@@ -44,11 +62,11 @@ func SendWithLogger(logger *log.Logger, verbosity int) SendOption {
 	}
 }
 
-// SendWithCloneSources will use the given snapshots as clone sources for an
-// incremental send.
+// SendWithCloneSources will use the given snapshots as clone sources, which the
+// stream may clone shared extents from instead of sending their data. Clone sources
+// do not make the send incremental, use SendWithParentRoot for that.
 func SendWithCloneSources(sources ...string) SendOption {
 	return func(ctx *sendCtx) error {
-		ctx.args.Clone_sources_count = uint64(len(sources))
 		srcs := make([]uint64, len(sources))
 		for i, source := range sources {
 			f, err := os.OpenFile(source, os.O_RDONLY, os.ModeDir)
@@ -56,16 +74,18 @@ func SendWithCloneSources(sources ...string) SendOption {
 				return err
 			}
 			rootID, err := lookupRootIDFromFd(f.Fd())
+			f.Close()
 			if err != nil {
 				return err
 			}
 			srcs[i] = rootID
-			if err := f.Close(); err != nil {
-				return err
-			}
 		}
-		srcptr := uintptr(unsafe.Pointer(&srcs[0]))
-		ctx.args.Clone_sources = uint64(srcptr)
+		ctx.cloneSources = srcs
+		ctx.args.Clone_sources_count = uint64(len(srcs))
+		ctx.args.Clone_sources = 0
+		if len(srcs) > 0 {
+			ctx.args.Clone_sources = uint64(uintptr(unsafe.Pointer(&srcs[0])))
+		}
 		return nil
 	}
 }
@@ -133,6 +153,55 @@ func SendToPipe() (SendOption, *os.File, error) {
 	return SendToFile(wf), rf, nil
 }
 
+// SendToWriter will copy the send stream to the given io.Writer. The stream is
+// read from a pipe that is created and closed by Send.
+func SendToWriter(w io.Writer) SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.writer = w
+		return nil
+	}
+}
+
+// SendWithContext will abort the send when the given context is done. This is
+// only effective when sending to a writer.
+func SendWithContext(c context.Context) SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.Context = c
+		return nil
+	}
+}
+
+// SendWithProgress will call fn with the total number of bytes copied so far each
+// time data is copied to the writer given with SendToWriter.
+func SendWithProgress(fn func(bytesSent uint64)) SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.progress = fn
+		return nil
+	}
+}
+
+// DefaultBufferSize is a buffer size for SendWithBufferSize and the receive
+// package's WithBufferSize that suits fast links. It matches the default of
+// /proc/sys/fs/pipe-max-size, the largest pipe an unprivileged process can request.
+const DefaultBufferSize = 1 << 20
+
+// SendWithBufferSize copies the stream to the writer given with SendToWriter in
+// chunks of up to size bytes instead of the 32KiB used by io.Copy, and grows the
+// pipe the kernel writes the stream to to size bytes with F_SETPIPE_SZ. Larger
+// writes reduce the per-write overhead of network writers and compressors and
+// help keep fast links busy. Growing the pipe is best effort: the kernel may round
+// size up to a power of two pages, and sizes above /proc/sys/fs/pipe-max-size are
+// refused for unprivileged processes, in which case the pipe keeps its size.
+func SendWithBufferSize(size int) SendOption {
+	return func(ctx *sendCtx) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid send buffer size %d", size)
+		}
+		ctx.bufferSize = size
+		return nil
+	}
+}
+
 // Send will send the snapshot at source with the given options.
 // Source must be a path to a read-only snapshot.
 func Send(source string, opts ...SendOption) error {
@@ -142,29 +211,247 @@ func Send(source string, opts ...SendOption) error {
 		logger:  log.New(io.Discard, "", 0),
 	}
 	for _, opt := range opts {
-		opt(ctx)
+		if err := opt(ctx); err != nil {
+			if ctx.osPipe != nil {
+				ctx.osPipe.Close()
+			}
+			return err
+		}
 	}
 	// We only do version 2 so we always send the version flag
 	ctx.args.Flags |= SendVersion
+	start := time.Now()
+	if err := ctx.run(source); err != nil {
+		metrics.Count(MetricSendErrors, 1)
+		return err
+	}
+	observeSince(MetricSendDuration, start)
+	metrics.Gauge(MetricLastSendTimestamp, float64(time.Now().Unix()))
+	return nil
+}
+
+func (ctx *sendCtx) run(source string) error {
+	if ctx.writer != nil {
+		if ctx.args.Send_fd != 0 {
+			return errors.New("cannot send to both a file and a writer")
+		}
+		return ctx.sendToWriter(source)
+	}
+	if ctx.compressor != nil {
+		if ctx.osPipe != nil {
+			ctx.osPipe.Close()
+		}
+		return errors.New("compression requires sending to a writer")
+	}
+	if ctx.limiter != nil {
+		if ctx.osPipe != nil {
+			ctx.osPipe.Close()
+		}
+		return errors.New("bandwidth limiting requires sending to a writer")
+	}
+	return ctx.send(source)
+}
+
+func (ctx *sendCtx) send(source string) error {
+	if ctx.osPipe != nil {
+		defer ctx.osPipe.Close()
+	}
 	if ctx.args.Send_fd == 0 {
 		return errors.New("no send target specified")
 	}
 	if ctx.verbosity >= 2 {
 		ctx.logger.Printf("opening snapshot at %q for send", source)
 	}
-	f, err := os.OpenFile(source, os.O_RDONLY, os.ModeDir)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if ctx.osPipe != nil {
-		defer ctx.osPipe.Close()
+	f := ctx.sourceFile
+	if f == nil {
+		var err error
+		if err := assertBtrfs(source); err != nil {
+			return err
+		}
+		f, err = os.OpenFile(source, os.O_RDONLY, os.ModeDir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 	}
 	if ctx.verbosity > 1 {
 		ctx.logger.Printf("sending snapshot %s", source)
 	}
-	if err := callWriteIoctl(f.Fd(), BTRFS_IOC_SEND, ctx.args); err != nil {
+	err := callWriteIoctl(f.Fd(), BTRFS_IOC_SEND, ctx.args)
+	runtime.KeepAlive(ctx.cloneSources)
+	if err != nil {
 		return fmt.Errorf("error sending snapshot: %w", err)
 	}
 	return nil
 }
+
+func (ctx *sendCtx) sendToWriter(source string) error {
+	var w io.Writer = ctx.writer
+	if ctx.limiter != nil {
+		w = &limitedWriter{ctx: ctx, w: w, limiter: ctx.limiter}
+	}
+	var cw io.WriteCloser
+	if ctx.compressor != nil {
+		var err error
+		if cw, err = ctx.compressor.NewWriter(w); err != nil {
+			return fmt.Errorf("error creating compressor: %w", err)
+		}
+		w = cw
+	}
+	if ctx.progress != nil {
+		w = &progressWriter{w: w, fn: ctx.progress}
+	}
+	n, copyErr, sendErr := copyFromPipe(ctx, w, ctx.bufferSize, func(wf *os.File) error {
+		if err := SendToFile(wf)(ctx); err != nil {
+			return err
+		}
+		return ctx.send(source)
+	})
+	metrics.Count(MetricSendBytes, float64(n))
+	var closeErr error
+	if cw != nil {
+		// Always closed, so that compressors release their resources even when
+		// the stream was cut short
+		closeErr = cw.Close()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return fmt.Errorf("error copying send stream: %w", copyErr)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	if closeErr != nil {
+		return fmt.Errorf("error flushing compressed send stream: %w", closeErr)
+	}
+	return nil
+}
+
+// copyFromPipe calls produce in a goroutine with the write end of a new pipe and
+// copies everything written to it to w, in chunks of bufSize bytes if it is
+// positive. It returns the number of bytes copied, the error of the copy and the
+// error of produce. Both ends of the pipe are closed and produce has returned by
+// the time copyFromPipe returns, also when w fails early or ctx is done: the read
+// end is closed then, which makes pending and further writes to the pipe fail with
+// EPIPE instead of blocking.
+func copyFromPipe(ctx context.Context, w io.Writer, bufSize int, produce func(wf *os.File) error) (int64, error, error) {
+	rf, wf, err := os.Pipe()
+	if err != nil {
+		return 0, err, nil
+	}
+	defer rf.Close()
+	if bufSize > 0 {
+		// Best effort, the copy buffer is used regardless
+		_, _ = unix.FcntlInt(wf.Fd(), unix.F_SETPIPE_SZ, bufSize)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		err := produce(wf)
+		// Closing the write end lets the copy see EOF once produce is done
+		wf.Close()
+		errCh <- err
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rf.Close()
+		case <-done:
+		}
+	}()
+	var n int64
+	var copyErr error
+	if bufSize > 0 {
+		// Hide the pipe's WriteTo so that the buffer is actually used
+		n, copyErr = io.CopyBuffer(w, struct{ io.Reader }{rf}, make([]byte, bufSize))
+	} else {
+		n, copyErr = io.Copy(w, rf)
+	}
+	// Closing the read end unblocks produce if the copy stopped early
+	rf.Close()
+	return n, copyErr, <-errCh
+}
+
+type progressWriter struct {
+	w    io.Writer
+	sent uint64
+	fn   func(uint64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.sent += uint64(n)
+	p.fn(p.sent)
+	return n, err
+}
+
+// SendSubvolume sends the read-only subvolume at path to w. If parent is not empty,
+// an incremental send is performed against it, as with `btrfs send -p`. The
+// cloneSources are read-only subvolumes the stream may clone shared extents from
+// instead of carrying their data, as with `btrfs send -c`; they do not change what
+// the stream is a diff against. The kernel always allows cloning from the parent,
+// so it need not be repeated among them. Additional options, such as
+// SendWithProgress, are passed to Send.
+func SendSubvolume(path, parent string, cloneSources []string, w io.Writer, opts ...SendOption) error {
+	return SendSubvolumeContext(context.Background(), path, parent, cloneSources, w, opts...)
+}
+
+// SendSubvolumeContext is like SendSubvolume but aborts the send when the context
+// is done. The pipe between the send ioctl and w is closed, which interrupts the
+// ioctl, and ctx.Err() is returned.
+func SendSubvolumeContext(ctx context.Context, path, parent string, cloneSources []string, w io.Writer, opts ...SendOption) error {
+	readonly, err := IsSubvolumeReadOnly(path)
+	if err != nil {
+		return err
+	}
+	if !readonly {
+		return fmt.Errorf("%w: %s must be read-only to send", ErrNotReadOnlySubvolume, path)
+	}
+	sendOpts := append([]SendOption{SendWithContext(ctx), SendToWriter(w)}, incrementalOptions(parent, cloneSources)...)
+	return Send(path, append(sendOpts, opts...)...)
+}
+
+// incrementalOptions returns the options selecting parent as the parent of a send
+// and cloneSources as its clone sources, either of which may be empty.
+func incrementalOptions(parent string, cloneSources []string) []SendOption {
+	var opts []SendOption
+	if parent != "" {
+		opts = append(opts, SendWithParentRoot(parent))
+	}
+	if len(cloneSources) > 0 {
+		opts = append(opts, SendWithCloneSources(cloneSources...))
+	}
+	return opts
+}
+
+// EstimateSendSize returns an estimate of the size of the data that would be sent
+// for the subvolume at path using quota group accounting. For a full send this is
+// the referenced size of the subvolume, and for an incremental send it is the size
+// exclusive to the subvolume, which does not account for data it shares with
+// subvolumes other than the parent. Quotas must be enabled on the filesystem,
+// otherwise ErrQuotasDisabled is returned.
+func EstimateSendSize(path, parent string) (uint64, error) {
+	if err := assertBtrfs(path); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	rootID, err := lookupRootIDFromFd(f.Fd())
+	if err != nil {
+		return 0, err
+	}
+	info, err := lookupQgroupInfo(f.Fd(), rootID)
+	if err != nil {
+		return 0, err
+	}
+	if parent == "" {
+		return info.Rfer, nil
+	}
+	return info.Excl, nil
+}
@@ -0,0 +1,159 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// StreamCompressor compresses and decompresses send streams. Codec implements it
+// for the built-in algorithms, callers may supply their own implementation to
+// SendWithCompressor.
+type StreamCompressor interface {
+	// NewWriter returns a writer that compresses data written to it into w. Close
+	// must flush any buffered data but must not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader that decompresses data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Codec is a built-in send stream compression algorithm.
+type Codec int
+
+const (
+	// CodecNone does not compress the stream.
+	CodecNone Codec = iota
+	// CodecZstd compresses the stream with zstd.
+	CodecZstd
+	// CodecGzip compresses the stream with gzip.
+	CodecGzip
+	// CodecLZ4 compresses the stream with the lz4 frame format.
+	CodecLZ4
+)
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecZstd:
+		return "zstd"
+	case CodecGzip:
+		return "gzip"
+	case CodecLZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("Codec(%d)", int(c))
+	}
+}
+
+// ParseCodec returns the codec with the given name as returned by Codec.String.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{CodecNone, CodecZstd, CodecGzip, CodecLZ4} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("unknown codec %q", name)
+}
+
+// NewWriter implements StreamCompressor.
+func (c Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecLZ4:
+		return lz4.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %s", c)
+	}
+}
+
+// NewReader implements StreamCompressor.
+func (c Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CodecNone:
+		return io.NopCloser(r), nil
+	case CodecZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecLZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %s", c)
+	}
+}
+
+// DetectCodec sniffs the compression of the stream in r from its leading magic
+// bytes without consuming them. Streams that are not recognized are reported as
+// CodecNone.
+func DetectCodec(r *bufio.Reader) (Codec, error) {
+	magic, err := r.Peek(4)
+	if err != nil && len(magic) == 0 {
+		return CodecNone, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CodecZstd, nil
+	case bytes.HasPrefix(magic, lz4Magic):
+		return CodecLZ4, nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CodecGzip, nil
+	}
+	return CodecNone, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// SendWithCompressor will compress the stream copied to the writer given with
+// SendToWriter using c. Progress reported by SendWithProgress counts the bytes
+// of the uncompressed stream.
+func SendWithCompressor(c StreamCompressor) SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.compressor = c
+		return nil
+	}
+}
+
+// SendSubvolumeCompressed is like SendSubvolume but compresses the stream written
+// to w with the given codec.
+func SendSubvolumeCompressed(path, parent string, cloneSources []string, w io.Writer, codec Codec) error {
+	return SendSubvolume(path, parent, cloneSources, w, SendWithCompressor(codec))
+}
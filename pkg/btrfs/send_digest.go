@@ -0,0 +1,39 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"crypto"
+	_ "crypto/sha256" // register SHA-224 and SHA-256 for crypto.Hash
+	"fmt"
+	"io"
+)
+
+// SendSubvolumeWithDigest is like SendSubvolume but also computes a digest of the
+// stream written to w using the hash algorithm h, which is returned once the send
+// succeeds. The digest covers the bytes as written to w, after any compression set
+// up with SendWithCompressor. The package implementing h must be linked into the
+// binary; SHA-256 always is.
+func SendSubvolumeWithDigest(path, parent string, cloneSources []string, w io.Writer, h crypto.Hash, opts ...SendOption) ([]byte, error) {
+	if !h.Available() {
+		return nil, fmt.Errorf("hash function %v is not available", h)
+	}
+	hw := h.New()
+	if err := SendSubvolume(path, parent, cloneSources, io.MultiWriter(w, hw), opts...); err != nil {
+		return nil, err
+	}
+	return hw.Sum(nil), nil
+}
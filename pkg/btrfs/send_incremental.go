@@ -0,0 +1,268 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// SendIncremental sends the read-only subvolume at src to w, choosing the send parent
+// automatically. The parent UUID chain of src is followed and the nearest ancestor
+// whose UUID is in knownUUIDs is used as the parent. The known UUIDs are typically
+// the received UUIDs of the subvolumes present at the destination. If no ancestor is
+// known a full send is performed.
+func SendIncremental(src string, knownUUIDs []uuid.UUID, w io.Writer) error {
+	parent, err := findIncrementalParent(src, knownUUIDs)
+	if err != nil {
+		return err
+	}
+	if parent != "" {
+		if err := ValidateIncrementalParent(src, parent); err != nil {
+			return err
+		}
+	}
+	return SendSubvolume(src, parent, nil, w)
+}
+
+// ValidateIncrementalParent checks that the subvolume at parent can be used as the
+// parent of an incremental send of the subvolume at src. The parent must appear in
+// the parent UUID chain of src and its ctransid must be lower than that of src,
+// otherwise the resulting stream could not be received. ErrInvalidParent is returned
+// if either check fails. Ancestors are looked up through the UUID tree, so neither
+// the parent nor the intermediate ancestors need to be beneath the mount of src.
+func ValidateIncrementalParent(src, parent string) error {
+	srcInfo, err := GetSubvolumeInfo(src)
+	if err != nil {
+		return err
+	}
+	parentInfo, err := GetSubvolumeInfo(parent)
+	if err != nil {
+		return err
+	}
+	if parentInfo.Ctransid >= srcInfo.Ctransid {
+		return fmt.Errorf("%w: %s (ctransid %d) is not older than %s (ctransid %d)",
+			ErrInvalidParent, parent, parentInfo.Ctransid, src, srcInfo.Ctransid)
+	}
+	ok, err := inParentChain(src, srcInfo, parentInfo.UUID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s (%s) is not in the parent UUID chain of %s", ErrInvalidParent, parent, parentInfo.UUID, src)
+	}
+	return nil
+}
+
+// SendIncrementalWithParent sends the read-only subvolume at src to w incrementally
+// against the subvolume at parent. Unlike SendIncremental the parent is given
+// explicitly and may be reached through any mount of the filesystem, for instance
+// when snapshots are kept on a separate subvolume mount. The parent must be a
+// read-only subvolume whose UUID is in the parent UUID chain of src and that is older
+// than src. The kernel identifies the parent by subvolume ID, so it must be on the
+// same filesystem as src, otherwise ErrCrossDevice is returned. Additional options
+// are passed to SendSubvolume.
+func SendIncrementalWithParent(src, parent string, w io.Writer, opts ...SendOption) error {
+	srcVol, err := Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcVol.Close()
+	parentVol, err := Open(parent)
+	if err != nil {
+		return err
+	}
+	defer parentVol.Close()
+	readonly, err := parentVol.IsReadOnly()
+	if err != nil {
+		return err
+	}
+	if !readonly {
+		return fmt.Errorf("%w: parent %s must be read-only", ErrNotReadOnlySubvolume, parent)
+	}
+	if err := checkSameFilesystem(srcVol.f, parentVol.f); err != nil {
+		return err
+	}
+	if err := ValidateIncrementalParent(src, parent); err != nil {
+		return err
+	}
+	return SendSubvolume(src, parent, nil, w, opts...)
+}
+
+// inParentChain reports whether target is in the parent UUID chain of the subvolume
+// at path described by info.
+func inParentChain(path string, info *SubvolumeInfo, target uuid.UUID) (bool, error) {
+	var found bool
+	err := walkParentChain(path, info, func(next uuid.UUID) (bool, error) {
+		found = next == target
+		return found, nil
+	})
+	return found, err
+}
+
+// walkParentChain calls fn with the UUID of each ancestor in the parent UUID chain
+// of the subvolume at path described by info, nearest first, until fn returns true.
+// Ancestors are resolved through the UUID tree, so the chain is followed regardless
+// of which subvolumes are mounted. The walk ends at the first ancestor that no
+// longer exists.
+func walkParentChain(path string, info *SubvolumeInfo, fn func(uuid.UUID) (bool, error)) error {
+	seen := map[uuid.UUID]struct{}{info.UUID: {}}
+	next := info.ParentUUID
+	for next != uuid.Nil {
+		if _, ok := seen[next]; ok {
+			return fmt.Errorf("parent UUID chain of %s contains a cycle at %s", path, next)
+		}
+		seen[next] = struct{}{}
+		if stop, err := fn(next); stop || err != nil {
+			return err
+		}
+		id, err := UUIDTreeLookupID(path, next, LookupUUIDKeySubvol)
+		if errors.Is(err, ErrSubvolumeNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item, err := lookupRootItem(path, id)
+		if errors.Is(err, ErrSubvolumeNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		next = uuid.UUID(item.Parent_uuid)
+	}
+	return nil
+}
+
+// findIncrementalParent returns the path of the nearest ancestor of src whose UUID
+// is in known, or an empty string if there is none. The chain is walked like
+// ValidateIncrementalParent does, so the ancestor found is accepted by it. Known
+// ancestors that cannot be reached beneath the mount of src are skipped, as the
+// parent of a send is given by path.
+func findIncrementalParent(src string, known []uuid.UUID) (string, error) {
+	info, err := GetSubvolumeInfo(src)
+	if err != nil {
+		return "", err
+	}
+	mount, err := FindRootMount(src)
+	if err != nil {
+		return "", err
+	}
+	knownSet := make(map[uuid.UUID]struct{}, len(known))
+	for _, uu := range known {
+		knownSet[uu] = struct{}{}
+	}
+	var parent string
+	err = walkParentChain(src, info, func(next uuid.UUID) (bool, error) {
+		if _, ok := knownSet[next]; !ok {
+			return false, nil
+		}
+		path, err := FindSubvolumeByUUID(mount.Path, next)
+		if errors.Is(err, ErrSubvolumeNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		parent = path
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return parent, nil
+}
+
+// FindCloneSources returns the candidates that are likely to share extents with the
+// subvolume at src and can be passed to SendSubvolume as clone sources. Candidates
+// are selected by lineage: the subvolume src was snapshotted from, snapshots of src
+// and other snapshots of the same subvolume. Candidates that are not read-only, are
+// on another filesystem or are unrelated to src are left out. The result is ordered
+// by how close the candidates are to src in ctransid, nearest first.
+func FindCloneSources(src string, candidates []string) ([]string, error) {
+	srcVol, err := Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer srcVol.Close()
+	srcInfo, err := srcVol.Info()
+	if err != nil {
+		return nil, err
+	}
+	type scored struct {
+		path     string
+		distance uint64
+	}
+	var found []scored
+	for _, candidate := range candidates {
+		candidate, err := filepath.Abs(candidate)
+		if err != nil {
+			return nil, err
+		}
+		ok, distance, err := cloneSourceDistance(srcVol, srcInfo, candidate)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", candidate, err)
+		}
+		if ok {
+			found = append(found, scored{path: candidate, distance: distance})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].distance < found[j].distance })
+	out := make([]string, len(found))
+	for i, f := range found {
+		out[i] = f.path
+	}
+	return out, nil
+}
+
+// cloneSourceDistance returns whether the subvolume at candidate is usable as a clone
+// source for src, and the distance between their ctransids.
+func cloneSourceDistance(src *Subvolume, srcInfo *SubvolumeInfo, candidate string) (bool, uint64, error) {
+	vol, err := Open(candidate)
+	if err != nil {
+		return false, 0, err
+	}
+	defer vol.Close()
+	if err := checkSameFilesystem(src.f, vol.f); err != nil {
+		if errors.Is(err, ErrCrossDevice) {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	info, err := vol.Info()
+	if err != nil {
+		return false, 0, err
+	}
+	if !info.ReadOnly || info.UUID == srcInfo.UUID {
+		return false, 0, nil
+	}
+	related := info.UUID == srcInfo.ParentUUID ||
+		info.ParentUUID == srcInfo.UUID ||
+		(info.ParentUUID != uuid.Nil && info.ParentUUID == srcInfo.ParentUUID)
+	if !related {
+		return false, 0, nil
+	}
+	if info.Ctransid > srcInfo.Ctransid {
+		return true, info.Ctransid - srcInfo.Ctransid, nil
+	}
+	return true, srcInfo.Ctransid - info.Ctransid, nil
+}
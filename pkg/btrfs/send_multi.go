@@ -0,0 +1,122 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MultiWriterError is returned by SendSubvolumeMulti when one or more writers failed.
+type MultiWriterError struct {
+	// Errors holds the error of each writer by index, or nil for writers that
+	// received the whole stream.
+	Errors []error
+}
+
+// Error implements the error interface.
+func (e *MultiWriterError) Error() string {
+	var msgs []string
+	for i, err := range e.Errors {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("writer %d: %s", i, err))
+		}
+	}
+	return "send failed for " + strings.Join(msgs, "; ")
+}
+
+// Failed returns the indexes of the writers that failed.
+func (e *MultiWriterError) Failed() []int {
+	var out []int
+	for i, err := range e.Errors {
+		if err != nil {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// SendContinueOnWriterError makes SendSubvolumeMulti keep sending to the remaining
+// writers when one of them fails. By default the first failing writer aborts the send.
+func SendContinueOnWriterError() SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.isolateWriters = true
+		return nil
+	}
+}
+
+// SendSubvolumeMulti is like SendSubvolume but copies a single send stream to all of
+// the given writers. If any writer fails a *MultiWriterError reporting each failed
+// writer is returned. Use SendContinueOnWriterError to keep feeding the other writers
+// after a failure, the send is then only aborted once all writers have failed.
+func SendSubvolumeMulti(path, parent string, cloneSources []string, writers []io.Writer, opts ...SendOption) error {
+	if len(writers) == 0 {
+		return errors.New("no writers given")
+	}
+	fw := &fanoutWriter{writers: writers, errs: make([]error, len(writers))}
+	opts = append(opts, func(ctx *sendCtx) error {
+		fw.isolate = ctx.isolateWriters
+		return nil
+	})
+	err := SendSubvolume(path, parent, cloneSources, fw, opts...)
+	if fw.failed() {
+		return &MultiWriterError{Errors: fw.errs}
+	}
+	return err
+}
+
+// fanoutWriter writes to several writers, tracking the error of each.
+type fanoutWriter struct {
+	writers []io.Writer
+	errs    []error
+	isolate bool
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	active := 0
+	for i, w := range f.writers {
+		if f.errs[i] != nil {
+			continue
+		}
+		n, err := w.Write(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			f.errs[i] = err
+			if !f.isolate {
+				return 0, fmt.Errorf("writer %d: %w", i, err)
+			}
+			continue
+		}
+		active++
+	}
+	if active == 0 {
+		return 0, errors.New("all writers failed")
+	}
+	return len(p), nil
+}
+
+func (f *fanoutWriter) failed() bool {
+	for _, err := range f.errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
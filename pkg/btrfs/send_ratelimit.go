@@ -0,0 +1,136 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLimiterSleep bounds a single wait of a BandwidthLimiter so that a changed limit
+// takes effect promptly.
+const maxLimiterSleep = 100 * time.Millisecond
+
+// BandwidthLimiter is a token bucket limiting the throughput of send streams in
+// bytes per second. A single limiter can be shared by several concurrent sends, which
+// then share the bandwidth. Its limit can be changed while sends are in progress.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter allowing bytesPerSec bytes per second. Zero
+// or a negative value means unlimited.
+func NewBandwidthLimiter(bytesPerSec int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bytesPerSec, last: time.Now()}
+}
+
+// SetLimit changes the limit to bytesPerSec bytes per second. Zero or a negative
+// value means unlimited. Sends waiting on the limiter pick up the new limit within
+// a fraction of a second. Accumulated tokens are kept up to one second worth at the
+// new limit, and outstanding debt is still paid off at the new limit.
+func (l *BandwidthLimiter) SetLimit(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = bytesPerSec
+	if l.rate <= 0 {
+		l.tokens = 0
+	} else if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+// Limit returns the current limit in bytes per second, zero if unlimited.
+func (l *BandwidthLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate < 0 {
+		return 0
+	}
+	return l.rate
+}
+
+// refill adds the tokens accumulated since the last refill, holding at most one
+// second worth of tokens. It must be called with the lock held.
+func (l *BandwidthLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// wait blocks until n bytes may be passed on or ctx is done. Writes larger than the
+// available tokens are let through once the bucket is not in debt and the debt is
+// paid off by the following writes, so writes of any size are accepted.
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill(time.Now())
+		if l.tokens >= 0 {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		d := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+		if d > maxLimiterSleep {
+			d = maxLimiterSleep
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// SendWithBandwidthLimit limits the throughput of the send stream written to the
+// writer given with SendToWriter to the limit of l. When the stream is compressed the
+// compressed bytes are limited. Keep a reference to l to change the limit during the
+// send with SetLimit.
+func SendWithBandwidthLimit(l *BandwidthLimiter) SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.limiter = l
+		return nil
+	}
+}
+
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *BandwidthLimiter
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if err := l.limiter.wait(l.ctx, len(b)); err != nil {
+		return 0, err
+	}
+	return l.w.Write(b)
+}
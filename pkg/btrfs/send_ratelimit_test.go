@@ -0,0 +1,47 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiterSetLimitKeepsTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tokens float64
+		limit  int64
+		want   float64
+	}{
+		{"lowered", 1000, 400, 400},
+		{"raised", 1000, 4000, 1000},
+		{"debt", -300, 400, -300},
+		{"unlimited", 1000, 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewBandwidthLimiter(1000)
+			l.last = time.Now()
+			l.tokens = tc.tokens
+			l.SetLimit(tc.limit)
+			// Allow for the tokens refilled since last was set
+			if math.Abs(l.tokens-tc.want) > 1 {
+				t.Errorf("tokens after SetLimit(%d) = %v, want %v", tc.limit, l.tokens, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var errWriterFailed = errors.New("writer failed")
+
+// failingWriter accepts limit bytes and fails every write after that. A negative
+// limit accepts everything.
+type failingWriter struct {
+	limit int
+	n     int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.limit >= 0 && w.n+len(p) > w.limit {
+		n := w.limit - w.n
+		w.n = w.limit
+		return n, errWriterFailed
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+// produceForever writes to wf until a write fails.
+func produceForever(wf *os.File) error {
+	buf := make([]byte, 64<<10)
+	for {
+		if _, err := wf.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+func openFds(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open file descriptors: %v", err)
+	}
+	return len(fds)
+}
+
+// waitGoroutines waits for the number of goroutines to drop to want, as the
+// goroutines of copyFromPipe may still be exiting when it returns.
+func waitGoroutines(want int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCopyFromPipeDoesNotLeak(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		bufSize int
+		limit   int
+		wantErr error
+	}{
+		{name: "buffered", ctx: context.Background(), bufSize: 1 << 20, limit: 100 << 10, wantErr: errWriterFailed},
+		{name: "unbuffered", ctx: context.Background(), limit: 100 << 10, wantErr: errWriterFailed},
+		{name: "cancelled", ctx: cancelled, limit: -1, wantErr: os.ErrClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fds := openFds(t)
+			goroutines := runtime.NumGoroutine()
+			w := &failingWriter{limit: tt.limit}
+			errc := make(chan [2]error, 1)
+			go func() {
+				_, copyErr, produceErr := copyFromPipe(tt.ctx, w, tt.bufSize, produceForever)
+				errc <- [2]error{copyErr, produceErr}
+			}()
+			var errs [2]error
+			select {
+			case errs = <-errc:
+			case <-time.After(10 * time.Second):
+				t.Fatal("copyFromPipe did not return")
+			}
+			if !errors.Is(errs[0], tt.wantErr) {
+				t.Errorf("copy error = %v, want %v", errs[0], tt.wantErr)
+			}
+			if errs[1] == nil {
+				t.Error("produce did not fail after the read end was closed")
+			}
+			if got := openFds(t); got != fds {
+				t.Errorf("open file descriptors = %d, want %d", got, fds)
+			}
+			if got := waitGoroutines(goroutines); got > goroutines {
+				t.Errorf("goroutines = %d, want %d", got, goroutines)
+			}
+		})
+	}
+}
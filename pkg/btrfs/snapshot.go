@@ -16,6 +16,7 @@ If not, see <https://www.gnu.org/licenses/>.
 package btrfs
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -70,6 +71,9 @@ func CreateSnapshot(source string, opts ...SnapshotOption) error {
 	if err != nil {
 		return err
 	}
+	if err := assertBtrfs(source); err != nil {
+		return err
+	}
 	src, err := os.OpenFile(source, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return err
@@ -96,29 +100,60 @@ func CreateSnapshot(source string, opts ...SnapshotOption) error {
 	if err := callWriteIoctl(uintptr(fddst), BTRFS_IOC_SNAP_CREATE_V2, args); err != nil {
 		return err
 	}
+	metrics.Count(MetricSnapshotsCreated, 1)
 	return nil
 }
 
-// DeleteSnapshot deletes the given snapshot.
-func DeleteSnapshot(path string) error {
-	path, err := filepath.Abs(path)
+// SnapshotSubvolume creates a snapshot of the subvolume at source at the path dest.
+// If readonly is true the snapshot is created read-only in the same ioctl.
+func SnapshotSubvolume(source, dest string, readonly bool) error {
+	isSubvol, err := IsSubvolumeRoot(source)
 	if err != nil {
 		return err
 	}
-	topdir := filepath.Dir(path)
-	name := filepath.Base(path)
-	f, err := os.OpenFile(topdir, os.O_RDONLY, os.ModeDir)
+	if !isSubvol {
+		return fmt.Errorf("%w: %s", ErrNotASubvolume, source)
+	}
+	opts := []SnapshotOption{WithSnapshotPath(dest)}
+	if readonly {
+		opts = append(opts, WithReadOnlySnapshot())
+	}
+	return CreateSnapshot(source, opts...)
+}
+
+// SnapshotSubvolumeAfterSync is like SnapshotSubvolume, but syncs the filesystem of
+// source first so that all data written before the call is committed, and returns
+// the information of the new snapshot. The snapshot is created in its own committed
+// transaction, so the returned Ctransid identifies a generation that is on disk.
+func SnapshotSubvolumeAfterSync(source, dest string, readonly bool) (*SubvolumeInfo, error) {
+	if err := SyncFilesystem(source); err != nil {
+		return nil, fmt.Errorf("syncing %s before snapshot: %w", source, err)
+	}
+	if err := SnapshotSubvolume(source, dest, readonly); err != nil {
+		return nil, err
+	}
+	return GetSubvolumeInfo(dest)
+}
+
+// CloneFromSeed creates a new writable subvolume at dest seeded from the subvolume
+// at seed, and returns its information. The new subvolume is a read-write snapshot
+// of seed, so it is created instantly and shares all data with seed until either
+// is changed. The seed may be read-only, such as a golden image that is kept
+// unchanged while many volumes are provisioned from it.
+func CloneFromSeed(seed, dest string) (*SubvolumeInfo, error) {
+	if err := SnapshotSubvolume(seed, dest, false); err != nil {
+		return nil, err
+	}
+	return GetSubvolumeInfo(dest)
+}
+
+// DeleteSnapshot deletes the given snapshot.
+func DeleteSnapshot(path string) error {
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	args := &volumeArgsV2{
-		Fd:      int64(f.Fd()),
-		Transid: 0,
-		Flags:   0,
-		Name:    toSnapInt8Array(name),
-	}
-	return callWriteIoctl(uintptr(f.Fd()), BTRFS_IOC_SNAP_DESTROY_V2, args)
+	return destroySubvolume(path)
 }
 
 func toSnapInt8Array(s string) [4040]int8 {
@@ -0,0 +1,208 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SnapshotRequest describes a single snapshot to create with SnapshotMany.
+type SnapshotRequest struct {
+	// Source is the path of the subvolume to snapshot.
+	Source string
+	// Dest is the path of the snapshot to create.
+	Dest string
+	// ReadOnly creates the snapshot read-only.
+	ReadOnly bool
+}
+
+// SnapshotManyError is returned by SnapshotMany when one of the requests fails.
+type SnapshotManyError struct {
+	// Index is the index of the request that failed.
+	Index int
+	// Err is the error for the failed request.
+	Err error
+	// RollbackErrors holds the errors for the indexes of already created snapshots
+	// that could not be removed again. Snapshots not listed were rolled back.
+	RollbackErrors map[int]error
+	// RolledBack lists the paths of the snapshots that were created and deleted
+	// again, in request order.
+	RolledBack []string
+	// Orphaned lists the paths of the snapshots that were created but could not be
+	// deleted again and are left behind, in request order.
+	Orphaned []string
+}
+
+// Error implements the error interface.
+func (e *SnapshotManyError) Error() string {
+	msg := fmt.Sprintf("snapshot request %d failed: %s", e.Index, e.Err)
+	if len(e.RollbackErrors) == 0 {
+		return msg
+	}
+	idxs := make([]int, 0, len(e.RollbackErrors))
+	for idx := range e.RollbackErrors {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	msgs := make([]string, len(idxs))
+	for i, idx := range idxs {
+		msgs[i] = fmt.Sprintf("%d: %s", idx, e.RollbackErrors[idx])
+	}
+	return fmt.Sprintf("%s (rollback failed for %s; orphaned snapshots: %s)",
+		msg, strings.Join(msgs, "; "), strings.Join(e.Orphaned, ", "))
+}
+
+// Unwrap returns the error of the failed request joined with the rollback errors
+// in request order, so that errors.Is and errors.As match any of them.
+func (e *SnapshotManyError) Unwrap() error {
+	errs := []error{e.Err}
+	idxs := make([]int, 0, len(e.RollbackErrors))
+	for idx := range e.RollbackErrors {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	for _, idx := range idxs {
+		errs = append(errs, fmt.Errorf("rollback of snapshot request %d: %w", idx, e.RollbackErrors[idx]))
+	}
+	return errors.Join(errs...)
+}
+
+// snapshotBatchItem holds the open descriptors for one request of a batch.
+type snapshotBatchItem struct {
+	src  *os.File
+	dst  *os.File
+	dest string
+	args *volumeArgsV2
+}
+
+func (s *snapshotBatchItem) close() {
+	if s.src != nil {
+		s.src.Close()
+	}
+	if s.dst != nil {
+		s.dst.Close()
+	}
+}
+
+// SnapshotMany creates the requested snapshots as close together in time as possible.
+// All sources and destination directories are opened before the snapshot ioctls are
+// issued back-to-back. If any snapshot fails, the snapshots already created are
+// deleted again and a *SnapshotManyError is returned. On success the information for
+// each created snapshot is returned in the order of the requests.
+func SnapshotMany(pairs []SnapshotRequest) ([]SubvolumeInfo, error) {
+	items := make([]*snapshotBatchItem, len(pairs))
+	defer func() {
+		for _, item := range items {
+			if item != nil {
+				item.close()
+			}
+		}
+	}()
+	for i, req := range pairs {
+		item, err := prepareSnapshot(req)
+		if err != nil {
+			return nil, &SnapshotManyError{Index: i, Err: err}
+		}
+		items[i] = item
+	}
+	for i, item := range items {
+		if err := callWriteIoctl(item.dst.Fd(), BTRFS_IOC_SNAP_CREATE_V2, item.args); err != nil {
+			serr := &SnapshotManyError{Index: i, Err: err}
+			serr.rollback(items[:i])
+			return nil, serr
+		}
+	}
+	metrics.Count(MetricSnapshotsCreated, float64(len(items)))
+	infos := make([]SubvolumeInfo, len(items))
+	for i, item := range items {
+		info, err := GetSubvolumeInfo(item.dest)
+		if err != nil {
+			return nil, &SnapshotManyError{Index: i, Err: fmt.Errorf("snapshot created but could not be inspected: %w", err)}
+		}
+		infos[i] = *info
+	}
+	return infos, nil
+}
+
+func prepareSnapshot(req SnapshotRequest) (*snapshotBatchItem, error) {
+	source, err := filepath.Abs(req.Source)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := filepath.Abs(req.Dest)
+	if err != nil {
+		return nil, err
+	}
+	isSubvol, err := IsSubvolumeRoot(source)
+	if err != nil {
+		return nil, err
+	}
+	if !isSubvol {
+		return nil, fmt.Errorf("%w: %s", ErrNotASubvolume, source)
+	}
+	item := &snapshotBatchItem{dest: dest}
+	item.src, err = os.OpenFile(source, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	topdir := filepath.Dir(dest)
+	if err := os.MkdirAll(topdir, 0755); err != nil {
+		item.close()
+		return nil, err
+	}
+	item.dst, err = os.OpenFile(topdir, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		item.close()
+		return nil, err
+	}
+	item.args = &volumeArgsV2{
+		Fd:   int64(item.src.Fd()),
+		Name: toSnapInt8Array(filepath.Base(dest)),
+	}
+	if req.ReadOnly {
+		item.args.Flags |= SubvolReadOnly
+	}
+	return item, nil
+}
+
+// rollback deletes the snapshots created for the given items in reverse order and
+// records which of them were deleted and which are left behind. A failure to delete
+// one snapshot does not stop the others from being rolled back.
+func (e *SnapshotManyError) rollback(items []*snapshotBatchItem) {
+	deleted := make([]bool, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := destroySubvolume(items[i].dest); err != nil {
+			if e.RollbackErrors == nil {
+				e.RollbackErrors = make(map[int]error)
+			}
+			e.RollbackErrors[i] = err
+			continue
+		}
+		deleted[i] = true
+	}
+	for i, item := range items {
+		if deleted[i] {
+			e.RolledBack = append(e.RolledBack, item.dest)
+		} else {
+			e.Orphaned = append(e.Orphaned, item.dest)
+		}
+	}
+}
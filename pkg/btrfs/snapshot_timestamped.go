@@ -0,0 +1,79 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultSnapshotLayout is the time layout used by CreateTimestampedSnapshot when
+// no layout is given. It is RFC 3339 in UTC without colons, so the resulting names
+// are safe on every filesystem and sort chronologically.
+const DefaultSnapshotLayout = "20060102T150405Z"
+
+// maxSnapshotNameCollisions bounds the counter appended to a timestamped snapshot
+// name that already exists.
+const maxSnapshotNameCollisions = 1000
+
+// CreateTimestampedSnapshot creates a snapshot of source in destDir named after the
+// current time formatted with layout, or DefaultSnapshotLayout if layout is empty.
+// If a snapshot of that name already exists, a counter is appended (name.1, name.2,
+// ...). The chosen path and the information of the new snapshot are returned.
+// Additional options such as WithReadOnlySnapshot are applied to the snapshot; they
+// must not set the snapshot name or path.
+func CreateTimestampedSnapshot(source, destDir, layout string, opts ...SnapshotOption) (string, *SubvolumeInfo, error) {
+	if layout == "" {
+		layout = DefaultSnapshotLayout
+	}
+	now := time.Now().UTC()
+	name := now.Format(layout)
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", nil, fmt.Errorf("invalid snapshot name %q from layout %q", name, layout)
+	}
+	isSubvol, err := IsSubvolumeRoot(source)
+	if err != nil {
+		return "", nil, err
+	}
+	if !isSubvol {
+		return "", nil, fmt.Errorf("%w: %s", ErrNotASubvolume, source)
+	}
+	for i := 0; i <= maxSnapshotNameCollisions; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s.%d", name, i)
+		}
+		path := filepath.Join(destDir, candidate)
+		// The kernel refuses to create a snapshot over an existing entry, which
+		// makes the collision check atomic.
+		err := CreateSnapshot(source, append([]SnapshotOption{WithSnapshotPath(path)}, opts...)...)
+		if errors.Is(err, syscall.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		info, err := GetSubvolumeInfo(path)
+		if err != nil {
+			return path, nil, err
+		}
+		return path, info, nil
+	}
+	return "", nil, fmt.Errorf("failed to find a free snapshot name for %q in %s: %w", name, destDir, syscall.EEXIST)
+}
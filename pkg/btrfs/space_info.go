@@ -0,0 +1,182 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// BlockGroupFlags describe the type and profile of a block group.
+type BlockGroupFlags uint64
+
+// Block group types and profiles.
+const (
+	BlockGroupData     BlockGroupFlags = 1 << 0
+	BlockGroupSystem   BlockGroupFlags = 1 << 1
+	BlockGroupMetadata BlockGroupFlags = 1 << 2
+	BlockGroupRaid0    BlockGroupFlags = 1 << 3
+	BlockGroupRaid1    BlockGroupFlags = 1 << 4
+	BlockGroupDup      BlockGroupFlags = 1 << 5
+	BlockGroupRaid10   BlockGroupFlags = 1 << 6
+	BlockGroupRaid5    BlockGroupFlags = 1 << 7
+	BlockGroupRaid6    BlockGroupFlags = 1 << 8
+	BlockGroupRaid1C3  BlockGroupFlags = 1 << 9
+	BlockGroupRaid1C4  BlockGroupFlags = 1 << 10
+	// SpaceInfoGlobalReserve marks the global reserve, which is reported
+	// alongside the block groups but is carved out of metadata space.
+	SpaceInfoGlobalReserve BlockGroupFlags = 1 << 49
+
+	blockGroupTypeMask    = BlockGroupData | BlockGroupSystem | BlockGroupMetadata
+	blockGroupProfileMask = BlockGroupRaid0 | BlockGroupRaid1 | BlockGroupDup | BlockGroupRaid10 |
+		BlockGroupRaid5 | BlockGroupRaid6 | BlockGroupRaid1C3 | BlockGroupRaid1C4
+)
+
+// Type returns the block group type bits of the flags.
+func (f BlockGroupFlags) Type() BlockGroupFlags {
+	return f & blockGroupTypeMask
+}
+
+// Profile returns the profile bits of the flags. Zero means the single profile.
+func (f BlockGroupFlags) Profile() BlockGroupFlags {
+	return f & blockGroupProfileMask
+}
+
+// TypeString returns the type of the block group as printed by btrfs filesystem df,
+// such as "Data", "Metadata", "Data+Metadata" or "GlobalReserve".
+func (f BlockGroupFlags) TypeString() string {
+	if f&SpaceInfoGlobalReserve != 0 {
+		return "GlobalReserve"
+	}
+	var parts []string
+	if f&BlockGroupData != 0 {
+		parts = append(parts, "Data")
+	}
+	if f&BlockGroupSystem != 0 {
+		parts = append(parts, "System")
+	}
+	if f&BlockGroupMetadata != 0 {
+		parts = append(parts, "Metadata")
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, "+")
+}
+
+// ProfileString returns the profile of the block group as printed by btrfs
+// filesystem df, such as "single", "DUP" or "RAID1".
+func (f BlockGroupFlags) ProfileString() string {
+	switch f.Profile() {
+	case 0:
+		return "single"
+	case BlockGroupRaid0:
+		return "RAID0"
+	case BlockGroupRaid1:
+		return "RAID1"
+	case BlockGroupDup:
+		return "DUP"
+	case BlockGroupRaid10:
+		return "RAID10"
+	case BlockGroupRaid5:
+		return "RAID5"
+	case BlockGroupRaid6:
+		return "RAID6"
+	case BlockGroupRaid1C3:
+		return "RAID1C3"
+	case BlockGroupRaid1C4:
+		return "RAID1C4"
+	default:
+		return "unknown"
+	}
+}
+
+// SpaceInfo is the space allocated to and used by the block groups of one type
+// and profile.
+type SpaceInfo struct {
+	// Flags are the type and profile of the block groups.
+	Flags BlockGroupFlags
+	// TotalBytes is the space allocated to the block groups, not counting the
+	// redundancy of the profile.
+	TotalBytes uint64
+	// UsedBytes is the space used within the block groups, not counting the
+	// redundancy of the profile.
+	UsedBytes uint64
+}
+
+// spaceInfo mirrors struct btrfs_ioctl_space_info.
+type spaceInfo struct {
+	Flags       uint64
+	Total_bytes uint64
+	Used_bytes  uint64
+}
+
+// GetSpaceInfo returns the space allocated to and used by each block group type
+// and profile of the filesystem at mountpoint, as reported by BTRFS_IOC_SPACE_INFO.
+// The groups are returned as reported by the kernel, so callers can compute the
+// available space for the profile they intend to use.
+func GetSpaceInfo(mountpoint string) ([]SpaceInfo, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// A first call with no slots returns the number of groups
+	var count spaceArgs
+	if err := callReadIoctl(f.Fd(), BTRFS_IOC_SPACE_INFO, &count); err != nil {
+		return nil, fmt.Errorf("failed to count space info: %w", err)
+	}
+	if count.Total_spaces == 0 {
+		return nil, nil
+	}
+	buf, err := encodeStructure(&spaceArgs{Space_slots: count.Total_spaces})
+	if err != nil {
+		return nil, err
+	}
+	hdrSize := len(buf)
+	buf = append(buf, make([]byte, int(count.Total_spaces)*binary.Size(spaceInfo{}))...)
+	if err := ioctlBytes(f.Fd(), BTRFS_IOC_SPACE_INFO, buf); err != nil {
+		return nil, fmt.Errorf("failed to get space info: %w", err)
+	}
+	var args spaceArgs
+	if err := decodeStructure(buf[:hdrSize], &args); err != nil {
+		return nil, err
+	}
+	// Groups may have disappeared between the calls, never read past the slots
+	n := args.Total_spaces
+	if n > count.Total_spaces {
+		n = count.Total_spaces
+	}
+	infos := make([]spaceInfo, n)
+	if err := binary.Read(bytes.NewReader(buf[hdrSize:]), binary.LittleEndian, infos); err != nil {
+		return nil, fmt.Errorf("failed to decode space info: %w", err)
+	}
+	out := make([]SpaceInfo, n)
+	for i, info := range infos {
+		out[i] = SpaceInfo{
+			Flags:      BlockGroupFlags(info.Flags),
+			TotalBytes: info.Total_bytes,
+			UsedBytes:  info.Used_bytes,
+		}
+	}
+	return out, nil
+}
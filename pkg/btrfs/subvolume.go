@@ -16,68 +16,231 @@ If not, see <https://www.gnu.org/licenses/>.
 package btrfs
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"syscall"
+	"unsafe"
 
 	"github.com/google/uuid"
 )
 
-// IsSubvolume returns true if the given path is a subvolume.
+// IsSubvolume returns true if the given path is on a btrfs filesystem, and therefore
+// inside some subvolume. It does not check that the path is the root of a subvolume,
+// use IsSubvolumeRoot for that. It returns false and a nil error if the path exists
+// but is not on a btrfs filesystem. If the path does not exist the returned error
+// matches os.ErrNotExist.
 func IsSubvolume(path string) (bool, error) {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return false, err
 	}
 	var statfs syscall.Statfs_t
-	err = syscall.Statfs(path, &statfs)
+	err = runner.Statfs(path, &statfs)
 	if err != nil {
-		return false, err
+		return false, &os.PathError{Op: "statfs", Path: path, Err: err}
 	}
 	// Cast to uint32 avoids compile error on arm: "constant 2435016766 overflows int32"
 	return uint32(statfs.Type) == BTRFS_SUPER_MAGIC, nil
 }
 
+// IsSubvolumeRoot returns true if path is the root directory of a subvolume on a
+// btrfs filesystem, which always has the first free object ID (256) as its inode
+// number. It returns false and a nil error for any other path on btrfs and for paths
+// that are not on btrfs at all.
+func IsSubvolumeRoot(path string) (bool, error) {
+	isBtrfs, err := IsSubvolume(path)
+	if err != nil || !isBtrfs {
+		return false, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("cannot determine inode of %s", path)
+	}
+	return st.IsDir() && sys.Ino == uint64(FirstFreeObjectID), nil
+}
+
+// SubvolumeExists reports whether path is the root of a subvolume. Unlike
+// IsSubvolumeRoot it returns false and a nil error if the path, or one of its
+// parent directories, does not exist, so only genuine failures such as permission
+// errors are reported as errors.
+func SubvolumeExists(path string) (bool, error) {
+	ok, err := IsSubvolumeRoot(path)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return false, nil
+	}
+	return ok, err
+}
+
 // CreateSubvolume creates a subvolume at the given path.
 func CreateSubvolume(path string) error {
+	return createSubvolume(path, CreateOptions{})
+}
+
+// CreateOptions are options for CreateSubvolumeWithOptions.
+type CreateOptions struct {
+	// InheritQgroups are the IDs of the qgroups the new subvolume's qgroup is added
+	// to, so that its usage is accounted to them as well.
+	InheritQgroups []uint64
+	// ReadOnly makes the new subvolume read-only once it has been created.
+	ReadOnly bool
+	// DirMode is the mode of the missing parent directories that are created for
+	// the subvolume, before the umask. If zero, 0755 is used.
+	DirMode os.FileMode
+	// RequireParent makes creation fail when the parent directory of the subvolume
+	// does not exist, instead of creating the missing directories.
+	RequireParent bool
+}
+
+// prepareParent makes sure the parent directory of a new subvolume exists,
+// creating it unless opts.RequireParent is set.
+func (opts CreateOptions) prepareParent(dir string) error {
+	if opts.RequireParent {
+		st, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("parent directory of new subvolume: %w", err)
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("parent of new subvolume %s is not a directory: %w", dir, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	mode := opts.DirMode
+	if mode == 0 {
+		mode = 0755
+	}
+	return os.MkdirAll(dir, mode.Perm())
+}
+
+// CreateSubvolumeWithOptions creates a subvolume at the given path with the given
+// options and returns the information of the new subvolume, such as its ID and UUID.
+func CreateSubvolumeWithOptions(path string, opts CreateOptions) (*SubvolumeInfo, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSubvolume(path, opts); err != nil {
+		return nil, err
+	}
+	return GetSubvolumeInfo(path)
+}
+
+func createSubvolume(path string, opts CreateOptions) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 	topdir := filepath.Dir(path)
 	name := filepath.Base(path)
-	if err := os.MkdirAll(topdir, 0755); err != nil {
+	if err := opts.prepareParent(topdir); err != nil {
+		return err
+	}
+	if err := assertBtrfs(topdir); err != nil {
 		return err
 	}
 	dest, err := os.OpenFile(topdir, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return err
 	}
+	defer dest.Close()
 	args := &volumeArgsV2{
 		Fd:   int64(dest.Fd()),
 		Name: toSnapInt8Array(name),
 	}
-	return callWriteIoctl(dest.Fd(), BTRFS_IOC_SUBVOL_CREATE_V2, args)
+	var inherit []byte
+	if len(opts.InheritQgroups) > 0 {
+		inherit, err = encodeQgroupInherit(opts.InheritQgroups)
+		if err != nil {
+			return err
+		}
+		args.Flags |= SubvolQgroupInherit
+		binary.LittleEndian.PutUint64(args.Anon0[0:8], uint64(len(inherit)))
+		binary.LittleEndian.PutUint64(args.Anon0[8:16], uint64(uintptr(unsafe.Pointer(&inherit[0]))))
+	}
+	err = callWriteIoctl(dest.Fd(), BTRFS_IOC_SUBVOL_CREATE_V2, args)
+	// The kernel reads the inherit structure through the pointer in the arguments
+	runtime.KeepAlive(inherit)
+	if err != nil {
+		return err
+	}
+	if opts.ReadOnly {
+		return SetSubvolumeReadOnly(path, true)
+	}
+	return nil
 }
 
 // SetReceivedSubvolume sets the received UUID and ctransid for a subvolume. This
-// method is intended for use by receive operations.
+// method is intended for use by receive operations. The send time and flags are
+// zeroed, use SetReceivedSubvolumeState to set them as well.
 func SetReceivedSubvolume(path string, uuid uuid.UUID, ctransid uint64) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return setReceivedSubvolumeFd(f.Fd(), uuid, ctransid)
+}
+
+// SetReceivedOptions are options for SetReceivedSubvolumeWithOptions.
+type SetReceivedOptions struct {
+	// CheckCtransid refuses to set a ctransid lower than the one the subvolume has
+	// already received from the same UUID, so that replaying an older stream cannot
+	// move the subvolume back in its incremental lineage.
+	CheckCtransid bool
+}
+
+// SetReceivedSubvolumeWithOptions is like SetReceivedSubvolume but with options.
+// With CheckCtransid, ErrCtransidRegression is returned if the subvolume already
+// has a received state for uuid with a higher ctransid. Setting the same ctransid
+// again, or a received UUID that differs from the existing one, is allowed.
+func SetReceivedSubvolumeWithOptions(path string, uuid uuid.UUID, ctransid uint64, opts SetReceivedOptions) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	if opts.CheckCtransid {
+		info, err := getSubvolumeInfoFd(f.Fd())
+		if err != nil {
+			return err
+		}
+		if info.ReceivedUUID == uuid && info.Stransid > ctransid {
+			return fmt.Errorf("%w: %s already received ctransid %d of %s, refusing to set %d",
+				ErrCtransidRegression, path, info.Stransid, uuid, ctransid)
+		}
+	}
+	return setReceivedSubvolumeFd(f.Fd(), uuid, ctransid)
+}
+
+func setReceivedSubvolumeFd(fd uintptr, uuid uuid.UUID, ctransid uint64) error {
 	args := &receivedSubvolArgs{
 		Uuid:     uuidToInt8Array(uuid),
 		Stransid: ctransid,
 	}
-	return callWriteIoctl(f.Fd(), BTRFS_IOC_SET_RECEIVED_SUBVOL, args)
+	return callWriteIoctl(fd, BTRFS_IOC_SET_RECEIVED_SUBVOL, args)
 }
 
 // SetSubvolumeReadOnly sets the read-only status of the subvolume at the given path to
@@ -87,13 +250,19 @@ func SetSubvolumeReadOnly(path string, readonly bool) error {
 	if err != nil {
 		return err
 	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	var flags uint64
-	err = ioctlUint64(f.Fd(), BTRFS_IOC_SUBVOL_GETFLAGS, &flags)
+	return setSubvolumeReadOnlyFd(f.Fd(), readonly)
+}
+
+func setSubvolumeReadOnlyFd(fd uintptr, readonly bool) error {
+	flags, err := getSubvolumeFlagsFd(fd)
 	if err != nil {
 		return err
 	}
@@ -102,41 +271,290 @@ func SetSubvolumeReadOnly(path string, readonly bool) error {
 	} else {
 		flags = flags &^ SubvolReadOnly
 	}
-	return ioctlUint64(f.Fd(), BTRFS_IOC_SUBVOL_SETFLAGS, &flags)
+	return setSubvolumeFlagsFd(fd, flags)
+}
+
+// ReadOnlyOptions are options for SetSubvolumeReadOnlyWithOptions.
+type ReadOnlyOptions struct {
+	// Force makes a subvolume read-write even if it has read-only snapshots.
+	Force bool
+}
+
+// DependentSnapshotsError is returned by SetSubvolumeReadOnlyWithOptions when a
+// subvolume cannot be made read-write because read-only snapshots were taken of
+// it. It matches ErrDependentSnapshots.
+type DependentSnapshotsError struct {
+	// Path is the path of the subvolume.
+	Path string
+	// Snapshots are the paths of the read-only snapshots of the subvolume, oldest
+	// first. Snapshots outside of the mounted subvolume are given relative to the
+	// top-level subvolume.
+	Snapshots []string
+}
+
+// Error implements the error interface.
+func (e *DependentSnapshotsError) Error() string {
+	return fmt.Sprintf("%s: %s has %s", ErrDependentSnapshots, e.Path, strings.Join(e.Snapshots, ", "))
+}
+
+// Unwrap returns ErrDependentSnapshots.
+func (e *DependentSnapshotsError) Unwrap() error { return ErrDependentSnapshots }
+
+// SetSubvolumeReadOnlyWithOptions is like SetSubvolumeReadOnly, but refuses to make
+// a read-only subvolume read-write if read-only snapshots were taken of it, unless
+// opts.Force is set, and returns a *DependentSnapshotsError listing them. Changing
+// such a subvolume advances its generation, so incremental sends that used it as
+// their parent no longer line up with it.
+func SetSubvolumeReadOnlyWithOptions(path string, readonly bool, opts ReadOnlyOptions) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if !readonly && !opts.Force {
+		if err := checkNoDependentSnapshots(path); err != nil {
+			return err
+		}
+	}
+	return SetSubvolumeReadOnly(path, readonly)
+}
+
+// checkNoDependentSnapshots returns a *DependentSnapshotsError if the subvolume at
+// path is read-only and has read-only snapshots.
+func checkNoDependentSnapshots(path string) error {
+	info, err := GetSubvolumeInfo(path)
+	if err != nil {
+		return err
+	}
+	if !info.ReadOnly {
+		return nil
+	}
+	snaps, err := ListSnapshotsOf(path, info.UUID)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		return nil
+	}
+	paths := make([]string, len(snaps))
+	for i, snap := range snaps {
+		if strings.HasPrefix(snap.Path, topLevelPathPrefix+"/") {
+			paths[i] = snap.Path
+		} else {
+			paths[i] = filepath.Join(path, snap.Path)
+		}
+	}
+	return &DependentSnapshotsError{Path: path, Snapshots: paths}
+}
+
+// WithReadOnly runs fn with the subvolume at path made read-write and then restores
+// its original read-only status, including when fn returns an error or panics. A
+// subvolume that is already read-write is left as is. The status is restored
+// through a file descriptor opened before fn runs, so it applies to the same
+// subvolume even if fn renames it. If fn deletes the subvolume there is nothing to
+// restore. An error from fn takes precedence over an error restoring the status.
+func WithReadOnly(path string, fn func() error) (err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	readonly, err := isSubvolumeReadOnlyFd(f.Fd())
+	if err != nil {
+		return err
+	}
+	if !readonly {
+		return fn()
+	}
+	if err := setSubvolumeReadOnlyFd(f.Fd(), false); err != nil {
+		return err
+	}
+	defer func() {
+		rerr := setSubvolumeReadOnlyFd(f.Fd(), true)
+		if rerr == nil || err != nil {
+			return
+		}
+		if _, serr := os.Stat(path); os.IsNotExist(serr) {
+			return
+		}
+		err = fmt.Errorf("failed to make %s read-only again: %w", path, rerr)
+	}()
+	return fn()
 }
 
 // DeleteSubvolume deletes the subvolume at the given path. If the subvolume
-// is read-only then it will be made read-write before deletion.
+// is read-only then it will be made read-write before deletion when force is
+// true. Subvolumes containing nested subvolumes cannot be deleted and return
+// ErrNestedSubvolumes, naming the nested subvolume if it can be listed.
 func DeleteSubvolume(path string, force bool) error {
+	return DeleteSubvolumeWithOptions(path, DeleteOptions{Force: force})
+}
+
+// DeleteOptions are options for DeleteSubvolumeWithOptions.
+type DeleteOptions struct {
+	// Force makes read-only subvolumes read-write before deleting them.
+	Force bool
+	// Recursive deletes subvolumes nested beneath the subvolume as well, the
+	// deepest first. Without it, nested subvolumes cause ErrNestedSubvolumes to be
+	// returned.
+	Recursive bool
+}
+
+// DeleteSubvolumeWithOptions deletes the subvolume at the given path with the
+// given options. When deleting recursively, all read-only checks are made before
+// anything is deleted, so a missing Force does not leave a partially deleted tree.
+// Only recursive deletes list the nested subvolumes up front, which requires
+// CAP_SYS_ADMIN. Otherwise they are only looked for to name one in the error once
+// the kernel refuses the deletion, so unprivileged users can delete subvolumes on
+// filesystems mounted with user_subvol_rm_allowed.
+func DeleteSubvolumeWithOptions(path string, opts DeleteOptions) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	if !opts.Recursive {
+		return deleteSingleSubvolume(path, opts.Force)
+	}
+	nested, err := nestedSubvolumes(path)
+	if err != nil {
+		return err
+	}
+	// Parents are made read-write before their children are deleted, as deleting
+	// a subvolume modifies the directory containing it.
+	targets := append(nested, path)
+	for i := len(targets) - 1; i >= 0; i-- {
+		if _, err := clearReadOnlyForDelete(targets[i], opts.Force); err != nil {
+			return err
+		}
+	}
+	for _, target := range targets {
+		if err := destroySubvolume(target); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// deleteSingleSubvolume deletes the subvolume at path, which must not contain
+// nested subvolumes. A subvolume made read-write for the deletion is made
+// read-only again if it could not be deleted.
+func deleteSingleSubvolume(path string, force bool) error {
+	cleared, err := clearReadOnlyForDelete(path, force)
 	if err != nil {
 		return err
 	}
-	// Check if readonly flag is set - if so, remove it
+	err = destroySubvolume(path)
+	if err == nil {
+		return nil
+	}
+	if cleared {
+		if rerr := SetSubvolumeReadOnly(path, true); rerr != nil {
+			err = fmt.Errorf("%w (and failed to make it read-only again: %v)", err, rerr)
+		}
+	}
+	if errors.Is(err, syscall.ENOTEMPTY) {
+		// Naming the nested subvolume is best effort, listing may not be permitted
+		if nested, lerr := nestedSubvolumes(path); lerr == nil && len(nested) > 0 {
+			return fmt.Errorf("%w: %s contains %s", ErrNestedSubvolumes, path, nested[len(nested)-1])
+		}
+		return fmt.Errorf("%w: %s: %v", ErrNestedSubvolumes, path, err)
+	}
+	return fmt.Errorf("failed to delete %s: %w", path, err)
+}
+
+// clearReadOnlyForDelete makes the subvolume at path read-write if it is
+// read-only and force is true, and returns ErrReadOnlySubvolume if it is
+// read-only and force is false. It reports whether the flag was cleared.
+func clearReadOnlyForDelete(path string, force bool) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
 	var flags uint64
-	err = ioctlUint64(f.Fd(), BTRFS_IOC_SUBVOL_GETFLAGS, &flags)
+	if err := ioctlUint64(f.Fd(), BTRFS_IOC_SUBVOL_GETFLAGS, &flags); err != nil {
+		return false, err
+	}
+	if flags&SubvolReadOnly == 0 {
+		return false, nil
+	}
+	if !force {
+		return false, fmt.Errorf("%w: %s", ErrReadOnlySubvolume, path)
+	}
+	flags = flags &^ SubvolReadOnly
+	if err := ioctlUint64(f.Fd(), BTRFS_IOC_SUBVOL_SETFLAGS, &flags); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// destroySubvolume issues BTRFS_IOC_SNAP_DESTROY_V2 for the subvolume at the given
+// absolute path against its parent directory.
+func destroySubvolume(path string) error {
+	parent, err := os.OpenFile(filepath.Dir(path), os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return err
 	}
-	if flags&SubvolReadOnly != 0 {
-		if force {
-			flags = flags &^ SubvolReadOnly
-			if err := ioctlUint64(f.Fd(), BTRFS_IOC_SUBVOL_SETFLAGS, &flags); err != nil {
-				return err
-			}
-		} else {
-			return fmt.Errorf("subvolume %s is read-only", path)
+	defer parent.Close()
+	args := &volumeArgsV2{
+		Fd:   int64(parent.Fd()),
+		Name: toSnapInt8Array(filepath.Base(path)),
+	}
+	return callWriteIoctl(parent.Fd(), BTRFS_IOC_SNAP_DESTROY_V2, args)
+}
+
+// DeleteSubvolumeDryRun returns the paths of the subvolumes that would be deleted
+// by deleting the subvolume at the given path, without deleting anything. Nested
+// subvolumes are returned first in the order they would need to be deleted, with
+// the deepest first, and the given path is always the last element.
+func DeleteSubvolumeDryRun(path string) ([]string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	nested, err := nestedSubvolumes(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(nested, path), nil
+}
+
+// nestedSubvolumes returns the absolute paths of all subvolumes nested beneath the
+// subvolume at path, ordered so that the deepest subvolumes come first.
+func nestedSubvolumes(path string) ([]string, error) {
+	// Paths are listed relative to the subvolume containing the given path,
+	// anything outside of it is prefixed with the top-level marker.
+	subvols, err := ListSubvolumes(path)
+	if err != nil {
+		return nil, err
+	}
+	nested := make([]string, 0)
+	for _, subvol := range subvols {
+		if strings.HasPrefix(subvol.Path, topLevelPathPrefix+"/") {
+			continue
 		}
+		nested = append(nested, filepath.Join(path, subvol.Path))
 	}
-	return os.RemoveAll(path)
+	sort.SliceStable(nested, func(i, j int) bool {
+		return strings.Count(nested[i], "/") > strings.Count(nested[j], "/")
+	})
+	return nested, nil
 }
 
 // IsSubvolumeReadOnly returns true if the subvolume at the given path is read-only.
 func IsSubvolumeReadOnly(path string) (bool, error) {
+	if err := assertBtrfs(path); err != nil {
+		return false, err
+	}
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return false, err
@@ -146,8 +564,7 @@ func IsSubvolumeReadOnly(path string) (bool, error) {
 }
 
 func isSubvolumeReadOnlyFd(fd uintptr) (bool, error) {
-	var flags uint64
-	err := ioctlUint64(fd, BTRFS_IOC_SUBVOL_GETFLAGS, &flags)
+	flags, err := getSubvolumeFlagsFd(fd)
 	if err != nil {
 		return false, err
 	}
@@ -161,3 +578,11 @@ func uuidToInt8Array(uuid uuid.UUID) [16]int8 {
 	}
 	return arr
 }
+
+func int8ArrayToUUID(arr [16]int8) uuid.UUID {
+	var uu uuid.UUID
+	for i, b := range arr {
+		uu[i] = byte(b)
+	}
+	return uu
+}
@@ -0,0 +1,70 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// SubvolumeAncestry returns the lineage of the subvolume at path, oldest first,
+// ending with the subvolume itself. The chain is followed through parent UUIDs up to
+// the subvolume that is not a snapshot of another, usually the original read-write
+// source. If an ancestor has been deleted the chain starts at its child, whose
+// ParentUUID is then not the UUID of any subvolume in the chain. Paths are relative
+// to the root mount of the filesystem, as returned by ListSubvolumes. An error
+// matching ErrAncestryCycle is returned if the parent UUIDs form a cycle.
+func SubvolumeAncestry(path string) ([]SubvolumeInfo, error) {
+	mount, err := FindRootMount(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := GetSubvolumeInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	subvols, err := ListSubvolumes(mount.Path)
+	if err != nil {
+		return nil, err
+	}
+	byUUID := make(map[uuid.UUID]SubvolumeInfo, len(subvols))
+	for _, subvol := range subvols {
+		byUUID[subvol.UUID] = subvol
+	}
+	self, ok := byUUID[info.UUID]
+	if !ok {
+		self = *info
+	}
+	chain := []SubvolumeInfo{self}
+	seen := map[uuid.UUID]bool{self.UUID: true}
+	for next := self.ParentUUID; next != uuid.Nil; {
+		if seen[next] {
+			return nil, fmt.Errorf("%w: %s is its own ancestor", ErrAncestryCycle, next)
+		}
+		seen[next] = true
+		ancestor, ok := byUUID[next]
+		if !ok {
+			break
+		}
+		chain = append(chain, ancestor)
+		next = ancestor.ParentUUID
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
@@ -0,0 +1,85 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"context"
+)
+
+// IsSubvolumeContext is like IsSubvolume but stops waiting and returns ctx.Err() once
+// the context is done. The statfs call cannot be interrupted, so it is left running
+// until it returns, for example when the device behind path has stalled.
+func IsSubvolumeContext(ctx context.Context, path string) (bool, error) {
+	return runContext(ctx, func() (bool, error) {
+		return IsSubvolume(path)
+	})
+}
+
+// CreateSubvolumeContext is like CreateSubvolume but stops waiting and returns
+// ctx.Err() once the context is done. The ioctl cannot be interrupted and keeps
+// running in the background, so the subvolume may still be created afterwards.
+func CreateSubvolumeContext(ctx context.Context, path string) error {
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, CreateSubvolume(path)
+	})
+	return err
+}
+
+// DeleteSubvolumeContext is like DeleteSubvolume but stops waiting and returns
+// ctx.Err() once the context is done. As with CreateSubvolumeContext the deletion
+// carries on in the background and may still complete.
+func DeleteSubvolumeContext(ctx context.Context, path string, force bool) error {
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, DeleteSubvolume(path, force)
+	})
+	return err
+}
+
+// SetSubvolumeReadOnlyContext is like SetSubvolumeReadOnly but stops waiting and
+// returns ctx.Err() once the context is done, leaving the flag change to finish or
+// fail in the background.
+func SetSubvolumeReadOnlyContext(ctx context.Context, path string, readonly bool) error {
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, SetSubvolumeReadOnly(path, readonly)
+	})
+	return err
+}
+
+// runContext runs fn in a goroutine and returns its result, or ctx.Err() if the
+// context is done first, in which case the goroutine is abandoned and exits once
+// fn returns. fn is not started if the context is already done.
+func runContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	// Buffered, so that an abandoned fn can still deliver its result and exit
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn()
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
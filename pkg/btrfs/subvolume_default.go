@@ -0,0 +1,102 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// defaultDirItemName is the name of the directory item in the root tree directory
+// that points to the default subvolume.
+const defaultDirItemName = "default"
+
+// dirItemHeaderSize is the size of the packed struct btrfs_dir_item preceding the
+// name of a directory item.
+const dirItemHeaderSize = 30
+
+// GetDefaultSubvolume returns the ID of the default subvolume of the filesystem
+// mounted at mountpoint, which is mounted when no subvolume is given. It is the
+// top-level subvolume (ID 5) unless it was changed.
+func GetDefaultSubvolume(mountpoint string) (uint64, error) {
+	if err := assertBtrfs(mountpoint); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	params := SearchParams{
+		Tree_id:      uint64(RootTreeObjectID),
+		Min_objectid: uint64(RootTreeDirObjectID),
+		Max_objectid: uint64(RootTreeDirObjectID),
+		Min_offset:   0,
+		Max_offset:   math.MaxUint64,
+		Min_transid:  0,
+		Max_transid:  math.MaxUint64,
+		Min_type:     uint32(DirItemKey),
+		Max_type:     uint32(DirItemKey),
+	}
+	id := uint64(FSTreeObjectID)
+	err = walkBtrfsTreeV2Fd(f.Fd(), params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if len(item.Data) < dirItemHeaderSize {
+			return fmt.Errorf("dir item is too short: %d bytes", len(item.Data))
+		}
+		nameLen := int(binary.LittleEndian.Uint16(item.Data[27:29]))
+		if len(item.Data) < dirItemHeaderSize+nameLen {
+			return fmt.Errorf("dir item name is truncated")
+		}
+		if string(item.Data[dirItemHeaderSize:dirItemHeaderSize+nameLen]) != defaultDirItemName {
+			return nil
+		}
+		dirItem, err := item.DirItem()
+		if err != nil {
+			return fmt.Errorf("failed to decode dir item: %w", err)
+		}
+		id = dirItem.Location.Objectid
+		return ErrStopWalk
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to search root tree directory: %w", err)
+	}
+	return id, nil
+}
+
+// SetDefaultSubvolume sets the subvolume with the given ID as the default
+// subvolume of the filesystem mounted at mountpoint. ErrSubvolumeNotFound is
+// returned if there is no subvolume with the ID.
+func SetDefaultSubvolume(mountpoint string, subvolID uint64) error {
+	if subvolID != uint64(FSTreeObjectID) {
+		if _, err := lookupRootItem(mountpoint, subvolID); err != nil {
+			return err
+		}
+	}
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ioctlUint64(f.Fd(), BTRFS_IOC_DEFAULT_SUBVOL, &subvolID)
+}
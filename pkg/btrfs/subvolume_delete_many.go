@@ -0,0 +1,134 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DeleteResult is the outcome of deleting one subvolume with DeleteSubvolumes.
+type DeleteResult struct {
+	// Path is the absolute path of the subvolume.
+	Path string
+	// Err is nil if the subvolume was deleted.
+	Err error
+}
+
+// DeleteSubvolumes deletes the subvolumes at the given paths with the given options
+// and returns the result for each path in the order they were given. Subvolumes are
+// deleted in dependency order: snapshots before the subvolumes in the set they were
+// taken of, found through their parent UUIDs, and nested subvolumes before the
+// subvolumes containing them. When a subvolume could not be deleted, the subvolumes
+// it depends on are not deleted either, so a failed deletion never leaves a snapshot
+// without its parent. Deletion continues with the unrelated subvolumes. The returned
+// error is non-nil if any subvolume was not deleted and wraps the first failure.
+func DeleteSubvolumes(paths []string, opts DeleteOptions) ([]DeleteResult, error) {
+	type node struct {
+		info *SubvolumeInfo
+		// before holds the indexes of the nodes that must be deleted first
+		before []int
+	}
+	results := make([]DeleteResult, len(paths))
+	nodes := make([]*node, len(paths))
+	byUUID := make(map[uuid.UUID]int, len(paths))
+	for i, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			results[i] = DeleteResult{Path: path, Err: err}
+			continue
+		}
+		results[i].Path = abs
+		info, err := GetSubvolumeInfo(abs)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		nodes[i] = &node{info: info}
+		byUUID[info.UUID] = i
+	}
+	for i, n := range nodes {
+		if n == nil {
+			continue
+		}
+		if parent, ok := byUUID[n.info.ParentUUID]; ok && parent != i {
+			nodes[parent].before = append(nodes[parent].before, i)
+		}
+		for j, other := range nodes {
+			if other != nil && j != i && strings.HasPrefix(results[i].Path, results[j].Path+"/") {
+				other.before = append(other.before, i)
+			}
+		}
+	}
+	done := make([]bool, len(paths))
+	for i, n := range nodes {
+		done[i] = n == nil
+	}
+	// Repeatedly delete the subvolumes whose dependants have all been handled
+	for progressed := true; progressed; {
+		progressed = false
+		for i, n := range nodes {
+			if done[i] {
+				continue
+			}
+			ready := true
+			var blocker string
+			for _, dep := range n.before {
+				if !done[dep] {
+					ready = false
+					break
+				}
+				if results[dep].Err != nil && blocker == "" {
+					blocker = results[dep].Path
+				}
+			}
+			if !ready {
+				continue
+			}
+			if blocker != "" {
+				results[i].Err = fmt.Errorf("not deleted because dependent subvolume %s was not deleted", blocker)
+			} else {
+				results[i].Err = DeleteSubvolumeWithOptions(results[i].Path, opts)
+			}
+			done[i] = true
+			progressed = true
+		}
+	}
+	// Anything left is part of a cycle in the parent UUIDs, which should not
+	// happen; delete it in the given order.
+	for i := range done {
+		if !done[i] {
+			results[i].Err = DeleteSubvolumeWithOptions(results[i].Path, opts)
+		}
+	}
+	var failed int
+	var first error
+	for _, r := range results {
+		if r.Err != nil {
+			if first == nil {
+				first = fmt.Errorf("%s: %w", r.Path, r.Err)
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("failed to delete %d of %d subvolumes: %w", failed, len(paths), first)
+	}
+	return results, nil
+}
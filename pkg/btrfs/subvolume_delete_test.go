@@ -0,0 +1,89 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs_test
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs/btrfstest"
+)
+
+// treeSearches returns the number of tree searches made through fake, which
+// need CAP_SYS_ADMIN.
+func treeSearches(fake *btrfstest.FakeIoctlRunner) int {
+	return len(fake.CallsFor(btrfs.BTRFS_IOC_TREE_SEARCH)) + len(fake.CallsFor(btrfs.BTRFS_IOC_TREE_SEARCH_V2))
+}
+
+func TestDeleteSubvolumeDoesNotSearch(t *testing.T) {
+	fake := btrfstest.NewFakeIoctlRunner()
+	defer fake.Install()()
+	dir := t.TempDir()
+	if err := btrfs.DeleteSubvolume(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	destroys := fake.CallsFor(btrfs.BTRFS_IOC_SNAP_DESTROY_V2)
+	if len(destroys) != 1 {
+		t.Fatalf("got %d destroy calls, want 1", len(destroys))
+	}
+	if name, err := destroys[0].StringField("Name"); err != nil || name != filepath.Base(dir) {
+		t.Errorf("destroyed %q, %v, want %q", name, err, filepath.Base(dir))
+	}
+	if n := treeSearches(fake); n != 0 {
+		t.Errorf("got %d tree searches, want none", n)
+	}
+}
+
+func TestDeleteSubvolumeNested(t *testing.T) {
+	fake := btrfstest.NewFakeIoctlRunner().
+		Reply(btrfs.BTRFS_IOC_SUBVOL_GETFLAGS, btrfstest.IoctlReply{Out: uint64(btrfs.SubvolReadOnly)}).
+		Reply(btrfs.BTRFS_IOC_SNAP_DESTROY_V2, btrfstest.IoctlReply{Err: syscall.ENOTEMPTY}).
+		// Unprivileged, so the nested subvolume cannot be named
+		Reply(btrfs.BTRFS_IOC_TREE_SEARCH, btrfstest.IoctlReply{Err: syscall.EPERM}).
+		Reply(btrfs.BTRFS_IOC_TREE_SEARCH_V2, btrfstest.IoctlReply{Err: syscall.EPERM})
+	defer fake.Install()()
+	err := btrfs.DeleteSubvolume(t.TempDir(), true)
+	if !errors.Is(err, btrfs.ErrNestedSubvolumes) {
+		t.Fatalf("error = %v, want %v", err, btrfs.ErrNestedSubvolumes)
+	}
+	// The subvolume was made read-write for the deletion and read-only again
+	setflags := fake.CallsFor(btrfs.BTRFS_IOC_SUBVOL_SETFLAGS)
+	if len(setflags) != 2 {
+		t.Fatalf("got %d setflags calls, want 2", len(setflags))
+	}
+	if flags := setflags[0].Data.(uint64); flags&btrfs.SubvolReadOnly != 0 {
+		t.Errorf("first setflags call kept the read-only flag: %#x", flags)
+	}
+	if flags := setflags[1].Data.(uint64); flags&btrfs.SubvolReadOnly == 0 {
+		t.Errorf("read-only flag not restored: %#x", flags)
+	}
+}
+
+func TestDeleteSubvolumeReadOnlyWithoutForce(t *testing.T) {
+	fake := btrfstest.NewFakeIoctlRunner().
+		Reply(btrfs.BTRFS_IOC_SUBVOL_GETFLAGS, btrfstest.IoctlReply{Out: uint64(btrfs.SubvolReadOnly)})
+	defer fake.Install()()
+	err := btrfs.DeleteSubvolume(t.TempDir(), false)
+	if !errors.Is(err, btrfs.ErrReadOnlySubvolume) {
+		t.Fatalf("error = %v, want %v", err, btrfs.ErrReadOnlySubvolume)
+	}
+	if n := len(fake.CallsFor(btrfs.BTRFS_IOC_SNAP_DESTROY_V2)); n != 0 {
+		t.Errorf("got %d destroy calls, want none", n)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// extentDataKey is the key type of file extent items in a subvolume tree.
+const extentDataKey SearchKey = 108
+
+// Offsets into the packed struct btrfs_file_extent_item.
+const (
+	fileExtentGenerationOffset = 0
+	fileExtentRAMBytesOffset   = 8
+	fileExtentTypeOffset       = 20
+	fileExtentDiskBytenrOffset = 21
+	fileExtentNumBytesOffset   = 45
+	fileExtentInlineHeaderSize = 21
+	fileExtentRegularItemSize  = 53
+	fileExtentTypeInline       = 0
+	fileExtentTypeRegular      = 1
+	fileExtentTypePreallocated = 2
+)
+
+// SubvolumeDiffSize returns an estimate of the number of file data bytes changed in
+// the subvolume at src since the subvolume at parent was last changed, which is
+// roughly the data an incremental send of src against parent transfers. It counts
+// the file extents of src written in a transaction after the ctransid of parent, in
+// the way `btrfs subvolume find-new` finds them. Unlike EstimateSendSize it does not
+// need quotas, but it does not account for metadata or deleted data. The parent
+// must be older than src, otherwise ErrInvalidParent is returned.
+func SubvolumeDiffSize(src, parent string) (uint64, error) {
+	srcVol, err := Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcVol.Close()
+	parentVol, err := Open(parent)
+	if err != nil {
+		return 0, err
+	}
+	defer parentVol.Close()
+	if err := checkSameFilesystem(srcVol.f, parentVol.f); err != nil {
+		return 0, err
+	}
+	srcInfo, err := srcVol.Info()
+	if err != nil {
+		return 0, err
+	}
+	parentInfo, err := parentVol.Info()
+	if err != nil {
+		return 0, err
+	}
+	if parentInfo.Ctransid >= srcInfo.Ctransid {
+		return 0, fmt.Errorf("%w: %s (ctransid %d) is not older than %s (ctransid %d)",
+			ErrInvalidParent, parent, parentInfo.Ctransid, src, srcInfo.Ctransid)
+	}
+	return changedExtentBytes(srcVol.Fd(), srcInfo.ID, parentInfo.Ctransid+1)
+}
+
+// changedExtentBytes sums the length of the file extents of the given tree that were
+// written in transaction minTransid or later. Holes are not counted.
+func changedExtentBytes(fd uintptr, treeID, minTransid uint64) (uint64, error) {
+	params := SearchParams{
+		Tree_id:      treeID,
+		Min_objectid: 0,
+		Max_objectid: math.MaxUint64,
+		Min_offset:   0,
+		Max_offset:   math.MaxUint64,
+		// The tree search filters on the generation of tree blocks, individual
+		// extents are filtered on their own generation below
+		Min_transid: minTransid,
+		Max_transid: math.MaxUint64,
+		Min_type:    uint32(extentDataKey),
+		Max_type:    uint32(extentDataKey),
+	}
+	var total uint64
+	err := walkBtrfsTreeV2Fd(fd, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if hdr.ItemType() != extentDataKey {
+			return nil
+		}
+		data := item.Data
+		if len(data) < fileExtentInlineHeaderSize {
+			return fmt.Errorf("file extent item of inode %d is too short: %d bytes", hdr.Objectid, len(data))
+		}
+		if binary.LittleEndian.Uint64(data[fileExtentGenerationOffset:]) < minTransid {
+			return nil
+		}
+		switch data[fileExtentTypeOffset] {
+		case fileExtentTypeInline:
+			total += binary.LittleEndian.Uint64(data[fileExtentRAMBytesOffset:])
+		case fileExtentTypeRegular:
+			if len(data) < fileExtentRegularItemSize {
+				return fmt.Errorf("file extent item of inode %d is too short: %d bytes", hdr.Objectid, len(data))
+			}
+			// A zero disk address marks a hole
+			if binary.LittleEndian.Uint64(data[fileExtentDiskBytenrOffset:]) != 0 {
+				total += binary.LittleEndian.Uint64(data[fileExtentNumBytesOffset:])
+			}
+		case fileExtentTypePreallocated:
+			// Preallocated extents are sent as fallocate commands without data
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to search file extents: %w", err)
+	}
+	return total, nil
+}
@@ -0,0 +1,114 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// FindSubvolumeByUUID returns the absolute path of the subvolume with the given UUID
+// on the filesystem mounted at mountpoint. ErrSubvolumeNotFound is returned if no
+// subvolume beneath mountpoint has the UUID.
+func FindSubvolumeByUUID(mountpoint string, id uuid.UUID) (string, error) {
+	return findSubvolumePath(mountpoint, func(info *SubvolumeInfo) bool {
+		return info.UUID == id
+	})
+}
+
+// FindSubvolumeByReceivedUUID returns the absolute path of the subvolume that was
+// received with the given UUID on the filesystem mounted at mountpoint.
+// ErrSubvolumeNotFound is returned if no subvolume beneath mountpoint has the
+// received UUID.
+func FindSubvolumeByReceivedUUID(mountpoint string, id uuid.UUID) (string, error) {
+	return findSubvolumePath(mountpoint, func(info *SubvolumeInfo) bool {
+		return info.ReceivedUUID == id
+	})
+}
+
+// FindReceivedSubvolume is like FindSubvolumeByReceivedUUID but only matches the
+// subvolume that was received at the given stransid, so that a subvolume received
+// from another state of the same source is never returned.
+func FindReceivedSubvolume(mountpoint string, id uuid.UUID, stransid uint64) (string, error) {
+	return findSubvolumePath(mountpoint, func(info *SubvolumeInfo) bool {
+		return info.ReceivedUUID == id && info.Stransid == stransid
+	})
+}
+
+// FindSubvolumes returns the subvolumes beneath mountpoint whose path relative to
+// mountpoint matches the glob pattern, using filepath.Match semantics. As with
+// filepath.Match, '*' does not match the path separator, so "backup-*" only matches
+// subvolumes directly beneath mountpoint. Subvolumes outside of the mounted
+// subvolume are never matched.
+func FindSubvolumes(mountpoint string, pattern string) ([]SubvolumeInfo, error) {
+	// Reject malformed patterns even if there is nothing to match against
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return findSubvolumes(mountpoint, func(path string) bool {
+		ok, _ := filepath.Match(pattern, path)
+		return ok
+	})
+}
+
+// FindSubvolumesRegexp is like FindSubvolumes but matches the path relative to
+// mountpoint against the regular expression re.
+func FindSubvolumesRegexp(mountpoint string, re *regexp.Regexp) ([]SubvolumeInfo, error) {
+	return findSubvolumes(mountpoint, re.MatchString)
+}
+
+func findSubvolumes(mountpoint string, match func(path string) bool) ([]SubvolumeInfo, error) {
+	subvols, err := ListSubvolumes(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	var out []SubvolumeInfo
+	for _, subvol := range subvols {
+		if strings.HasPrefix(subvol.Path, topLevelPathPrefix+"/") {
+			continue
+		}
+		if match(subvol.Path) {
+			out = append(out, subvol)
+		}
+	}
+	return out, nil
+}
+
+func findSubvolumePath(mountpoint string, match func(*SubvolumeInfo) bool) (string, error) {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	subvols, err := ListSubvolumes(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	for _, subvol := range subvols {
+		if !match(&subvol) {
+			continue
+		}
+		// Subvolumes outside of the mounted subvolume cannot be reached by path
+		if strings.HasPrefix(subvol.Path, topLevelPathPrefix+"/") {
+			continue
+		}
+		return filepath.Join(mountpoint, subvol.Path), nil
+	}
+	return "", fmt.Errorf("%w beneath %s", ErrSubvolumeNotFound, mountpoint)
+}
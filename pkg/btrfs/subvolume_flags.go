@@ -0,0 +1,96 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Subvolume flags known to the kernel, alongside SubvolReadOnly. Only
+// SubvolReadOnly can be read and changed with GetSubvolumeFlags and
+// SetSubvolumeFlags, the others are only meaningful in the volume arguments used
+// to create, snapshot and delete subvolumes.
+const (
+	// SubvolCreateAsync requested asynchronous snapshot creation. It is no longer
+	// supported by the kernel.
+	SubvolCreateAsync = 1 << 0
+	// SubvolQgroupInherit indicates that a qgroup inherit structure is passed
+	// when creating a subvolume or snapshot.
+	SubvolQgroupInherit = 1 << 2
+	// SubvolSpecByID identifies the subvolume to delete by its ID rather than by
+	// its name.
+	SubvolSpecByID = 1 << 4
+)
+
+// GetSubvolumeFlags returns the flags of the subvolume at the given path as
+// reported by BTRFS_IOC_SUBVOL_GETFLAGS.
+func GetSubvolumeFlags(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := assertBtrfs(path); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return getSubvolumeFlagsFd(f.Fd())
+}
+
+// SetSubvolumeFlags replaces the flags of the subvolume at the given path with
+// flags in a single BTRFS_IOC_SUBVOL_SETFLAGS call. The kernel rejects flags it does
+// not support changing.
+func SetSubvolumeFlags(path string, flags uint64) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := assertBtrfs(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return setSubvolumeFlagsFd(f.Fd(), flags)
+}
+
+// Flags returns the flags of the subvolume. See GetSubvolumeFlags.
+func (s *Subvolume) Flags() (uint64, error) {
+	return getSubvolumeFlagsFd(s.f.Fd())
+}
+
+// SetFlags replaces the flags of the subvolume. See SetSubvolumeFlags.
+func (s *Subvolume) SetFlags(flags uint64) error {
+	return setSubvolumeFlagsFd(s.f.Fd(), flags)
+}
+
+func getSubvolumeFlagsFd(fd uintptr) (uint64, error) {
+	var flags uint64
+	if err := ioctlUint64(fd, BTRFS_IOC_SUBVOL_GETFLAGS, &flags); err != nil {
+		return 0, err
+	}
+	return flags, nil
+}
+
+func setSubvolumeFlagsFd(fd uintptr, flags uint64) error {
+	return ioctlUint64(fd, BTRFS_IOC_SUBVOL_SETFLAGS, &flags)
+}
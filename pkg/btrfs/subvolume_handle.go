@@ -0,0 +1,212 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/google/uuid"
+)
+
+// Subvolume is an open handle to a subvolume. Operations on the handle use the
+// open file descriptor rather than resolving the path again, so they keep
+// referring to the same subvolume even if its path changes.
+type Subvolume struct {
+	f    *os.File
+	path string
+}
+
+// Open opens the subvolume at path. The path must be the root of a subvolume,
+// otherwise ErrNotASubvolume is returned. The handle must be closed with Close.
+func Open(path string) (*Subvolume, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSubvolumeRootFd(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Subvolume{f: f, path: path}, nil
+}
+
+// OpenAndInfo opens the subvolume at path like Open and returns the handle together
+// with the information of the subvolume. The information is queried through the
+// opened file descriptor, so it describes the same subvolume the handle refers to.
+func OpenAndInfo(path string) (*Subvolume, *SubvolumeInfo, error) {
+	s, err := Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := s.Info()
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return s, info, nil
+}
+
+// checkSubvolumeRootFd returns ErrNotASubvolume unless f is the root directory of
+// a subvolume on a btrfs filesystem.
+func checkSubvolumeRootFd(f *os.File) error {
+	var statfs syscall.Statfs_t
+	if err := runner.Fstatfs(f.Fd(), &statfs); err != nil {
+		return &os.PathError{Op: "fstatfs", Path: f.Name(), Err: err}
+	}
+	if uint32(statfs.Type) != BTRFS_SUPER_MAGIC {
+		return fmt.Errorf("%w: %s is not on a btrfs filesystem", ErrNotASubvolume, f.Name())
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return &os.PathError{Op: "fstat", Path: f.Name(), Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR || st.Ino != uint64(FirstFreeObjectID) {
+		return fmt.Errorf("%w: %s", ErrNotASubvolume, f.Name())
+	}
+	return nil
+}
+
+// Path returns the absolute path the subvolume was opened with.
+func (s *Subvolume) Path() string {
+	return s.path
+}
+
+// Fd returns the file descriptor of the open subvolume.
+func (s *Subvolume) Fd() uintptr {
+	return s.f.Fd()
+}
+
+// Close closes the handle.
+func (s *Subvolume) Close() error {
+	return s.f.Close()
+}
+
+// IsReadOnly returns true if the subvolume is read-only.
+func (s *Subvolume) IsReadOnly() (bool, error) {
+	return isSubvolumeReadOnlyFd(s.f.Fd())
+}
+
+// SetReadOnly sets the read-only status of the subvolume to readonly.
+func (s *Subvolume) SetReadOnly(readonly bool) error {
+	return setSubvolumeReadOnlyFd(s.f.Fd(), readonly)
+}
+
+// SetReceived sets the received UUID and ctransid of the subvolume. The subvolume
+// must be read-write; see SetReceivedSubvolume.
+func (s *Subvolume) SetReceived(id uuid.UUID, ctransid uint64) error {
+	return setReceivedSubvolumeFd(s.f.Fd(), id, ctransid)
+}
+
+// Info returns information about the subvolume.
+func (s *Subvolume) Info() (*SubvolumeInfo, error) {
+	return getSubvolumeInfoFd(s.f.Fd())
+}
+
+// Snapshot creates a snapshot of the subvolume at the path dest. If readonly is
+// true the snapshot is created read-only.
+func (s *Subvolume) Snapshot(dest string, readonly bool) error {
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	topdir := filepath.Dir(dest)
+	if err := os.MkdirAll(topdir, 0755); err != nil {
+		return err
+	}
+	parent, err := os.OpenFile(topdir, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	args := &volumeArgsV2{
+		Fd:   int64(s.f.Fd()),
+		Name: toSnapInt8Array(filepath.Base(dest)),
+	}
+	if readonly {
+		args.Flags |= SubvolReadOnly
+	}
+	if err := callWriteIoctl(parent.Fd(), BTRFS_IOC_SNAP_CREATE_V2, args); err != nil {
+		return err
+	}
+	metrics.Count(MetricSnapshotsCreated, 1)
+	return nil
+}
+
+// Send sends the subvolume to w, which must be read-only. See SendSubvolume for
+// the meaning of parent, cloneSources and opts.
+func (s *Subvolume) Send(parent string, cloneSources []string, w io.Writer, opts ...SendOption) error {
+	readonly, err := s.IsReadOnly()
+	if err != nil {
+		return err
+	}
+	if !readonly {
+		return fmt.Errorf("%w: %s must be read-only to send", ErrNotReadOnlySubvolume, s.path)
+	}
+	sendOpts := append([]SendOption{SendToWriter(w), sendFromFile(s.f)}, incrementalOptions(parent, cloneSources)...)
+	return Send(s.path, append(sendOpts, opts...)...)
+}
+
+// Delete deletes the subvolume with the given options and closes the handle. The
+// subvolume is deleted by its path, so ErrSubvolumeNotFound is returned if the
+// path no longer refers to the opened subvolume.
+func (s *Subvolume) Delete(opts DeleteOptions) error {
+	if err := s.checkPath(); err != nil {
+		return err
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return DeleteSubvolumeWithOptions(s.path, opts)
+}
+
+// checkPath verifies that the path of the handle still refers to the opened
+// subvolume.
+func (s *Subvolume) checkPath() error {
+	want, err := lookupRootIDFromFd(s.f.Fd())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	got, err := lookupRootIDFromFd(f.Fd())
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s no longer refers to subvolume %d", ErrSubvolumeNotFound, s.path, want)
+	}
+	return nil
+}
+
+// sendFromFile sends from an already open subvolume instead of opening the
+// source path.
+func sendFromFile(f *os.File) SendOption {
+	return func(ctx *sendCtx) error {
+		ctx.sourceFile = f
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SubvolumeInfo contains information about a subvolume as returned by the
+// BTRFS_IOC_GET_SUBVOL_INFO ioctl.
+type SubvolumeInfo struct {
+	// The ID of the subvolume
+	ID uint64
+	// The ID of the subvolume containing this one
+	ParentID uint64
+	// The inode of the directory containing this subvolume in its parent
+	DirID uint64
+	// The name of the subvolume
+	Name string
+	// The path of the subvolume relative to the mountpoint. Only populated
+	// by ListSubvolumes.
+	Path string
+	// The UUID of the subvolume
+	UUID uuid.UUID
+	// The UUID of the subvolume this one was snapshotted from, if any
+	ParentUUID uuid.UUID
+	// The UUID of the subvolume this one was received from, if any
+	ReceivedUUID uuid.UUID
+	// The generation of the subvolume
+	Generation uint64
+	// The transid of the last change to the subvolume. Transids are filesystem
+	// generation numbers, not timestamps; use Ctime for the wall-clock time.
+	Ctransid uint64
+	// The transid when the subvolume was created. See CreationTime for the
+	// wall-clock time.
+	Otransid uint64
+	// The transid of the send the subvolume was received from
+	Stransid uint64
+	// The transid when the subvolume was received
+	Rtransid uint64
+	// The time of the last change to the subvolume
+	Ctime time.Time
+	// The time the subvolume was created
+	Otime time.Time
+	// The time of the send the subvolume was received from
+	Stime time.Time
+	// The time the subvolume was received
+	Rtime time.Time
+	// Whether the subvolume is read-only
+	ReadOnly bool
+}
+
+// GetSubvolumeInfo returns information about the subvolume at the given path.
+func GetSubvolumeInfo(path string) (*SubvolumeInfo, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertBtrfs(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return getSubvolumeInfoFd(f.Fd())
+}
+
+func getSubvolumeInfoFd(fd uintptr) (*SubvolumeInfo, error) {
+	args := &getSubvolumeInfoArgs{}
+	if err := callReadIoctl(fd, BTRFS_IOC_GET_SUBVOL_INFO, args); err != nil {
+		return nil, err
+	}
+	return subvolumeInfoFromArgs(args), nil
+}
+
+func subvolumeInfoFromArgs(args *getSubvolumeInfoArgs) *SubvolumeInfo {
+	return &SubvolumeInfo{
+		ID:           args.Treeid,
+		ParentID:     args.Parent_id,
+		DirID:        args.Dirid,
+		Name:         int8ArrayToString(args.Name[:]),
+		UUID:         uuid.UUID(args.Uuid),
+		ParentUUID:   uuid.UUID(args.Parent_uuid),
+		ReceivedUUID: uuid.UUID(args.Received_uuid),
+		Generation:   args.Generation,
+		Ctransid:     args.Ctransid,
+		Otransid:     args.Otransid,
+		Stransid:     args.Stransid,
+		Rtransid:     args.Rtransid,
+		Ctime:        args.Ctime.Time(),
+		Otime:        args.Otime.Time(),
+		Stime:        args.Stime.Time(),
+		Rtime:        args.Rtime.Time(),
+		ReadOnly:     args.Flags&SubvolReadOnly != 0,
+	}
+}
+
+// CreationTime returns the time the subvolume was created, with nanosecond
+// precision. It is the zero time if the kernel did not record one.
+func (s SubvolumeInfo) CreationTime() time.Time {
+	return s.Otime
+}
+
+// ChangeTime returns the time of the last change to the subvolume, with
+// nanosecond precision.
+func (s SubvolumeInfo) ChangeTime() time.Time {
+	return s.Ctime
+}
+
+// Time converts a btrfs timespec to a time.Time. An all-zero timespec is
+// returned as the zero time so that unset timestamps can be detected with IsZero.
+func (t timespec) Time() time.Time {
+	if t.Sec == 0 && t.Nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t.Sec), int64(t.Nsec))
+}
@@ -0,0 +1,327 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// rootSubvolReadOnly is the read-only flag as stored in a root item. This differs
+// from the SubvolReadOnly flag used with the subvolume flags ioctls.
+const rootSubvolReadOnly = 1 << 0
+
+// topLevelPathPrefix is prepended to subvolume paths that are not beneath the
+// subvolume mounted at the mountpoint, mirroring `btrfs subvolume list -a`.
+const topLevelPathPrefix = "<FS_TREE>"
+
+// ListSubvolumes returns information about all subvolumes on the filesystem mounted
+// at the given mountpoint. The top-level subvolume (ID 5) is not included in the
+// results. Paths are relative to the subvolume mounted at mountpoint. Subvolumes
+// outside of it are prefixed with "<FS_TREE>/" and are relative to the top-level
+// subvolume instead. Results are ordered by subvolume ID.
+func ListSubvolumes(mountpoint string) ([]SubvolumeInfo, error) {
+	out := make([]SubvolumeInfo, 0)
+	err := WalkSubvolumes(mountpoint, func(info SubvolumeInfo) error {
+		out = append(out, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WalkSubvolumes calls fn for each subvolume on the filesystem mounted at the given
+// mountpoint, in order of subvolume ID, as the results of the tree search are read.
+// Subvolumes are described as by ListSubvolumes, but are not collected in memory.
+// If fn returns ErrStopWalk the walk stops and nil is returned, any other error
+// stops the walk and is returned.
+func WalkSubvolumes(mountpoint string, fn func(SubvolumeInfo) error) error {
+	return walkSubvolumes(mountpoint, uint64(FirstFreeObjectID), uint64(LastFreeObjectID), fn)
+}
+
+// GetSubvolumeInfoByID returns information about the subvolume with the given ID on
+// the filesystem mounted at mountpoint, described as by ListSubvolumes, without
+// needing a path to it. BTRFS_IOC_GET_SUBVOL_INFO only describes the subvolume of
+// the file descriptor it is called on, so the root tree is searched for the
+// subvolume instead, which requires CAP_SYS_ADMIN. ErrSubvolumeNotFound is returned
+// if there is no such subvolume, including for deleted subvolumes and the
+// top-level subvolume.
+func GetSubvolumeInfoByID(mountpoint string, id uint64) (*SubvolumeInfo, error) {
+	var found *SubvolumeInfo
+	err := walkSubvolumes(mountpoint, id, id, func(info SubvolumeInfo) error {
+		found = &info
+		return ErrStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no subvolume with ID %d", ErrSubvolumeNotFound, id)
+	}
+	return found, nil
+}
+
+// walkSubvolumes is WalkSubvolumes limited to the subvolumes with IDs from minID
+// to maxID.
+func walkSubvolumes(mountpoint string, minID, maxID uint64, fn func(SubvolumeInfo) error) error {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+	if err := assertBtrfs(mountpoint); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mountID, err := lookupRootIDFromFd(f.Fd())
+	if err != nil {
+		return fmt.Errorf("failed to find root id: %w", err)
+	}
+	resolver := &subvolumePathResolver{fd: f.Fd(), paths: make(map[uint64]string)}
+	var mountPath string
+	if mountID != uint64(FSTreeObjectID) {
+		if mountPath, err = resolver.resolveID(mountID); err != nil {
+			return fmt.Errorf("failed to resolve path of mounted subvolume: %w", err)
+		}
+	}
+	params := SearchParams{
+		Tree_id:      uint64(RootTreeObjectID),
+		Min_objectid: minID,
+		Max_objectid: maxID,
+		Min_offset:   0,
+		Max_offset:   math.MaxUint64,
+		Min_transid:  0,
+		Max_transid:  math.MaxUint64,
+		Min_type:     uint32(RootItemKey),
+		Max_type:     uint32(RootBackrefKey),
+	}
+	// Items are returned ordered by objectid, with the root item before its back
+	// reference, so a subvolume is complete once an item of the next one is seen.
+	var cur *SubvolumeInfo
+	var fnErr error
+	flush := func() error {
+		info := cur
+		cur = nil
+		// Subvolumes without a back reference are deleted and awaiting cleanup
+		if info == nil || info.ParentID == 0 {
+			return nil
+		}
+		p, err := resolver.resolve(info.ID, info.ParentID, info.DirID, info.Name)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path of subvolume %d: %w", info.ID, err)
+		}
+		info.Path = relativeSubvolumePath(mountPath, p)
+		return fn(*info)
+	}
+	err = walkBtrfsTreeV2Fd(f.Fd(), params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if cur != nil && cur.ID != hdr.Objectid {
+			if fnErr = flush(); fnErr != nil {
+				return ErrStopWalk
+			}
+		}
+		if cur == nil {
+			cur = &SubvolumeInfo{ID: hdr.Objectid}
+		}
+		switch hdr.ItemType() {
+		case RootItemKey:
+			rootItem, err := item.RootItem()
+			if err != nil {
+				return fmt.Errorf("failed to decode root item: %w", err)
+			}
+			cur.UUID = uuid.UUID(rootItem.Uuid)
+			cur.ParentUUID = uuid.UUID(rootItem.Parent_uuid)
+			cur.ReceivedUUID = uuid.UUID(rootItem.Received_uuid)
+			cur.Generation = rootItem.Generation
+			cur.Ctransid = rootItem.Ctransid
+			cur.Otransid = rootItem.Otransid
+			cur.Stransid = rootItem.Stransid
+			cur.Rtransid = rootItem.Rtransid
+			cur.Ctime = rootItem.Ctime.Time()
+			cur.Otime = rootItem.Otime.Time()
+			cur.Stime = rootItem.Stime.Time()
+			cur.Rtime = rootItem.Rtime.Time()
+			cur.ReadOnly = rootItem.Flags&rootSubvolReadOnly != 0
+		case RootBackrefKey:
+			ref, name, err := item.RootRef()
+			if err != nil {
+				return fmt.Errorf("failed to decode root ref: %w", err)
+			}
+			cur.ParentID = hdr.Offset
+			cur.DirID = ref.Dirid
+			cur.Name = name
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk root tree: %w", err)
+	}
+	if fnErr == nil {
+		fnErr = flush()
+	}
+	if errors.Is(fnErr, ErrStopWalk) {
+		return nil
+	}
+	return fnErr
+}
+
+// subvolumePathResolver resolves and caches the paths of subvolumes relative to the
+// top-level subvolume. Only paths are cached, the back references of parents that
+// have not been seen yet are looked up on demand.
+type subvolumePathResolver struct {
+	fd    uintptr
+	paths map[uint64]string
+}
+
+// resolve returns the path of the subvolume with the given back reference.
+func (r *subvolumePathResolver) resolve(id, parentID, dirID uint64, name string) (string, error) {
+	return r.resolveRef(id, parentID, dirID, name, make(map[uint64]bool))
+}
+
+// resolveID returns the path of the subvolume with the given ID, looking up its
+// back reference.
+func (r *subvolumePathResolver) resolveID(id uint64) (string, error) {
+	return r.resolveIDVisiting(id, make(map[uint64]bool))
+}
+
+func (r *subvolumePathResolver) resolveIDVisiting(id uint64, visiting map[uint64]bool) (string, error) {
+	if p, ok := r.paths[id]; ok {
+		return p, nil
+	}
+	parentID, dirID, name, err := lookupRootBackref(r.fd, id)
+	if err != nil {
+		return "", err
+	}
+	return r.resolveRef(id, parentID, dirID, name, visiting)
+}
+
+func (r *subvolumePathResolver) resolveRef(id, parentID, dirID uint64, name string, visiting map[uint64]bool) (string, error) {
+	if p, ok := r.paths[id]; ok {
+		return p, nil
+	}
+	if visiting[id] {
+		return "", fmt.Errorf("subvolume %d has a cyclic parent reference", id)
+	}
+	visiting[id] = true
+	dir, err := lookupDirPath(r.fd, parentID, dirID)
+	if err != nil {
+		return "", err
+	}
+	p := path.Join(dir, name)
+	if parentID != uint64(FSTreeObjectID) {
+		parentPath, err := r.resolveIDVisiting(parentID, visiting)
+		if err != nil {
+			return "", fmt.Errorf("parent %d of subvolume %d: %w", parentID, id, err)
+		}
+		p = path.Join(parentPath, p)
+	}
+	r.paths[id] = p
+	return p, nil
+}
+
+// lookupRootBackref returns the parent, directory and name of the subvolume with
+// the given ID from its back reference in the root tree.
+func lookupRootBackref(fd uintptr, id uint64) (parentID, dirID uint64, name string, err error) {
+	params := SearchParams{
+		Tree_id:      uint64(RootTreeObjectID),
+		Min_objectid: id,
+		Max_objectid: id,
+		Min_offset:   0,
+		Max_offset:   math.MaxUint64,
+		Min_transid:  0,
+		Max_transid:  math.MaxUint64,
+		Min_type:     uint32(RootBackrefKey),
+		Max_type:     uint32(RootBackrefKey),
+	}
+	found := false
+	err = walkBtrfsTreeV2Fd(fd, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		ref, refName, err := item.RootRef()
+		if err != nil {
+			return fmt.Errorf("failed to decode root ref: %w", err)
+		}
+		parentID, dirID, name, found = hdr.Offset, ref.Dirid, refName, true
+		return ErrStopWalk
+	})
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if !found {
+		return 0, 0, "", fmt.Errorf("back reference of subvolume %d: %w", id, ErrNotFound)
+	}
+	return parentID, dirID, name, nil
+}
+
+// ListSnapshotsOf returns the read-only snapshots of the subvolume with the given UUID
+// on the filesystem mounted at mountpoint, oldest first by ctransid. Only direct
+// snapshots of the source are returned, not snapshots of those snapshots.
+func ListSnapshotsOf(mountpoint string, sourceUUID uuid.UUID) ([]SubvolumeInfo, error) {
+	if sourceUUID == uuid.Nil {
+		return nil, ErrInvalidUUID
+	}
+	subvols, err := ListSubvolumes(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	var out []SubvolumeInfo
+	for _, info := range subvols {
+		if info.ParentUUID == sourceUUID && info.ReadOnly {
+			out = append(out, info)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Ctransid < out[j].Ctransid })
+	return out, nil
+}
+
+// lookupDirPath returns the path of the directory with the given inode inside
+// the given tree, relative to the root of that tree.
+func lookupDirPath(fd uintptr, treeID, dirID uint64) (string, error) {
+	args := &inoLookupArgs{
+		Treeid:   treeID,
+		Objectid: dirID,
+	}
+	if err := callWriteIoctl(fd, BTRFS_IOC_INO_LOOKUP, args); err != nil {
+		return "", fmt.Errorf("failed to lookup inode path: %w", err)
+	}
+	return strings.TrimSuffix(stringFromLookupArgsName(args.Name), "/"), nil
+}
+
+func relativeSubvolumePath(mountPath, toplevelPath string) string {
+	if mountPath == "" {
+		return toplevelPath
+	}
+	if strings.HasPrefix(toplevelPath, mountPath+"/") {
+		return strings.TrimPrefix(toplevelPath, mountPath+"/")
+	}
+	return path.Join(topLevelPathPrefix, toplevelPath)
+}
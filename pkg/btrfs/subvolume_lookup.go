@@ -16,12 +16,36 @@ If not, see <https://www.gnu.org/licenses/>.
 package btrfs
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"strings"
+	"syscall"
 )
 
+// InodeToPath returns the path of the inode with the given number inside the
+// subvolume with the given ID, relative to the root of that subvolume. The
+// mountpoint can be any path on the filesystem; a subvolume ID of zero means the
+// subvolume containing mountpoint. For inodes with several hard links the first one
+// found is returned, and the root directory of the subvolume resolves to "". If
+// there is no such inode the error matches ErrNotFound.
+func InodeToPath(mountpoint string, subvolID uint64, inode uint64) (string, error) {
+	f, err := openBtrfs(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if inode == uint64(FirstFreeObjectID) {
+		return "", nil
+	}
+	path, err := lookupDirPath(f.Fd(), subvolID, inode)
+	if errors.Is(err, syscall.ENOENT) {
+		return "", fmt.Errorf("%w: inode %d in subvolume %d: %s", ErrNotFound, inode, subvolID, err)
+	}
+	return path, err
+}
+
 func lookupInoPath(fd uintptr, info *RootInfo) (path string, err error) {
 	var args inoLookupArgs
 	args.Treeid = uint64(info.RefTree)
@@ -69,7 +93,7 @@ func lookupRootItem(path string, rootID uint64) (*BtrfsRootItem, error) {
 		return nil
 	})
 	if found == nil {
-		err = fmt.Errorf("failed to find root item %s (%d): %w", path, rootID, ErrNotFound)
+		err = fmt.Errorf("failed to find root item %s (%d): %w", path, rootID, ErrSubvolumeNotFound)
 	}
 	return found, err
 }
@@ -137,6 +161,10 @@ func lookupRootIDFromFd(fd uintptr) (uint64, error) {
 }
 
 func stringFromLookupArgsName(bb [4080]int8) string {
+	return int8ArrayToString(bb[:])
+}
+
+func int8ArrayToString(bb []int8) string {
 	var sb strings.Builder
 	for _, b := range bb {
 		if b == 0 {
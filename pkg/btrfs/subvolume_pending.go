@@ -0,0 +1,58 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"math"
+)
+
+// orphanItemKey is the key type of the orphan items recording deleted subvolumes
+// whose cleanup has not finished yet.
+const orphanItemKey SearchKey = 48
+
+// ListPendingDeletions returns the IDs of the subvolumes on the filesystem mounted
+// at mountpoint that have been deleted but are still being cleaned up. The space of
+// such subvolumes is only given back as the cleaner frees their extents, which is
+// why usage reported by GetSpaceInfo or df can stay unchanged for a while after a
+// large delete. The subvolumes no longer have paths, so only their IDs are
+// returned, in ascending order. Searching the root tree requires CAP_SYS_ADMIN.
+func ListPendingDeletions(mountpoint string) ([]uint64, error) {
+	// Every deleted subvolume has an orphan item in the root tree keyed by the
+	// orphan object ID and the ID of the subvolume, removed once cleanup completes
+	params := SearchParams{
+		Tree_id:      uint64(RootTreeObjectID),
+		Min_objectid: uint64(OrphanObjectID),
+		Max_objectid: uint64(OrphanObjectID),
+		Min_type:     uint32(orphanItemKey),
+		Max_type:     uint32(orphanItemKey),
+		Max_offset:   math.MaxUint64,
+		Max_transid:  math.MaxUint64,
+	}
+	ids := make([]uint64, 0)
+	err := WalkBtrfsTree(mountpoint, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if hdr.Objectid == uint64(OrphanObjectID) && hdr.Type == uint32(orphanItemKey) {
+			ids = append(ids, hdr.Offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,189 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ListIncompleteReceives returns the subvolumes beneath the receive directory dir
+// that look like interrupted receives: they are writable and have no received UUID.
+// A receive only sets the received UUID and the read-only flag once the stream has
+// been applied completely. The returned paths are relative to dir. Since every
+// writable subvolume that was not received matches as well, dir should only contain
+// received subvolumes.
+func ListIncompleteReceives(dir string) ([]SubvolumeInfo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := pathInSubvolume(dir)
+	if err != nil {
+		return nil, err
+	}
+	subvols, err := ListSubvolumes(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []SubvolumeInfo
+	for _, info := range subvols {
+		if strings.HasPrefix(info.Path, topLevelPathPrefix+"/") {
+			continue
+		}
+		rel := info.Path
+		if prefix != "" {
+			if !strings.HasPrefix(rel, prefix+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(rel, prefix+"/")
+		}
+		if info.ReadOnly || info.ReceivedUUID != uuid.Nil {
+			continue
+		}
+		info.Path = rel
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// IsReceiveComplete returns true if the subvolume at path has a received UUID set,
+// which happens once a receive into it has finished.
+func IsReceiveComplete(path string) (bool, error) {
+	info, err := GetSubvolumeInfo(path)
+	if err != nil {
+		return false, err
+	}
+	return info.ReceivedUUID != uuid.Nil, nil
+}
+
+// pathInSubvolume returns the path of the directory dir relative to the root of the
+// subvolume containing it. It is empty if dir is the root of a subvolume.
+func pathInSubvolume(dir string) (string, error) {
+	f, err := os.OpenFile(dir, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("cannot determine inode of %s", dir)
+	}
+	if sys.Ino == uint64(FirstFreeObjectID) {
+		return "", nil
+	}
+	rootID, err := lookupRootIDFromFd(f.Fd())
+	if err != nil {
+		return "", err
+	}
+	return lookupDirPath(f.Fd(), rootID, sys.Ino)
+}
+
+// ReceivedSubvolume is the received state the kernel stores for a subvolume.
+type ReceivedSubvolume struct {
+	// UUID is the UUID of the subvolume this one was received from.
+	UUID uuid.UUID
+	// Stransid is the ctransid of the sent subvolume.
+	Stransid uint64
+	// Stime is the time the subvolume was sent.
+	Stime time.Time
+	// Rtransid is the transid in which the subvolume was received. It is set by the
+	// kernel and ignored by SetReceivedSubvolumeState.
+	Rtransid uint64
+	// Rtime is the time the subvolume was received. It is set by the kernel and
+	// ignored by SetReceivedSubvolumeState.
+	Rtime time.Time
+	// Flags are passed to the kernel as is. No flags are currently defined and the
+	// kernel does not store them, so they always read back as zero.
+	Flags uint64
+}
+
+// GetReceivedSubvolume returns the received UUID and ctransid of the subvolume at
+// path, as set by SetReceivedSubvolume. The UUID is uuid.Nil if the subvolume was not
+// received.
+func GetReceivedSubvolume(path string) (uuid.UUID, uint64, error) {
+	info, err := GetSubvolumeInfo(path)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	return info.ReceivedUUID, info.Stransid, nil
+}
+
+// GetReceivedSubvolumeState returns the full received state of the subvolume at path.
+func GetReceivedSubvolumeState(path string) (*ReceivedSubvolume, error) {
+	info, err := GetSubvolumeInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReceivedSubvolume{
+		UUID:     info.ReceivedUUID,
+		Stransid: info.Stransid,
+		Stime:    info.Stime,
+		Rtransid: info.Rtransid,
+		Rtime:    info.Rtime,
+	}, nil
+}
+
+// SetReceivedSubvolumeState is like SetReceivedSubvolume but also sets the send time
+// and flags, so that a received state read with GetReceivedSubvolumeState can be
+// restored on another host. The subvolume must be read-write. The state stored by
+// the kernel is returned, including the receive transid and time it assigned.
+func SetReceivedSubvolumeState(path string, state ReceivedSubvolume) (*ReceivedSubvolume, error) {
+	if err := assertBtrfs(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	args := &receivedSubvolArgs{
+		Uuid:     uuidToInt8Array(state.UUID),
+		Stransid: state.Stransid,
+		Stime:    timespecFromTime(state.Stime),
+		Flags:    state.Flags,
+	}
+	if err := callWriteIoctl(f.Fd(), BTRFS_IOC_SET_RECEIVED_SUBVOL, args); err != nil {
+		return nil, err
+	}
+	return &ReceivedSubvolume{
+		UUID:     int8ArrayToUUID(args.Uuid),
+		Stransid: args.Stransid,
+		Stime:    args.Stime.Time(),
+		Rtransid: args.Rtransid,
+		Rtime:    args.Rtime.Time(),
+		Flags:    args.Flags,
+	}, nil
+}
+
+// timespecFromTime converts a time.Time to a btrfs timespec. The zero time is
+// converted to an all-zero timespec.
+func timespecFromTime(t time.Time) timespec {
+	if t.IsZero() {
+		return timespec{}
+	}
+	return timespec{Sec: uint64(t.Unix()), Nsec: uint32(t.Nanosecond())}
+}
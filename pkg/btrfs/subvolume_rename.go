@@ -0,0 +1,141 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrExchangeNotSupported is returned by SwapSubvolumes when the kernel does not
+// support exchanging two paths atomically.
+var ErrExchangeNotSupported = errors.New("atomic exchange of paths is not supported by the kernel")
+
+// RenameSubvolume moves the subvolume at oldPath to newPath. The parent directory of
+// newPath must exist and be on the same btrfs filesystem, otherwise ErrCrossDevice is
+// returned. An existing file, directory or subvolume at newPath is never replaced.
+func RenameSubvolume(oldPath, newPath string) error {
+	oldPath, err := filepath.Abs(oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = filepath.Abs(newPath)
+	if err != nil {
+		return err
+	}
+	ok, err := IsSubvolumeRoot(oldPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotASubvolume, oldPath)
+	}
+	newParent := filepath.Dir(newPath)
+	st, err := os.Stat(newParent)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", newParent)
+	}
+	if err := assertBtrfs(oldPath); err != nil {
+		return err
+	}
+	src, err := os.OpenFile(oldPath, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(newParent, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := checkSameFilesystem(src, dst); err != nil {
+		return err
+	}
+	// RENAME_NOREPLACE makes the existence check atomic with the rename
+	if err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE); err != nil {
+		switch {
+		case errors.Is(err, syscall.EXDEV):
+			return fmt.Errorf("%w: %s and %s", ErrCrossDevice, oldPath, newPath)
+		case errors.Is(err, syscall.EEXIST):
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrExist}
+		}
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// SwapSubvolumes atomically exchanges the subvolumes at a and b, so that each path
+// refers to the other subvolume afterwards, for instance to promote a restored
+// subvolume in place of a live one. Both must be subvolume roots on the same btrfs
+// filesystem and neither may contain the other. The exchange is made with a single
+// renameat2 call with RENAME_EXCHANGE, so there is no moment at which either path
+// is missing. ErrExchangeNotSupported is returned if the kernel lacks support for it.
+func SwapSubvolumes(a, b string) error {
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return err
+	}
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{a, b} {
+		ok, err := IsSubvolumeRoot(p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotASubvolume, p)
+		}
+	}
+	if a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/") {
+		return fmt.Errorf("cannot swap %s and %s: one contains the other", a, b)
+	}
+	fa, err := os.OpenFile(a, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+	fb, err := os.OpenFile(b, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer fb.Close()
+	if err := checkSameFilesystem(fa, fb); err != nil {
+		return err
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE); err != nil {
+		switch {
+		case errors.Is(err, syscall.ENOSYS), errors.Is(err, syscall.EINVAL):
+			// Kernels without renameat2 return ENOSYS, and EINVAL is returned when
+			// the flag is not supported
+			return fmt.Errorf("%w: %s", ErrExchangeNotSupported, err)
+		case errors.Is(err, syscall.EXDEV):
+			return fmt.Errorf("%w: %s and %s", ErrCrossDevice, a, b)
+		}
+		return &os.LinkError{Op: "exchange", Old: a, New: b, Err: err}
+	}
+	return nil
+}
@@ -25,6 +25,9 @@ import (
 // BuildRBTree builds a red-black tree from the subvolume root tree. Colors are
 // currently not assigned as they are not needed for the current implementation.
 func BuildRBTree(path string) (*RBRoot, error) {
+	if err := assertBtrfs(path); err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return nil, err
@@ -117,7 +117,7 @@ func SubvolumeSearch(opts ...SearchOption) (*RootInfo, error) {
 			f, err = os.OpenFile(ctx.path, os.O_RDONLY, os.ModeDir)
 			if err != nil {
 				if os.IsNotExist(err) {
-					return nil, fmt.Errorf("%w: path %q does not exist", ErrNotFound, ctx.path)
+					return nil, fmt.Errorf("%w: path %q does not exist", ErrSubvolumeNotFound, ctx.path)
 				}
 				return nil, err
 			}
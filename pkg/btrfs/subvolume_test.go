@@ -0,0 +1,41 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestInt8ArrayUUIDRoundTrip(t *testing.T) {
+	for _, uu := range []uuid.UUID{
+		uuid.Nil,
+		uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+		// Bytes above 0x7f are negative as int8
+		uuid.MustParse("ffffffff-ffff-ffff-ffff-ffffffffffff"),
+		uuid.MustParse("7f80817e-fe01-4c3d-9a2b-8badf00dcafe"),
+	} {
+		arr := uuidToInt8Array(uu)
+		if got := int8ArrayToUUID(arr); got != uu {
+			t.Errorf("round trip of %s gave %s", uu, got)
+		}
+	}
+	arr := [16]int8{-1, -128, 127, 0}
+	if got := uuidToInt8Array(int8ArrayToUUID(arr)); got != arr {
+		t.Errorf("round trip of %v gave %v", arr, got)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// SubvolumeUsage describes the space used by a subvolume, as reported by
+// SubvolumeUsageReport.
+type SubvolumeUsage struct {
+	// ID is the ID of the subvolume.
+	ID uint64
+	// Path is the path of the subvolume as returned by ListSubvolumes.
+	Path string
+	// Created is the wall-clock creation time of the subvolume.
+	Created time.Time
+	// ReadOnly is true if the subvolume is read-only.
+	ReadOnly bool
+	// Referenced is the number of bytes referenced by the subvolume, including data
+	// shared with other subvolumes.
+	Referenced uint64
+	// Exclusive is the number of bytes referenced only by the subvolume, which is the
+	// space freed by deleting it.
+	Exclusive uint64
+}
+
+// SubvolumeUsageReport returns the space usage of every subvolume on the filesystem
+// mounted at mountpoint, ordered by creation time. The usage is taken from quota
+// group accounting, so quotas must be enabled, otherwise ErrQuotasDisabled is
+// returned. Quotas are not enabled implicitly since doing so starts a rescan of the
+// whole filesystem, and the figures are inaccurate until a rescan has finished.
+func SubvolumeUsageReport(mountpoint string) ([]SubvolumeUsage, error) {
+	mountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertBtrfs(mountpoint); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(mountpoint, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := subvolumeQgroupInfos(f.Fd())
+	if err != nil {
+		return nil, err
+	}
+	subvols, err := ListSubvolumes(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]SubvolumeUsage, len(subvols))
+	for i, subvol := range subvols {
+		out[i] = SubvolumeUsage{
+			ID:       subvol.ID,
+			Path:     subvol.Path,
+			Created:  subvol.CreationTime(),
+			ReadOnly: subvol.ReadOnly,
+		}
+		if info, ok := infos[subvol.ID]; ok {
+			out[i].Referenced = info.Rfer
+			out[i].Exclusive = info.Excl
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+// subvolumeQgroupInfos returns the qgroup info items of all level 0 qgroups, keyed
+// by subvolume ID, with a single walk of the quota tree.
+func subvolumeQgroupInfos(fd uintptr) (map[uint64]qgroupInfoItem, error) {
+	params := SearchParams{
+		Tree_id:     uint64(QuotaTreeObjectID),
+		Max_offset:  math.MaxUint64,
+		Max_transid: math.MaxUint64,
+		Min_type:    uint32(qgroupInfoKey),
+		Max_type:    uint32(qgroupInfoKey),
+	}
+	infos := make(map[uint64]qgroupInfoItem)
+	err := walkBtrfsTreeV2Fd(fd, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		// Higher level qgroups have the level in the top 16 bits of their ID
+		if hdr.ItemType() != qgroupInfoKey || hdr.Offset>>48 != 0 {
+			return nil
+		}
+		var info qgroupInfoItem
+		if err := item.decode(&info); err != nil {
+			return fmt.Errorf("failed to decode qgroup info: %w", err)
+		}
+		infos[hdr.Offset] = info
+		return nil
+	})
+	if errors.Is(err, syscall.ENOENT) {
+		return nil, ErrQuotasDisabled
+	}
+	return infos, err
+}
@@ -15,15 +15,55 @@ If not, see <https://www.gnu.org/licenses/>.
 
 package btrfs
 
-import "os"
+import (
+	"os"
+)
 
-// SyncFilesystem runs an I/O sync on the filesystem at the given path.
-// If the path is not a BTRFS filesystem, an error will be returned.
+// SyncFilesystem runs an I/O sync on the filesystem at the given path, committing
+// the current transaction. If the path is not a BTRFS filesystem, an error
+// matching ErrNotBtrfs will be returned.
 func SyncFilesystem(path string) error {
-	f, err := os.Open(path)
+	f, err := openBtrfs(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	return ioctlUnsafe(f.Fd(), BTRFS_IOC_SYNC, nil)
 }
+
+// StartTransactionSync starts committing the current transaction of the
+// filesystem at the given path without waiting for it to complete, and returns
+// the generation of the transaction being committed. Pass it to
+// WaitForTransaction to block until it is on disk.
+func StartTransactionSync(path string) (uint64, error) {
+	f, err := openBtrfs(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var transid uint64
+	if err := ioctlUint64(f.Fd(), BTRFS_IOC_START_SYNC, &transid); err != nil {
+		return 0, err
+	}
+	return transid, nil
+}
+
+// WaitForTransaction blocks until the transaction with the given generation of
+// the filesystem at the given path has been committed. A generation of zero waits
+// for the current transaction.
+func WaitForTransaction(path string, gen uint64) error {
+	f, err := openBtrfs(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ioctlUint64(f.Fd(), BTRFS_IOC_WAIT_SYNC, &gen)
+}
+
+// openBtrfs opens the given path after checking that it is on a btrfs filesystem.
+func openBtrfs(path string) (*os.File, error) {
+	if err := assertBtrfs(path); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,156 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SnapshotTagPrefix is the extended attribute namespace snapshot tags are stored in.
+const SnapshotTagPrefix = "user.btrsync."
+
+// xattrNameMax is the longest extended attribute name the kernel accepts.
+const xattrNameMax = 255
+
+// SetSnapshotTag tags the subvolume at path with the given key and value, stored as
+// the user.btrsync.<key> extended attribute on the root of the subvolume. Tags are
+// carried by send streams like any other extended attribute, so received snapshots
+// keep them. A read-only snapshot cannot be modified, so tags must be set before
+// the snapshot is made read-only or ErrReadOnlySubvolume is returned. Making a
+// received snapshot writable to tag it would break incremental receives on top of
+// it.
+func SetSnapshotTag(path, key, value string) error {
+	if err := validateTagKey(key); err != nil {
+		return err
+	}
+	if err := unix.Setxattr(path, SnapshotTagPrefix+key, []byte(value), 0); err != nil {
+		return tagError("setxattr", path, err)
+	}
+	return nil
+}
+
+// RemoveSnapshotTag removes the tag with the given key from the subvolume at path.
+// It is not an error if the tag does not exist.
+func RemoveSnapshotTag(path, key string) error {
+	if err := validateTagKey(key); err != nil {
+		return err
+	}
+	err := unix.Removexattr(path, SnapshotTagPrefix+key)
+	if err != nil && !errors.Is(err, unix.ENODATA) {
+		return tagError("removexattr", path, err)
+	}
+	return nil
+}
+
+// GetSnapshotTags returns the tags set on the subvolume at path with SetSnapshotTag.
+func GetSnapshotTags(path string) (map[string]string, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, name := range names {
+		if !strings.HasPrefix(name, SnapshotTagPrefix) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if errors.Is(err, unix.ENODATA) {
+			// Removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		tags[strings.TrimPrefix(name, SnapshotTagPrefix)] = string(value)
+	}
+	return tags, nil
+}
+
+func validateTagKey(key string) error {
+	if key == "" {
+		return errors.New("tag key must not be empty")
+	}
+	if strings.IndexByte(key, 0) >= 0 {
+		return errors.New("tag key must not contain NUL bytes")
+	}
+	if len(SnapshotTagPrefix)+len(key) > xattrNameMax {
+		return fmt.Errorf("tag key is too long: %d bytes", len(key))
+	}
+	return nil
+}
+
+func tagError(op, path string, err error) error {
+	if errors.Is(err, unix.EROFS) || errors.Is(err, unix.EPERM) {
+		if ro, roErr := IsSubvolumeReadOnly(path); roErr == nil && ro {
+			return fmt.Errorf("%w: %s", ErrReadOnlySubvolume, path)
+		}
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// listXattrs returns the names of the extended attributes of path.
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Listxattr(path, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := unix.Listxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// The list grew since it was measured
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -59,6 +59,9 @@ func UUIDTreeLookupID(path string, uuid uuid.UUID, typ LookupType) (id uint64, e
 			Nr_items:     1,
 		},
 	}
+	if err := assertBtrfs(path); err != nil {
+		return 0, err
+	}
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
 	if err != nil {
 		return
@@ -69,7 +72,7 @@ func UUIDTreeLookupID(path string, uuid uuid.UUID, typ LookupType) (id uint64, e
 		return
 	}
 	if args.Key.Nr_items < 1 {
-		err = fmt.Errorf("no item found for UUID %s", uuid)
+		err = fmt.Errorf("no item found for UUID %s: %w", uuid, ErrSubvolumeNotFound)
 		return
 	}
 	var hdr SearchHeader
@@ -78,7 +81,7 @@ func UUIDTreeLookupID(path string, uuid uuid.UUID, typ LookupType) (id uint64, e
 		return
 	}
 	if hdr.Len == 0 {
-		err = fmt.Errorf("no item found for UUID %s", uuid)
+		err = fmt.Errorf("no item found for UUID %s: %w", uuid, ErrSubvolumeNotFound)
 		return
 	}
 	// Read the first ID off the buffer
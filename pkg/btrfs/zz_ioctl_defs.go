@@ -61,62 +61,66 @@ const (
 
 // BTRFS ioctl commands
 const (
-	BTRFS_IOC_SNAP_CREATE         IoctlCmd = 0x50009401
-	BTRFS_IOC_DEFRAG              IoctlCmd = 0x50009402
-	BTRFS_IOC_RESIZE              IoctlCmd = 0x50009403
-	BTRFS_IOC_SCAN_DEV            IoctlCmd = 0x50009404
-	BTRFS_IOC_FORGET_DEV          IoctlCmd = 0x50009405
-	BTRFS_IOC_TRANS_START         IoctlCmd = 0x9406
-	BTRFS_IOC_TRANS_END           IoctlCmd = 0x9407
-	BTRFS_IOC_SYNC                IoctlCmd = 0x9408
-	BTRFS_IOC_CLONE               IoctlCmd = 0x40049409
-	BTRFS_IOC_ADD_DEV             IoctlCmd = 0x5000940a
-	BTRFS_IOC_RM_DEV              IoctlCmd = 0x5000940b
-	BTRFS_IOC_BALANCE             IoctlCmd = 0x5000940c
-	BTRFS_IOC_CLONE_RANGE         IoctlCmd = 0x4020940d
-	BTRFS_IOC_SUBVOL_CREATE       IoctlCmd = 0x5000940e
-	BTRFS_IOC_SNAP_DESTROY        IoctlCmd = 0x5000940f
-	BTRFS_IOC_DEFRAG_RANGE        IoctlCmd = 0x40309410
-	BTRFS_IOC_TREE_SEARCH         IoctlCmd = 0xd0009411
-	BTRFS_IOC_TREE_SEARCH_V2      IoctlCmd = 0xc0709411
-	BTRFS_IOC_INO_LOOKUP          IoctlCmd = 0xd0009412
-	BTRFS_IOC_DEFAULT_SUBVOL      IoctlCmd = 0x40089413
-	BTRFS_IOC_SPACE_INFO          IoctlCmd = 0xc0109414
-	BTRFS_IOC_START_SYNC          IoctlCmd = 0x80089418
-	BTRFS_IOC_WAIT_SYNC           IoctlCmd = 0x40089416
-	BTRFS_IOC_SNAP_CREATE_V2      IoctlCmd = 0x50009417
-	BTRFS_IOC_SUBVOL_CREATE_V2    IoctlCmd = 0x50009418
-	BTRFS_IOC_SUBVOL_GETFLAGS     IoctlCmd = 0x80089419
-	BTRFS_IOC_SUBVOL_SETFLAGS     IoctlCmd = 0x4008941a
-	BTRFS_IOC_SCRUB               IoctlCmd = 0xc400941b
-	BTRFS_IOC_SCRUB_CANCEL        IoctlCmd = 0x941c
-	BTRFS_IOC_SCRUB_PROGRESS      IoctlCmd = 0xc400941d
-	BTRFS_IOC_DEV_INFO            IoctlCmd = 0xd000941e
-	BTRFS_IOC_FS_INFO             IoctlCmd = 0x8400941f
-	BTRFS_IOC_BALANCE_V2          IoctlCmd = 0xc4009420
-	BTRFS_IOC_BALANCE_CTL         IoctlCmd = 0x40049421
-	BTRFS_IOC_BALANCE_PROGRESS    IoctlCmd = 0x84009422
-	BTRFS_IOC_INO_PATHS           IoctlCmd = 0xc0389423
-	BTRFS_IOC_LOGICAL_INO         IoctlCmd = 0xc0389424
-	BTRFS_IOC_SET_RECEIVED_SUBVOL IoctlCmd = 0xc0c89425
-	BTRFS_IOC_SEND                IoctlCmd = 0x40489426
-	BTRFS_IOC_DEVICES_READY       IoctlCmd = 0x90009427
-	BTRFS_IOC_QUOTA_CTL           IoctlCmd = 0xc0109428
-	BTRFS_IOC_QGROUP_ASSIGN       IoctlCmd = 0x40189429
-	BTRFS_IOC_QGROUP_CREATE       IoctlCmd = 0x4010942a
-	BTRFS_IOC_QGROUP_LIMIT        IoctlCmd = 0x8030942b
-	BTRFS_IOC_QUOTA_RESCAN        IoctlCmd = 0x4040942c
-	BTRFS_IOC_QUOTA_RESCAN_STATUS IoctlCmd = 0x8040942d
-	BTRFS_IOC_QUOTA_RESCAN_WAIT   IoctlCmd = 0x942e
-	BTRFS_IOC_GET_DEV_STATS       IoctlCmd = 0xc4089434
-	BTRFS_IOC_DEV_REPLACE         IoctlCmd = 0xca289435
-	BTRFS_IOC_FILE_EXTENT_SAME    IoctlCmd = 0xc0189436
-	BTRFS_IOC_RM_DEV_V2           IoctlCmd = 0x5000943a
-	BTRFS_IOC_LOGICAL_INO_V2      IoctlCmd = 0xc038943b
-	BTRFS_IOC_GET_SUBVOL_INFO     IoctlCmd = 0x81f8943c
-	BTRFS_IOC_GET_SUBVOL_ROOTREF  IoctlCmd = 0xd000943d
-	BTRFS_IOC_INO_LOOKUP_USER     IoctlCmd = 0xd000943e
-	BTRFS_IOC_SNAP_DESTROY_V2     IoctlCmd = 0x5000943f
-	BTRFS_IOC_ENCODED_READ        IoctlCmd = 0x80809440
-	BTRFS_IOC_ENCODED_WRITE       IoctlCmd = 0x40809440
+	BTRFS_IOC_SNAP_CREATE            IoctlCmd = 0x50009401
+	BTRFS_IOC_DEFRAG                 IoctlCmd = 0x50009402
+	BTRFS_IOC_RESIZE                 IoctlCmd = 0x50009403
+	BTRFS_IOC_SCAN_DEV               IoctlCmd = 0x50009404
+	BTRFS_IOC_FORGET_DEV             IoctlCmd = 0x50009405
+	BTRFS_IOC_TRANS_START            IoctlCmd = 0x9406
+	BTRFS_IOC_TRANS_END              IoctlCmd = 0x9407
+	BTRFS_IOC_SYNC                   IoctlCmd = 0x9408
+	BTRFS_IOC_CLONE                  IoctlCmd = 0x40049409
+	BTRFS_IOC_ADD_DEV                IoctlCmd = 0x5000940a
+	BTRFS_IOC_RM_DEV                 IoctlCmd = 0x5000940b
+	BTRFS_IOC_BALANCE                IoctlCmd = 0x5000940c
+	BTRFS_IOC_CLONE_RANGE            IoctlCmd = 0x4020940d
+	BTRFS_IOC_SUBVOL_CREATE          IoctlCmd = 0x5000940e
+	BTRFS_IOC_SNAP_DESTROY           IoctlCmd = 0x5000940f
+	BTRFS_IOC_DEFRAG_RANGE           IoctlCmd = 0x40309410
+	BTRFS_IOC_TREE_SEARCH            IoctlCmd = 0xd0009411
+	BTRFS_IOC_TREE_SEARCH_V2         IoctlCmd = 0xc0709411
+	BTRFS_IOC_INO_LOOKUP             IoctlCmd = 0xd0009412
+	BTRFS_IOC_DEFAULT_SUBVOL         IoctlCmd = 0x40089413
+	BTRFS_IOC_SPACE_INFO             IoctlCmd = 0xc0109414
+	BTRFS_IOC_START_SYNC             IoctlCmd = 0x80089418
+	BTRFS_IOC_WAIT_SYNC              IoctlCmd = 0x40089416
+	BTRFS_IOC_SNAP_CREATE_V2         IoctlCmd = 0x50009417
+	BTRFS_IOC_SUBVOL_CREATE_V2       IoctlCmd = 0x50009418
+	BTRFS_IOC_SUBVOL_GETFLAGS        IoctlCmd = 0x80089419
+	BTRFS_IOC_SUBVOL_SETFLAGS        IoctlCmd = 0x4008941a
+	BTRFS_IOC_SCRUB                  IoctlCmd = 0xc400941b
+	BTRFS_IOC_SCRUB_CANCEL           IoctlCmd = 0x941c
+	BTRFS_IOC_SCRUB_PROGRESS         IoctlCmd = 0xc400941d
+	BTRFS_IOC_DEV_INFO               IoctlCmd = 0xd000941e
+	BTRFS_IOC_FS_INFO                IoctlCmd = 0x8400941f
+	BTRFS_IOC_BALANCE_V2             IoctlCmd = 0xc4009420
+	BTRFS_IOC_BALANCE_CTL            IoctlCmd = 0x40049421
+	BTRFS_IOC_BALANCE_PROGRESS       IoctlCmd = 0x84009422
+	BTRFS_IOC_INO_PATHS              IoctlCmd = 0xc0389423
+	BTRFS_IOC_LOGICAL_INO            IoctlCmd = 0xc0389424
+	BTRFS_IOC_SET_RECEIVED_SUBVOL    IoctlCmd = 0xc0c89425
+	BTRFS_IOC_SEND                   IoctlCmd = 0x40489426
+	BTRFS_IOC_DEVICES_READY          IoctlCmd = 0x90009427
+	BTRFS_IOC_QUOTA_CTL              IoctlCmd = 0xc0109428
+	BTRFS_IOC_QGROUP_ASSIGN          IoctlCmd = 0x40189429
+	BTRFS_IOC_QGROUP_CREATE          IoctlCmd = 0x4010942a
+	BTRFS_IOC_QGROUP_LIMIT           IoctlCmd = 0x8030942b
+	BTRFS_IOC_QUOTA_RESCAN           IoctlCmd = 0x4040942c
+	BTRFS_IOC_QUOTA_RESCAN_STATUS    IoctlCmd = 0x8040942d
+	BTRFS_IOC_QUOTA_RESCAN_WAIT      IoctlCmd = 0x942e
+	BTRFS_IOC_GET_FSLABEL            IoctlCmd = 0x81009431
+	BTRFS_IOC_SET_FSLABEL            IoctlCmd = 0x41009432
+	BTRFS_IOC_GET_DEV_STATS          IoctlCmd = 0xc4089434
+	BTRFS_IOC_DEV_REPLACE            IoctlCmd = 0xca289435
+	BTRFS_IOC_FILE_EXTENT_SAME       IoctlCmd = 0xc0189436
+	BTRFS_IOC_GET_FEATURES           IoctlCmd = 0x80189439
+	BTRFS_IOC_GET_SUPPORTED_FEATURES IoctlCmd = 0x80489439
+	BTRFS_IOC_RM_DEV_V2              IoctlCmd = 0x5000943a
+	BTRFS_IOC_LOGICAL_INO_V2         IoctlCmd = 0xc038943b
+	BTRFS_IOC_GET_SUBVOL_INFO        IoctlCmd = 0x81f8943c
+	BTRFS_IOC_GET_SUBVOL_ROOTREF     IoctlCmd = 0xd000943d
+	BTRFS_IOC_INO_LOOKUP_USER        IoctlCmd = 0xd000943e
+	BTRFS_IOC_SNAP_DESTROY_V2        IoctlCmd = 0x5000943f
+	BTRFS_IOC_ENCODED_READ           IoctlCmd = 0x80809440
+	BTRFS_IOC_ENCODED_WRITE          IoctlCmd = 0x40809440
 )
@@ -58,9 +58,13 @@ func _() {
 	_ = x[BTRFS_IOC_QUOTA_RESCAN-1077974060]
 	_ = x[BTRFS_IOC_QUOTA_RESCAN_STATUS-2151715885]
 	_ = x[BTRFS_IOC_QUOTA_RESCAN_WAIT-37934]
+	_ = x[BTRFS_IOC_GET_FSLABEL-2164298801]
+	_ = x[BTRFS_IOC_SET_FSLABEL-1090556978]
 	_ = x[BTRFS_IOC_GET_DEV_STATS-3288896564]
 	_ = x[BTRFS_IOC_DEV_REPLACE-3391657013]
 	_ = x[BTRFS_IOC_FILE_EXTENT_SAME-3222836278]
+	_ = x[BTRFS_IOC_GET_FEATURES-2149094457]
+	_ = x[BTRFS_IOC_GET_SUPPORTED_FEATURES-2152240185]
 	_ = x[BTRFS_IOC_RM_DEV_V2-1342215226]
 	_ = x[BTRFS_IOC_LOGICAL_INO_V2-3224933435]
 	_ = x[BTRFS_IOC_GET_SUBVOL_INFO-2180551740]
@@ -71,7 +75,7 @@ func _() {
 	_ = x[BTRFS_IOC_ENCODED_WRITE-1082168384]
 }
 
-const _IoctlCmd_name = "BTRFS_IOC_TRANS_STARTBTRFS_IOC_TRANS_ENDBTRFS_IOC_SYNCBTRFS_IOC_SCRUB_CANCELBTRFS_IOC_QUOTA_RESCAN_WAITBTRFS_IOC_CLONEBTRFS_IOC_BALANCE_CTLBTRFS_IOC_DEFAULT_SUBVOLBTRFS_IOC_WAIT_SYNCBTRFS_IOC_SUBVOL_SETFLAGSBTRFS_IOC_QGROUP_CREATEBTRFS_IOC_QGROUP_ASSIGNBTRFS_IOC_CLONE_RANGEBTRFS_IOC_DEFRAG_RANGEBTRFS_IOC_QUOTA_RESCANBTRFS_IOC_SENDFS_IOC_ENABLE_VERITYBTRFS_IOC_ENCODED_WRITEBTRFS_IOC_SNAP_CREATEBTRFS_IOC_DEFRAGBTRFS_IOC_RESIZEBTRFS_IOC_SCAN_DEVBTRFS_IOC_FORGET_DEVBTRFS_IOC_ADD_DEVBTRFS_IOC_RM_DEVBTRFS_IOC_BALANCEBTRFS_IOC_SUBVOL_CREATEBTRFS_IOC_SNAP_DESTROYBTRFS_IOC_SNAP_CREATE_V2BTRFS_IOC_SUBVOL_CREATE_V2BTRFS_IOC_RM_DEV_V2BTRFS_IOC_SNAP_DESTROY_V2BTRFS_IOC_START_SYNCBTRFS_IOC_SUBVOL_GETFLAGSBTRFS_IOC_QGROUP_LIMITBTRFS_IOC_QUOTA_RESCAN_STATUSBTRFS_IOC_ENCODED_READBTRFS_IOC_GET_SUBVOL_INFOBTRFS_IOC_FS_INFOBTRFS_IOC_BALANCE_PROGRESSBTRFS_IOC_DEVICES_READYFS_IOC_MEASURE_VERITYBTRFS_IOC_SPACE_INFOBTRFS_IOC_QUOTA_CTLBTRFS_IOC_FILE_EXTENT_SAMEFS_IOC_READ_VERITY_METADATABTRFS_IOC_INO_PATHSBTRFS_IOC_LOGICAL_INOBTRFS_IOC_LOGICAL_INO_V2BTRFS_IOC_TREE_SEARCH_V2BTRFS_IOC_SET_RECEIVED_SUBVOLBTRFS_IOC_SCRUBBTRFS_IOC_SCRUB_PROGRESSBTRFS_IOC_BALANCE_V2BTRFS_IOC_GET_DEV_STATSBTRFS_IOC_DEV_REPLACEBTRFS_IOC_TREE_SEARCHBTRFS_IOC_INO_LOOKUPBTRFS_IOC_DEV_INFOBTRFS_IOC_GET_SUBVOL_ROOTREFBTRFS_IOC_INO_LOOKUP_USER"
+const _IoctlCmd_name = "BTRFS_IOC_TRANS_STARTBTRFS_IOC_TRANS_ENDBTRFS_IOC_SYNCBTRFS_IOC_SCRUB_CANCELBTRFS_IOC_QUOTA_RESCAN_WAITBTRFS_IOC_CLONEBTRFS_IOC_BALANCE_CTLBTRFS_IOC_DEFAULT_SUBVOLBTRFS_IOC_WAIT_SYNCBTRFS_IOC_SUBVOL_SETFLAGSBTRFS_IOC_QGROUP_CREATEBTRFS_IOC_QGROUP_ASSIGNBTRFS_IOC_CLONE_RANGEBTRFS_IOC_DEFRAG_RANGEBTRFS_IOC_QUOTA_RESCANBTRFS_IOC_SENDFS_IOC_ENABLE_VERITYBTRFS_IOC_ENCODED_WRITEBTRFS_IOC_SET_FSLABELBTRFS_IOC_SNAP_CREATEBTRFS_IOC_DEFRAGBTRFS_IOC_RESIZEBTRFS_IOC_SCAN_DEVBTRFS_IOC_FORGET_DEVBTRFS_IOC_ADD_DEVBTRFS_IOC_RM_DEVBTRFS_IOC_BALANCEBTRFS_IOC_SUBVOL_CREATEBTRFS_IOC_SNAP_DESTROYBTRFS_IOC_SNAP_CREATE_V2BTRFS_IOC_SUBVOL_CREATE_V2BTRFS_IOC_RM_DEV_V2BTRFS_IOC_SNAP_DESTROY_V2BTRFS_IOC_START_SYNCBTRFS_IOC_SUBVOL_GETFLAGSBTRFS_IOC_GET_FEATURESBTRFS_IOC_QGROUP_LIMITBTRFS_IOC_QUOTA_RESCAN_STATUSBTRFS_IOC_GET_SUPPORTED_FEATURESBTRFS_IOC_ENCODED_READBTRFS_IOC_GET_FSLABELBTRFS_IOC_GET_SUBVOL_INFOBTRFS_IOC_FS_INFOBTRFS_IOC_BALANCE_PROGRESSBTRFS_IOC_DEVICES_READYFS_IOC_MEASURE_VERITYBTRFS_IOC_SPACE_INFOBTRFS_IOC_QUOTA_CTLBTRFS_IOC_FILE_EXTENT_SAMEFS_IOC_READ_VERITY_METADATABTRFS_IOC_INO_PATHSBTRFS_IOC_LOGICAL_INOBTRFS_IOC_LOGICAL_INO_V2BTRFS_IOC_TREE_SEARCH_V2BTRFS_IOC_SET_RECEIVED_SUBVOLBTRFS_IOC_SCRUBBTRFS_IOC_SCRUB_PROGRESSBTRFS_IOC_BALANCE_V2BTRFS_IOC_GET_DEV_STATSBTRFS_IOC_DEV_REPLACEBTRFS_IOC_TREE_SEARCHBTRFS_IOC_INO_LOOKUPBTRFS_IOC_DEV_INFOBTRFS_IOC_GET_SUBVOL_ROOTREFBTRFS_IOC_INO_LOOKUP_USER"
 
 var _IoctlCmd_map = map[IoctlCmd]string{
 	37894:      _IoctlCmd_name[0:21],
@@ -92,49 +96,53 @@ var _IoctlCmd_map = map[IoctlCmd]string{
 	1078498342: _IoctlCmd_name[318:332],
 	1082156677: _IoctlCmd_name[332:352],
 	1082168384: _IoctlCmd_name[352:375],
-	1342215169: _IoctlCmd_name[375:396],
-	1342215170: _IoctlCmd_name[396:412],
-	1342215171: _IoctlCmd_name[412:428],
-	1342215172: _IoctlCmd_name[428:446],
-	1342215173: _IoctlCmd_name[446:466],
-	1342215178: _IoctlCmd_name[466:483],
-	1342215179: _IoctlCmd_name[483:499],
-	1342215180: _IoctlCmd_name[499:516],
-	1342215182: _IoctlCmd_name[516:539],
-	1342215183: _IoctlCmd_name[539:561],
-	1342215191: _IoctlCmd_name[561:585],
-	1342215192: _IoctlCmd_name[585:611],
-	1342215226: _IoctlCmd_name[611:630],
-	1342215231: _IoctlCmd_name[630:655],
-	2148045848: _IoctlCmd_name[655:675],
-	2148045849: _IoctlCmd_name[675:700],
-	2150667307: _IoctlCmd_name[700:722],
-	2151715885: _IoctlCmd_name[722:751],
-	2155910208: _IoctlCmd_name[751:773],
-	2180551740: _IoctlCmd_name[773:798],
-	2214630431: _IoctlCmd_name[798:815],
-	2214630434: _IoctlCmd_name[815:841],
-	2415957031: _IoctlCmd_name[841:864],
-	3221513862: _IoctlCmd_name[864:885],
-	3222311956: _IoctlCmd_name[885:905],
-	3222311976: _IoctlCmd_name[905:924],
-	3222836278: _IoctlCmd_name[924:950],
-	3223873159: _IoctlCmd_name[950:977],
-	3224933411: _IoctlCmd_name[977:996],
-	3224933412: _IoctlCmd_name[996:1017],
-	3224933435: _IoctlCmd_name[1017:1041],
-	3228603409: _IoctlCmd_name[1041:1065],
-	3234370597: _IoctlCmd_name[1065:1094],
-	3288372251: _IoctlCmd_name[1094:1109],
-	3288372253: _IoctlCmd_name[1109:1133],
-	3288372256: _IoctlCmd_name[1133:1153],
-	3288896564: _IoctlCmd_name[1153:1176],
-	3391657013: _IoctlCmd_name[1176:1197],
-	3489698833: _IoctlCmd_name[1197:1218],
-	3489698834: _IoctlCmd_name[1218:1238],
-	3489698846: _IoctlCmd_name[1238:1256],
-	3489698877: _IoctlCmd_name[1256:1284],
-	3489698878: _IoctlCmd_name[1284:1309],
+	1090556978: _IoctlCmd_name[375:396],
+	1342215169: _IoctlCmd_name[396:417],
+	1342215170: _IoctlCmd_name[417:433],
+	1342215171: _IoctlCmd_name[433:449],
+	1342215172: _IoctlCmd_name[449:467],
+	1342215173: _IoctlCmd_name[467:487],
+	1342215178: _IoctlCmd_name[487:504],
+	1342215179: _IoctlCmd_name[504:520],
+	1342215180: _IoctlCmd_name[520:537],
+	1342215182: _IoctlCmd_name[537:560],
+	1342215183: _IoctlCmd_name[560:582],
+	1342215191: _IoctlCmd_name[582:606],
+	1342215192: _IoctlCmd_name[606:632],
+	1342215226: _IoctlCmd_name[632:651],
+	1342215231: _IoctlCmd_name[651:676],
+	2148045848: _IoctlCmd_name[676:696],
+	2148045849: _IoctlCmd_name[696:721],
+	2149094457: _IoctlCmd_name[721:743],
+	2150667307: _IoctlCmd_name[743:765],
+	2151715885: _IoctlCmd_name[765:794],
+	2152240185: _IoctlCmd_name[794:826],
+	2155910208: _IoctlCmd_name[826:848],
+	2164298801: _IoctlCmd_name[848:869],
+	2180551740: _IoctlCmd_name[869:894],
+	2214630431: _IoctlCmd_name[894:911],
+	2214630434: _IoctlCmd_name[911:937],
+	2415957031: _IoctlCmd_name[937:960],
+	3221513862: _IoctlCmd_name[960:981],
+	3222311956: _IoctlCmd_name[981:1001],
+	3222311976: _IoctlCmd_name[1001:1020],
+	3222836278: _IoctlCmd_name[1020:1046],
+	3223873159: _IoctlCmd_name[1046:1073],
+	3224933411: _IoctlCmd_name[1073:1092],
+	3224933412: _IoctlCmd_name[1092:1113],
+	3224933435: _IoctlCmd_name[1113:1137],
+	3228603409: _IoctlCmd_name[1137:1161],
+	3234370597: _IoctlCmd_name[1161:1190],
+	3288372251: _IoctlCmd_name[1190:1205],
+	3288372253: _IoctlCmd_name[1205:1229],
+	3288372256: _IoctlCmd_name[1229:1249],
+	3288896564: _IoctlCmd_name[1249:1272],
+	3391657013: _IoctlCmd_name[1272:1293],
+	3489698833: _IoctlCmd_name[1293:1314],
+	3489698834: _IoctlCmd_name[1314:1334],
+	3489698846: _IoctlCmd_name[1334:1352],
+	3489698877: _IoctlCmd_name[1352:1380],
+	3489698878: _IoctlCmd_name[1380:1405],
 }
 
 func (i IoctlCmd) String() string {
@@ -25,8 +25,8 @@ import (
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/spf13/cobra"
 
-	"github.com/tinyzimmer/btrsync/pkg/receive"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/memfs"
+	"github.com/madworx/btrsync/pkg/receive"
+	"github.com/madworx/btrsync/pkg/receive/receivers/memfs"
 )
 
 func NewMountCommand() *cobra.Command {
@@ -21,8 +21,8 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snapmanager"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+	"github.com/madworx/btrsync/pkg/cmd/snapmanager"
+	"github.com/madworx/btrsync/pkg/cmd/syncmanager"
 )
 
 func NewPruneCommand() *cobra.Command {
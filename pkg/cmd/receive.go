@@ -22,12 +22,14 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/tinyzimmer/btrsync/pkg/receive"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/local"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive"
+	"github.com/madworx/btrsync/pkg/receive/receivers/local"
 )
 
 var (
-	receivefile string
+	receivefile    string
+	receiveBufSize int
 )
 
 func NewReceiveCommand() *cobra.Command {
@@ -38,6 +40,7 @@ func NewReceiveCommand() *cobra.Command {
 		RunE:  runReceive,
 	}
 	cmd.Flags().StringVarP(&receivefile, "file", "f", "", "receive from encoded file")
+	cmd.Flags().IntVar(&receiveBufSize, "buffer-size", btrfs.DefaultBufferSize, "size in bytes of the buffer the stream is read through")
 	return cmd
 }
 
@@ -58,6 +61,7 @@ func runReceive(cmd *cobra.Command, args []string) error {
 	return receive.ProcessSendStream(src,
 		receive.WithLogger(log.New(os.Stderr, "[receive]", log.LstdFlags|log.Lshortfile), conf.Verbosity),
 		receive.HonorEndCommand(),
+		receive.WithBufferSize(receiveBufSize),
 		receive.To(local.New(dest)),
 	)
 }
@@ -22,9 +22,9 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/tinyzimmer/btrsync/pkg/cmd/queue"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snapmanager"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+	"github.com/madworx/btrsync/pkg/cmd/queue"
+	"github.com/madworx/btrsync/pkg/cmd/snapmanager"
+	"github.com/madworx/btrsync/pkg/cmd/syncmanager"
 )
 
 var (
@@ -23,7 +23,7 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs"
 )
 
 var (
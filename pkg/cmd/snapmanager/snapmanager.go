@@ -17,14 +17,15 @@ If not, see <https://www.gnu.org/licenses/>.
 package snapmanager
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"time"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
 )
 
 // Config is the config for a snapshot manager.
@@ -75,6 +76,11 @@ func (sm *SnapManager) EnsureMostRecentSnapshot() error {
 	if err := sm.ensureSnapshotSubvol(); err != nil {
 		return err
 	}
+	unlock, err := sm.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	mostRecent, err := sm.GetMostRecentSnapshot()
 	if err != nil {
 		return err
@@ -119,6 +125,11 @@ func (sm *SnapManager) PruneSnapshots() error {
 	if sm.config.SnapshotRetention == 0 {
 		return nil
 	}
+	unlock, err := sm.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	// Delete snapshots older than the retention period
 	sm.config.logLevel(1, "Pruning snapshots older than %s\n", sm.config.SnapshotRetention)
 
@@ -131,6 +142,7 @@ func (sm *SnapManager) PruneSnapshots() error {
 			if err := btrfs.DeleteSubvolume(fullPath, true); err != nil {
 				return err
 			}
+			btrfs.CurrentMetrics().Count(btrfs.MetricSnapshotsDeleted, 1)
 		} else {
 			remaining = append(remaining, snap)
 		}
@@ -176,11 +188,27 @@ func (sm *SnapManager) PruneSnapshots() error {
 			if err := btrfs.DeleteSubvolume(fullPath, true); err != nil {
 				return err
 			}
+			btrfs.CurrentMetrics().Count(btrfs.MetricSnapshotsDeleted, 1)
 		}
 	}
 	return nil
 }
 
+// lock acquires the filesystem lock of the snapshot directory so that snapshot
+// creation and pruning by other btrsync processes do not interleave with ours.
+func (sm *SnapManager) lock() (unlock func(), err error) {
+	lock := btrfs.NewFilesystemLock(sm.config.SnapshotDirectory)
+	sm.config.logLevel(3, "Acquiring lock on %s\n", sm.config.SnapshotDirectory)
+	if err := lock.Lock(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", sm.config.SnapshotDirectory, err)
+	}
+	return func() {
+		if err := lock.Unlock(); err != nil {
+			sm.config.logLevel(1, "Failed to release lock on %s: %s\n", sm.config.SnapshotDirectory, err)
+		}
+	}, nil
+}
+
 func (sm *SnapManager) ensureSnapshotSubvol() error {
 	snapDir := sm.config.SnapshotDirectory
 	isSubvol, err := btrfs.IsSubvolume(snapDir)
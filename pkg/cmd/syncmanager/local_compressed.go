@@ -29,9 +29,9 @@ import (
 	"github.com/google/uuid"
 	"github.com/klauspost/compress/zstd"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/config"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
 )
 
 type localCompressedManager struct {
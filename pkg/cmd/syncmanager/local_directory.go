@@ -24,10 +24,10 @@ import (
 	"sync"
 
 	"github.com/google/uuid"
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
-	"github.com/tinyzimmer/btrsync/pkg/receive"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/directory"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/receive"
+	"github.com/madworx/btrsync/pkg/receive/receivers/directory"
 )
 
 type localDirectoryManager struct {
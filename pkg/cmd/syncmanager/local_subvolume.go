@@ -25,10 +25,10 @@ import (
 	"sync"
 	"time"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
-	"github.com/tinyzimmer/btrsync/pkg/receive"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/local"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/receive"
+	"github.com/madworx/btrsync/pkg/receive/receivers/local"
 )
 
 type localSubvolumeManager struct {
@@ -29,10 +29,10 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/klauspost/compress/zstd"
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/config"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/cmd/sshutil"
 	"golang.org/x/crypto/ssh"
 )
 
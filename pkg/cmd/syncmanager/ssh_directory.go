@@ -25,11 +25,11 @@ import (
 	"sync"
 
 	"github.com/google/uuid"
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
-	"github.com/tinyzimmer/btrsync/pkg/receive"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/sshdir"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/cmd/sshutil"
+	"github.com/madworx/btrsync/pkg/receive"
+	"github.com/madworx/btrsync/pkg/receive/receivers/sshdir"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -27,9 +27,9 @@ import (
 	"sync"
 
 	"github.com/google/uuid"
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/cmd/sshutil"
 	"golang.org/x/crypto/ssh"
 )
 
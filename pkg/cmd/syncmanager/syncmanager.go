@@ -21,8 +21,8 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/madworx/btrsync/pkg/cmd/config"
+	"github.com/madworx/btrsync/pkg/cmd/snaputil"
 )
 
 var OffsetDirectory = ".btrsync"
@@ -22,7 +22,7 @@ import (
 	"os"
 	"os/user"
 
-	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/madworx/btrsync/pkg/cmd/config"
 	"golang.org/x/crypto/ssh"
 )
 
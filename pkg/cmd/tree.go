@@ -21,7 +21,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/xlab/treeprint"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs"
 )
 
 func NewTreeCommand() *cobra.Command {
@@ -0,0 +1,23 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package prom exports the measurements of btrsync to Prometheus. It is only built
+// with the prometheus build tag, so that builds without it do not need the
+// Prometheus client library. Build with -tags prometheus to use it:
+//
+//	m := prom.New(prometheus.DefaultRegisterer)
+//	restore := btrfs.SetMetrics(m)
+//	defer restore()
+package prom
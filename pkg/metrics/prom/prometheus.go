@@ -0,0 +1,126 @@
+//go:build prometheus
+
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package prom
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// help are the descriptions of the metrics reported by btrsync.
+var help = map[string]string{
+	btrfs.MetricSendBytes:         "Bytes of send streams written.",
+	btrfs.MetricSendDuration:      "Duration of sends in seconds.",
+	btrfs.MetricSendErrors:        "Number of failed sends.",
+	btrfs.MetricLastSendTimestamp: "Unix time of the last successful send.",
+	btrfs.MetricReceiveBytes:      "Bytes of send streams received.",
+	btrfs.MetricReceiveDuration:   "Duration of receives in seconds.",
+	btrfs.MetricReceiveErrors:     "Number of errors while receiving.",
+	btrfs.MetricSnapshotsCreated:  "Number of snapshots created.",
+	btrfs.MetricSnapshotsDeleted:  "Number of snapshots deleted by pruning.",
+}
+
+// DurationBuckets are the histogram buckets used for metrics, from a tenth of a
+// second to about an hour and a half.
+var DurationBuckets = prometheus.ExponentialBuckets(0.1, 2, 16)
+
+// Metrics is a btrfs.Metrics that reports to Prometheus. Collectors are created and
+// registered the first time a metric is reported.
+type Metrics struct {
+	reg        prometheus.Registerer
+	mu         sync.Mutex
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+}
+
+var _ btrfs.Metrics = (*Metrics)(nil)
+
+// New returns Metrics that register their collectors with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	return &Metrics{
+		reg:        reg,
+		counters:   make(map[string]prometheus.Counter),
+		gauges:     make(map[string]prometheus.Gauge),
+		histograms: make(map[string]prometheus.Histogram),
+	}
+}
+
+// Count implements btrfs.Metrics.
+func (m *Metrics) Count(name string, delta float64) {
+	m.mu.Lock()
+	c, ok := m.counters[name]
+	if !ok {
+		c = register(m.reg, prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: helpFor(name)}))
+		m.counters[name] = c
+	}
+	m.mu.Unlock()
+	c.Add(delta)
+}
+
+// Gauge implements btrfs.Metrics.
+func (m *Metrics) Gauge(name string, value float64) {
+	m.mu.Lock()
+	g, ok := m.gauges[name]
+	if !ok {
+		g = register(m.reg, prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: helpFor(name)}))
+		m.gauges[name] = g
+	}
+	m.mu.Unlock()
+	g.Set(value)
+}
+
+// Observe implements btrfs.Metrics.
+func (m *Metrics) Observe(name string, value float64) {
+	m.mu.Lock()
+	h, ok := m.histograms[name]
+	if !ok {
+		h = register(m.reg, prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: name, Help: helpFor(name), Buckets: DurationBuckets,
+		}))
+		m.histograms[name] = h
+	}
+	m.mu.Unlock()
+	h.Observe(value)
+}
+
+// register registers c with reg, returning the collector that is already
+// registered under the same name if there is one.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) C {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		// The collector still works unregistered, it is just not exported
+	}
+	return c
+}
+
+func helpFor(name string) string {
+	if h, ok := help[name]; ok {
+		return h
+	}
+	return name
+}
@@ -0,0 +1,48 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/sendstream"
+)
+
+// ReceiveBatch receives every send stream of the batch stream read from r, as
+// written by sendstream.SendBatch, into destDir with ReceiveSubvolume, in order,
+// and returns the information of the received subvolumes. opts are passed to every
+// receive. The first failing receive stops the batch; the subvolumes received
+// before it are returned along with the error.
+func ReceiveBatch(destDir string, r io.Reader, opts ...Option) ([]*btrfs.SubvolumeInfo, error) {
+	br := sendstream.NewBatchReader(r)
+	var received []*btrfs.SubvolumeInfo
+	for {
+		name, stream, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			return received, nil
+		} else if err != nil {
+			return received, err
+		}
+		info, err := ReceiveSubvolume(destDir, stream, opts...)
+		if err != nil {
+			return received, fmt.Errorf("failed to receive %s: %w", name, err)
+		}
+		received = append(received, info)
+	}
+}
@@ -19,8 +19,8 @@ import (
 	"context"
 	"log"
 
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
-	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/sendstream"
 )
 
 type receiveCtx struct {
@@ -34,7 +34,9 @@ type receiveCtx struct {
 	receiver        receivers.Receiver
 	ignoreChecksums bool
 	startOffset     uint64
+	eventHandler    EventHandler
 	currentOffset   uint64
+	bufferSize      int
 	// State
 	currentSubvolInfo *sendstream.ReceivingSubvolume
 }
@@ -5,8 +5,8 @@ import (
 	"io"
 	"sync"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/sendstream"
 )
 
 // FindPathDiffOffset is the same as FindDiffOffset but will initiate the stream
@@ -0,0 +1,94 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"encoding/binary"
+
+	"github.com/madworx/btrsync/pkg/sendstream"
+)
+
+// SendStreamCommand describes a command read from a send stream. It is passed to
+// an EventHandler before the command is applied to the receiver.
+type SendStreamCommand struct {
+	// Offset is the index of the command in the stream.
+	Offset uint64
+	// Cmd is the type of the command.
+	Cmd sendstream.SendCommand
+	// Path is the path the command operates on, relative to the subvolume being
+	// received. For subvol and snapshot commands it is the name of the subvolume.
+	Path string
+	// PathTo is the destination of a rename or the new name of a link.
+	PathTo string
+	// PathLink is the target of a link or symlink.
+	PathLink string
+	// FileOffset is the offset in the file of a write, clone or fallocate.
+	FileOffset uint64
+	// Length is the number of bytes written by a write or encoded write, cloned by
+	// a clone, or the size given to a truncate or fallocate.
+	Length uint64
+	// Attrs are the raw attributes of the command. They are only valid for the
+	// duration of the call to the handler.
+	Attrs sendstream.CmdAttrs
+}
+
+// EventHandler is called for each command processed from a send stream. It is
+// called from the goroutine processing the stream and blocks processing until it
+// returns.
+type EventHandler func(SendStreamCommand)
+
+// WithEventHandler sets a handler that is called for each command read from the
+// stream, before it is dispatched to the receiver. Commands skipped while seeking
+// with FromOffset are not reported.
+func WithEventHandler(h EventHandler) Option {
+	return func(args *receiveCtx) error {
+		args.eventHandler = h
+		return nil
+	}
+}
+
+// emitEvent calls the event handler, if any, for the given command.
+func (r *receiveCtx) emitEvent(cmd sendstream.SendCommand, attrs sendstream.CmdAttrs) {
+	if r.eventHandler == nil {
+		return
+	}
+	ev := SendStreamCommand{
+		Offset:     r.currentOffset,
+		Cmd:        cmd,
+		Path:       attrs.GetPath(),
+		PathTo:     attrs.GetPathTo(),
+		PathLink:   attrs.GetPathLink(),
+		FileOffset: attrUint64(attrs, sendstream.BTRFS_SEND_A_FILE_OFFSET),
+		Attrs:      attrs,
+	}
+	switch cmd {
+	case sendstream.BTRFS_SEND_C_WRITE, sendstream.BTRFS_SEND_C_ENCODED_WRITE:
+		ev.Length = uint64(len(attrs.GetData()))
+	case sendstream.BTRFS_SEND_C_CLONE:
+		ev.Length = attrUint64(attrs, sendstream.BTRFS_SEND_A_CLONE_LEN)
+	case sendstream.BTRFS_SEND_C_TRUNCATE, sendstream.BTRFS_SEND_C_FALLOCATE:
+		ev.Length = attrUint64(attrs, sendstream.BTRFS_SEND_A_SIZE)
+	}
+	r.eventHandler(ev)
+}
+
+// attrUint64 decodes a 64-bit attribute, returning 0 if it is missing or malformed.
+func attrUint64(attrs sendstream.CmdAttrs, attr sendstream.SendAttribute) uint64 {
+	if b := attrs[attr]; len(b) == 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/sendstream"
+)
+
+// ErrUnresolvedCloneSource is returned by ReceiveFromFile when the stream references
+// a subvolume that is neither part of the stream nor present at the destination.
+var ErrUnresolvedCloneSource = errors.New("clone source not found at destination")
+
+// ReceiveFromFile receives the send stream stored in the file at streamPath into
+// destDir. See ReceiveFromReadSeeker.
+func ReceiveFromFile(destDir, streamPath string, opts ...Option) (*btrfs.SubvolumeInfo, error) {
+	f, err := os.Open(streamPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReceiveFromReadSeeker(destDir, f, opts...)
+}
+
+// ReceiveFromReadSeeker receives the send stream read from r into destDir like
+// ReceiveSubvolume, decompressing it if needed. Clone and snapshot commands do not
+// carry the data they share, they reference extents of subvolumes that must already
+// exist at the destination, found by their received UUID. A receiver reading from an
+// io.Reader only learns of a missing subvolume when it reaches the command that
+// needs it, leaving a partially received subvolume behind. Since r can be rewound,
+// the stream is scanned first and ErrUnresolvedCloneSource is returned before
+// anything is written if a referenced subvolume cannot be found.
+func ReceiveFromReadSeeker(destDir string, r io.ReadSeeker, opts ...Option) (*btrfs.SubvolumeInfo, error) {
+	codec, err := detectSeekableCodec(r)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := codec.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyCloneSources(destDir, dr)
+	dr.Close()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ReceiveSubvolumeCompressed(destDir, r, codec, opts...)
+}
+
+// detectSeekableCodec detects the compression of the stream in r and rewinds it.
+func detectSeekableCodec(r io.ReadSeeker) (btrfs.Codec, error) {
+	codec, err := btrfs.DetectCodec(bufio.NewReader(r))
+	if err != nil {
+		return codec, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return codec, err
+}
+
+// verifyCloneSources scans the stream read from r and checks that every subvolume
+// referenced by a snapshot or clone command is either received by the stream itself
+// or is present beneath destDir.
+func verifyCloneSources(destDir string, r io.Reader) error {
+	inStream := make(map[uuid.UUID]bool)
+	resolved := make(map[uuid.UUID]bool)
+	check := func(id uuid.UUID, cmd sendstream.SendCommand) error {
+		if inStream[id] || resolved[id] {
+			return nil
+		}
+		_, err := btrfs.SubvolumeSearch(btrfs.SearchWithRootMount(destDir), btrfs.SearchWithReceivedUUID(id))
+		if errors.Is(err, btrfs.ErrSubvolumeNotFound) {
+			return fmt.Errorf("%w: %s references %s", ErrUnresolvedCloneSource, cmd, id)
+		}
+		if err != nil {
+			return err
+		}
+		resolved[id] = true
+		return nil
+	}
+	scanner := sendstream.NewScanner(r, false)
+	for scanner.Scan() {
+		hdr, attrs := scanner.Command()
+		switch hdr.Cmd {
+		case sendstream.BTRFS_SEND_C_SUBVOL, sendstream.BTRFS_SEND_C_SNAPSHOT:
+			id, err := attrs.GetUUID()
+			if err != nil {
+				return fmt.Errorf("invalid UUID in %s: %w", hdr.Cmd, err)
+			}
+			if hdr.Cmd == sendstream.BTRFS_SEND_C_SNAPSHOT {
+				parent, err := attrs.GetCloneUUID()
+				if err != nil {
+					return fmt.Errorf("invalid clone UUID in %s: %w", hdr.Cmd, err)
+				}
+				if err := check(parent, hdr.Cmd); err != nil {
+					return err
+				}
+			}
+			inStream[id] = true
+		case sendstream.BTRFS_SEND_C_CLONE:
+			id, err := attrs.GetCloneUUID()
+			if err != nil {
+				return fmt.Errorf("invalid clone UUID in %s: %w", hdr.Cmd, err)
+			}
+			if err := check(id, hdr.Cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,108 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// MigrateSubvolume moves the read-only subvolume src to the btrfs filesystem
+// mounted at destMount, where os.Rename fails with EXDEV. The subvolume is sent in
+// full and received directly beneath destMount, the received UUID and ctransid of
+// the copy are checked against src, and src is deleted only after that check has
+// passed. The information of the received subvolume is returned.
+//
+// The migration can be retried after a failure: if a read-only subvolume received
+// from src already exists on the destination filesystem, the send is skipped and
+// only src is deleted.
+func MigrateSubvolume(src, destMount string) (*btrfs.SubvolumeInfo, error) {
+	srcInfo, err := btrfs.GetSubvolumeInfo(src)
+	if err != nil {
+		return nil, err
+	}
+	if !srcInfo.ReadOnly {
+		return nil, fmt.Errorf("%w: %s must be read-only to migrate", btrfs.ErrNotReadOnlySubvolume, src)
+	}
+	// The kernel identifies a subvolume that was itself received by its received
+	// UUID in the stream, so that is what the copy will be received as.
+	want := srcInfo.UUID
+	if srcInfo.ReceivedUUID != uuid.Nil {
+		want = srcInfo.ReceivedUUID
+	}
+	info, err := findMigrated(destMount, want, srcInfo.Ctransid)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		if info, err = migrateStream(src, destMount); err != nil {
+			return nil, fmt.Errorf("failed to migrate %s to %s: %w", src, destMount, err)
+		}
+	}
+	if info.ReceivedUUID != want || info.Stransid != srcInfo.Ctransid {
+		return nil, fmt.Errorf("migrated copy of %s was received as %s at transid %d, expected %s at transid %d",
+			src, info.ReceivedUUID, info.Stransid, want, srcInfo.Ctransid)
+	}
+	if err := btrfs.DeleteSubvolume(src, true); err != nil {
+		return nil, fmt.Errorf("failed to delete %s after migrating it: %w", src, err)
+	}
+	return info, nil
+}
+
+// findMigrated returns the information of a completed earlier migration of the
+// subvolume with the given stream UUID and ctransid to destMount, or nil if there
+// is none. A copy that is still read-write was not finished and is not used.
+func findMigrated(destMount string, id uuid.UUID, ctransid uint64) (*btrfs.SubvolumeInfo, error) {
+	path, err := btrfs.FindSubvolumeByReceivedUUID(destMount, id)
+	if errors.Is(err, btrfs.ErrSubvolumeNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := btrfs.GetSubvolumeInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.ReadOnly || info.Stransid != ctransid {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// migrateStream sends src in full and receives the stream beneath destMount.
+func migrateStream(src, destMount string) (*btrfs.SubvolumeInfo, error) {
+	pr, pw := io.Pipe()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := btrfs.SendSubvolume(src, "", nil, pw)
+		pw.CloseWithError(err)
+		sendErr <- err
+	}()
+	info, err := ReceiveSubvolume(destMount, pr)
+	// Unblock the sender if the receiver stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if serr := <-sendErr; serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -17,9 +17,10 @@ package receive
 
 import (
 	"context"
+	"fmt"
 	"log"
 
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
 )
 
 // Option is a function that can be passed to ProcessSendStream to configure
@@ -99,3 +100,17 @@ func FromOffset(offset uint64) Option {
 		return nil
 	}
 }
+
+// WithBufferSize will read the stream through a buffer of the given size. The
+// stream is otherwise read one command header and payload at a time, which costs
+// a read for every few bytes on network and pipe readers. btrfs.DefaultBufferSize
+// suits fast links.
+func WithBufferSize(size int) Option {
+	return func(args *receiveCtx) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid receive buffer size %d", size)
+		}
+		args.bufferSize = size
+		return nil
+	}
+}
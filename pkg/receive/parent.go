@@ -0,0 +1,81 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/sendstream"
+)
+
+// ErrMissingParent is matched by errors returned when an incremental stream cannot
+// be received because its parent subvolume is not present at the destination.
+var ErrMissingParent = errors.New("parent subvolume not found at destination")
+
+// MissingParentError is returned by ReceiveSubvolume when the parent of an
+// incremental stream is not present at the destination. It carries the UUID and
+// ctransid of the required parent so that the caller can fetch a full send of it
+// instead. It matches ErrMissingParent.
+type MissingParentError struct {
+	// UUID is the UUID of the parent subvolume on the sending side.
+	UUID uuid.UUID
+	// Ctransid is the ctransid of the parent subvolume on the sending side.
+	Ctransid uint64
+}
+
+// Error implements the error interface.
+func (e *MissingParentError) Error() string {
+	return fmt.Sprintf("%s: %s (ctransid %d)", ErrMissingParent, e.UUID, e.Ctransid)
+}
+
+// Unwrap returns ErrMissingParent.
+func (e *MissingParentError) Unwrap() error { return ErrMissingParent }
+
+// checkParent reads the header of the stream from r and, if the stream is
+// incremental, finds the subvolume received from its parent on the filesystem of
+// destDir, which is the one the receiver snapshots. The returned reader yields the
+// whole stream, including the bytes consumed to read the header. The returned path
+// is that of the parent subvolume, or empty for full streams.
+func checkParent(destDir string, r io.Reader) (io.Reader, string, error) {
+	var buf bytes.Buffer
+	hdr, err := sendstream.ParseSendStreamHeader(io.TeeReader(r, &buf))
+	r = io.MultiReader(&buf, r)
+	if err != nil {
+		return r, "", err
+	}
+	if !hdr.Incremental() {
+		return r, "", nil
+	}
+	root, err := btrfs.FindRootMount(destDir)
+	if err != nil {
+		return r, "", fmt.Errorf("failed to find root mount for %s: %w", destDir, err)
+	}
+	// The receiver snapshots the subvolume received at the same ctransid, a
+	// subvolume received from another state of the parent cannot be used.
+	path, err := btrfs.FindReceivedSubvolume(root.Path, hdr.ParentUUID, hdr.ParentCtransid)
+	if errors.Is(err, btrfs.ErrSubvolumeNotFound) {
+		return r, "", &MissingParentError{UUID: hdr.ParentUUID, Ctransid: hdr.ParentCtransid}
+	}
+	if err != nil {
+		return r, "", err
+	}
+	return r, path, nil
+}
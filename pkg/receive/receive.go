@@ -17,17 +17,18 @@ If not, see <https://www.gnu.org/licenses/>.
 package receive
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"time"
 
-	"github.com/google/uuid"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/nop"
-	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/receive/receivers/nop"
+	"github.com/madworx/btrsync/pkg/sendstream"
 )
 
 var (
@@ -49,11 +50,26 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 			return err
 		}
 	}
+	parent := ctx.Context
 	var cancel func()
-	ctx.Context, cancel = context.WithCancel(ctx.Context)
+	ctx.Context, cancel = context.WithCancel(parent)
+
+	// Report the stream to the metrics, if any are set
+	metrics := btrfs.CurrentMetrics()
+	defer func(start time.Time) {
+		metrics.Observe(btrfs.MetricReceiveDuration, time.Since(start).Seconds())
+	}(time.Now())
+	r = &meteredReader{r: r, metrics: metrics}
+	if ctx.bufferSize > 0 {
+		r = bufio.NewReaderSize(r, ctx.bufferSize)
+	}
 
 	// Start an error counter and create a stream scanner
 	var streamErrors int
+	countError := func() {
+		streamErrors++
+		metrics.Count(btrfs.MetricReceiveErrors, 1)
+	}
 	stream := sendstream.NewScanner(r, ctx.ignoreChecksums)
 
 	// Scan the stream in a goroutine so we can block on either the context or the stream
@@ -65,6 +81,9 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 			ctx.log.Printf("Skipping to offset %d", ctx.startOffset)
 		}
 		for stream.Scan() {
+			if ctx.Err() != nil {
+				return
+			}
 			cmd, attrs := stream.Command()
 			if ctx.verbosity >= 2 {
 				ctx.log.Println("processing send cmd:", cmd.Cmd)
@@ -74,17 +93,20 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 			if ctx.startOffset > ctx.currentOffset {
 				ctx.currentOffset++
 				if cmd.Cmd == sendstream.BTRFS_SEND_C_SUBVOL || cmd.Cmd == sendstream.BTRFS_SEND_C_SNAPSHOT {
-					path := string(attrs[sendstream.BTRFS_SEND_A_PATH])
-					ctransid := binary.LittleEndian.Uint64(attrs[sendstream.BTRFS_SEND_A_CTRANSID])
-					uuid, err := uuid.FromBytes(attrs[sendstream.BTRFS_SEND_A_UUID])
+					c, err := sendstream.DecodeCommand(cmd, attrs)
 					if err != nil {
-						errCh <- fmt.Errorf("error parsing uuid: %s", err)
+						errCh <- fmt.Errorf("error parsing subvolume: %w", err)
 						return
 					}
-					ctx.log.Printf("Resuming subvol %s", path)
-					ctx.currentSubvolInfo = &sendstream.ReceivingSubvolume{
-						Path: path, UUID: uuid, Ctransid: ctransid,
+					var subvol *sendstream.ReceivingSubvolume
+					switch c := c.(type) {
+					case *sendstream.SubvolCmd:
+						subvol = &sendstream.ReceivingSubvolume{Path: c.Path, UUID: c.UUID, Ctransid: c.Ctransid}
+					case *sendstream.SnapshotCmd:
+						subvol = &sendstream.ReceivingSubvolume{Path: c.Path, UUID: c.UUID, Ctransid: c.Ctransid}
 					}
+					ctx.log.Printf("Resuming subvol %s", subvol.Path)
+					ctx.currentSubvolInfo = subvol
 				}
 				if ctx.verbosity >= 2 {
 					ctx.log.Printf("skipping cmd at offset %d", ctx.currentOffset)
@@ -92,13 +114,15 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 				continue
 			}
 
+			ctx.emitEvent(cmd.Cmd, attrs)
+
 			// Run any preop functions
 			if preOp, ok := ctx.receiver.(receivers.PreOpReceiver); ok {
 				err := preOp.PreOp(ctx, cmd, attrs)
 				if err != nil {
 					ctx.currentOffset++
 					if !errors.Is(err, receivers.ErrSkipCommand) {
-						streamErrors++
+						countError()
 						if streamErrors >= ctx.maxErrors {
 							errCh <- fmt.Errorf("max errors reached (%d): last error: %w", streamErrors, err)
 							return
@@ -122,14 +146,12 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 				}
 				err = ctx.receiver.FinishSubvolume(ctx)
 				ctx.currentSubvolInfo = nil
-			} else if f, ok := processFuncs[cmd.Cmd]; ok {
-				err = f(ctx, attrs)
 			} else {
-				err = fmt.Errorf("%w: %d", ErrInvalidSendCommand, cmd.Cmd)
+				err = processCommand(ctx, cmd, attrs)
 			}
 			if err != nil && !errors.Is(err, receivers.ErrSkipCommand) {
 				ctx.log.Println("error processing command:", err)
-				streamErrors++
+				countError()
 				if streamErrors >= ctx.maxErrors {
 					errCh <- fmt.Errorf("max errors reached (%d): last error: %w", streamErrors, err)
 					return
@@ -140,7 +162,7 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 			if postOp, ok := ctx.receiver.(receivers.PostOpReceiver); ok {
 				err := postOp.PostOp(ctx, cmd, attrs)
 				if err != nil && !errors.Is(err, receivers.ErrSkipCommand) {
-					streamErrors++
+					countError()
 					if streamErrors >= ctx.maxErrors {
 						errCh <- fmt.Errorf("max errors reached (%d): last error: %w", streamErrors, err)
 						return
@@ -155,6 +177,7 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 
 		// Check for any stream errors
 		if err := stream.Err(); err != nil {
+			metrics.Count(btrfs.MetricReceiveErrors, 1)
 			errCh <- stream.Err()
 			return
 		}
@@ -166,8 +189,9 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 		}
 	}()
 	<-ctx.Context.Done()
-	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return ctx.Err()
+	if err := parent.Err(); err != nil {
+		// The stream goroutine may still be running, leave errCh open for it
+		return err
 	}
 	ctx.LogVerbose(1, "context finished, checking for errors from stream")
 	close(errCh)
@@ -178,3 +202,15 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 	}
 	return nil
 }
+
+// meteredReader counts the bytes read through it in MetricReceiveBytes.
+type meteredReader struct {
+	r       io.Reader
+	metrics btrfs.Metrics
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.metrics.Count(btrfs.MetricReceiveBytes, float64(n))
+	return n, err
+}
@@ -31,9 +31,9 @@ import (
 
 	"github.com/google/uuid"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
-	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/sendstream"
 )
 
 type directoryReceiver struct {
@@ -201,7 +201,7 @@ func (n *directoryReceiver) Write(ctx receivers.ReceiveContext, path string, off
 }
 
 func (n *directoryReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
-	data, err := op.Decompress()
+	data, err := op.FileData()
 	if err != nil {
 		return err
 	}
@@ -19,4 +19,7 @@ import "errors"
 
 var (
 	ErrNotSupported = errors.New("operation not supported by receiver")
+	// ErrUnsafePath is returned when a path in a stream would resolve outside of
+	// the subvolume being received, such as through ".." or a symlink.
+	ErrUnsafePath = errors.New("path escapes the receive destination")
 )
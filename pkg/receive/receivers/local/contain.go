@@ -0,0 +1,101 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package local
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+)
+
+// containPath joins the path rel from a send stream to base and returns it, after
+// checking that the result stays within base. The path itself must not be
+// absolute or climb out of base with "..", and its parent directory must not
+// resolve outside of base through symlinks created earlier in the stream, nor pass
+// through a dangling symlink whose target cannot be checked. The last element of
+// the path may be a symlink, which operations on it must not follow; see
+// containTarget. Errors match receivers.ErrUnsafePath.
+//
+// The checks race with changes made to the tree by others while receiving, which
+// is acceptable as only the stream is expected to modify it.
+func containPath(base, rel string) (string, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(rel) {
+		return "", fmt.Errorf("%w: %q is absolute", receivers.ErrUnsafePath, rel)
+	}
+	path := filepath.Join(base, rel)
+	if !within(base, path) {
+		return "", fmt.Errorf("%w: %q", receivers.ErrUnsafePath, rel)
+	}
+	if path == base {
+		return path, nil
+	}
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	// Check the deepest existing ancestor if the parent does not exist yet, the
+	// operation then fails on its own but must not be attempted outside of base
+	for dir := filepath.Dir(path); within(base, dir); dir = filepath.Dir(dir) {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			if _, lerr := os.Lstat(dir); lerr == nil {
+				// A dangling symlink, whose target cannot be checked
+				return "", fmt.Errorf("%w: %q passes through dangling symlink %s", receivers.ErrUnsafePath, rel, dir)
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !within(realBase, realDir) {
+			return "", fmt.Errorf("%w: %q resolves to %s", receivers.ErrUnsafePath, rel, realDir)
+		}
+		return path, nil
+	}
+	return path, nil
+}
+
+// containTarget is like containPath, but also rejects a path whose last element
+// is a symlink, for operations that follow symlinks. A send stream never applies
+// such operations to a symlink, so one doing so is trying to reach the file the
+// symlink points to.
+func containTarget(base, rel string) (string, error) {
+	path, err := containPath(base, rel)
+	if err != nil {
+		return "", err
+	}
+	if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%w: %q is a symlink", receivers.ErrUnsafePath, rel)
+	}
+	return path, nil
+}
+
+// within returns true if path is base or lies beneath it. Both must be clean and
+// absolute.
+func within(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
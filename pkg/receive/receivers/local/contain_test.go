@@ -0,0 +1,130 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package local
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+)
+
+func TestContainPath(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"dir/sub", "other"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "dir/file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"escape":        outside,
+		"dir/up":        "../..",
+		"dir/abs":       "/etc",
+		"dir/inside":    "../other",
+		"dir/filelink":  "file",
+		"dir/dangling":  "missing",
+		"dir/sneaky":    filepath.Join(outside, "x"),
+		"other/relpeer": "../dir",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name       string
+		rel        string
+		wantPath   string
+		unsafe     bool
+		unsafeFile bool
+	}{
+		{name: "root", rel: "", wantPath: ""},
+		{name: "dot", rel: ".", wantPath: ""},
+		{name: "top level", rel: "new", wantPath: "new"},
+		{name: "nested", rel: "dir/sub/new", wantPath: "dir/sub/new"},
+		{name: "missing parents", rel: "dir/a/b/c", wantPath: "dir/a/b/c"},
+		{name: "dotdot within", rel: "dir/sub/../file", wantPath: "dir/file"},
+		{name: "symlink within", rel: "dir/inside/new", wantPath: "dir/inside/new"},
+		{name: "relative symlink to sibling", rel: "other/relpeer/file", wantPath: "other/relpeer/file"},
+		{name: "final symlink", rel: "dir/filelink", wantPath: "dir/filelink", unsafeFile: true},
+		{name: "final escaping symlink", rel: "escape", wantPath: "escape", unsafeFile: true},
+		{name: "final dangling symlink", rel: "dir/dangling", wantPath: "dir/dangling", unsafeFile: true},
+		{name: "dotdot", rel: "..", unsafe: true},
+		{name: "dotdot escape", rel: "../outside", unsafe: true},
+		{name: "nested dotdot escape", rel: "dir/../../outside", unsafe: true},
+		{name: "deep dotdot escape", rel: "dir/sub/../../../../etc/passwd", unsafe: true},
+		{name: "absolute", rel: "/etc/passwd", unsafe: true},
+		{name: "absolute root", rel: "/", unsafe: true},
+		{name: "symlink escape", rel: "escape/file", unsafe: true},
+		{name: "relative symlink escape", rel: "dir/up/file", unsafe: true},
+		{name: "absolute symlink escape", rel: "dir/abs/passwd", unsafe: true},
+		{name: "symlink escape missing parents", rel: "escape/a/b", unsafe: true},
+		{name: "symlink to missing outside", rel: "dir/sneaky/file", unsafe: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := filepath.Join(base, tt.wantPath)
+			path, err := containPath(base, tt.rel)
+			switch {
+			case tt.unsafe:
+				if !errors.Is(err, receivers.ErrUnsafePath) {
+					t.Errorf("containPath(%q) = %q, %v, want ErrUnsafePath", tt.rel, path, err)
+				}
+			case err != nil:
+				t.Errorf("containPath(%q) failed: %v", tt.rel, err)
+			case path != want:
+				t.Errorf("containPath(%q) = %q, want %q", tt.rel, path, want)
+			}
+			path, err = containTarget(base, tt.rel)
+			switch {
+			case tt.unsafe || tt.unsafeFile:
+				if !errors.Is(err, receivers.ErrUnsafePath) {
+					t.Errorf("containTarget(%q) = %q, %v, want ErrUnsafePath", tt.rel, path, err)
+				}
+			case err != nil:
+				t.Errorf("containTarget(%q) failed: %v", tt.rel, err)
+			case path != want:
+				t.Errorf("containTarget(%q) = %q, want %q", tt.rel, path, want)
+			}
+		})
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		base, path string
+		want       bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b", "/a/b/c", true},
+		{"/a/b", "/a/b/..c", true},
+		{"/a/b", "/a", false},
+		{"/a/b", "/a/bc", false},
+		{"/a/b", "/x", false},
+		{"/", "/anything", true},
+	}
+	for _, tt := range tests {
+		if got := within(tt.base, tt.path); got != tt.want {
+			t.Errorf("within(%q, %q) = %v, want %v", tt.base, tt.path, got, tt.want)
+		}
+	}
+}
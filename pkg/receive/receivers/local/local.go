@@ -17,6 +17,7 @@ If not, see <https://www.gnu.org/licenses/>.
 package local
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -26,37 +27,94 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
 )
 
 type localReceiver struct {
 	destPath string
+	parent   string
 }
 
-func New(destPath string) receivers.Receiver {
-	return &localReceiver{destPath: destPath}
+// Option configures a receiver created with New.
+type Option func(*localReceiver)
+
+// WithParent makes the receiver use the subvolume at path as the base of
+// snapshots whose parent it was received from, rather than searching the
+// filesystem for it. Snapshots of other parents are still searched for.
+func WithParent(path string) Option {
+	return func(n *localReceiver) {
+		n.parent = path
+	}
+}
+
+func New(destPath string, opts ...Option) receivers.Receiver {
+	n := &localReceiver{destPath: destPath}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// resolvePath returns the path in the local filesystem of path in the subvolume
+// being received, rejecting paths that escape the subvolume with containPath.
+func (n *localReceiver) resolvePath(ctx receivers.ReceiveContext, path string) (string, error) {
+	return containPath(filepath.Join(n.destPath, ctx.CurrentSubvolume().Path), path)
 }
 
-func (n *localReceiver) resolvePath(ctx receivers.ReceiveContext, path string) string {
-	return filepath.Join(n.destPath, ctx.CurrentSubvolume().ResolvePath(path))
+// resolveTarget is like resolvePath but also rejects symlinks, for operations that
+// follow them.
+func (n *localReceiver) resolveTarget(ctx receivers.ReceiveContext, path string) (string, error) {
+	return containTarget(filepath.Join(n.destPath, ctx.CurrentSubvolume().Path), path)
 }
 
 func (n *localReceiver) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
-	fullpath := filepath.Join(n.destPath, path)
-	ctx.LogVerbose(2, "creating subvolume %q at %q\n", path, fullpath)
 	if err := os.MkdirAll(n.destPath, 0755); err != nil {
 		return err
 	}
+	fullpath, err := containPath(n.destPath, path)
+	if err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "creating subvolume %q at %q\n", path, fullpath)
 	return btrfs.CreateSubvolume(fullpath)
 }
 
 func (n *localReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	parent, err := n.findParent(ctx, path, cloneUUID, cloneCtransid)
+	if err != nil {
+		return err
+	}
+	dest, err := containPath(n.destPath, path)
+	if err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "creating snapshot of %q at %q\n", parent, dest)
+	if err := btrfs.CreateSnapshot(parent, btrfs.WithSnapshotPath(dest)); err != nil {
+		return err
+	}
+	return btrfs.SyncFilesystem(dest)
+}
+
+// findParent returns the path of the subvolume received from cloneUUID at
+// cloneCtransid, which is the base of the snapshot at path.
+func (n *localReceiver) findParent(ctx receivers.ReceiveContext, path string, cloneUUID uuid.UUID, cloneCtransid uint64) (string, error) {
+	if n.parent != "" {
+		info, err := btrfs.GetSubvolumeInfo(n.parent)
+		if err != nil {
+			return "", err
+		}
+		if info.ReceivedUUID == cloneUUID && info.Stransid == cloneCtransid {
+			ctx.LogVerbose(3, "using parent subvolume %s (%s) for snapshot %s\n", n.parent, cloneUUID, path)
+			return n.parent, nil
+		}
+	}
 	ctx.LogVerbose(3, "searching for parent subvolume of snapshot %q\n", path)
 	root, err := btrfs.FindRootMount(n.destPath)
 	if err != nil {
-		return fmt.Errorf("failed to find root mount for %s: %w", n.destPath, err)
+		return "", fmt.Errorf("failed to find root mount for %s: %w", n.destPath, err)
 	}
 	// Retry this a couple times for unknown reason still
 	var rbtree *btrfs.RBRoot
@@ -72,14 +130,14 @@ func (n *localReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid
 		retries++
 	}
 	if rbtree == nil {
-		return fmt.Errorf("failed to build rbtree for %s: %w", root, err)
+		return "", fmt.Errorf("failed to build rbtree for %s: %w", root, err)
 	}
 	var parent *btrfs.RootInfo
 	rbtree.PostOrderIterate(func(node *btrfs.RootInfo, lastErr error) error {
 		if node.Deleted || isNilUUID(node.ReceivedUUID) {
 			return nil
 		}
-		ctx.LogVerbose(3, "checking if %s (%d) matches with subvolume %s (%d)\n", cloneUUID, ctransid, node.ReceivedUUID, node.Item.Stransid)
+		ctx.LogVerbose(3, "checking if %s (%d) matches with subvolume %s (%d)\n", cloneUUID, cloneCtransid, node.ReceivedUUID, node.Item.Stransid)
 		if node.ReceivedUUID == cloneUUID && node.Item.Stransid == cloneCtransid {
 			ctx.LogVerbose(3, "found parent subvolume %s (%s) for snapshot %s\n", node.FullPath, node.ReceivedUUID, path)
 			parent = node
@@ -88,17 +146,12 @@ func (n *localReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid
 		return nil
 	})
 	if parent == nil {
-		return fmt.Errorf("could not find parent subvolume for snapshot %q", path)
+		return "", fmt.Errorf("could not find parent subvolume for snapshot %q", path)
 	}
-	dest := filepath.Join(n.destPath, path)
 	if !strings.HasPrefix(parent.FullPath, root.Path) {
-		parent.FullPath = filepath.Join(root.Path, parent.FullPath)
+		return filepath.Join(root.Path, parent.FullPath), nil
 	}
-	ctx.LogVerbose(2, "creating snapshot of %q at %q\n", parent.FullPath, dest)
-	if err := btrfs.CreateSnapshot(parent.FullPath, btrfs.WithSnapshotPath(dest)); err != nil {
-		return err
-	}
-	return btrfs.SyncFilesystem(dest)
+	return parent.FullPath, nil
 }
 
 func isNilUUID(uu uuid.UUID) bool {
@@ -106,9 +159,13 @@ func isNilUUID(uu uuid.UUID) bool {
 }
 
 func (n *localReceiver) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "creating file %q with mode 0600\n", path)
-	f, err := os.Create(path)
+	// Never open an existing file, a symlink planted at path would be followed
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
 	if err != nil {
 		return err
 	}
@@ -116,25 +173,37 @@ func (n *localReceiver) Mkfile(ctx receivers.ReceiveContext, path string, ino ui
 }
 
 func (n *localReceiver) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "making new directory at %q with mode 0755\n", path)
 	return os.Mkdir(path, 0755)
 }
 
 func (n *localReceiver) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "creating device %q with mode %d and rdev %d\n", path, mode, rdev)
 	return syscall.Mknod(path, mode, int(rdev))
 }
 
 func (n *localReceiver) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "creating fifo %q with mode 0600\n", path)
 	return syscall.Mkfifo(path, 0600)
 }
 
 func (n *localReceiver) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "creating unix domain socket at %q\n", path)
 	sock, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
@@ -145,40 +214,65 @@ func (n *localReceiver) Mksock(ctx receivers.ReceiveContext, path string, ino ui
 }
 
 func (n *localReceiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
-	path = n.resolvePath(ctx, path)
-	linkTo = n.resolvePath(ctx, linkTo)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	// The target is stored as is, like `btrfs receive` does. It may point anywhere,
+	// which is why later operations do not follow symlinks.
 	ctx.LogVerbose(3, "creating symlink %q -> %q\n", path, linkTo)
 	return os.Symlink(linkTo, path)
 }
 
 func (n *localReceiver) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
-	oldPath = n.resolvePath(ctx, oldPath)
-	newPath = n.resolvePath(ctx, newPath)
+	oldPath, err := n.resolvePath(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = n.resolvePath(ctx, newPath)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "rename %q to %q\n", oldPath, newPath)
 	return os.Rename(oldPath, newPath)
 }
 
 func (n *localReceiver) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
-	path = n.resolvePath(ctx, path)
-	linkTo = n.resolvePath(ctx, linkTo)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	linkTo, err = n.resolvePath(ctx, linkTo)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "link %q -> %q\n", path, linkTo)
 	return os.Link(linkTo, path)
 }
 
 func (n *localReceiver) Unlink(ctx receivers.ReceiveContext, path string) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "unlinking %q\n", path)
 	return os.Remove(path)
 }
 
 func (n *localReceiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "removing directory %q\n", path)
 	return os.RemoveAll(path)
 }
 
 func (n *localReceiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "write %d bytes to %q at offset %d\n", len(data), path, offset)
 	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
 	if err != nil {
@@ -192,9 +286,16 @@ func (n *localReceiver) Write(ctx receivers.ReceiveContext, path string, offset
 }
 
 func (n *localReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
-	fullpath := n.resolvePath(ctx, path)
+	fullpath, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "encoded write to %q at offset %d\n", fullpath, op.Offset)
-	return btrfs.EncodedWrite(fullpath, op)
+	err = btrfs.EncodedWrite(fullpath, op)
+	if errors.Is(err, btrfs.ErrEncodedWriteNotSupported) {
+		return fmt.Errorf("%w: %v", receivers.ErrNotSupported, err)
+	}
+	return err
 }
 
 func (n *localReceiver) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
@@ -208,46 +309,71 @@ func (n *localReceiver) Clone(ctx receivers.ReceiveContext, path string, offset
 		}
 		subvolPath = filepath.Join(n.destPath, parent.Path)
 	}
-	clonePath = filepath.Join(subvolPath, clonePath)
-	destPath := n.resolvePath(ctx, path)
+	clonePath, err := containTarget(subvolPath, clonePath)
+	if err != nil {
+		return err
+	}
+	destPath, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "clone %d bytes from %q at offset %d to %q at offset %d\n", len, clonePath, cloneOffset, destPath, offset)
 	return btrfs.Clone(clonePath, destPath, cloneOffset, offset, len)
 }
 
 func (n *localReceiver) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "setting xattr %q on %q\n", name, path)
-	return syscall.Setxattr(path, name, data, 0)
+	return unix.Lsetxattr(path, name, data, 0)
 }
 
 func (n *localReceiver) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "removing xattr %q on %q\n", name, path)
-	return syscall.Removexattr(path, name)
+	return unix.Lremovexattr(path, name)
 }
 
 func (n *localReceiver) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "truncating %q to %d bytes\n", path, size)
 	return os.Truncate(path, int64(size))
 }
 
 func (n *localReceiver) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "chmod %q to %o\n", path, mode)
 	return os.Chmod(path, fs.FileMode(mode))
 }
 
 func (n *localReceiver) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "chown %q to %d:%d\n", path, uid, gid)
-	return os.Chown(path, int(uid), int(gid))
+	return os.Lchown(path, int(uid), int(gid))
 }
 
 func (n *localReceiver) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolvePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "utimes %q to %v:%v", path, atime, mtime)
-	return os.Chtimes(path, atime, mtime)
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
 }
 
 func (n *localReceiver) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
@@ -259,13 +385,19 @@ func (n *localReceiver) UpdateExtent(ctx receivers.ReceiveContext, path string,
 }
 
 func (n *localReceiver) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "enable verity %q with algorithm %d, block size %d, salt %v, signature %v\n", path, algorithm, blockSize, salt, sig)
 	return btrfs.EnableVerity(path, uint32(algorithm), blockSize, salt, sig)
 }
 
 func (n *localReceiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "fallocate %q to %d bytes at offset %d\n", path, len, offset)
 	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
 	if err != nil {
@@ -277,7 +409,10 @@ func (n *localReceiver) Fallocate(ctx receivers.ReceiveContext, path string, mod
 
 func (n *localReceiver) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
 	// From source it looks like this just makes sure it can open the file for writing
-	path = n.resolvePath(ctx, path)
+	path, err := n.resolveTarget(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "fileattr %q to %d\n", path, attr)
 	f, err := os.OpenFile(path, os.O_RDWR, 0600)
 	if err != nil {
@@ -286,25 +421,34 @@ func (n *localReceiver) Fileattr(ctx receivers.ReceiveContext, path string, attr
 	return f.Close()
 }
 
+// FinishSubvolume sets the received UUID and ctransid on the subvolume and makes it
+// read-only. The received UUID can only be set while the subvolume is read-write,
+// so it is set before the read-only flag. Both are applied through a single open
+// handle, so the subvolume cannot be swapped out from under the path in between,
+// and the transaction is synced before returning.
 func (n *localReceiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
 	curVol := ctx.CurrentSubvolume()
 	path := filepath.Join(n.destPath, curVol.Path)
-	isReadOnly, err := btrfs.IsSubvolumeReadOnly(path)
+	subvol, err := btrfs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer subvol.Close()
+	isReadOnly, err := subvol.IsReadOnly()
 	if err != nil {
 		return err
 	}
 	if isReadOnly {
 		ctx.LogVerbose(3, "setting subvolume %q read-write temporarily to finish operations\n", path)
-		err = btrfs.SetSubvolumeReadOnly(path, false)
-		if err != nil {
+		if err := subvol.SetReadOnly(false); err != nil {
 			return err
 		}
 	}
 	ctx.LogVerbose(2, "finish subvolume %s with uuid=%s ctransid=%d\n", curVol.Path, curVol.UUID, curVol.Ctransid)
-	if err := btrfs.SetReceivedSubvolume(path, curVol.UUID, curVol.Ctransid); err != nil {
+	if err := subvol.SetReceived(curVol.UUID, curVol.Ctransid); err != nil {
 		return err
 	}
-	if err := btrfs.SetSubvolumeReadOnly(path, true); err != nil {
+	if err := subvol.SetReadOnly(true); err != nil {
 		return err
 	}
 	return btrfs.SyncFilesystem(path)
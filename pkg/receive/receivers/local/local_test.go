@@ -0,0 +1,232 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/sendstream"
+)
+
+// testReceiveContext is a receive context for a subvolume at a fixed path.
+type testReceiveContext struct {
+	context.Context
+	subvol *sendstream.ReceivingSubvolume
+}
+
+func (c *testReceiveContext) CurrentOffset() uint64 { return 0 }
+
+func (c *testReceiveContext) CurrentSubvolume() *sendstream.ReceivingSubvolume { return c.subvol }
+
+func (c *testReceiveContext) ResolvePath(path string) string {
+	return filepath.Join(c.subvol.Path, path)
+}
+
+func (c *testReceiveContext) LogVerbose(level int, format string, args ...interface{}) {}
+
+func TestReceiverStaysWithinDestination(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup is applied to the receiver first and must succeed
+		setup func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error
+		op    func(r receivers.Receiver, ctx receivers.ReceiveContext) error
+	}{
+		{
+			name: "mkfile dotdot",
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Mkfile(ctx, "../escape", 1)
+			},
+		},
+		{
+			name: "mkfile deep dotdot",
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Mkfile(ctx, "a/../../../escape", 1)
+			},
+		},
+		{
+			name: "mkfile over symlink",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Symlink(ctx, "x", 1, filepath.Join(outside, "secret"))
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Mkfile(ctx, "x", 2)
+			},
+		},
+		{
+			name: "mkfile over dangling symlink",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Symlink(ctx, "x", 1, filepath.Join(outside, "new"))
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Mkfile(ctx, "x", 2)
+			},
+		},
+		{
+			name: "mkfile through symlinked directory",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Symlink(ctx, "d", 1, outside)
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Mkfile(ctx, "d/new", 2)
+			},
+		},
+		{
+			name: "write through symlink",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Symlink(ctx, "x", 1, filepath.Join(outside, "secret"))
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Write(ctx, "x", 0, []byte("gotcha"))
+			},
+		},
+		{
+			name: "rename dotdot",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Mkfile(ctx, "file", 1)
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Rename(ctx, "file", "../../moved")
+			},
+		},
+		{
+			name: "rename into symlinked directory",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				if err := r.Mkfile(ctx, "file", 1); err != nil {
+					return err
+				}
+				return r.Symlink(ctx, "d", 2, outside)
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Rename(ctx, "file", "d/moved")
+			},
+		},
+		{
+			name: "rename from outside",
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Rename(ctx, "../../outside/secret", "stolen")
+			},
+		},
+		{
+			name: "link dotdot",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Mkfile(ctx, "file", 1)
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Link(ctx, "../linked", "file")
+			},
+		},
+		{
+			name: "link into symlinked directory",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				if err := r.Mkfile(ctx, "file", 1); err != nil {
+					return err
+				}
+				return r.Symlink(ctx, "d", 2, outside)
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Link(ctx, "d/linked", "file")
+			},
+		},
+		{
+			name: "link to file through symlinked directory",
+			setup: func(r receivers.Receiver, ctx receivers.ReceiveContext, outside string) error {
+				return r.Symlink(ctx, "d", 1, outside)
+			},
+			op: func(r receivers.Receiver, ctx receivers.ReceiveContext) error {
+				return r.Link(ctx, "stolen", "d/secret")
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "dest")
+			outside := filepath.Join(root, "outside")
+			for _, dir := range []string{filepath.Join(dest, "subvol"), outside} {
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			secret := filepath.Join(outside, "secret")
+			if err := os.WriteFile(secret, []byte("keep"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			r := New(dest)
+			ctx := &testReceiveContext{
+				Context: context.Background(),
+				subvol:  &sendstream.ReceivingSubvolume{Path: "subvol"},
+			}
+			if tc.setup != nil {
+				if err := tc.setup(r, ctx, outside); err != nil {
+					t.Fatalf("setup: %v", err)
+				}
+			}
+			before := listTree(t, root)
+			err := tc.op(r, ctx)
+			if !errors.Is(err, receivers.ErrUnsafePath) {
+				t.Errorf("got error %v, want %v", err, receivers.ErrUnsafePath)
+			}
+			if after := listTree(t, root); after != before {
+				t.Errorf("tree changed:\nbefore:\n%s\nafter:\n%s", before, after)
+			}
+			if data, err := os.ReadFile(secret); err != nil || string(data) != "keep" {
+				t.Errorf("file outside of destination changed: %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestMkfileCreatesFile(t *testing.T) {
+	dest := t.TempDir()
+	r := New(dest)
+	ctx := &testReceiveContext{Context: context.Background(), subvol: &sendstream.ReceivingSubvolume{}}
+	if err := r.Mkfile(ctx, "file", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Write(ctx, "file", 0, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "file")); err != nil || string(data) != "data" {
+		t.Errorf("got %q, %v, want %q", data, err, "data")
+	}
+	if err := r.Mkfile(ctx, "file", 2); !errors.Is(err, os.ErrExist) {
+		t.Errorf("mkfile of existing file: got %v, want %v", err, os.ErrExist)
+	}
+}
+
+// listTree returns the paths, types and sizes of everything beneath root.
+func listTree(t *testing.T, root string) string {
+	t.Helper()
+	var out string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		out += fmt.Sprintf("%s %s %d\n", rel, info.Mode().Type(), info.Size())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
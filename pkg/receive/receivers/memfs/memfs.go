@@ -32,8 +32,8 @@ import (
 	"github.com/google/uuid"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
 )
 
 type fmode int
@@ -141,7 +141,7 @@ func (n *MemFSReceiver) Write(ctx receivers.ReceiveContext, path string, offset
 }
 
 func (n *MemFSReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
-	data, err := op.Decompress()
+	data, err := op.FileData()
 	if err != nil {
 		return err
 	}
@@ -231,7 +231,7 @@ func (n *MemFSReceiver) OnAdd(ctx context.Context) {
 		dir, base := filepath.Split(name)
 		p := n.mkdirAll(ctx, dir)
 		embedder := &fusefs.MemSymlink{
-			Inode: n.findInode(ctx, target),
+			Data: []byte(target),
 		}
 		ch := p.NewPersistentInode(ctx, embedder, fusefs.StableAttr{})
 		p.AddChild(base, ch, true)
@@ -240,20 +240,6 @@ func (n *MemFSReceiver) OnAdd(ctx context.Context) {
 	n.symlinks = make(map[string]string)
 }
 
-func (n *MemFSReceiver) findInode(ctx context.Context, path string) fusefs.Inode {
-	p := &n.Inode
-	for _, name := range filepath.SplitList(path) {
-		if name == "" {
-			continue
-		}
-		p = p.GetChild(name)
-		if p == nil {
-			return fusefs.Inode{}
-		}
-	}
-	return *p
-}
-
 func (n *MemFSReceiver) mkdirAll(ctx context.Context, path string) *fusefs.Inode {
 	p := &n.Inode
 	for _, component := range strings.Split(path, "/") {
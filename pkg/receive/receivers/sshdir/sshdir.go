@@ -33,9 +33,9 @@ import (
 	"github.com/google/uuid"
 	"golang.org/x/crypto/ssh"
 
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
-	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/sendstream"
 )
 
 type sshReceiver struct {
@@ -234,7 +234,7 @@ func (n *sshReceiver) Write(ctx receivers.ReceiveContext, path string, offset ui
 }
 
 func (n *sshReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
-	data, err := op.Decompress()
+	data, err := op.FileData()
 	if err != nil {
 		return err
 	}
@@ -19,451 +19,152 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/google/uuid"
-
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
-	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/sendstream"
 )
 
-type processFunc func(*receiveCtx, sendstream.CmdAttrs) error
-
-var processFuncs = map[sendstream.SendCommand]processFunc{
-	sendstream.BTRFS_SEND_C_SUBVOL:        processSubvol,
-	sendstream.BTRFS_SEND_C_SNAPSHOT:      processSnapshot,
-	sendstream.BTRFS_SEND_C_MKFILE:        processMkfile,
-	sendstream.BTRFS_SEND_C_MKDIR:         processMkdir,
-	sendstream.BTRFS_SEND_C_MKNOD:         processMknod,
-	sendstream.BTRFS_SEND_C_MKFIFO:        processMkfifo,
-	sendstream.BTRFS_SEND_C_MKSOCK:        processMksock,
-	sendstream.BTRFS_SEND_C_SYMLINK:       processSymlink,
-	sendstream.BTRFS_SEND_C_RENAME:        processRename,
-	sendstream.BTRFS_SEND_C_LINK:          processLink,
-	sendstream.BTRFS_SEND_C_UNLINK:        processUnlink,
-	sendstream.BTRFS_SEND_C_RMDIR:         processRmdir,
-	sendstream.BTRFS_SEND_C_WRITE:         processWrite,
-	sendstream.BTRFS_SEND_C_ENCODED_WRITE: processEncodedWrite,
-	sendstream.BTRFS_SEND_C_CLONE:         processClone,
-	sendstream.BTRFS_SEND_C_SET_XATTR:     processSetXattr,
-	sendstream.BTRFS_SEND_C_REMOVE_XATTR:  processRemoveXattr,
-	sendstream.BTRFS_SEND_C_TRUNCATE:      processTruncate,
-	sendstream.BTRFS_SEND_C_CHMOD:         processChmod,
-	sendstream.BTRFS_SEND_C_CHOWN:         processChown,
-	sendstream.BTRFS_SEND_C_UTIMES:        processUtimes,
-	sendstream.BTRFS_SEND_C_UPDATE_EXTENT: processUpdateExtent,
-	sendstream.BTRFS_SEND_C_ENABLE_VERITY: processEnableVerity,
-	sendstream.BTRFS_SEND_C_FALLOCATE:     processFallocate,
-	sendstream.BTRFS_SEND_C_FILEATTR:      processFileattr,
-}
-
-func processSubvol(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_UUID, sendstream.BTRFS_SEND_A_CTRANSID,
-	}); err != nil {
-		return fmt.Errorf("processSubvol: %w", err)
+// processCommand decodes a command read from the stream and applies it to the
+// receiver. END commands are handled by the caller.
+func processCommand(ctx *receiveCtx, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	c, err := sendstream.DecodeCommand(hdr, attrs)
+	if err != nil {
+		if errors.Is(err, sendstream.ErrUnknownCommand) {
+			return fmt.Errorf("%w: %d", ErrInvalidSendCommand, hdr.Cmd)
+		}
+		return err
 	}
+	switch c := c.(type) {
+	case *sendstream.SubvolCmd:
+		return processSubvol(ctx, c)
+	case *sendstream.SnapshotCmd:
+		return processSnapshot(ctx, c)
+	case *sendstream.MkfileCmd:
+		ctx.LogVerbose(2, "receiving mkfile %q ino=%d\n", c.Path, c.Ino)
+		return ctx.receiver.Mkfile(ctx, c.Path, c.Ino)
+	case *sendstream.MkdirCmd:
+		ctx.LogVerbose(2, "receiving mkdir %q ino=%d\n", c.Path, c.Ino)
+		return ctx.receiver.Mkdir(ctx, c.Path, c.Ino)
+	case *sendstream.MknodCmd:
+		ctx.LogVerbose(2, "receiving mknod %q ino=%d mode=%o rdev=%d\n", c.Path, c.Ino, c.Mode, c.Rdev)
+		return ctx.receiver.Mknod(ctx, c.Path, c.Ino, c.Mode, c.Rdev)
+	case *sendstream.MkfifoCmd:
+		ctx.LogVerbose(2, "receiving mkfifo %q ino=%d\n", c.Path, c.Ino)
+		return ctx.receiver.Mkfifo(ctx, c.Path, c.Ino)
+	case *sendstream.MksockCmd:
+		ctx.LogVerbose(2, "receiving mksock %q ino=%d\n", c.Path, c.Ino)
+		return ctx.receiver.Mksock(ctx, c.Path, c.Ino)
+	case *sendstream.SymlinkCmd:
+		ctx.LogVerbose(2, "receiving symlink %q ino=%d -> %q\n", c.Path, c.Ino, c.PathLink)
+		return ctx.receiver.Symlink(ctx, c.Path, c.Ino, c.PathLink)
+	case *sendstream.RenameCmd:
+		ctx.LogVerbose(2, "receiving rename %q -> %q", c.Path, c.PathTo)
+		return ctx.receiver.Rename(ctx, c.Path, c.PathTo)
+	case *sendstream.LinkCmd:
+		ctx.LogVerbose(2, "receiving link %q -> %q", c.Path, c.PathLink)
+		return ctx.receiver.Link(ctx, c.Path, c.PathLink)
+	case *sendstream.UnlinkCmd:
+		ctx.LogVerbose(2, "receiving unlink %q", c.Path)
+		return ctx.receiver.Unlink(ctx, c.Path)
+	case *sendstream.RmdirCmd:
+		ctx.LogVerbose(2, "receiving rmdir %q", c.Path)
+		return ctx.receiver.Rmdir(ctx, c.Path)
+	case *sendstream.WriteCmd:
+		ctx.LogVerbose(2, "receiving write %q offset=%d len=%d", c.Path, c.Offset, len(c.Data))
+		return ctx.receiver.Write(ctx, c.Path, c.Offset, c.Data)
+	case *sendstream.EncodedWriteCmd:
+		return processEncodedWrite(ctx, c)
+	case *sendstream.CloneCmd:
+		ctx.LogVerbose(2, "receiving clone %q offset=%d len=%d cloneUUID=%s cloneCTransID=%d clonePath=%q cloneOffset=%d",
+			c.Path, c.Offset, c.CloneLen, c.CloneUUID, c.CloneCtransid, c.ClonePath, c.CloneOffset)
+		return ctx.receiver.Clone(ctx, c.Path, c.Offset, c.CloneLen, c.CloneUUID, c.CloneCtransid, c.ClonePath, c.CloneOffset)
+	case *sendstream.SetXattrCmd:
+		ctx.LogVerbose(2, "receiving setxattr %q name=%q len=%d", c.Path, c.Name, len(c.Data))
+		return ctx.receiver.SetXattr(ctx, c.Path, c.Name, c.Data)
+	case *sendstream.RemoveXattrCmd:
+		ctx.LogVerbose(2, "receiving removexattr %q name=%q", c.Path, c.Name)
+		return ctx.receiver.RemoveXattr(ctx, c.Path, c.Name)
+	case *sendstream.TruncateCmd:
+		ctx.LogVerbose(2, "receiving truncate %q size=%d", c.Path, c.Size)
+		return ctx.receiver.Truncate(ctx, c.Path, c.Size)
+	case *sendstream.ChmodCmd:
+		ctx.LogVerbose(2, "receiving chmod %q mode=%o", c.Path, c.Mode)
+		return ctx.receiver.Chmod(ctx, c.Path, c.Mode)
+	case *sendstream.ChownCmd:
+		ctx.LogVerbose(2, "receiving chown %q uid=%d gid=%d", c.Path, c.UID, c.GID)
+		return ctx.receiver.Chown(ctx, c.Path, c.UID, c.GID)
+	case *sendstream.UtimesCmd:
+		ctx.LogVerbose(2, "receiving utimes %q atime=%v mtime=%v ctime=%v", c.Path, c.Atime, c.Mtime, c.Ctime)
+		return ctx.receiver.Utimes(ctx, c.Path, c.Atime, c.Mtime, c.Ctime)
+	case *sendstream.UpdateExtentCmd:
+		ctx.LogVerbose(2, "receiving update_extent %q offset=%d size=%d", c.Path, c.Offset, c.Size)
+		return ctx.receiver.UpdateExtent(ctx, c.Path, c.Offset, c.Size)
+	case *sendstream.EnableVerityCmd:
+		ctx.LogVerbose(2, "receiving enable_verity %q algorithm=%d block_size=%d", c.Path, c.Algorithm, c.BlockSize)
+		return ctx.receiver.EnableVerity(ctx, c.Path, c.Algorithm, c.BlockSize, c.Salt, c.Sig)
+	case *sendstream.FallocateCmd:
+		ctx.LogVerbose(2, "receiving fallocate %q mode=%d offset=%d size=%d", c.Path, c.Mode, c.Offset, c.Size)
+		return ctx.receiver.Fallocate(ctx, c.Path, c.Mode, c.Offset, c.Size)
+	case *sendstream.FileattrCmd:
+		ctx.LogVerbose(2, "receiving fileattr %q fileattr=%d", c.Path, c.Attr)
+		return ctx.receiver.Fileattr(ctx, c.Path, c.Attr)
+	}
+	return fmt.Errorf("%w: %d", ErrInvalidSendCommand, hdr.Cmd)
+}
+
+func processSubvol(ctx *receiveCtx, c *sendstream.SubvolCmd) error {
 	if ctx.currentSubvolInfo != nil {
 		if err := ctx.receiver.FinishSubvolume(ctx); err != nil {
 			return fmt.Errorf("processSubvol: error finishing in-process subvolume: %w", err)
 		}
 		ctx.currentSubvolInfo = nil
 	}
-	path := attrs.GetPath()
-	ctransid := attrs.GetCtransid()
-	uuid, err := attrs.GetUUID()
-	if err != nil {
-		return fmt.Errorf("processSubvol: error parsing uuid %w", err)
-	}
-	ctx.LogVerbose(0, "At subvol %q\n", path)
-	ctx.LogVerbose(2, "receiving subvol %q uuid=%s, stransid=%d\n", path, uuid, ctransid)
+	ctx.LogVerbose(0, "At subvol %q\n", c.Path)
+	ctx.LogVerbose(2, "receiving subvol %q uuid=%s, stransid=%d\n", c.Path, c.UUID, c.Ctransid)
 	ctx.currentSubvolInfo = &sendstream.ReceivingSubvolume{
-		Path: path, UUID: uuid, Ctransid: ctransid,
-	}
-	if err := ctx.receiver.Subvol(ctx, path, uuid, ctransid); err != nil {
-		return err
+		Path: c.Path, UUID: c.UUID, Ctransid: c.Ctransid,
 	}
-	return nil
+	return ctx.receiver.Subvol(ctx, c.Path, c.UUID, c.Ctransid)
 }
 
-func processSnapshot(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_UUID, sendstream.BTRFS_SEND_A_CTRANSID,
-		sendstream.BTRFS_SEND_A_CLONE_UUID, sendstream.BTRFS_SEND_A_CLONE_CTRANSID,
-	}); err != nil {
-		return fmt.Errorf("processSnapshot: %w", err)
-	}
+func processSnapshot(ctx *receiveCtx, c *sendstream.SnapshotCmd) error {
 	if ctx.currentSubvolInfo != nil {
 		if err := ctx.receiver.FinishSubvolume(ctx); err != nil {
 			return fmt.Errorf("processSnapshot: error finishing in-process subvolume: %w", err)
 		}
 		ctx.currentSubvolInfo = nil
 	}
-	path := attrs.GetPath()
-	snapuuid, err := attrs.GetUUID()
-	if err != nil {
-		return fmt.Errorf("processSnapshot: error parsing uuid %w", err)
-	}
-	ctransid := attrs.GetCtransid()
-	cloneUUID, err := attrs.GetCloneUUID()
-	if err != nil {
-		return fmt.Errorf("processSnapshot: error parsing clone uuid %w", err)
-	}
-	cloneCtransid := attrs.GetCloneCtransid()
-	ctx.LogVerbose(0, "At snapshot %q\n", path)
+	ctx.LogVerbose(0, "At snapshot %q\n", c.Path)
 	ctx.LogVerbose(2, "receiving snapshot %q uuid=%s, stransid=%d, clone_uuid=%s, clone_stransid=%d\n",
-		path, snapuuid, ctransid, cloneUUID, cloneCtransid)
+		c.Path, c.UUID, c.Ctransid, c.CloneUUID, c.CloneCtransid)
 	ctx.currentSubvolInfo = &sendstream.ReceivingSubvolume{
-		Path: path, UUID: snapuuid, Ctransid: ctransid,
-	}
-	if err := ctx.receiver.Snapshot(ctx, path, snapuuid, ctransid, cloneUUID, cloneCtransid); err != nil {
-		return err
-	}
-	return nil
-}
-
-func processMkfile(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_INO,
-	}); err != nil {
-		return fmt.Errorf("processMkfile: %w", err)
-	}
-	path := attrs.GetPath()
-	ino := attrs.GetIno()
-	if ctx.verbosity >= 2 {
-		ctx.LogVerbose(2, "receiving mkfile %q ino=%d\n", path, ino)
-	}
-	return ctx.receiver.Mkfile(ctx, path, ino)
-}
-
-func processMkdir(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_INO,
-	}); err != nil {
-		return fmt.Errorf("processMkfile: %w", err)
-	}
-	path := attrs.GetPath()
-	ino := attrs.GetIno()
-	ctx.LogVerbose(2, "receiving mkfile %q ino=%d\n", path, ino)
-	return ctx.receiver.Mkdir(ctx, path, ino)
-}
-
-func processMknod(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_INO, sendstream.BTRFS_SEND_A_MODE, sendstream.BTRFS_SEND_A_RDEV,
-	}); err != nil {
-		return fmt.Errorf("processMknod: %w", err)
-	}
-	path := attrs.GetPath()
-	ino := attrs.GetIno()
-	mode := attrs.GetMode32()
-	rdev := attrs.GetRdev()
-	ctx.LogVerbose(2, "receiving mknod %q ino=%d mode=%o rdev=%d\n", path, ino, mode, rdev)
-	return ctx.receiver.Mknod(ctx, path, ino, mode, rdev)
-}
-
-func processMkfifo(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_INO,
-	}); err != nil {
-		return fmt.Errorf("processMkfifo: %w", err)
-	}
-	path := attrs.GetPath()
-	ino := attrs.GetIno()
-	ctx.LogVerbose(2, "receiving mkfifo %q ino=%d\n", path, ino)
-	return ctx.receiver.Mkfifo(ctx, path, ino)
-}
-
-func processMksock(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_INO,
-	}); err != nil {
-		return fmt.Errorf("processMksock: %w", err)
-	}
-	path := attrs.GetPath()
-	ino := attrs.GetIno()
-	ctx.LogVerbose(2, "receiving mksock %q ino=%d\n", path, ino)
-	return ctx.receiver.Mksock(ctx, path, ino)
-}
-
-func processSymlink(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_INO, sendstream.BTRFS_SEND_A_PATH_LINK,
-	}); err != nil {
-		return fmt.Errorf("processSymlink: %w", err)
-	}
-	path := attrs.GetPath()
-	ino := attrs.GetIno()
-	pathLink := attrs.GetPathLink()
-	ctx.LogVerbose(2, "receiving symlink %q ino=%d -> %q\n", path, ino, pathLink)
-	return ctx.receiver.Symlink(ctx, path, ino, pathLink)
-}
-
-func processRename(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_PATH_TO,
-	}); err != nil {
-		return fmt.Errorf("processRename: %w", err)
-	}
-	path := attrs.GetPath()
-	pathTo := attrs.GetPathTo()
-	ctx.LogVerbose(2, "receiving rename %q -> %q", path, pathTo)
-	return ctx.receiver.Rename(ctx, path, pathTo)
-}
-
-func processLink(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_PATH_LINK,
-	}); err != nil {
-		return fmt.Errorf("processLink: %w", err)
-	}
-	path := attrs.GetPath()
-	pathLink := attrs.GetPathLink()
-	ctx.LogVerbose(2, "receiving link %q -> %q", path, pathLink)
-	return ctx.receiver.Link(ctx, path, pathLink)
-}
-
-func processUnlink(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH,
-	}); err != nil {
-		return fmt.Errorf("processUnlink: %w", err)
-	}
-	path := attrs.GetPath()
-	ctx.LogVerbose(2, "receiving unlink %q", path)
-	return ctx.receiver.Unlink(ctx, path)
-}
-
-func processRmdir(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH,
-	}); err != nil {
-		return fmt.Errorf("processRmdir: %w", err)
+		Path: c.Path, UUID: c.UUID, Ctransid: c.Ctransid,
 	}
-	path := attrs.GetPath()
-	ctx.LogVerbose(2, "receiving rmdir %q", path)
-	return ctx.receiver.Rmdir(ctx, path)
+	return ctx.receiver.Snapshot(ctx, c.Path, c.UUID, c.Ctransid, c.CloneUUID, c.CloneCtransid)
 }
 
-func processWrite(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_FILE_OFFSET, sendstream.BTRFS_SEND_A_DATA,
-	}); err != nil {
-		return fmt.Errorf("processWrite: %w", err)
-	}
-	path := attrs.GetPath()
-	offset := attrs.GetFileOffset()
-	data := attrs.GetData()
-	ctx.LogVerbose(2, "receiving write %q offset=%d len=%d", path, offset, len(data))
-	return ctx.receiver.Write(ctx, path, offset, data)
-}
-
-func processEncodedWrite(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_FILE_OFFSET, sendstream.BTRFS_SEND_A_UNENCODED_FILE_LEN, sendstream.BTRFS_SEND_A_UNENCODED_LEN,
-		sendstream.BTRFS_SEND_A_UNENCODED_OFFSET, sendstream.BTRFS_SEND_A_DATA, // Optional: sendstream.BTRFS_SEND_A_COMPRESSION, sendstream.BTRFS_SEND_A_ENCRYPTION
-	}); err != nil {
-		return fmt.Errorf("processEncodedWrite: %w", err)
-	}
-	path := attrs.GetPath()
-	var op btrfs.EncodedWriteOp
-	op.Offset = attrs.GetFileOffset()
-	op.Data = attrs.GetData()
-	op.UnencodedFileLength = attrs.GetUnencodedFileLen()
-	op.UnencodedLength = attrs.GetUnencodedLen()
-	op.UnencodedOffset = attrs.GetUnencodedOffset()
-	if len(attrs[sendstream.BTRFS_SEND_A_COMPRESSION]) > 0 {
-		op.Compression = attrs.GetCompressionType()
-	}
-	if len(attrs[sendstream.BTRFS_SEND_A_ENCRYPTION]) > 0 {
-		op.Encryption = attrs.GetEncryptionType()
-	}
-	ctx.LogVerbose(2, "receiving encoded write %q offset=%d len=%d", path, op.Offset, len(op.Data))
+func processEncodedWrite(ctx *receiveCtx, c *sendstream.EncodedWriteCmd) error {
+	op := &c.Op
+	ctx.LogVerbose(2, "receiving encoded write %q offset=%d len=%d", c.Path, op.Offset, len(op.Data))
 	if ctx.forceDecompress {
-		ctx.LogVerbose(1, "forcing decompression of encoded write")
-		data, err := op.Decompress()
-		if err != nil {
-			return fmt.Errorf("processEncodedWrite: failed to decompress data: %w", err)
-		}
-		return ctx.receiver.Write(ctx, path, op.Offset, data)
+		ctx.LogVerbose(3, "forcing decompression of encoded write")
+		return writeDecompressed(ctx, c.Path, op)
 	}
-	err := ctx.receiver.EncodedWrite(ctx, path, &op)
+	err := ctx.receiver.EncodedWrite(ctx, c.Path, op)
 	if err != nil && errors.Is(err, receivers.ErrNotSupported) {
-		ctx.LogVerbose(1, "receiver does not support encoded writes, forcing decompression")
-		data, err := op.Decompress()
-		if err != nil {
-			return fmt.Errorf("processEncodedWrite: failed to decompress data: %w", err)
-		}
-		return ctx.receiver.Write(ctx, path, op.Offset, data)
+		// Decompress the remaining encoded writes of the stream as well instead of
+		// failing each of them first.
+		ctx.LogVerbose(1, "receiver does not support encoded writes, forcing decompression: %v", err)
+		ctx.forceDecompress = true
+		return writeDecompressed(ctx, c.Path, op)
 	}
 	return err
 }
 
-func processClone(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_FILE_OFFSET, sendstream.BTRFS_SEND_A_CLONE_LEN, sendstream.BTRFS_SEND_A_CLONE_UUID,
-		sendstream.BTRFS_SEND_A_CLONE_CTRANSID, sendstream.BTRFS_SEND_A_CLONE_PATH, sendstream.BTRFS_SEND_A_CLONE_OFFSET,
-	}); err != nil {
-		return fmt.Errorf("processClone: %w", err)
-	}
-	cloneUUID, err := uuid.FromBytes(attrs[sendstream.BTRFS_SEND_A_CLONE_UUID])
+func writeDecompressed(ctx *receiveCtx, path string, op *btrfs.EncodedWriteOp) error {
+	data, err := op.FileData()
 	if err != nil {
-		return fmt.Errorf("processClone: error parsing cloneUUID: %w", err)
-	}
-	path := attrs.GetPath()
-	offset := attrs.GetFileOffset()
-	cloneLen := attrs.GetCloneLen()
-	cloneCTransID := attrs.GetCloneCTransid()
-	clonePath := attrs.GetClonePath()
-	cloneOffset := attrs.GetCloneOffset()
-	ctx.LogVerbose(2, "receiving clone %q offset=%d len=%d cloneUUID=%s cloneCTransID=%d clonePath=%q cloneOffset=%d",
-		path, offset, cloneLen, cloneUUID, cloneCTransID, clonePath, cloneOffset)
-	return ctx.receiver.Clone(ctx, path, offset, cloneLen, cloneUUID, cloneCTransID, clonePath, cloneOffset)
-}
-
-func processSetXattr(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_XATTR_NAME, sendstream.BTRFS_SEND_A_XATTR_DATA,
-	}); err != nil {
-		return fmt.Errorf("processSetXattr: %w", err)
-	}
-	path := attrs.GetPath()
-	name := attrs.GetXattrName()
-	data := attrs.GetXattrData()
-	ctx.LogVerbose(2, "receiving setxattr %q name=%q len=%d", path, name, len(data))
-	return ctx.receiver.SetXattr(ctx, path, name, data)
-}
-
-func processRemoveXattr(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_XATTR_NAME,
-	}); err != nil {
-		return fmt.Errorf("processRemoveXattr: %w", err)
-	}
-	path := attrs.GetPath()
-	name := attrs.GetXattrName()
-	ctx.LogVerbose(2, "receiving removexattr %q name=%q", path, name)
-	return ctx.receiver.RemoveXattr(ctx, path, name)
-}
-
-func processTruncate(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_SIZE,
-	}); err != nil {
-		return fmt.Errorf("processTruncate: %w", err)
-	}
-	path := attrs.GetPath()
-	size := attrs.GetSize()
-	ctx.LogVerbose(2, "receiving truncate %q size=%d", path, size)
-	return ctx.receiver.Truncate(ctx, path, size)
-}
-
-func processChmod(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_MODE,
-	}); err != nil {
-		return fmt.Errorf("processChmod: %w", err)
-	}
-	path := attrs.GetPath()
-	mode := attrs.GetMode64()
-	ctx.LogVerbose(2, "receiving chmod %q mode=%o", path, mode)
-	return ctx.receiver.Chmod(ctx, path, mode)
-}
-
-func processChown(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_UID, sendstream.BTRFS_SEND_A_GID,
-	}); err != nil {
-		return fmt.Errorf("processChown: %w", err)
-	}
-	path := attrs.GetPath()
-	uid := attrs.GetUid()
-	gid := attrs.GetGid()
-	ctx.LogVerbose(2, "receiving chown %q uid=%d gid=%d", path, uid, gid)
-	return ctx.receiver.Chown(ctx, path, uid, gid)
-}
-
-func processUtimes(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_ATIME, sendstream.BTRFS_SEND_A_MTIME, sendstream.BTRFS_SEND_A_CTIME,
-	}); err != nil {
-		return fmt.Errorf("processUtimes: %w", err)
-	}
-	path := attrs.GetPath()
-	atime, err := attrs.GetAtime()
-	if err != nil {
-		return fmt.Errorf("processUtimes: error parsing atime: %w", err)
-	}
-	mtime, err := attrs.GetMtime()
-	if err != nil {
-		return fmt.Errorf("processUtimes: error parsing mtime: %w", err)
-	}
-	ctime, err := attrs.GetCtime()
-	if err != nil {
-		return fmt.Errorf("processUtimes: error parsing ctime: %w", err)
-	}
-	ctx.LogVerbose(2, "receiving utimes %q atime=%v mtime=%v ctime=%v", path, atime, mtime, ctime)
-	return ctx.receiver.Utimes(ctx, path, atime, mtime, ctime)
-}
-
-func processUpdateExtent(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_FILE_OFFSET, sendstream.BTRFS_SEND_A_SIZE,
-	}); err != nil {
-		return fmt.Errorf("processUpdateExtent: %w", err)
-	}
-	path := attrs.GetPath()
-	offset := attrs.GetFileOffset()
-	size := attrs.GetSize()
-	ctx.LogVerbose(2, "receiving update_extent %q offset=%d size=%d", path, offset, size)
-	return ctx.receiver.UpdateExtent(ctx, path, offset, size)
-}
-
-func processEnableVerity(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_VERITY_ALGORITHM, sendstream.BTRFS_SEND_A_VERITY_BLOCK_SIZE,
-		sendstream.BTRFS_SEND_A_VERITY_SALT_DATA, sendstream.BTRFS_SEND_A_VERITY_SIG_DATA,
-	}); err != nil {
-		return fmt.Errorf("processEnableVerity: %w", err)
-	}
-	path := attrs.GetPath()
-	blockSize := attrs.GetVerityBlockSize()
-	salt := attrs.GetVeritySalt()
-	sig := attrs.GetVeritySig()
-	algorithm := attrs.GetVerityAlgorithm()
-	return ctx.receiver.EnableVerity(ctx, path, algorithm, blockSize, salt, sig)
-}
-
-func processFallocate(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_FALLOCATE_MODE, sendstream.BTRFS_SEND_A_FILE_OFFSET, sendstream.BTRFS_SEND_A_SIZE,
-	}); err != nil {
-		return fmt.Errorf("processFallocate: %w", err)
-	}
-	path := attrs.GetPath()
-	mode := attrs.GetFallocateMode()
-	offset := attrs.GetFileOffset()
-	size := attrs.GetSize()
-	ctx.LogVerbose(2, "receiving fallocate %q mode=%d offset=%d size=%d", path, mode, offset, size)
-	return ctx.receiver.Fallocate(ctx, path, mode, offset, size)
-}
-
-func processFileattr(ctx *receiveCtx, attrs sendstream.CmdAttrs) error {
-	if err := ensureAttrs(attrs, []sendstream.SendAttribute{
-		sendstream.BTRFS_SEND_A_PATH, sendstream.BTRFS_SEND_A_FILEATTR,
-	}); err != nil {
-		return fmt.Errorf("processFileattr: %w", err)
-	}
-	path := attrs.GetPath()
-	fileattr := attrs.GetFileAttr()
-	ctx.LogVerbose(2, "receiving fileattr %q fileattr=%d", path, fileattr)
-	return ctx.receiver.Fileattr(ctx, path, fileattr)
-}
-
-func ensureAttrs(attrs sendstream.CmdAttrs, keys []sendstream.SendAttribute) error {
-	for _, key := range keys {
-		if _, ok := attrs[key]; !ok {
-			return fmt.Errorf("missing attribute in send stream: %s", key)
-		}
+		return fmt.Errorf("processEncodedWrite: failed to decompress data: %w", err)
 	}
-	return nil
+	return ctx.receiver.Write(ctx, path, op.Offset, data)
 }
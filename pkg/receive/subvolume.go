@@ -0,0 +1,125 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive/receivers"
+	"github.com/madworx/btrsync/pkg/receive/receivers/local"
+)
+
+// ErrNoSubvolumeReceived is returned by ReceiveSubvolume when the stream did not
+// contain a subvolume.
+var ErrNoSubvolumeReceived = errors.New("no subvolume received from stream")
+
+// ReceiveSubvolume receives the send stream from r into destDir on a local btrfs
+// filesystem and returns the information of the received subvolume. The received
+// UUID and ctransid from the stream are set on the subvolume so that incremental
+// sends can be received on top of it. The subvolume is made read-only as part of
+// finishing it, immediately after the received UUID is set, so it is never
+// returned read-write. For incremental streams the parent is located among the
+// subvolumes received on the destination filesystem before anything is written,
+// and a *MissingParentError is returned if it is not there. Additional options are
+// passed through to ProcessSendStream.
+func ReceiveSubvolume(destDir string, r io.Reader, opts ...Option) (*btrfs.SubvolumeInfo, error) {
+	return ReceiveSubvolumeContext(context.Background(), destDir, r, opts...)
+}
+
+// ReceiveSubvolumeContext is like ReceiveSubvolume but stops processing the stream
+// and returns ctx.Err() when the context is done. A read from r that is already
+// blocked is not interrupted, but no further data is consumed from it.
+func ReceiveSubvolumeContext(ctx context.Context, destDir string, r io.Reader, opts ...Option) (*btrfs.SubvolumeInfo, error) {
+	r = &contextReader{ctx: ctx, r: r}
+	r, parent, err := checkParent(destDir, r)
+	if err != nil {
+		return nil, err
+	}
+	var localOpts []local.Option
+	if parent != "" {
+		localOpts = append(localOpts, local.WithParent(parent))
+	}
+	opts = append(opts, WithContext(ctx))
+	rcvr := &finishRecorder{Receiver: local.New(destDir, localOpts...)}
+	opts = append([]Option{HonorEndCommand()}, opts...)
+	opts = append(opts, To(rcvr))
+	if err := ProcessSendStream(r, opts...); err != nil {
+		return nil, err
+	}
+	if rcvr.finishErr != nil {
+		// ProcessSendStream only logs errors from finishing the final subvolume
+		return nil, rcvr.finishErr
+	}
+	if rcvr.lastPath == "" {
+		return nil, ErrNoSubvolumeReceived
+	}
+	return btrfs.GetSubvolumeInfo(filepath.Join(destDir, rcvr.lastPath))
+}
+
+// ReceiveSubvolumeCompressed is like ReceiveSubvolume but decompresses the stream
+// read from r with c. If c is nil, the compression is detected from the leading
+// bytes of the stream and uncompressed streams are accepted as is.
+func ReceiveSubvolumeCompressed(destDir string, r io.Reader, c btrfs.StreamCompressor, opts ...Option) (*btrfs.SubvolumeInfo, error) {
+	if c == nil {
+		br := bufio.NewReader(r)
+		codec, err := btrfs.DetectCodec(br)
+		if err != nil {
+			return nil, err
+		}
+		c, r = codec, br
+	}
+	dr, err := c.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	return ReceiveSubvolume(destDir, dr, opts...)
+}
+
+// finishRecorder wraps a receiver and records the path of the last subvolume
+// that was successfully finished, or the error finishing it.
+type finishRecorder struct {
+	receivers.Receiver
+	lastPath  string
+	finishErr error
+}
+
+func (f *finishRecorder) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	if err := f.Receiver.FinishSubvolume(ctx); err != nil {
+		f.finishErr = err
+		return err
+	}
+	f.lastPath = ctx.CurrentSubvolume().Path
+	return nil
+}
+
+// contextReader is a reader that fails once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,377 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"golang.org/x/sys/unix"
+)
+
+// ErrVerifyMismatch is returned by VerifyReceived when the received tree differs
+// from the source.
+var ErrVerifyMismatch = errors.New("received subvolume differs from source")
+
+// VerifyMismatchError describes the first difference found by VerifyReceived. It
+// matches ErrVerifyMismatch.
+type VerifyMismatchError struct {
+	// Path is the path of the differing entry relative to the roots of the trees.
+	Path string
+	// Reason describes the difference.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *VerifyMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrVerifyMismatch, e.Path, e.Reason)
+}
+
+// Unwrap returns ErrVerifyMismatch.
+func (e *VerifyMismatchError) Unwrap() error { return ErrVerifyMismatch }
+
+// VerifyOption is an option for VerifyReceived.
+type VerifyOption func(*verifyOptions)
+
+type verifyOptions struct {
+	workers  int
+	every    int
+	metadata bool
+	xattrs   bool
+}
+
+// VerifyWithWorkers hashes up to n files concurrently. Defaults to the number of
+// CPUs.
+func VerifyWithWorkers(n int) VerifyOption {
+	return func(o *verifyOptions) {
+		o.workers = n
+	}
+}
+
+// VerifyEveryNth only compares the contents of every nth regular file, in walk
+// order, to bound the time spent on huge trees. The structure of the trees and the
+// sizes of all files are still compared.
+func VerifyEveryNth(n int) VerifyOption {
+	return func(o *verifyOptions) {
+		o.every = n
+	}
+}
+
+// VerifyMetadata also compares the permission bits, owners and modification times
+// of all entries.
+func VerifyMetadata() VerifyOption {
+	return func(o *verifyOptions) {
+		o.metadata = true
+	}
+}
+
+// VerifyXattrs also compares the extended attributes of all entries.
+func VerifyXattrs() VerifyOption {
+	return func(o *verifyOptions) {
+		o.xattrs = true
+	}
+}
+
+// VerifyReceived compares the tree at destPath, usually a subvolume received from a
+// send of srcPath, with the tree at srcPath. Both trees must contain the same
+// entries with the same types, file sizes and symlink targets, and regular files
+// must have the same SHA-256 checksums. Nested subvolumes, which a send turns into
+// empty directories, are not descended into. It returns true if the trees match,
+// and false with a *VerifyMismatchError describing the first difference otherwise.
+// The entries of the trees are compared in order of their paths before any file
+// contents are. Any other error means the comparison could not be completed.
+func VerifyReceived(srcPath, destPath string, opts ...VerifyOption) (bool, error) {
+	o := verifyOptions{workers: runtime.NumCPU(), every: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.workers < 1 {
+		o.workers = 1
+	}
+	if o.every < 1 {
+		o.every = 1
+	}
+	srcEntries, err := verifyWalk(srcPath)
+	if err != nil {
+		return false, err
+	}
+	destEntries, err := verifyWalk(destPath)
+	if err != nil {
+		return false, err
+	}
+	var hashes []string
+	for i, j := 0, 0; i < len(srcEntries) || j < len(destEntries); {
+		switch {
+		case j == len(destEntries) || (i < len(srcEntries) && srcEntries[i].path < destEntries[j].path):
+			return false, &VerifyMismatchError{Path: srcEntries[i].path, Reason: "missing from received tree"}
+		case i == len(srcEntries) || destEntries[j].path < srcEntries[i].path:
+			return false, &VerifyMismatchError{Path: destEntries[j].path, Reason: "not in source tree"}
+		}
+		path := srcEntries[i].path
+		reason, err := compareEntries(srcPath, destPath, path, srcEntries[i].info, destEntries[j].info, o)
+		if err != nil {
+			return false, err
+		}
+		if reason != "" {
+			return false, &VerifyMismatchError{Path: path, Reason: reason}
+		}
+		if srcEntries[i].info.Mode().IsRegular() {
+			hashes = append(hashes, path)
+		}
+		i++
+		j++
+	}
+	sampled := hashes[:0]
+	for i, path := range hashes {
+		if i%o.every == 0 {
+			sampled = append(sampled, path)
+		}
+	}
+	return compareContents(srcPath, destPath, sampled, o.workers)
+}
+
+type verifyEntry struct {
+	path string
+	info fs.FileInfo
+}
+
+// verifyWalk returns the entries beneath root sorted by their relative path. Nested
+// subvolumes are listed but not descended into.
+func verifyWalk(root string) ([]verifyEntry, error) {
+	var entries []verifyEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, verifyEntry{path: rel, info: info})
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && d.IsDir() && st.Ino == uint64(btrfs.FirstFreeObjectID) {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// WalkDir orders by name within a directory, which is not the order of the
+	// full paths when names contain characters sorting before the separator
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries, nil
+}
+
+// compareEntries returns a description of how the entry at path differs between
+// the trees, or an empty string if it does not, without comparing file contents.
+func compareEntries(srcRoot, destRoot, path string, src, dest fs.FileInfo, o verifyOptions) (string, error) {
+	if src.Mode().Type() != dest.Mode().Type() {
+		return fmt.Sprintf("type %s differs from %s", dest.Mode().Type(), src.Mode().Type()), nil
+	}
+	if src.Mode().IsRegular() && src.Size() != dest.Size() {
+		return fmt.Sprintf("size %d differs from %d", dest.Size(), src.Size()), nil
+	}
+	if src.Mode()&fs.ModeSymlink != 0 {
+		srcTarget, err := os.Readlink(filepath.Join(srcRoot, path))
+		if err != nil {
+			return "", err
+		}
+		destTarget, err := os.Readlink(filepath.Join(destRoot, path))
+		if err != nil {
+			return "", err
+		}
+		if srcTarget != destTarget {
+			return fmt.Sprintf("symlink target %q differs from %q", destTarget, srcTarget), nil
+		}
+	}
+	if o.metadata {
+		if reason := compareMetadata(src, dest); reason != "" {
+			return reason, nil
+		}
+	}
+	if o.xattrs {
+		srcXattrs, err := lxattrs(filepath.Join(srcRoot, path))
+		if err != nil {
+			return "", err
+		}
+		destXattrs, err := lxattrs(filepath.Join(destRoot, path))
+		if err != nil {
+			return "", err
+		}
+		for name, value := range srcXattrs {
+			destValue, ok := destXattrs[name]
+			if !ok {
+				return fmt.Sprintf("extended attribute %s is missing", name), nil
+			}
+			if !bytes.Equal(value, destValue) {
+				return fmt.Sprintf("extended attribute %s differs", name), nil
+			}
+		}
+		for name := range destXattrs {
+			if _, ok := srcXattrs[name]; !ok {
+				return fmt.Sprintf("extended attribute %s is not in source", name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// compareMetadata compares the permission bits, owners and, except for
+// directories, modification times of two entries. The modification times of
+// directories change as their entries are created during a receive.
+func compareMetadata(src, dest fs.FileInfo) string {
+	if src.Mode() != dest.Mode() {
+		return fmt.Sprintf("mode %s differs from %s", dest.Mode(), src.Mode())
+	}
+	srcSt, ok1 := src.Sys().(*syscall.Stat_t)
+	destSt, ok2 := dest.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && (srcSt.Uid != destSt.Uid || srcSt.Gid != destSt.Gid) {
+		return fmt.Sprintf("owner %d:%d differs from %d:%d", destSt.Uid, destSt.Gid, srcSt.Uid, srcSt.Gid)
+	}
+	if !src.IsDir() && !src.ModTime().Equal(dest.ModTime()) {
+		return fmt.Sprintf("modification time %s differs from %s", dest.ModTime(), src.ModTime())
+	}
+	return ""
+}
+
+// compareContents compares the SHA-256 checksums of the regular files at paths in
+// both trees using a pool of workers. Once a mismatch or error is found no further
+// files are started, and the first difference in the order of paths among the
+// files that were compared is reported.
+func compareContents(srcRoot, destRoot string, paths []string, workers int) (bool, error) {
+	type result struct {
+		reason string
+		err    error
+	}
+	results := make([]result, len(paths))
+	jobs := make(chan int)
+	var failed sync.Once
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				reason, err := compareFile(filepath.Join(srcRoot, paths[i]), filepath.Join(destRoot, paths[i]))
+				results[i] = result{reason, err}
+				if reason != "" || err != nil {
+					failed.Do(func() { close(stop) })
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := range paths {
+		select {
+		case jobs <- i:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	for i, r := range results {
+		if r.err != nil {
+			return false, r.err
+		}
+		if r.reason != "" {
+			return false, &VerifyMismatchError{Path: paths[i], Reason: r.reason}
+		}
+	}
+	return true, nil
+}
+
+// compareFile returns a description of how the contents of dest differ from src,
+// or an empty string if they have the same checksum.
+func compareFile(src, dest string) (string, error) {
+	srcSum, err := fileChecksum(src)
+	if err != nil {
+		return "", err
+	}
+	destSum, err := fileChecksum(dest)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(srcSum, destSum) {
+		return fmt.Sprintf("checksum %x differs from %x", destSum, srcSum), nil
+	}
+	return "", nil
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// lxattrs returns the extended attributes of path, without following symlinks.
+func lxattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+	}
+	out := make(map[string][]byte)
+	if size == 0 {
+		return out, nil
+	}
+	buf := make([]byte, size)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+	}
+	for _, name := range bytes.Split(buf[:n], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+		out[string(name)] = value[:n]
+	}
+	return out, nil
+}
@@ -0,0 +1,224 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// Batch streams carry several send streams one after another, so that many
+// subvolumes can be transferred over a single connection. Each send stream is
+// preceded by an entry header naming it and split into length-prefixed segments,
+// as the length of a send stream is not known until it ends.
+//
+// Version 1 of the format, all integers little-endian:
+//
+//	header:  magic "BTRSBTCH" (8 bytes) | version uint32
+//	entry:   name length uint16 | name | segment... | end segment
+//	segment: length uint32 | payload
+//
+// The name is a non-empty UTF-8 label of the subvolume chosen by the sender; it
+// is informational and not used as a path. A segment with a length of zero ends
+// the send stream of an entry. An entry with a name length of zero ends the batch.
+const (
+	// BatchStreamMagic identifies a batch stream.
+	BatchStreamMagic = "BTRSBTCH"
+	// BatchStreamVersion is the version of the batch stream format written.
+	BatchStreamVersion = 1
+)
+
+// ErrTruncatedBatch is returned when a batch stream ends before its end entry.
+var ErrTruncatedBatch = errors.New("batch stream ended without end entry")
+
+type batchStreamHeader struct {
+	Magic   [8]byte
+	Version uint32
+}
+
+// SendSpec describes a subvolume sent by SendBatch.
+type SendSpec struct {
+	// Path is the path of the read-only subvolume to send.
+	Path string
+	// Parent is the parent of an incremental send, as for btrfs.SendSubvolume.
+	Parent string
+	// CloneSources are additional clone sources, as for btrfs.SendSubvolume.
+	CloneSources []string
+	// Name labels the stream in the batch. Defaults to the base name of Path.
+	Name string
+}
+
+// SendBatch sends the subvolumes described by specs to w, in order, as a single
+// batch stream. opts are passed to every send. A subvolume sent incrementally may
+// use a subvolume sent earlier in the same batch as its parent, as the streams are
+// received in order. The first failing send stops the batch and is returned,
+// leaving w without an end entry so that the receiver fails as well.
+func SendBatch(specs []SendSpec, w io.Writer, opts ...btrfs.SendOption) error {
+	hdr := batchStreamHeader{Version: BatchStreamVersion}
+	copy(hdr.Magic[:], BatchStreamMagic)
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		name := spec.Name
+		if name == "" {
+			name = filepath.Base(spec.Path)
+		}
+		if name == "" || len(name) > math.MaxUint16 {
+			return fmt.Errorf("invalid batch entry name %q", name)
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint16(len(name))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, name); err != nil {
+			return err
+		}
+		if err := btrfs.SendSubvolume(spec.Path, spec.Parent, spec.CloneSources, &segmentWriter{w: w}, opts...); err != nil {
+			return fmt.Errorf("failed to send %s: %w", spec.Path, err)
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(0)); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, uint16(0))
+}
+
+// segmentWriter writes everything written to it as one segment per write.
+type segmentWriter struct {
+	w io.Writer
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := uint64(len(p))
+		if m > math.MaxUint32 {
+			m = math.MaxUint32
+		}
+		if err := binary.Write(s.w, binary.LittleEndian, uint32(m)); err != nil {
+			return n, err
+		}
+		k, err := s.w.Write(p[:m])
+		n += k
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// BatchReader reads the send streams of a batch stream.
+type BatchReader struct {
+	r       io.Reader
+	started bool
+	done    bool
+	cur     *segmentReader
+}
+
+// NewBatchReader returns a BatchReader reading a batch stream from r.
+func NewBatchReader(r io.Reader) *BatchReader {
+	return &BatchReader{r: r}
+}
+
+// Next advances to the next send stream of the batch and returns its name and a
+// reader for the stream, which is valid until the following call to Next. Any part
+// of the previous stream that was not read is skipped. io.EOF is returned after the
+// last stream, and ErrTruncatedBatch if the batch ends without its end entry.
+func (b *BatchReader) Next() (string, io.Reader, error) {
+	if b.done {
+		return "", nil, io.EOF
+	}
+	if !b.started {
+		var hdr batchStreamHeader
+		if err := binary.Read(b.r, binary.LittleEndian, &hdr); err != nil {
+			return "", nil, fmt.Errorf("failed to read batch stream header: %w", err)
+		}
+		if string(hdr.Magic[:]) != BatchStreamMagic {
+			return "", nil, fmt.Errorf("%w %q", ErrInvalidMagic, hdr.Magic)
+		}
+		if hdr.Version == 0 || hdr.Version > BatchStreamVersion {
+			return "", nil, fmt.Errorf("%w %d", ErrInvalidVersion, hdr.Version)
+		}
+		b.started = true
+	}
+	if b.cur != nil {
+		if _, err := io.Copy(io.Discard, b.cur); err != nil {
+			return "", nil, err
+		}
+		b.cur = nil
+	}
+	var nameLen uint16
+	if err := binary.Read(b.r, binary.LittleEndian, &nameLen); err != nil {
+		return "", nil, batchReadError(err)
+	}
+	if nameLen == 0 {
+		b.done = true
+		return "", nil, io.EOF
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(b.r, name); err != nil {
+		return "", nil, batchReadError(err)
+	}
+	b.cur = &segmentReader{r: b.r}
+	return string(name), b.cur, nil
+}
+
+// segmentReader reads the payloads of segments up to an end segment.
+type segmentReader struct {
+	r      io.Reader
+	remain uint32
+	done   bool
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for s.remain == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := binary.Read(s.r, binary.LittleEndian, &s.remain); err != nil {
+			return 0, batchReadError(err)
+		}
+		if s.remain == 0 {
+			s.done = true
+		}
+	}
+	if uint64(len(p)) > uint64(s.remain) {
+		p = p[:s.remain]
+	}
+	n, err := s.r.Read(p)
+	s.remain -= uint32(n)
+	if errors.Is(err, io.EOF) {
+		// The segment or the end segment is still missing
+		err = ErrTruncatedBatch
+	}
+	return n, err
+}
+
+// batchReadError reports the end of the underlying reader in the middle of a
+// batch as ErrTruncatedBatch.
+func batchReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncatedBatch
+	}
+	return err
+}
@@ -0,0 +1,309 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// Chunked streams wrap a send stream in numbered, checksummed frames so that a
+// receiver can acknowledge the frames it has committed and an interrupted transfer
+// can be restarted after the last acknowledged frame. The kernel cannot resume a
+// send part way through, so a resumed sender regenerates the whole stream and
+// skips the frames the receiver already has. This relies on the stream of a
+// read-only subvolume being reproducible for the same parents, which is verified
+// against the checksum of the last acknowledged frame.
+//
+// Version 1 of the format, all integers little-endian:
+//
+//	header: magic "BTRSCHNK" (8 bytes) | version uint32 | chunk size uint32
+//	frame:  sequence uint64 | length uint32 | crc32c uint32 | payload
+//
+// Frames are numbered from 1 and each carries at most chunk size bytes of the
+// send stream. A frame with a length of zero and a checksum of zero ends the
+// stream. A resumed stream repeats the header and continues with the frame
+// following the resume point.
+const (
+	// ChunkStreamMagic identifies a chunked send stream.
+	ChunkStreamMagic = "BTRSCHNK"
+	// ChunkStreamVersion is the version of the chunked stream format written.
+	ChunkStreamVersion = 1
+	// DefaultChunkSize is the chunk size used when none is given.
+	DefaultChunkSize = 4 * 1024 * 1024
+	// MaxChunkSize is the largest chunk size accepted by ChunkReader.
+	MaxChunkSize = 64 * 1024 * 1024
+)
+
+var (
+	// ErrChunkSequence is returned when a frame arrives out of order.
+	ErrChunkSequence = errors.New("chunk out of sequence")
+	// ErrChunkChecksum is returned when a frame does not match its checksum.
+	ErrChunkChecksum = errors.New("invalid chunk checksum")
+	// ErrChunkMismatch is returned when a resumed send does not reproduce the frame
+	// at the resume point, so the remaining frames cannot be appended to the ones
+	// already received.
+	ErrChunkMismatch = errors.New("regenerated chunk does not match resume point")
+)
+
+type chunkStreamHeader struct {
+	Magic     [8]byte
+	Version   uint32
+	ChunkSize uint32
+}
+
+type chunkFrameHeader struct {
+	Seq uint64
+	Len uint32
+	Crc uint32
+}
+
+// ResumePoint identifies the last frame committed by a receiver.
+type ResumePoint struct {
+	// Seq is the sequence number of the last committed frame.
+	Seq uint64
+	// CRC is the checksum of the last committed frame.
+	CRC uint32
+}
+
+// ChunkWriter frames the data written to it into a chunked stream.
+type ChunkWriter struct {
+	w         io.Writer
+	chunkSize int
+	buf       []byte
+	seq       uint64
+	resume    *ResumePoint
+	started   bool
+	closed    bool
+}
+
+// NewChunkWriter returns a ChunkWriter writing frames of at most chunkSize bytes
+// to w. If resume is not nil, frames up to and including resume.Seq are not written
+// and the frame at resume.Seq must match resume.CRC. A chunkSize of zero or less
+// uses DefaultChunkSize.
+func NewChunkWriter(w io.Writer, chunkSize int, resume *ResumePoint) *ChunkWriter {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &ChunkWriter{w: w, chunkSize: chunkSize, buf: make([]byte, 0, chunkSize), resume: resume}
+}
+
+// Write implements io.Writer.
+func (c *ChunkWriter) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, errors.New("write to closed chunk writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		m := copy(c.buf[len(c.buf):c.chunkSize], p)
+		c.buf = c.buf[:len(c.buf)+m]
+		p = p[m:]
+		n += m
+		if len(c.buf) == c.chunkSize {
+			if err := c.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes any buffered data and the end frame. It does not close the
+// underlying writer.
+func (c *ChunkWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if len(c.buf) > 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	if c.resume != nil && c.seq < c.resume.Seq {
+		return fmt.Errorf("%w: stream ended at chunk %d before resume point %d", ErrChunkMismatch, c.seq, c.resume.Seq)
+	}
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return binary.Write(c.w, binary.LittleEndian, &chunkFrameHeader{Seq: c.seq + 1})
+}
+
+func (c *ChunkWriter) writeHeader() error {
+	if c.started {
+		return nil
+	}
+	hdr := chunkStreamHeader{Version: ChunkStreamVersion, ChunkSize: uint32(c.chunkSize)}
+	copy(hdr.Magic[:], ChunkStreamMagic)
+	if err := binary.Write(c.w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	c.started = true
+	return nil
+}
+
+func (c *ChunkWriter) flush() error {
+	c.seq++
+	crc := btrfsCrc32c(0, c.buf)
+	defer func() { c.buf = c.buf[:0] }()
+	if c.resume != nil && c.seq <= c.resume.Seq {
+		if c.seq == c.resume.Seq && crc != c.resume.CRC {
+			return fmt.Errorf("%w: chunk %d", ErrChunkMismatch, c.seq)
+		}
+		return nil
+	}
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	hdr := chunkFrameHeader{Seq: c.seq, Len: uint32(len(c.buf)), Crc: crc}
+	if err := binary.Write(c.w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	_, err := c.w.Write(c.buf)
+	return err
+}
+
+// ChunkReader reads the send stream carried by a chunked stream.
+type ChunkReader struct {
+	r       io.Reader
+	onChunk func(ResumePoint)
+	next    uint64
+	last    ResumePoint
+	buf     []byte
+	pending ResumePoint
+	started bool
+	done    bool
+}
+
+// NewChunkReader returns a ChunkReader reading a chunked stream from r. If resume
+// is not nil the stream is expected to continue after resume.Seq. If onChunk is not
+// nil it is called with the resume point of each frame once all of its payload has
+// been read, which is when it can be acknowledged to the sender.
+func NewChunkReader(r io.Reader, resume *ResumePoint, onChunk func(ResumePoint)) *ChunkReader {
+	c := &ChunkReader{r: r, onChunk: onChunk, next: 1}
+	if resume != nil {
+		c.next = resume.Seq + 1
+		c.last = *resume
+	}
+	return c
+}
+
+// Last returns the resume point of the last frame that was fully read.
+func (c *ChunkReader) Last() ResumePoint {
+	return c.last
+}
+
+// Read implements io.Reader.
+func (c *ChunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 {
+		c.commit()
+	}
+	return n, nil
+}
+
+func (c *ChunkReader) commit() {
+	c.last = c.pending
+	if c.onChunk != nil {
+		c.onChunk(c.last)
+	}
+}
+
+func (c *ChunkReader) readFrame() error {
+	if !c.started {
+		var hdr chunkStreamHeader
+		if err := binary.Read(c.r, binary.LittleEndian, &hdr); err != nil {
+			return fmt.Errorf("failed to read chunk stream header: %w", err)
+		}
+		if string(hdr.Magic[:]) != ChunkStreamMagic {
+			return fmt.Errorf("%w %q", ErrInvalidMagic, hdr.Magic)
+		}
+		if hdr.Version == 0 || hdr.Version > ChunkStreamVersion {
+			return fmt.Errorf("%w %d", ErrInvalidVersion, hdr.Version)
+		}
+		if hdr.ChunkSize == 0 || hdr.ChunkSize > MaxChunkSize {
+			return fmt.Errorf("invalid chunk size %d", hdr.ChunkSize)
+		}
+		c.started = true
+	}
+	var hdr chunkFrameHeader
+	if err := binary.Read(c.r, binary.LittleEndian, &hdr); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("failed to read chunk header: %w", err)
+	}
+	if hdr.Seq != c.next {
+		return fmt.Errorf("%w: expected %d, got %d", ErrChunkSequence, c.next, hdr.Seq)
+	}
+	if hdr.Len == 0 && hdr.Crc == 0 {
+		c.done = true
+		return nil
+	}
+	if hdr.Len > MaxChunkSize {
+		return fmt.Errorf("chunk %d is too large: %d bytes", hdr.Seq, hdr.Len)
+	}
+	buf := make([]byte, hdr.Len)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return fmt.Errorf("failed to read chunk %d: %w", hdr.Seq, err)
+	}
+	if crc := btrfsCrc32c(0, buf); crc != hdr.Crc {
+		return fmt.Errorf("%w: chunk %d", ErrChunkChecksum, hdr.Seq)
+	}
+	c.next++
+	c.buf = buf
+	c.pending = ResumePoint{Seq: hdr.Seq, CRC: hdr.Crc}
+	return nil
+}
+
+// ChunkOptions configure SendSubvolumeChunked.
+type ChunkOptions struct {
+	// ChunkSize is the maximum payload of a frame. Defaults to DefaultChunkSize.
+	ChunkSize int
+	// Resume restarts the transfer after the given frame. The frames up to it are
+	// regenerated but not written.
+	Resume *ResumePoint
+}
+
+// SendSubvolumeChunked sends the read-only subvolume at path to w as a chunked
+// stream. See btrfs.SendSubvolume for the meaning of parent, cloneSources and opts.
+func SendSubvolumeChunked(path, parent string, cloneSources []string, w io.Writer, chunkOpts ChunkOptions, opts ...btrfs.SendOption) error {
+	return SendSubvolumeChunkedContext(context.Background(), path, parent, cloneSources, w, chunkOpts, opts...)
+}
+
+// SendSubvolumeChunkedContext is like SendSubvolumeChunked but aborts the send when
+// the context is done.
+func SendSubvolumeChunkedContext(ctx context.Context, path, parent string, cloneSources []string, w io.Writer, chunkOpts ChunkOptions, opts ...btrfs.SendOption) error {
+	cw := NewChunkWriter(w, chunkOpts.ChunkSize, chunkOpts.Resume)
+	if err := btrfs.SendSubvolumeContext(ctx, path, parent, cloneSources, cw, opts...); err != nil {
+		return err
+	}
+	return cw.Close()
+}
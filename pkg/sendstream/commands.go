@@ -21,7 +21,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/btrfs"
 )
 
 const (
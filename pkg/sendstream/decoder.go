@@ -0,0 +1,488 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// Command is a typed command decoded from a send stream. The concrete types are
+// the *Cmd structs of this package, such as *SubvolCmd or *WriteCmd.
+type Command interface {
+	// Type returns the type of the command in the stream.
+	Type() SendCommand
+}
+
+// SubvolCmd starts a new subvolume sent in full.
+type SubvolCmd struct {
+	Path     string
+	UUID     uuid.UUID
+	Ctransid uint64
+}
+
+// SnapshotCmd starts a new subvolume sent as a snapshot of a parent.
+type SnapshotCmd struct {
+	Path          string
+	UUID          uuid.UUID
+	Ctransid      uint64
+	CloneUUID     uuid.UUID
+	CloneCtransid uint64
+}
+
+// MkfileCmd creates a regular file.
+type MkfileCmd struct {
+	Path string
+	Ino  uint64
+}
+
+// MkdirCmd creates a directory.
+type MkdirCmd struct {
+	Path string
+	Ino  uint64
+}
+
+// MknodCmd creates a device node.
+type MknodCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint32
+	Rdev uint64
+}
+
+// MkfifoCmd creates a named pipe.
+type MkfifoCmd struct {
+	Path string
+	Ino  uint64
+}
+
+// MksockCmd creates a unix socket.
+type MksockCmd struct {
+	Path string
+	Ino  uint64
+}
+
+// SymlinkCmd creates a symbolic link at Path pointing to PathLink.
+type SymlinkCmd struct {
+	Path     string
+	Ino      uint64
+	PathLink string
+}
+
+// RenameCmd renames Path to PathTo.
+type RenameCmd struct {
+	Path   string
+	PathTo string
+}
+
+// LinkCmd creates a hard link at Path to the existing PathLink.
+type LinkCmd struct {
+	Path     string
+	PathLink string
+}
+
+// UnlinkCmd removes a file.
+type UnlinkCmd struct {
+	Path string
+}
+
+// RmdirCmd removes a directory.
+type RmdirCmd struct {
+	Path string
+}
+
+// WriteCmd writes Data to the file at Offset.
+type WriteCmd struct {
+	Path   string
+	Offset uint64
+	Data   []byte
+}
+
+// EncodedWriteCmd writes encoded, usually compressed, data to the file.
+type EncodedWriteCmd struct {
+	Path string
+	Op   btrfs.EncodedWriteOp
+}
+
+// CloneCmd clones a range of CloneLen bytes from ClonePath in the subvolume
+// identified by CloneUUID and CloneCtransid.
+type CloneCmd struct {
+	Path          string
+	Offset        uint64
+	CloneLen      uint64
+	CloneUUID     uuid.UUID
+	CloneCtransid uint64
+	ClonePath     string
+	CloneOffset   uint64
+}
+
+// SetXattrCmd sets an extended attribute.
+type SetXattrCmd struct {
+	Path string
+	Name string
+	Data []byte
+}
+
+// RemoveXattrCmd removes an extended attribute.
+type RemoveXattrCmd struct {
+	Path string
+	Name string
+}
+
+// TruncateCmd sets the size of a file.
+type TruncateCmd struct {
+	Path string
+	Size uint64
+}
+
+// ChmodCmd sets the mode of a file.
+type ChmodCmd struct {
+	Path string
+	Mode uint64
+}
+
+// ChownCmd sets the owner of a file.
+type ChownCmd struct {
+	Path string
+	UID  uint64
+	GID  uint64
+}
+
+// UtimesCmd sets the timestamps of a file.
+type UtimesCmd struct {
+	Path  string
+	Atime time.Time
+	Mtime time.Time
+	Ctime time.Time
+}
+
+// UpdateExtentCmd marks a range of a file as changed without sending its data.
+type UpdateExtentCmd struct {
+	Path   string
+	Offset uint64
+	Size   uint64
+}
+
+// EnableVerityCmd enables fs-verity on a file.
+type EnableVerityCmd struct {
+	Path      string
+	Algorithm uint8
+	BlockSize uint32
+	Salt      []byte
+	Sig       []byte
+}
+
+// FallocateCmd preallocates or punches a range of a file.
+type FallocateCmd struct {
+	Path   string
+	Mode   uint32
+	Offset uint64
+	Size   uint64
+}
+
+// FileattrCmd sets the inode flags of a file.
+type FileattrCmd struct {
+	Path string
+	Attr uint32
+}
+
+// EndCmd ends the stream.
+type EndCmd struct{}
+
+func (*SubvolCmd) Type() SendCommand       { return BTRFS_SEND_C_SUBVOL }
+func (*SnapshotCmd) Type() SendCommand     { return BTRFS_SEND_C_SNAPSHOT }
+func (*MkfileCmd) Type() SendCommand       { return BTRFS_SEND_C_MKFILE }
+func (*MkdirCmd) Type() SendCommand        { return BTRFS_SEND_C_MKDIR }
+func (*MknodCmd) Type() SendCommand        { return BTRFS_SEND_C_MKNOD }
+func (*MkfifoCmd) Type() SendCommand       { return BTRFS_SEND_C_MKFIFO }
+func (*MksockCmd) Type() SendCommand       { return BTRFS_SEND_C_MKSOCK }
+func (*SymlinkCmd) Type() SendCommand      { return BTRFS_SEND_C_SYMLINK }
+func (*RenameCmd) Type() SendCommand       { return BTRFS_SEND_C_RENAME }
+func (*LinkCmd) Type() SendCommand         { return BTRFS_SEND_C_LINK }
+func (*UnlinkCmd) Type() SendCommand       { return BTRFS_SEND_C_UNLINK }
+func (*RmdirCmd) Type() SendCommand        { return BTRFS_SEND_C_RMDIR }
+func (*WriteCmd) Type() SendCommand        { return BTRFS_SEND_C_WRITE }
+func (*EncodedWriteCmd) Type() SendCommand { return BTRFS_SEND_C_ENCODED_WRITE }
+func (*CloneCmd) Type() SendCommand        { return BTRFS_SEND_C_CLONE }
+func (*SetXattrCmd) Type() SendCommand     { return BTRFS_SEND_C_SET_XATTR }
+func (*RemoveXattrCmd) Type() SendCommand  { return BTRFS_SEND_C_REMOVE_XATTR }
+func (*TruncateCmd) Type() SendCommand     { return BTRFS_SEND_C_TRUNCATE }
+func (*ChmodCmd) Type() SendCommand        { return BTRFS_SEND_C_CHMOD }
+func (*ChownCmd) Type() SendCommand        { return BTRFS_SEND_C_CHOWN }
+func (*UtimesCmd) Type() SendCommand       { return BTRFS_SEND_C_UTIMES }
+func (*UpdateExtentCmd) Type() SendCommand { return BTRFS_SEND_C_UPDATE_EXTENT }
+func (*EnableVerityCmd) Type() SendCommand { return BTRFS_SEND_C_ENABLE_VERITY }
+func (*FallocateCmd) Type() SendCommand    { return BTRFS_SEND_C_FALLOCATE }
+func (*FileattrCmd) Type() SendCommand     { return BTRFS_SEND_C_FILEATTR }
+func (*EndCmd) Type() SendCommand          { return BTRFS_SEND_C_END }
+
+// Decoder reads typed commands from a send stream. Every command is checked
+// against its checksum, and every attribute is checked for presence and size
+// before it is decoded, so malformed input results in an error rather than a
+// panic. It is not safe for concurrent use.
+type Decoder struct {
+	s *Scanner
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{s: NewScanner(r, false)}
+}
+
+// Version returns the version of the stream, see Scanner.Version.
+func (d *Decoder) Version() uint32 { return d.s.Version() }
+
+// Next reads and decodes the next command from the stream. It returns io.EOF when
+// the stream ends after an END command, and ErrTruncatedStream when it ends
+// without one.
+func (d *Decoder) Next() (Command, error) {
+	if !d.s.Scan() {
+		err := d.s.Err()
+		if err == nil {
+			return nil, io.EOF
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, ErrTruncatedStream
+		}
+		return nil, err
+	}
+	return DecodeCommand(d.s.Command())
+}
+
+// DecodeCommand decodes the attributes of a command read by a Scanner into its
+// typed form. Paths that are absolute or contain ".." components are rejected
+// with ErrInvalidPath, since receivers resolve them below their destination.
+func DecodeCommand(hdr CmdHeader, attrs CmdAttrs) (Command, error) {
+	d := &attrDecoder{attrs: attrs}
+	var c Command
+	switch hdr.Cmd {
+	case BTRFS_SEND_C_SUBVOL:
+		c = &SubvolCmd{Path: d.path(BTRFS_SEND_A_PATH), UUID: d.uuid(BTRFS_SEND_A_UUID), Ctransid: d.u64(BTRFS_SEND_A_CTRANSID)}
+	case BTRFS_SEND_C_SNAPSHOT:
+		c = &SnapshotCmd{
+			Path: d.path(BTRFS_SEND_A_PATH), UUID: d.uuid(BTRFS_SEND_A_UUID), Ctransid: d.u64(BTRFS_SEND_A_CTRANSID),
+			CloneUUID: d.uuid(BTRFS_SEND_A_CLONE_UUID), CloneCtransid: d.u64(BTRFS_SEND_A_CLONE_CTRANSID),
+		}
+	case BTRFS_SEND_C_MKFILE:
+		c = &MkfileCmd{Path: d.path(BTRFS_SEND_A_PATH), Ino: d.u64(BTRFS_SEND_A_INO)}
+	case BTRFS_SEND_C_MKDIR:
+		c = &MkdirCmd{Path: d.path(BTRFS_SEND_A_PATH), Ino: d.u64(BTRFS_SEND_A_INO)}
+	case BTRFS_SEND_C_MKNOD:
+		c = &MknodCmd{
+			Path: d.path(BTRFS_SEND_A_PATH), Ino: d.u64(BTRFS_SEND_A_INO),
+			Mode: uint32(d.uint(BTRFS_SEND_A_MODE)), Rdev: d.u64(BTRFS_SEND_A_RDEV),
+		}
+	case BTRFS_SEND_C_MKFIFO:
+		c = &MkfifoCmd{Path: d.path(BTRFS_SEND_A_PATH), Ino: d.u64(BTRFS_SEND_A_INO)}
+	case BTRFS_SEND_C_MKSOCK:
+		c = &MksockCmd{Path: d.path(BTRFS_SEND_A_PATH), Ino: d.u64(BTRFS_SEND_A_INO)}
+	case BTRFS_SEND_C_SYMLINK:
+		// The target of a symbolic link is stored as is and not resolved by the
+		// receiver, so it is not checked like the other paths.
+		c = &SymlinkCmd{Path: d.path(BTRFS_SEND_A_PATH), Ino: d.u64(BTRFS_SEND_A_INO), PathLink: d.str(BTRFS_SEND_A_PATH_LINK)}
+	case BTRFS_SEND_C_RENAME:
+		c = &RenameCmd{Path: d.path(BTRFS_SEND_A_PATH), PathTo: d.path(BTRFS_SEND_A_PATH_TO)}
+	case BTRFS_SEND_C_LINK:
+		c = &LinkCmd{Path: d.path(BTRFS_SEND_A_PATH), PathLink: d.path(BTRFS_SEND_A_PATH_LINK)}
+	case BTRFS_SEND_C_UNLINK:
+		c = &UnlinkCmd{Path: d.path(BTRFS_SEND_A_PATH)}
+	case BTRFS_SEND_C_RMDIR:
+		c = &RmdirCmd{Path: d.path(BTRFS_SEND_A_PATH)}
+	case BTRFS_SEND_C_WRITE:
+		c = &WriteCmd{Path: d.path(BTRFS_SEND_A_PATH), Offset: d.u64(BTRFS_SEND_A_FILE_OFFSET), Data: d.bytes(BTRFS_SEND_A_DATA)}
+	case BTRFS_SEND_C_ENCODED_WRITE:
+		c = &EncodedWriteCmd{Path: d.path(BTRFS_SEND_A_PATH), Op: btrfs.EncodedWriteOp{
+			Offset:              d.u64(BTRFS_SEND_A_FILE_OFFSET),
+			Data:                d.bytes(BTRFS_SEND_A_DATA),
+			UnencodedFileLength: d.u64(BTRFS_SEND_A_UNENCODED_FILE_LEN),
+			UnencodedLength:     d.u64(BTRFS_SEND_A_UNENCODED_LEN),
+			UnencodedOffset:     d.u64(BTRFS_SEND_A_UNENCODED_OFFSET),
+			Compression:         btrfs.CompressionType(d.optU32(BTRFS_SEND_A_COMPRESSION)),
+			Encryption:          d.optU32(BTRFS_SEND_A_ENCRYPTION),
+		}}
+	case BTRFS_SEND_C_CLONE:
+		c = &CloneCmd{
+			Path: d.path(BTRFS_SEND_A_PATH), Offset: d.u64(BTRFS_SEND_A_FILE_OFFSET), CloneLen: d.u64(BTRFS_SEND_A_CLONE_LEN),
+			CloneUUID: d.uuid(BTRFS_SEND_A_CLONE_UUID), CloneCtransid: d.u64(BTRFS_SEND_A_CLONE_CTRANSID),
+			ClonePath: d.path(BTRFS_SEND_A_CLONE_PATH), CloneOffset: d.u64(BTRFS_SEND_A_CLONE_OFFSET),
+		}
+	case BTRFS_SEND_C_SET_XATTR:
+		c = &SetXattrCmd{Path: d.path(BTRFS_SEND_A_PATH), Name: d.str(BTRFS_SEND_A_XATTR_NAME), Data: d.bytes(BTRFS_SEND_A_XATTR_DATA)}
+	case BTRFS_SEND_C_REMOVE_XATTR:
+		c = &RemoveXattrCmd{Path: d.path(BTRFS_SEND_A_PATH), Name: d.str(BTRFS_SEND_A_XATTR_NAME)}
+	case BTRFS_SEND_C_TRUNCATE:
+		c = &TruncateCmd{Path: d.path(BTRFS_SEND_A_PATH), Size: d.u64(BTRFS_SEND_A_SIZE)}
+	case BTRFS_SEND_C_CHMOD:
+		c = &ChmodCmd{Path: d.path(BTRFS_SEND_A_PATH), Mode: d.uint(BTRFS_SEND_A_MODE)}
+	case BTRFS_SEND_C_CHOWN:
+		c = &ChownCmd{Path: d.path(BTRFS_SEND_A_PATH), UID: d.u64(BTRFS_SEND_A_UID), GID: d.u64(BTRFS_SEND_A_GID)}
+	case BTRFS_SEND_C_UTIMES:
+		c = &UtimesCmd{
+			Path: d.path(BTRFS_SEND_A_PATH), Atime: d.time(BTRFS_SEND_A_ATIME),
+			Mtime: d.time(BTRFS_SEND_A_MTIME), Ctime: d.time(BTRFS_SEND_A_CTIME),
+		}
+	case BTRFS_SEND_C_UPDATE_EXTENT:
+		c = &UpdateExtentCmd{Path: d.path(BTRFS_SEND_A_PATH), Offset: d.u64(BTRFS_SEND_A_FILE_OFFSET), Size: d.u64(BTRFS_SEND_A_SIZE)}
+	case BTRFS_SEND_C_ENABLE_VERITY:
+		c = &EnableVerityCmd{
+			Path: d.path(BTRFS_SEND_A_PATH), Algorithm: d.u8(BTRFS_SEND_A_VERITY_ALGORITHM),
+			BlockSize: d.u32(BTRFS_SEND_A_VERITY_BLOCK_SIZE),
+			Salt:      d.bytes(BTRFS_SEND_A_VERITY_SALT_DATA), Sig: d.bytes(BTRFS_SEND_A_VERITY_SIG_DATA),
+		}
+	case BTRFS_SEND_C_FALLOCATE:
+		c = &FallocateCmd{
+			Path: d.path(BTRFS_SEND_A_PATH), Mode: d.u32(BTRFS_SEND_A_FALLOCATE_MODE),
+			Offset: d.u64(BTRFS_SEND_A_FILE_OFFSET), Size: d.u64(BTRFS_SEND_A_SIZE),
+		}
+	case BTRFS_SEND_C_FILEATTR:
+		c = &FileattrCmd{Path: d.path(BTRFS_SEND_A_PATH), Attr: uint32(d.uint(BTRFS_SEND_A_FILEATTR))}
+	case BTRFS_SEND_C_END:
+		c = &EndCmd{}
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownCommand, hdr.Cmd)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%s command: %w", hdr.Cmd, d.err)
+	}
+	return c, nil
+}
+
+// attrDecoder decodes the attributes of a command, keeping the first error so
+// that a command can be decoded in one expression and checked once.
+type attrDecoder struct {
+	attrs CmdAttrs
+	err   error
+}
+
+func (d *attrDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *attrDecoder) bytes(attr SendAttribute) []byte {
+	b, ok := d.attrs[attr]
+	if !ok {
+		d.fail(fmt.Errorf("%w %s", ErrMissingAttribute, attr))
+	}
+	return b
+}
+
+// fixed returns the attribute if it is exactly size bytes long.
+func (d *attrDecoder) fixed(attr SendAttribute, size int) []byte {
+	b := d.bytes(attr)
+	if b != nil && len(b) != size {
+		d.fail(fmt.Errorf("%w: %s is %d bytes, expected %d", ErrInvalidAttribute, attr, len(b), size))
+		return nil
+	}
+	return b
+}
+
+func (d *attrDecoder) u8(attr SendAttribute) uint8 {
+	if b := d.fixed(attr, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *attrDecoder) u32(attr SendAttribute) uint32 {
+	if b := d.fixed(attr, 4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *attrDecoder) u64(attr SendAttribute) uint64 {
+	if b := d.fixed(attr, 8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// uint decodes an attribute that is sent as either 32 or 64 bits, such as the
+// mode, which the kernel sends as 64 bits and Writer as 32 bits for mknod.
+func (d *attrDecoder) uint(attr SendAttribute) uint64 {
+	b := d.bytes(attr)
+	switch {
+	case b == nil:
+		return 0
+	case len(b) == 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	case len(b) == 8:
+		return binary.LittleEndian.Uint64(b)
+	}
+	d.fail(fmt.Errorf("%w: %s is %d bytes, expected 4 or 8", ErrInvalidAttribute, attr, len(b)))
+	return 0
+}
+
+// optU32 decodes an optional 32-bit attribute, returning 0 if it is missing.
+func (d *attrDecoder) optU32(attr SendAttribute) uint32 {
+	if _, ok := d.attrs[attr]; !ok {
+		return 0
+	}
+	return d.u32(attr)
+}
+
+func (d *attrDecoder) str(attr SendAttribute) string {
+	return string(d.bytes(attr))
+}
+
+// path decodes a path attribute, which must be relative and stay below the
+// directory it is resolved in.
+func (d *attrDecoder) path(attr SendAttribute) string {
+	p := d.str(attr)
+	if strings.HasPrefix(p, "/") || strings.IndexByte(p, 0) >= 0 {
+		d.fail(fmt.Errorf("%w %q in %s", ErrInvalidPath, p, attr))
+		return ""
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			d.fail(fmt.Errorf("%w %q in %s", ErrInvalidPath, p, attr))
+			return ""
+		}
+	}
+	return p
+}
+
+func (d *attrDecoder) uuid(attr SendAttribute) uuid.UUID {
+	var id uuid.UUID
+	if b := d.fixed(attr, len(id)); b != nil {
+		copy(id[:], b)
+	}
+	return id
+}
+
+func (d *attrDecoder) time(attr SendAttribute) time.Time {
+	var ts btrfs.BtrfsTimespec
+	b := d.fixed(attr, binary.Size(ts))
+	if b == nil {
+		return time.Time{}
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &ts); err != nil {
+		d.fail(err)
+		return time.Time{}
+	}
+	return ts.Time()
+}
@@ -0,0 +1,304 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// ChangeType is the kind of change to a path reported by DiffSubvolumes.
+type ChangeType int
+
+const (
+	// ChangeCreated is a path that does not exist in the old subvolume.
+	ChangeCreated ChangeType = iota
+	// ChangeModified is a path whose data or metadata changed.
+	ChangeModified
+	// ChangeDeleted is a path that no longer exists in the new subvolume.
+	ChangeDeleted
+	// ChangeRenamed is a path that was moved, and possibly modified as well.
+	ChangeRenamed
+)
+
+// String returns the name of the change type.
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangeRenamed:
+		return "renamed"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(c))
+	}
+}
+
+// FileChange is a change to a path between two subvolumes.
+type FileChange struct {
+	// Path is the path relative to the root of the subvolume. It is the path in the
+	// new subvolume, except for deletions.
+	Path string
+	// OldPath is the path in the old subvolume of a renamed path.
+	OldPath string
+	// Type is the kind of change.
+	Type ChangeType
+	// SizeDelta is the change in size of a regular file, in bytes. It is zero for
+	// other file types.
+	SizeDelta int64
+}
+
+// DiffSubvolumes lists the paths that differ between the read-only subvolumes old
+// and new, sorted by path. It performs an incremental send of new with old as its
+// parent, without file data, and reads the commands of the stream instead of
+// receiving it, so nothing is written. Changes to timestamps only are not reported,
+// and the paths beneath a renamed directory are reported through the directory
+// alone. The size deltas are taken from the files in both subvolumes.
+func DiffSubvolumes(old, new string) ([]FileChange, error) {
+	pr, pw := io.Pipe()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := btrfs.SendSubvolume(new, old, nil, pw, btrfs.SendWithoutData())
+		pw.CloseWithError(err)
+		sendErr <- err
+	}()
+	d := newStreamDiff()
+	err := d.read(NewDecoder(pr))
+	// Unblock the sender if the stream was rejected before its end
+	pr.CloseWithError(io.ErrClosedPipe)
+	if serr := <-sendErr; serr != nil {
+		return nil, serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.changes(old, new)
+}
+
+// diffEntry is a path touched by a stream.
+type diffEntry struct {
+	// orig is the path in the parent, empty for created paths.
+	orig     string
+	renamed  bool
+	modified bool
+}
+
+// streamDiff collects the changes made by an incremental stream.
+type streamDiff struct {
+	// entries maps the current paths touched by the stream to their state.
+	entries map[string]*diffEntry
+	// deleted holds the paths in the parent that were removed.
+	deleted []string
+}
+
+func newStreamDiff() *streamDiff {
+	return &streamDiff{entries: make(map[string]*diffEntry)}
+}
+
+// read applies the commands of the first subvolume in the stream.
+func (s *streamDiff) read(d *Decoder) error {
+	for {
+		c, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch c := c.(type) {
+		case *MkfileCmd:
+			s.create(c.Path)
+		case *MkdirCmd:
+			s.create(c.Path)
+		case *MknodCmd:
+			s.create(c.Path)
+		case *MkfifoCmd:
+			s.create(c.Path)
+		case *MksockCmd:
+			s.create(c.Path)
+		case *SymlinkCmd:
+			s.create(c.Path)
+		case *LinkCmd:
+			s.create(c.Path)
+		case *RenameCmd:
+			s.rename(c.Path, c.PathTo)
+		case *UnlinkCmd:
+			s.remove(c.Path)
+		case *RmdirCmd:
+			s.remove(c.Path)
+		case *WriteCmd:
+			s.modify(c.Path)
+		case *EncodedWriteCmd:
+			s.modify(c.Path)
+		case *CloneCmd:
+			s.modify(c.Path)
+		case *UpdateExtentCmd:
+			s.modify(c.Path)
+		case *TruncateCmd:
+			s.modify(c.Path)
+		case *FallocateCmd:
+			s.modify(c.Path)
+		case *ChmodCmd:
+			s.modify(c.Path)
+		case *ChownCmd:
+			s.modify(c.Path)
+		case *SetXattrCmd:
+			s.modify(c.Path)
+		case *RemoveXattrCmd:
+			s.modify(c.Path)
+		case *FileattrCmd:
+			s.modify(c.Path)
+		case *EnableVerityCmd:
+			s.modify(c.Path)
+		case *EndCmd:
+			return nil
+		}
+	}
+}
+
+// origOf returns the path in the parent of the current path, or an empty string if
+// the path was created by the stream.
+func (s *streamDiff) origOf(path string) string {
+	if e, ok := s.entries[path]; ok {
+		return e.orig
+	}
+	for dir := filepath.Dir(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if e, ok := s.entries[dir]; ok {
+			if e.orig == "" {
+				return ""
+			}
+			return e.orig + path[len(dir):]
+		}
+	}
+	return path
+}
+
+// lookup returns the entry of the current path, adding it if it is not tracked yet.
+func (s *streamDiff) lookup(path string) *diffEntry {
+	e, ok := s.entries[path]
+	if !ok {
+		e = &diffEntry{orig: s.origOf(path)}
+		s.entries[path] = e
+	}
+	return e
+}
+
+func (s *streamDiff) create(path string) {
+	s.entries[path] = &diffEntry{}
+}
+
+func (s *streamDiff) modify(path string) {
+	s.lookup(path).modified = true
+}
+
+func (s *streamDiff) remove(path string) {
+	if orig := s.origOf(path); orig != "" {
+		s.deleted = append(s.deleted, orig)
+	}
+	delete(s.entries, path)
+}
+
+// rename moves from, and the tracked paths beneath it, to to.
+func (s *streamDiff) rename(from, to string) {
+	s.lookup(from).renamed = true
+	prefix := from + "/"
+	moved := make(map[string]*diffEntry)
+	for path, e := range s.entries {
+		switch {
+		case path == from:
+			moved[to] = e
+		case strings.HasPrefix(path, prefix):
+			moved[to+"/"+path[len(prefix):]] = e
+		default:
+			continue
+		}
+		delete(s.entries, path)
+	}
+	for path, e := range moved {
+		s.entries[path] = e
+	}
+}
+
+// changes returns the collected changes, with the size deltas of regular files
+// taken from the old and new subvolumes.
+func (s *streamDiff) changes(old, new string) ([]FileChange, error) {
+	var changes []FileChange
+	for path, e := range s.entries {
+		c := FileChange{Path: path}
+		switch {
+		case e.orig == "":
+			c.Type = ChangeCreated
+		case e.renamed && e.orig != path:
+			c.Type, c.OldPath = ChangeRenamed, e.orig
+		case e.modified:
+			c.Type = ChangeModified
+		default:
+			continue
+		}
+		newSize, err := regularFileSize(filepath.Join(new, path))
+		if err != nil {
+			return nil, err
+		}
+		var oldSize int64
+		if e.orig != "" {
+			if oldSize, err = regularFileSize(filepath.Join(old, e.orig)); err != nil {
+				return nil, err
+			}
+		}
+		c.SizeDelta = newSize - oldSize
+		changes = append(changes, c)
+	}
+	for _, path := range s.deleted {
+		oldSize, err := regularFileSize(filepath.Join(old, path))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, FileChange{Path: path, Type: ChangeDeleted, SizeDelta: -oldSize})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path != changes[j].Path {
+			return changes[i].Path < changes[j].Path
+		}
+		return changes[i].Type < changes[j].Type
+	})
+	return changes, nil
+}
+
+// regularFileSize returns the size of the regular file at path, or zero if it is
+// not a regular file or does not exist.
+func regularFileSize(path string) (int64, error) {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, nil
+	}
+	return fi.Size(), nil
+}
@@ -22,4 +22,16 @@ var (
 	ErrInvalidVersion         = errors.New("invalid version")
 	ErrHeaderAlreadyParsed    = errors.New("header already parsed")
 	ErrInvalidCommandChecksum = errors.New("invalid crc32 checksum for command")
+	ErrCommandTooLarge        = errors.New("command exceeds the maximum command size")
+	ErrUnknownCommand         = errors.New("unknown command")
+	ErrMissingAttribute       = errors.New("missing attribute")
+	ErrInvalidAttribute       = errors.New("invalid attribute")
+	ErrInvalidPath            = errors.New("invalid path")
+	// ErrFileNotInStream is returned by ExtractFile if the stream does not create
+	// a regular file at the wanted path.
+	ErrFileNotInStream = errors.New("file not in send stream")
+	// ErrIncompleteFile is returned by ExtractFile if the data of the wanted file
+	// is not all contained in the stream, such as when it clones from another
+	// subvolume or the stream was sent without file data.
+	ErrIncompleteFile = errors.New("file data not contained in send stream")
 )
@@ -0,0 +1,314 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+)
+
+// ExtractFile reconstructs a single regular file from the send stream stored at
+// streamPath and writes its contents to w, without receiving the subvolume. The
+// file is looked up by wantedRelPath, relative to the root of the subvolume, as it
+// stands at the end of the stream; only the first subvolume in the stream is
+// considered.
+//
+// The stream is read twice. The first pass follows the files through renames,
+// links and unlinks to find the wanted file and the other files it clones ranges
+// from, directly or through further clones. The second pass replays the write,
+// encoded write, clone, truncate and fallocate commands of just those files into
+// unlinked temporary files, in stream order, so that every clone sees its source
+// as it was at that point. ErrFileNotInStream is returned if the stream does not
+// create the file, which is the case for files only changed by an incremental
+// stream, and ErrIncompleteFile if the file depends on data outside the stream.
+func ExtractFile(streamPath, wantedRelPath string, w io.Writer) error {
+	wanted := filepath.Clean(strings.TrimPrefix(wantedRelPath, "/"))
+	if wanted == "." || wanted == ".." || strings.HasPrefix(wanted, "../") {
+		return fmt.Errorf("%w: %q", ErrInvalidPath, wantedRelPath)
+	}
+	needed, target, err := planExtract(streamPath, wanted)
+	if err != nil {
+		return err
+	}
+	files := make(map[int]*os.File, len(needed))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	err = replayStream(streamPath, func(t *fileTracker, c Command) error {
+		if mk, ok := c.(*MkfileCmd); ok {
+			id := t.paths[mk.Path]
+			if !needed[id] {
+				return nil
+			}
+			f, err := os.CreateTemp("", "btrsync-extract-")
+			if err != nil {
+				return err
+			}
+			files[id] = f
+			return os.Remove(f.Name())
+		}
+		return applyExtractCommand(t, files, c)
+	})
+	if err != nil {
+		return err
+	}
+	f := files[target]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// extractFile is what the first pass of ExtractFile records about a file.
+type extractFile struct {
+	// clones holds the files cloned from, -1 for sources outside the stream.
+	clones []int
+	// noData is set if the file has ranges that were sent without their data.
+	noData bool
+}
+
+// planExtract finds the file at wanted at the end of the stream and returns the
+// set of files needed to reconstruct it, together with the file itself.
+func planExtract(streamPath, wanted string) (map[int]bool, int, error) {
+	files := make(map[int]*extractFile)
+	get := func(id int) *extractFile {
+		if files[id] == nil {
+			files[id] = &extractFile{}
+		}
+		return files[id]
+	}
+	var tracker *fileTracker
+	err := replayStream(streamPath, func(t *fileTracker, c Command) error {
+		tracker = t
+		switch c := c.(type) {
+		case *CloneCmd:
+			id, ok := t.paths[c.Path]
+			if !ok {
+				return nil
+			}
+			src, ok := t.paths[c.ClonePath]
+			if c.CloneUUID != t.subvol || !ok {
+				src = -1
+			}
+			get(id).clones = append(get(id).clones, src)
+		case *UpdateExtentCmd:
+			if id, ok := t.paths[c.Path]; ok {
+				get(id).noData = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	target, ok := -1, false
+	if tracker != nil {
+		target, ok = tracker.paths[wanted]
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrFileNotInStream, wanted)
+	}
+	needed := map[int]bool{target: true}
+	for queue := []int{target}; len(queue) > 0; queue = queue[1:] {
+		f := files[queue[0]]
+		if f == nil {
+			continue
+		}
+		if f.noData {
+			return nil, 0, fmt.Errorf("%w: %s depends on data sent without contents", ErrIncompleteFile, wanted)
+		}
+		for _, src := range f.clones {
+			if src < 0 {
+				return nil, 0, fmt.Errorf("%w: %s clones data from another subvolume", ErrIncompleteFile, wanted)
+			}
+			if !needed[src] {
+				needed[src] = true
+				queue = append(queue, src)
+			}
+		}
+	}
+	return needed, target, nil
+}
+
+// applyExtractCommand applies a data command to the temporary file of its target,
+// if it is one of files.
+func applyExtractCommand(t *fileTracker, files map[int]*os.File, c Command) error {
+	var path string
+	switch c := c.(type) {
+	case *WriteCmd:
+		path = c.Path
+	case *EncodedWriteCmd:
+		path = c.Path
+	case *CloneCmd:
+		path = c.Path
+	case *TruncateCmd:
+		path = c.Path
+	case *FallocateCmd:
+		path = c.Path
+	default:
+		return nil
+	}
+	id, ok := t.paths[path]
+	if !ok || files[id] == nil {
+		return nil
+	}
+	f := files[id]
+	switch c := c.(type) {
+	case *WriteCmd:
+		_, err := f.WriteAt(c.Data, int64(c.Offset))
+		return err
+	case *EncodedWriteCmd:
+		data, err := c.Op.FileData()
+		if err != nil {
+			return fmt.Errorf("encoded write to %s: %w", c.Path, err)
+		}
+		_, err = f.WriteAt(data, int64(c.Op.Offset))
+		return err
+	case *CloneCmd:
+		src, ok := t.paths[c.ClonePath]
+		if !ok || files[src] == nil {
+			return fmt.Errorf("%w: clone source %s of %s", ErrIncompleteFile, c.ClonePath, c.Path)
+		}
+		return copyRange(files[src], int64(c.CloneOffset), f, int64(c.Offset), int64(c.CloneLen))
+	case *TruncateCmd:
+		return f.Truncate(int64(c.Size))
+	case *FallocateCmd:
+		return syscall.Fallocate(int(f.Fd()), c.Mode, int64(c.Offset), int64(c.Size))
+	}
+	return nil
+}
+
+// copyRange copies n bytes at srcOff in src to dstOff in dst. The part of the range
+// beyond the end of src is written as zeros, like a hole.
+func copyRange(src *os.File, srcOff int64, dst *os.File, dstOff int64, n int64) error {
+	buf := make([]byte, 1<<20)
+	for n > 0 {
+		chunk := buf
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		read, err := src.ReadAt(chunk, srcOff)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		for i := read; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		if _, err := dst.WriteAt(chunk, dstOff); err != nil {
+			return err
+		}
+		srcOff += int64(len(chunk))
+		dstOff += int64(len(chunk))
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// fileTracker follows the regular files created by a send stream through
+// renames, links and unlinks. Files are identified by the order of their
+// creation, so the same stream always gives them the same identifiers.
+type fileTracker struct {
+	// subvol is the UUID of the subvolume being sent.
+	subvol uuid.UUID
+	// paths maps the current paths of the files to their identifiers.
+	paths map[string]int
+	next  int
+}
+
+// track updates the paths of the files for c. It returns true at the end of the
+// first subvolume.
+func (t *fileTracker) track(c Command) bool {
+	switch c := c.(type) {
+	case *SubvolCmd:
+		t.subvol = c.UUID
+	case *SnapshotCmd:
+		t.subvol = c.UUID
+	case *MkfileCmd:
+		t.paths[c.Path] = t.next
+		t.next++
+	case *RenameCmd:
+		t.rename(c.Path, c.PathTo)
+	case *LinkCmd:
+		if id, ok := t.paths[c.PathLink]; ok {
+			t.paths[c.Path] = id
+		}
+	case *UnlinkCmd:
+		delete(t.paths, c.Path)
+	case *EndCmd:
+		return true
+	}
+	return false
+}
+
+// rename moves from, and everything beneath it if it is a directory, to to. A file
+// at to is replaced.
+func (t *fileTracker) rename(from, to string) {
+	delete(t.paths, to)
+	prefix := from + "/"
+	moved := make(map[string]int)
+	for path, id := range t.paths {
+		switch {
+		case path == from:
+			moved[to] = id
+		case strings.HasPrefix(path, prefix):
+			moved[to+"/"+path[len(prefix):]] = id
+		default:
+			continue
+		}
+		delete(t.paths, path)
+	}
+	for path, id := range moved {
+		t.paths[path] = id
+	}
+}
+
+// replayStream decodes the stream stored at streamPath up to the end of its first
+// subvolume, calling fn for every command after updating the file tracker for it.
+func replayStream(streamPath string, fn func(*fileTracker, Command) error) error {
+	f, err := os.Open(streamPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t := &fileTracker{paths: make(map[string]int)}
+	d := NewDecoder(f)
+	for {
+		c, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		done := t.track(c)
+		if err := fn(t, c); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
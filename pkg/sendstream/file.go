@@ -0,0 +1,200 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// ManifestSuffix is appended to the name of a stored send stream to form the name
+// of its manifest.
+const ManifestSuffix = ".meta"
+
+// tmpSuffix is appended to the name of a file while it is being written.
+const tmpSuffix = ".tmp"
+
+// SendFileManifest is the sidecar manifest written next to a stored send stream.
+type SendFileManifest struct {
+	// UUID is the UUID of the sent subvolume.
+	UUID uuid.UUID `json:"uuid"`
+	// ParentUUID is the UUID of the parent the stream is relative to. It is
+	// uuid.Nil for full streams.
+	ParentUUID uuid.UUID `json:"parent_uuid"`
+	// Ctransid is the ctransid of the sent subvolume.
+	Ctransid uint64 `json:"ctransid"`
+	// ParentCtransid is the ctransid of the parent the stream is relative to.
+	ParentCtransid uint64 `json:"parent_ctransid,omitempty"`
+}
+
+// SendToFile sends the read-only subvolume at path to destFile. The stream is
+// written to destFile.tmp, synced and renamed to destFile only if the send
+// succeeds, so destFile is never left truncated. A manifest describing the stream
+// is written to destFile.meta. See btrfs.SendSubvolume for the meaning of parent and
+// cloneSources.
+func SendToFile(path, parent string, cloneSources []string, destFile string, opts ...btrfs.SendOption) error {
+	return SendToFileContext(context.Background(), path, parent, cloneSources, destFile, opts...)
+}
+
+// SendToFileContext is like SendToFile but aborts the send when the context is
+// done. Temporary files are removed on any error, including cancellation.
+func SendToFileContext(ctx context.Context, path, parent string, cloneSources []string, destFile string, opts ...btrfs.SendOption) error {
+	_, err := sendToFile(ctx, path, parent, cloneSources, destFile, false, opts...)
+	return err
+}
+
+// SendToFileWithManifest is like SendToFile but also records the stream in the
+// backup manifest at manifestPath, with its size and SHA-256 digest, creating the
+// manifest if it does not exist. The manifest is only updated once destFile is in
+// place. See btrfs.UpdateManifest for how the file name is stored.
+func SendToFileWithManifest(path, parent string, cloneSources []string, destFile, manifestPath string, opts ...btrfs.SendOption) error {
+	stream, err := sendToFile(context.Background(), path, parent, cloneSources, destFile, true, opts...)
+	if err != nil {
+		return err
+	}
+	if stream.File, err = filepath.Abs(destFile); err != nil {
+		return err
+	}
+	return btrfs.UpdateManifest(manifestPath, *stream)
+}
+
+// sendToFile implements SendToFileContext. If digest is true the size and digest
+// of the written stream are computed as well. The returned manifest stream has no
+// file name set.
+func sendToFile(ctx context.Context, path, parent string, cloneSources []string, destFile string, digest bool, opts ...btrfs.SendOption) (stream *btrfs.ManifestStream, err error) {
+	tmpFile := destFile + tmpSuffix
+	f, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(tmpFile)
+		}
+	}()
+	if err = btrfs.SendSubvolumeContext(ctx, path, parent, cloneSources, f, opts...); err != nil {
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	hdr, err := ParseSendStreamHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse written stream: %w", err)
+	}
+	stream = &btrfs.ManifestStream{UUID: hdr.UUID, ParentUUID: hdr.ParentUUID, Ctransid: hdr.Ctransid}
+	if digest {
+		// Hash the stream as stored rather than as sent
+		if _, err = f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		if stream.Size, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		stream.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	if err = f.Close(); err != nil {
+		f = nil
+		return nil, err
+	}
+	f = nil
+	manifest := &SendFileManifest{
+		UUID:           hdr.UUID,
+		ParentUUID:     hdr.ParentUUID,
+		Ctransid:       hdr.Ctransid,
+		ParentCtransid: hdr.ParentCtransid,
+	}
+	if err = writeManifest(destFile+ManifestSuffix, manifest); err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		os.Remove(destFile + ManifestSuffix)
+		return nil, err
+	}
+	if err = os.Rename(tmpFile, destFile); err != nil {
+		os.Remove(destFile + ManifestSuffix)
+		return nil, err
+	}
+	return stream, syncDir(filepath.Dir(destFile))
+}
+
+// ReadSendFileManifest reads the manifest stored next to the send stream at
+// destFile by SendToFile.
+func ReadSendFileManifest(destFile string) (*SendFileManifest, error) {
+	b, err := os.ReadFile(destFile + ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var m SendFileManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", destFile+ManifestSuffix, err)
+	}
+	return &m, nil
+}
+
+// writeManifest atomically writes m as JSON to path.
+func writeManifest(path string, m *SendFileManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// syncDir flushes the directory entries of dir to disk so that renames into it
+// are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,129 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// seedStream returns a send stream of the given version made of cmds.
+func seedStream(t testing.TB, version uint32, cmds ...func() (SendCommand, CmdAttrs)) []byte {
+	var b bytes.Buffer
+	hdr := StreamHeader{Magic: BTRFS_SEND_STREAM_MAGIC_ENCODED, Version: version}
+	if err := binary.Write(&b, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	w := &Writer{Writer: &b, headerSent: true}
+	for _, cmd := range cmds {
+		if err := w.WriteCommand(cmd()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func FuzzDecoder(f *testing.F) {
+	subvol, parent := uuid.New(), uuid.New()
+	now := time.Unix(1700000000, 123)
+	full := seedStream(f, 2,
+		func() (SendCommand, CmdAttrs) { return NewSubvolCommand("vol", subvol, 7) },
+		func() (SendCommand, CmdAttrs) { return NewMkdirCommand("o257-7-0", 257) },
+		func() (SendCommand, CmdAttrs) { return NewRenameCommand("o257-7-0", "dir") },
+		func() (SendCommand, CmdAttrs) { return NewMkfileCommand("dir/file", 258) },
+		func() (SendCommand, CmdAttrs) { return NewWriteCommand("dir/file", 0, []byte("hello world")) },
+		func() (SendCommand, CmdAttrs) { return NewCloneCommand("dir/file", 11, 5, subvol, 7, "dir/file", 6) },
+		func() (SendCommand, CmdAttrs) { return NewTruncateCommand("dir/file", 16) },
+		func() (SendCommand, CmdAttrs) { return NewSymlinkCommand("link", "dir/file", 259) },
+		func() (SendCommand, CmdAttrs) { return NewLinkCommand("hard", "dir/file") },
+		func() (SendCommand, CmdAttrs) { return NewSetXattrCommand("dir/file", "user.a", []byte("b")) },
+		func() (SendCommand, CmdAttrs) { return NewChownCommand("dir/file", 1000, 1000) },
+		func() (SendCommand, CmdAttrs) { return NewChmodCommand("dir/file", 0o644) },
+		func() (SendCommand, CmdAttrs) { return NewUtimesCommand("dir/file", now, now, now) },
+		func() (SendCommand, CmdAttrs) { return NewUnlinkCommand("hard") },
+		NewEndCommand,
+	)
+	incremental := seedStream(f, 2,
+		func() (SendCommand, CmdAttrs) { return NewSnapshotCommand("vol", subvol, 9, parent, 7) },
+		func() (SendCommand, CmdAttrs) { return NewUpdateExtentCommand("dir/file", 0, 4096) },
+		func() (SendCommand, CmdAttrs) {
+			return NewEncodedWriteCommand("dir/file", &btrfs.EncodedWriteOp{
+				Offset: 4096, Data: make([]byte, 4096), UnencodedFileLength: 4096,
+				UnencodedLength: 4096, Compression: btrfs.CompressionNone,
+			})
+		},
+		func() (SendCommand, CmdAttrs) { return NewFallocateCommand("dir/file", 0, 0, 8192) },
+		func() (SendCommand, CmdAttrs) { return NewFileAttrCommand("dir/file", 0) },
+		func() (SendCommand, CmdAttrs) {
+			return NewEnableVerityCommand("dir/file", 1, 4096, []byte("salt"), nil)
+		},
+		func() (SendCommand, CmdAttrs) { return NewRemoveXattrCommand("dir/file", "user.a") },
+		func() (SendCommand, CmdAttrs) { return NewRmdirCommand("old") },
+		NewEndCommand,
+	)
+	// Writer encodes the data attribute as in version 2, so this one has no writes
+	v1 := seedStream(f, 1,
+		func() (SendCommand, CmdAttrs) { return NewSubvolCommand("vol", subvol, 7) },
+		func() (SendCommand, CmdAttrs) { return NewMkfileCommand("file", 257) },
+		func() (SendCommand, CmdAttrs) { return NewTruncateCommand("file", 4096) },
+		NewEndCommand,
+	)
+	for _, stream := range [][]byte{full, incremental, v1} {
+		if _, err := ValidateSendStream(bytes.NewReader(stream)); err != nil {
+			f.Fatalf("invalid seed stream: %v", err)
+		}
+	}
+	f.Add(full)
+	f.Add(incremental)
+	f.Add(v1)
+	f.Add(full[:len(full)-5])
+	f.Add(append(append([]byte{}, full...), incremental...))
+	f.Add(seedStream(f, 2))
+	f.Add([]byte(BTRFS_SEND_STREAM_MAGIC))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Errors are expected for most inputs, only panics and hangs are failures
+		_, _ = ValidateSendStream(bytes.NewReader(data))
+		dec := NewDecoder(bytes.NewReader(data))
+		for {
+			if _, err := dec.Next(); err != nil {
+				break
+			}
+		}
+		// Skip the checksums so that mutated attributes reach DecodeCommand
+		s := NewScanner(bytes.NewReader(data), true)
+		if _, err := s.ReadHeader(false); err != nil {
+			return
+		}
+		for {
+			hdr, attrs, err := s.ReadCommand()
+			if err != nil {
+				if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+					return
+				}
+				continue
+			}
+			_, _ = DecodeCommand(hdr, attrs)
+		}
+	})
+}
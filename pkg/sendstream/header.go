@@ -0,0 +1,94 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// ErrNoSubvolumeCommand is returned when a send stream does not start with a
+// subvolume or snapshot command.
+var ErrNoSubvolumeCommand = errors.New("stream does not start with a subvol or snapshot command")
+
+// SendStreamHeader describes the subvolume carried by a send stream.
+type SendStreamHeader struct {
+	// Version is the send stream protocol version.
+	Version uint32
+	// Path is the path of the subvolume as recorded by the sender.
+	Path string
+	// UUID is the UUID of the sent subvolume.
+	UUID uuid.UUID
+	// Ctransid is the ctransid of the sent subvolume.
+	Ctransid uint64
+	// ParentUUID is the UUID of the parent the stream is relative to. It is
+	// uuid.Nil for full streams.
+	ParentUUID uuid.UUID
+	// ParentCtransid is the ctransid of the parent the stream is relative to.
+	ParentCtransid uint64
+}
+
+// Incremental returns true if the stream is relative to a parent subvolume.
+func (h *SendStreamHeader) Incremental() bool {
+	return h.ParentUUID != uuid.Nil
+}
+
+// ParseSendStreamHeader reads the stream header and the leading subvol or snapshot
+// command from r and returns the information they carry. Only the header and the
+// first command are read from r, the rest of the stream is left unconsumed.
+func ParseSendStreamHeader(r io.Reader) (*SendStreamHeader, error) {
+	scanner := NewScanner(r, false)
+	hdr, err := scanner.ReadHeader(false)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:]) != BTRFS_SEND_STREAM_MAGIC {
+		return nil, fmt.Errorf("%w %q", ErrInvalidMagic, hdr.Magic)
+	}
+	if hdr.Version == 0 || hdr.Version > BTRFS_SEND_STREAM_VERSION {
+		return nil, fmt.Errorf("%w %d", ErrInvalidVersion, hdr.Version)
+	}
+	cmd, attrs, err := scanner.ReadCommand()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first command: %w", err)
+	}
+	out := &SendStreamHeader{Version: hdr.Version}
+	switch cmd.Cmd {
+	case BTRFS_SEND_C_SUBVOL:
+	case BTRFS_SEND_C_SNAPSHOT:
+		if len(attrs[BTRFS_SEND_A_CLONE_CTRANSID]) != 8 {
+			return nil, fmt.Errorf("snapshot command is missing the clone ctransid")
+		}
+		if out.ParentUUID, err = attrs.GetCloneUUID(); err != nil {
+			return nil, fmt.Errorf("invalid clone UUID: %w", err)
+		}
+		out.ParentCtransid = attrs.GetCloneCtransid()
+	default:
+		return nil, fmt.Errorf("%w: got %s", ErrNoSubvolumeCommand, cmd.Cmd)
+	}
+	if len(attrs[BTRFS_SEND_A_CTRANSID]) != 8 {
+		return nil, fmt.Errorf("%s command is missing the ctransid", cmd.Cmd)
+	}
+	if out.UUID, err = attrs.GetUUID(); err != nil {
+		return nil, fmt.Errorf("invalid UUID: %w", err)
+	}
+	out.Path = attrs.GetPath()
+	out.Ctransid = attrs.GetCtransid()
+	return out, nil
+}
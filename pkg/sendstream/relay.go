@@ -0,0 +1,140 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// cmdHeaderSize is the encoded size of a CmdHeader.
+var cmdHeaderSize = binary.Size(CmdHeader{})
+
+// ErrTruncatedStream is returned by RelaySendStream when the stream ends before an
+// END command.
+var ErrTruncatedStream = errors.New("send stream ended without an END command")
+
+// RelaySendStream copies the send stream read from r to w command by command,
+// without buffering more than one command in memory. The stream header is validated
+// and copied unchanged, and the checksum of every command is verified before it is
+// passed on.
+//
+// If transform is not nil it is called with each complete encoded command, header
+// and payload, and its result is written instead. Returning nil drops the command.
+// The result must be a single command whose length field matches its payload; its
+// checksum is recomputed, so transform may change the payload freely. The framing
+// of the stream is therefore preserved and it can still be received by btrfs
+// receive.
+func RelaySendStream(r io.Reader, w io.Writer, transform func([]byte) ([]byte, error)) error {
+	var hdr StreamHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("failed to read stream header: %w", err)
+	}
+	if string(hdr.Magic[:]) != BTRFS_SEND_STREAM_MAGIC {
+		return fmt.Errorf("%w %q", ErrInvalidMagic, hdr.Magic)
+	}
+	if hdr.Version == 0 || hdr.Version > BTRFS_SEND_STREAM_VERSION {
+		return fmt.Errorf("%w %d", ErrInvalidVersion, hdr.Version)
+	}
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	var last SendCommand
+	for {
+		raw, cmd, err := readRawCommand(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if last == BTRFS_SEND_C_END {
+					return nil
+				}
+				return ErrTruncatedStream
+			}
+			return err
+		}
+		last = cmd
+		if transform != nil {
+			if raw, err = transform(raw); err != nil {
+				return fmt.Errorf("failed to transform %s command: %w", cmd, err)
+			}
+			if raw == nil {
+				continue
+			}
+			if err := resealCommand(raw); err != nil {
+				return fmt.Errorf("invalid transformed %s command: %w", cmd, err)
+			}
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// readRawCommand reads the next command from r and verifies its checksum. It
+// returns the encoded command, header and payload. io.EOF is only returned if the
+// stream ends at a command boundary.
+func readRawCommand(r io.Reader) ([]byte, SendCommand, error) {
+	raw := make([]byte, cmdHeaderSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("failed to read command header: %w", err)
+	}
+	var hdr CmdHeader
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &hdr); err != nil {
+		return nil, 0, err
+	}
+	if err := checkCommandSize(hdr); err != nil {
+		return nil, hdr.Cmd, err
+	}
+	raw = append(raw, make([]byte, hdr.Len)...)
+	if _, err := io.ReadFull(r, raw[cmdHeaderSize:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, hdr.Cmd, fmt.Errorf("failed to read %s command: %w", hdr.Cmd, err)
+	}
+	if err := validateCrc32(hdr, raw[cmdHeaderSize:]); err != nil {
+		return nil, hdr.Cmd, fmt.Errorf("%s command: %w", hdr.Cmd, err)
+	}
+	return raw, hdr.Cmd, nil
+}
+
+// resealCommand checks that raw holds exactly one encoded command and updates its
+// checksum in place.
+func resealCommand(raw []byte) error {
+	if len(raw) < cmdHeaderSize {
+		return fmt.Errorf("%d bytes is shorter than a command header", len(raw))
+	}
+	var hdr CmdHeader
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if int(hdr.Len) != len(raw)-cmdHeaderSize {
+		return fmt.Errorf("length field %d does not match the payload of %d bytes", hdr.Len, len(raw)-cmdHeaderSize)
+	}
+	hdr.Crc = 0
+	sum, err := calculateCrc32(hdr, raw[cmdHeaderSize:])
+	if err != nil {
+		return err
+	}
+	// The checksum is the last field of the header
+	binary.LittleEndian.PutUint32(raw[cmdHeaderSize-4:cmdHeaderSize], sum)
+	return nil
+}
@@ -24,12 +24,19 @@ import (
 	"io"
 )
 
+// maxCommandSize is the largest command payload that is read from a stream. The
+// kernel uses a send buffer of 64KiB for version 1 streams and one of 16KiB plus
+// the largest compressed extent for later versions, so larger length fields are
+// rejected rather than allocated.
+const maxCommandSize = 1 << 20
+
 // Scanner is a send stream scanner. It reads a send stream from an io.Reader
 // and parses it into commands. It is not safe for concurrent use.
 type Scanner struct {
 	io.Reader
 	ignoreChecksums bool
 	headerParsed    bool
+	version         uint32
 	scanErr         error
 	curHdr          CmdHeader
 	curAttrs        CmdAttrs
@@ -121,12 +128,23 @@ func (s *Scanner) readHeader() (StreamHeader, error) {
 	if string(hdr.Magic[:]) != BTRFS_SEND_STREAM_MAGIC {
 		return hdr, fmt.Errorf("%w %q", ErrInvalidMagic, hdr.Magic)
 	}
-	if hdr.Version != BTRFS_SEND_STREAM_VERSION {
+	if hdr.Version == 0 || hdr.Version > BTRFS_SEND_STREAM_VERSION {
 		return hdr, fmt.Errorf("%w %d", ErrInvalidVersion, hdr.Version)
 	}
+	s.version = hdr.Version
 	return hdr, nil
 }
 
+// Version returns the version of the stream given in its header. Commands are
+// parsed according to this version. If the header has not been parsed, or its
+// version was not validated, the latest supported version is returned.
+func (s *Scanner) Version() uint32 {
+	if s.version == 0 {
+		return BTRFS_SEND_STREAM_VERSION
+	}
+	return s.version
+}
+
 func (s *Scanner) readCommandHeader() (CmdHeader, error) {
 	var hdr CmdHeader
 	if err := s.read(&hdr); err != nil {
@@ -136,9 +154,10 @@ func (s *Scanner) readCommandHeader() (CmdHeader, error) {
 }
 
 func (s *Scanner) readCommandAttributes(hdr CmdHeader) (CmdAttrs, error) {
-	size := int(hdr.Len)
-	attrs := make(CmdAttrs)
-	data := make([]byte, size)
+	if err := checkCommandSize(hdr); err != nil {
+		return nil, err
+	}
+	data := make([]byte, hdr.Len)
 	if err := s.read(data); err != nil {
 		return nil, err
 	}
@@ -147,26 +166,58 @@ func (s *Scanner) readCommandAttributes(hdr CmdHeader) (CmdAttrs, error) {
 			return nil, err
 		}
 	}
-	var pos int
-	for pos < size {
+	if err := checkCommandVersion(s.Version(), hdr.Cmd); err != nil {
+		return nil, err
+	}
+	return parseAttributes(s.Version(), data)
+}
+
+// checkCommandSize returns ErrCommandTooLarge if the payload of the command is
+// larger than maxCommandSize.
+func checkCommandSize(hdr CmdHeader) error {
+	if hdr.Len > maxCommandSize {
+		return fmt.Errorf("%w: %s command of %d bytes", ErrCommandTooLarge, hdr.Cmd, hdr.Len)
+	}
+	return nil
+}
+
+// checkCommandVersion returns ErrInvalidVersion if cmd is not part of the given
+// version of the stream format.
+func checkCommandVersion(version uint32, cmd SendCommand) error {
+	if version == 1 && cmd > BTRFS_SEND_C_MAX_V1 {
+		return fmt.Errorf("%w: %s command in a version %d stream", ErrInvalidVersion, cmd, version)
+	}
+	return nil
+}
+
+// parseAttributes decodes the attributes of a command payload, checking that every
+// attribute lies within the payload. From stream version 2 on the data attribute
+// has no length and extends to the end of the payload.
+func parseAttributes(version uint32, data []byte) (CmdAttrs, error) {
+	attrs := make(CmdAttrs)
+	rdr := bytes.NewReader(data)
+	for rdr.Len() > 0 {
 		var attr SendAttribute
-		if err := binary.Read(bytes.NewReader(data[pos:]), binary.LittleEndian, &attr); err != nil {
-			return nil, err
+		if err := binary.Read(rdr, binary.LittleEndian, &attr); err != nil {
+			return nil, fmt.Errorf("truncated attribute header: %w", err)
 		}
-		pos += binary.Size(attr)
-		var attrLen uint32
-		if attr == BTRFS_SEND_A_DATA {
-			attrLen = uint32(size - pos)
-		} else {
-			var len uint16
-			if err := binary.Read(bytes.NewReader(data[pos:]), binary.LittleEndian, &len); err != nil {
-				return nil, err
-			}
-			pos += binary.Size(len)
-			attrLen = uint32(len)
+		pos := len(data) - rdr.Len()
+		if attr == BTRFS_SEND_A_DATA && version >= 2 {
+			attrs[attr] = data[pos:]
+			break
+		}
+		var length uint16
+		if err := binary.Read(rdr, binary.LittleEndian, &length); err != nil {
+			return nil, fmt.Errorf("truncated header of %s: %w", attr, err)
+		}
+		pos += 2
+		if int(length) > rdr.Len() {
+			return nil, fmt.Errorf("%s of %d bytes exceeds the command by %d bytes", attr, length, int(length)-rdr.Len())
+		}
+		attrs[attr] = data[pos : pos+int(length)]
+		if _, err := rdr.Seek(int64(length), io.SeekCurrent); err != nil {
+			return nil, err
 		}
-		attrs[attr] = data[pos : pos+int(attrLen)]
-		pos += int(attrLen)
 	}
 	return attrs, nil
 }
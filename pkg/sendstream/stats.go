@@ -0,0 +1,96 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+)
+
+// StatsCodec is the codec used by SendSubvolumeStats to estimate the compressed
+// size of a stream.
+const StatsCodec = btrfs.CodecZstd
+
+// SendStats summarizes a send stream produced by SendSubvolumeStats.
+type SendStats struct {
+	StreamStats
+	// Writes is the number of write and encoded write commands.
+	Writes int
+	// Clones is the number of clone commands.
+	Clones int
+	// CompressedSize is the size of the stream after compression with StatsCodec.
+	CompressedSize int64
+}
+
+// SendSubvolumeStats performs a dry run of sending the read-only subvolume at path,
+// incrementally against parent if it is not empty, and returns a summary of the
+// stream without writing it anywhere. The stream is produced by the kernel and
+// checked as by ValidateSendStream, so the run takes as long as a real send and
+// reads the same data, but it needs no destination. The compressed size is that
+// of the whole stream compressed with StatsCodec, as with btrfs.SendWithCompressor.
+func SendSubvolumeStats(path, parent string) (*SendStats, error) {
+	pr, pw := io.Pipe()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := btrfs.SendSubvolume(path, parent, nil, pw)
+		pw.CloseWithError(err)
+		sendErr <- err
+	}()
+	stats, err := sendStats(pr)
+	// Unblock the sender if the stream was rejected before its end
+	pr.CloseWithError(io.ErrClosedPipe)
+	if serr := <-sendErr; serr != nil {
+		return nil, serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// sendStats summarizes the stream read from r.
+func sendStats(r io.Reader) (*SendStats, error) {
+	var compressed countingWriter
+	zw, err := StatsCodec.NewWriter(&compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s compressor: %w", StatsCodec, err)
+	}
+	vstats, err := ValidateSendStream(io.TeeReader(r, zw))
+	if cerr := zw.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SendStats{
+		StreamStats:    *vstats,
+		Writes:         vstats.Commands[BTRFS_SEND_C_WRITE] + vstats.Commands[BTRFS_SEND_C_ENCODED_WRITE],
+		Clones:         vstats.Commands[BTRFS_SEND_C_CLONE],
+		CompressedSize: compressed.n,
+	}, nil
+}
+
+// countingWriter discards the bytes written to it and counts them.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
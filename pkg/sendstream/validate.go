@@ -0,0 +1,158 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sendstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// StreamStats summarizes a send stream checked by ValidateSendStream.
+type StreamStats struct {
+	// Version is the version of the stream format.
+	Version uint32
+	// UUID is the UUID of the first subvolume in the stream.
+	UUID uuid.UUID
+	// Ctransid is the ctransid of the first subvolume in the stream.
+	Ctransid uint64
+	// ParentUUID is the UUID of the parent of the first subvolume if it is sent
+	// incrementally, uuid.Nil otherwise.
+	ParentUUID uuid.UUID
+	// ParentCtransid is the ctransid of the parent of the first subvolume.
+	ParentCtransid uint64
+	// Subvolumes is the number of subvolumes in the stream.
+	Subvolumes int
+	// Commands counts the commands in the stream by type.
+	Commands map[SendCommand]int
+	// DataBytes is the number of file data bytes carried by write and encoded
+	// write commands. For encoded writes this is the encoded size.
+	DataBytes uint64
+	// Size is the size of the stream in bytes.
+	Size int64
+}
+
+// StreamError is returned by ValidateSendStream for an invalid stream. It holds
+// the offset in the stream of the command, or header, that is invalid.
+type StreamError struct {
+	// Offset is the byte offset of the start of the invalid part of the stream.
+	Offset int64
+	// Err is the problem found.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("invalid send stream at offset %d: %s", e.Offset, e.Err)
+}
+
+// Unwrap returns the problem found.
+func (e *StreamError) Unwrap() error { return e.Err }
+
+// ValidateSendStream reads the whole send stream from r and checks it without
+// touching any filesystem: the stream header, the length and checksum of every
+// command, the command types and the framing of their attributes. A stream that
+// does not end with an END command is reported as truncated with
+// ErrTruncatedStream, as is a stream that ends within a command. Problems are returned as a *StreamError holding the offset of
+// the first invalid command. On success a summary of the stream is returned.
+func ValidateSendStream(r io.Reader) (*StreamStats, error) {
+	cr := &countingReader{r: r}
+	var hdr StreamHeader
+	if err := binary.Read(cr, binary.LittleEndian, &hdr); err != nil {
+		return nil, &StreamError{Offset: 0, Err: fmt.Errorf("failed to read stream header: %w", err)}
+	}
+	if string(hdr.Magic[:]) != BTRFS_SEND_STREAM_MAGIC {
+		return nil, &StreamError{Offset: 0, Err: fmt.Errorf("%w %q", ErrInvalidMagic, hdr.Magic)}
+	}
+	if hdr.Version == 0 || hdr.Version > BTRFS_SEND_STREAM_VERSION {
+		return nil, &StreamError{Offset: 0, Err: fmt.Errorf("%w %d", ErrInvalidVersion, hdr.Version)}
+	}
+	stats := &StreamStats{Version: hdr.Version, Commands: make(map[SendCommand]int)}
+	var last SendCommand
+	for {
+		offset := cr.n
+		raw, cmd, err := readRawCommand(cr)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if last != BTRFS_SEND_C_END {
+					return nil, &StreamError{Offset: offset, Err: ErrTruncatedStream}
+				}
+				stats.Size = cr.n
+				return stats, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("%w: %v", ErrTruncatedStream, err)
+			}
+			return nil, &StreamError{Offset: offset, Err: err}
+		}
+		if err := stats.add(hdr.Version, cmd, raw[cmdHeaderSize:]); err != nil {
+			return nil, &StreamError{Offset: offset, Err: err}
+		}
+		last = cmd
+	}
+}
+
+// add checks the attributes of a command and adds it to the statistics.
+func (s *StreamStats) add(version uint32, cmd SendCommand, data []byte) error {
+	if err := checkCommandVersion(version, cmd); err != nil {
+		return err
+	}
+	attrs, err := parseAttributes(version, data)
+	if err != nil {
+		return fmt.Errorf("%s command: %w", cmd, err)
+	}
+	for attr := range attrs {
+		if attr == BTRFS_SEND_A_UNSPEC || attr > BTRFS_SEND_A_MAX {
+			return fmt.Errorf("%s command: unknown attribute %d", cmd, attr)
+		}
+	}
+	c, err := DecodeCommand(CmdHeader{Cmd: cmd}, attrs)
+	if err != nil {
+		return err
+	}
+	s.Commands[cmd]++
+	s.DataBytes += uint64(len(attrs[BTRFS_SEND_A_DATA]))
+	switch c := c.(type) {
+	case *SubvolCmd:
+		if s.Subvolumes == 0 {
+			s.UUID, s.Ctransid = c.UUID, c.Ctransid
+		}
+	case *SnapshotCmd:
+		if s.Subvolumes == 0 {
+			s.UUID, s.Ctransid = c.UUID, c.Ctransid
+			s.ParentUUID, s.ParentCtransid = c.CloneUUID, c.CloneCtransid
+		}
+	default:
+		return nil
+	}
+	s.Subvolumes++
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,302 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/madworx/btrsync/pkg/btrfs"
+	"github.com/madworx/btrsync/pkg/receive"
+)
+
+// SSHOptions are options for an SSH transport.
+type SSHOptions struct {
+	// Port is the port to connect to. It defaults to the port in the host, or 22.
+	Port int
+	// KeyFile is the path of a private key used for authentication.
+	KeyFile string
+	// Password is used for password authentication. It is only supported by the
+	// native client.
+	Password string
+	// HostKey is the expected public key of the host in authorized_keys format. If
+	// empty, the host key is not verified by the native client, and the ssh
+	// binary's own known hosts handling applies.
+	HostKey string
+	// UseSSHBinary runs the ssh binary instead of the native client.
+	UseSSHBinary bool
+	// SSHBinary is the ssh binary to run. It defaults to "ssh".
+	SSHBinary string
+	// SSHArgs are additional arguments passed to the ssh binary.
+	SSHArgs []string
+	// ReceiveCommand is the command run on the remote host to receive a stream on
+	// stdin. The destination directory is appended. It defaults to "btrsync receive"
+	// if btrsync is installed on the remote host and "btrfs receive" otherwise.
+	ReceiveCommand string
+	// SendCommand is the command run on the remote host to write a stream to stdout.
+	// The subvolume path is appended. It defaults to "btrfs send".
+	SendCommand string
+}
+
+// remoteRunner runs a command on the remote host with the given stdin and stdout.
+type remoteRunner interface {
+	run(cmd string, stdin io.Reader, stdout io.Writer) error
+	close() error
+}
+
+type sshTransport struct {
+	runner remoteRunner
+	opts   SSHOptions
+}
+
+// NewSSHTransport returns a Transport to host that authenticates as user. The host
+// may include a port. If user is empty the current user is used. With the native
+// client the connection is established immediately.
+func NewSSHTransport(host, user string, opts SSHOptions) (Transport, error) {
+	if user == "" {
+		cur, err := currentUser()
+		if err != nil {
+			return nil, err
+		}
+		user = cur
+	}
+	hostname, port := host, 22
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid port in host %q: %w", host, err)
+		}
+	}
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	var runner remoteRunner
+	var err error
+	if opts.UseSSHBinary {
+		runner, err = newBinaryRunner(hostname, port, user, opts)
+	} else {
+		runner, err = newNativeRunner(hostname, port, user, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sshTransport{runner: runner, opts: opts}, nil
+}
+
+// Send implements Transport.
+func (t *sshTransport) Send(localPath, parent string, cloneSources []string, remotePath string) error {
+	recvCmd, err := t.receiveCommand()
+	if err != nil {
+		return err
+	}
+	cmd := recvCmd + " " + shellQuote(remotePath)
+	pr, pw := io.Pipe()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := btrfs.SendSubvolume(localPath, parent, cloneSources, pw)
+		pw.CloseWithError(err)
+		sendErr <- err
+	}()
+	runErr := t.runner.run(cmd, pr, io.Discard)
+	// Unblock the sender if the remote command stopped reading early
+	pr.CloseWithError(errors.New("remote receive exited"))
+	if err := <-sendErr; err != nil {
+		// The remote error says why the stream could not be written
+		if runErr != nil {
+			return runErr
+		}
+		return fmt.Errorf("failed to send %s: %w", localPath, err)
+	}
+	return runErr
+}
+
+// Receive implements Transport.
+func (t *sshTransport) Receive(remotePath, localPath string) error {
+	sendCmd := t.opts.SendCommand
+	if sendCmd == "" {
+		sendCmd = "btrfs send"
+	}
+	cmd := sendCmd + " " + shellQuote(remotePath)
+	pr, pw := io.Pipe()
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := receive.ReceiveSubvolume(localPath, pr)
+		pr.CloseWithError(err)
+		recvErr <- err
+	}()
+	runErr := t.runner.run(cmd, nil, pw)
+	pw.CloseWithError(runErr)
+	if err := <-recvErr; err != nil {
+		if runErr != nil {
+			return runErr
+		}
+		return fmt.Errorf("failed to receive %s: %w", remotePath, err)
+	}
+	return runErr
+}
+
+// Close implements Transport.
+func (t *sshTransport) Close() error { return t.runner.close() }
+
+func (t *sshTransport) receiveCommand() (string, error) {
+	if t.opts.ReceiveCommand != "" {
+		return t.opts.ReceiveCommand, nil
+	}
+	var out bytes.Buffer
+	err := t.runner.run("command -v btrsync", nil, &out)
+	if err == nil && strings.TrimSpace(out.String()) != "" {
+		t.opts.ReceiveCommand = "btrsync receive"
+	} else {
+		var remoteErr *RemoteError
+		if err != nil && !errors.As(err, &remoteErr) {
+			return "", err
+		}
+		t.opts.ReceiveCommand = "btrfs receive"
+	}
+	return t.opts.ReceiveCommand, nil
+}
+
+// nativeRunner runs commands using golang.org/x/crypto/ssh.
+type nativeRunner struct {
+	client *ssh.Client
+}
+
+func newNativeRunner(host string, port int, user string, opts SSHOptions) (*nativeRunner, error) {
+	cfg := &ssh.ClientConfig{User: user}
+	if opts.Password != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(opts.Password))
+	}
+	if opts.KeyFile != "" {
+		data, err := os.ReadFile(opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ssh key file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh key file: %w", err)
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if opts.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opts.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh host key: %w", err)
+		}
+		cfg.HostKeyCallback = ssh.FixedHostKey(key)
+	} else {
+		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial ssh server: %w", err)
+	}
+	return &nativeRunner{client: client}, nil
+}
+
+func (n *nativeRunner) run(cmd string, stdin io.Reader, stdout io.Writer) error {
+	sess, err := n.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create ssh session: %w", err)
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stdin = stdin
+	sess.Stdout = stdout
+	sess.Stderr = &stderr
+	if err := sess.Run(cmd); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return &RemoteError{Command: cmd, ExitStatus: exitErr.ExitStatus(), Stderr: stderr.String()}
+		}
+		var missingErr *ssh.ExitMissingError
+		if errors.As(err, &missingErr) {
+			return &RemoteError{Command: cmd, ExitStatus: -1, Stderr: stderr.String()}
+		}
+		return err
+	}
+	return nil
+}
+
+func (n *nativeRunner) close() error { return n.client.Close() }
+
+// binaryRunner runs commands by executing the ssh binary.
+type binaryRunner struct {
+	binary string
+	args   []string
+}
+
+// sshBinaryConnectionError is the exit status of the ssh binary on connection
+// failures, as opposed to the exit status of the remote command.
+const sshBinaryConnectionError = 255
+
+func newBinaryRunner(host string, port int, user string, opts SSHOptions) (*binaryRunner, error) {
+	if opts.Password != "" {
+		return nil, errors.New("password authentication is not supported with the ssh binary")
+	}
+	binary := opts.SSHBinary
+	if binary == "" {
+		binary = "ssh"
+	}
+	if _, err := exec.LookPath(binary); err != nil {
+		return nil, err
+	}
+	args := []string{"-o", "BatchMode=yes", "-p", strconv.Itoa(port), "-l", user}
+	if opts.KeyFile != "" {
+		args = append(args, "-i", opts.KeyFile)
+	}
+	args = append(args, opts.SSHArgs...)
+	args = append(args, host, "--")
+	return &binaryRunner{binary: binary, args: args}, nil
+}
+
+func (b *binaryRunner) run(cmd string, stdin io.Reader, stdout io.Writer) error {
+	c := exec.Command(b.binary, append(append([]string(nil), b.args...), cmd)...)
+	var stderr bytes.Buffer
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if exitErr.ExitCode() == sshBinaryConnectionError {
+				return fmt.Errorf("ssh failed: %s", strings.TrimSpace(stderr.String()))
+			}
+			return &RemoteError{Command: cmd, ExitStatus: exitErr.ExitCode(), Stderr: stderr.String()}
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *binaryRunner) close() error { return nil }
+
+func currentUser() (string, error) {
+	cur, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return cur.Username, nil
+}
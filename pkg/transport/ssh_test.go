@@ -0,0 +1,102 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRunner is a remoteRunner that records the commands it runs and replies with
+// canned output and errors.
+type fakeRunner struct {
+	// readStdin makes run consume all of stdin before returning
+	readStdin bool
+	stdout    []byte
+	err       error
+	cmds      []string
+}
+
+func (f *fakeRunner) run(cmd string, stdin io.Reader, stdout io.Writer) error {
+	f.cmds = append(f.cmds, cmd)
+	if f.readStdin && stdin != nil {
+		if _, err := io.Copy(io.Discard, stdin); err != nil {
+			return err
+		}
+	}
+	if len(f.stdout) > 0 {
+		if _, err := stdout.Write(f.stdout); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+func (f *fakeRunner) close() error { return nil }
+
+func TestSendReportsRemoteError(t *testing.T) {
+	remoteErr := &RemoteError{Command: "btrfs receive '/dest'", ExitStatus: 1, Stderr: "ERROR: cannot open /dest"}
+	runner := &fakeRunner{err: remoteErr}
+	tr := &sshTransport{runner: runner, opts: SSHOptions{ReceiveCommand: "btrfs receive"}}
+	err := tr.Send(filepath.Join(t.TempDir(), "missing"), "", nil, "/dest")
+	var got *RemoteError
+	if !errors.As(err, &got) {
+		t.Fatalf("got error %v, want a *RemoteError", err)
+	}
+	if got != remoteErr {
+		t.Errorf("got remote error %v, want %v", got, remoteErr)
+	}
+	if len(runner.cmds) != 1 || runner.cmds[0] != "btrfs receive '/dest'" {
+		t.Errorf("ran %q", runner.cmds)
+	}
+}
+
+func TestSendReportsLocalErrorIfRemoteSucceeds(t *testing.T) {
+	tr := &sshTransport{runner: &fakeRunner{readStdin: true}, opts: SSHOptions{ReceiveCommand: "btrfs receive"}}
+	err := tr.Send(filepath.Join(t.TempDir(), "missing"), "", nil, "/dest")
+	var remoteErr *RemoteError
+	if err == nil || errors.As(err, &remoteErr) {
+		t.Fatalf("got error %v, want the local send error", err)
+	}
+}
+
+func TestReceiveReportsRemoteError(t *testing.T) {
+	remoteErr := &RemoteError{Command: "btrfs send '/src'", ExitStatus: 1, Stderr: "ERROR: not a subvolume"}
+	runner := &fakeRunner{stdout: []byte("not a send stream"), err: remoteErr}
+	tr := &sshTransport{runner: runner}
+	err := tr.Receive("/src", t.TempDir())
+	var got *RemoteError
+	if !errors.As(err, &got) {
+		t.Fatalf("got error %v, want a *RemoteError", err)
+	}
+	if got != remoteErr {
+		t.Errorf("got remote error %v, want %v", got, remoteErr)
+	}
+	if len(runner.cmds) != 1 || runner.cmds[0] != "btrfs send '/src'" {
+		t.Errorf("ran %q", runner.cmds)
+	}
+}
+
+func TestReceiveReportsLocalErrorIfRemoteSucceeds(t *testing.T) {
+	tr := &sshTransport{runner: &fakeRunner{stdout: []byte("not a send stream")}}
+	err := tr.Receive("/src", t.TempDir())
+	var remoteErr *RemoteError
+	if err == nil || errors.As(err, &remoteErr) {
+		t.Fatalf("got error %v, want the local receive error", err)
+	}
+}
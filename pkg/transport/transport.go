@@ -0,0 +1,59 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package transport implements moving btrfs send streams between hosts.
+package transport
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transport sends subvolumes to and receives subvolumes from a remote host.
+type Transport interface {
+	// Send sends the read-only subvolume at localPath to the directory remotePath on
+	// the remote host. If parent is set an incremental send relative to it is
+	// performed, cloneSources are passed on as for btrfs.SendSubvolume.
+	Send(localPath, parent string, cloneSources []string, remotePath string) error
+	// Receive receives the read-only subvolume at remotePath on the remote host into
+	// the directory localPath.
+	Receive(remotePath, localPath string) error
+	// Close releases any resources held by the transport.
+	Close() error
+}
+
+// RemoteError is returned when a command on the remote host fails.
+type RemoteError struct {
+	// Command is the command that was run.
+	Command string
+	// ExitStatus is the exit status of the command, or -1 if it is unknown.
+	ExitStatus int
+	// Stderr holds the output the command wrote to its standard error.
+	Stderr string
+}
+
+// Error implements the error interface.
+func (e *RemoteError) Error() string {
+	msg := fmt.Sprintf("remote command %q exited with status %d", e.Command, e.ExitStatus)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}